@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Archivers keep expired users once the storage backend has deleted them:
+
+FileArchiver		- one file per user under date partitioned directories, written atomically
+S3Archiver			- one object per user in an S3 compatible bucket, e.g. MinIO
+JSONLArchiver		- one line per user appended to a single file
+
+RetryingArchiver wraps any of them, retrying failures in the background with exponential
+backoff. Outcomes are counted in expvar, served by cmd/userapi on /debug/vars.
+
+All three are also Readers, so archived users can be listed and restored.
+*/
+
+// Archiver stores an expired user. It must be safe to call concurrently.
+type Archiver interface {
+	Archive(Record) error
+}
+
+// Reader reads back what an Archiver archived
+type Reader interface {
+	// List returns the archived records of a username, newest first, without their Data
+	List(username string) ([]Record, error)
+	// Load returns a record from List with its Data
+	Load(Record) (Record, error)
+}
+
+const (
+	ReasonExpired = "expired"
+	// Purged from the recycle bin after being soft deleted
+	ReasonPurged = "purged"
+)
+
+// Record is an expired user. ModifiedNanos is the time of its last write, which together with
+// the username identifies it, as a username can expire many times.
+type Record struct {
+	Username      string
+	Data          string
+	ModifiedNanos int64
+	ExpiredAt     time.Time
+	// Why the storage backend removed the user, ReasonExpired or ReasonPurged
+	Reason string
+	// Where a Reader found the record, e.g. its file path or object key
+	location string
+}
+
+// Name is the name records have always been persisted under, username-nanos.json
+func (record Record) Name() string {
+	return record.Username + "-" + strconv.FormatInt(record.ModifiedNanos, 10) + ".json"
+}
+
+// parseName returns the ModifiedNanos of a record named by Name, with or without .gz, if the
+// record belongs to username
+func parseName(username string, name string) (int64, bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, username+"-") || !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+
+	modified_nanos, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, username+"-"), ".json"), 10, 64)
+
+	return modified_nanos, err == nil
+}
+
+// sortNewestFirst orders records by their last write, newest first
+func sortNewestFirst(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ModifiedNanos > records[j].ModifiedNanos
+	})
+}
+
+// decode reverses encode, for contents read back from a file or object named name
+func decode(contents []byte, name string) (string, error) {
+	if !strings.HasSuffix(name, ".gz") {
+		return string(contents), nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(reader)
+
+	return string(decompressed), err
+}
+
+// datePath partitions records by the UTC day they expired on, e.g. 2020/01/31
+func (record Record) datePath() string {
+	return record.ExpiredAt.UTC().Format("2006/01/02")
+}
+
+// encode returns a record's file contents and name, gzipped if compress is set
+func (record Record) encode(compress bool) ([]byte, string, error) {
+	if !compress {
+		return []byte(record.Data), record.Name(), nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Name = record.Name()
+	writer.ModTime = time.Unix(0, record.ModifiedNanos)
+	if _, err := writer.Write([]byte(record.Data)); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return compressed.Bytes(), record.Name() + ".gz", nil
+}
+
+var (
+	archivedUsers   = expvar.NewInt("archive_users_archived")
+	archiveRetries  = expvar.NewInt("archive_retries")
+	archiveFailures = expvar.NewInt("archive_failures")
+)
+
+// Most records waiting to be retried at once. Records failing while this many are waiting aren't
+// retried, so an archive which is down can't pile up records in memory.
+const maxPendingRetries = 1000
+
+// RetryingArchiver retries failures in the background, so the storage backend's reaper passing
+// records on never waits out the backoff and goes on expiring and purging other users.
+type RetryingArchiver struct {
+	archiver Archiver
+	attempts int
+	backoff  time.Duration
+	// Holds a value for every record waiting to be retried
+	pending chan struct{}
+	retries *sync.WaitGroup
+}
+
+// NewRetryingArchiver makes up to attempts attempts at archiving each record, waiting backoff
+// after the first failure and doubling the wait after each one after that
+func NewRetryingArchiver(archiver Archiver, attempts int, backoff time.Duration) RetryingArchiver {
+	var new_retrying_archiver RetryingArchiver
+
+	new_retrying_archiver.archiver = archiver
+	new_retrying_archiver.attempts = attempts
+	new_retrying_archiver.backoff = backoff
+	new_retrying_archiver.pending = make(chan struct{}, maxPendingRetries)
+	new_retrying_archiver.retries = &sync.WaitGroup{}
+
+	return new_retrying_archiver
+}
+
+// Archive makes the first attempt at archiving a record. If it fails and the record is left to
+// be retried, it returns nil and a record which runs out of attempts is logged with its data.
+// Otherwise it returns the failure.
+func (archiver RetryingArchiver) Archive(record Record) error {
+	err := archiver.archiver.Archive(record)
+	if err == nil {
+		archivedUsers.Add(1)
+		return nil
+	}
+
+	log.Printf("Archiving %s failed (attempt 1 of %d): %s", record.Name(), archiver.attempts, err)
+	if archiver.attempts <= 1 {
+		archiveFailures.Add(1)
+		return err
+	}
+	select {
+	case archiver.pending <- struct{}{}:
+	default:
+		archiveFailures.Add(1)
+		return err
+	}
+
+	archiver.retries.Add(1)
+	archiver.retry(record, 2, archiver.backoff)
+	return nil
+}
+
+// retry makes attempt after wait, scheduling the next one if it fails
+func (archiver RetryingArchiver) retry(record Record, attempt int, wait time.Duration) {
+	archiveRetries.Add(1)
+	time.AfterFunc(wait, func() {
+		err := archiver.archiver.Archive(record)
+		if err == nil {
+			archivedUsers.Add(1)
+			archiver.done()
+			return
+		}
+
+		log.Printf("Archiving %s failed (attempt %d of %d): %s", record.Name(), attempt, archiver.attempts, err)
+		if attempt >= archiver.attempts {
+			log.Printf("%s was not archived\nData: %s", record.Name(), record.Data)
+			archiveFailures.Add(1)
+			archiver.done()
+			return
+		}
+
+		archiver.retry(record, attempt+1, wait*2)
+	})
+}
+
+func (archiver RetryingArchiver) done() {
+	<-archiver.pending
+	archiver.retries.Done()
+}
+
+// Wait blocks until every record being retried has been archived or run out of attempts
+func (archiver RetryingArchiver) Wait() {
+	archiver.retries.Wait()
+}
@@ -0,0 +1,295 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var test_record = Record{
+	Username:      "bobman12",
+	Data:          `{"username": "bobman12", "email": "bob@bobmail.com"}`,
+	ModifiedNanos: 1580428800000000000,
+	ExpiredAt:     time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC),
+}
+
+func Test_FileArchiver(t *testing.T) {
+	archive_dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(archive_dir)
+
+	if err := NewFileArchiver(archive_dir, false).Archive(test_record); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(archive_dir, "2020", "01", "31", "bobman12-1580428800000000000.json"))
+	if err != nil || string(contents) != test_record.Data {
+		t.Logf("Expected:\t %s \nGot:\t %s (err: %v)\n", test_record.Data, contents, err)
+		t.Fail()
+	}
+
+	if err = NewFileArchiver(archive_dir, true).Archive(test_record); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	file, err := os.Open(filepath.Join(archive_dir, "2020", "01", "31", "bobman12-1580428800000000000.json.gz"))
+	if err != nil {
+		t.Logf("err: %s", err)
+		t.FailNow()
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Logf("err: %s", err)
+		t.FailNow()
+	}
+	contents, _ = ioutil.ReadAll(reader)
+	if string(contents) != test_record.Data {
+		t.Logf("Expected:\t %s \nGot:\t %s\n", test_record.Data, contents)
+		t.Fail()
+	}
+
+	// No temporary files are left behind
+	files, _ := ioutil.ReadDir(filepath.Join(archive_dir, "2020", "01", "31"))
+	if len(files) != 2 {
+		t.Logf("Expected 2 files, got %d", len(files))
+		t.Fail()
+	}
+
+	// Persisted before records were partitioned by date
+	legacy_record := test_record
+	legacy_record.ModifiedNanos--
+	ioutil.WriteFile(filepath.Join(archive_dir, legacy_record.Name()), []byte(legacy_record.Data), 0644)
+
+	newer_record := test_record
+	newer_record.ModifiedNanos++
+	newer_record.Data = `{"username": "bobman12", "email": "bobby@bobmail.com"}`
+	NewFileArchiver(archive_dir, true).Archive(newer_record)
+
+	testReader(t, NewFileArchiver(archive_dir, false), newer_record, 4)
+}
+
+func Test_JSONLArchiver(t *testing.T) {
+	archive_dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(archive_dir)
+
+	archiver := NewJSONLArchiver(filepath.Join(archive_dir, "expired.jsonl"))
+
+	var wait_group sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait_group.Add(1)
+		go func() {
+			defer wait_group.Done()
+			archiver.Archive(test_record)
+		}()
+	}
+	wait_group.Wait()
+
+	file, _ := os.Open(filepath.Join(archive_dir, "expired.jsonl"))
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line jsonlRecord
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Data != test_record.Data || line.Username != "bobman12" {
+			t.Logf("Bad line: %s (err: %v)", scanner.Text(), err)
+			t.Fail()
+		}
+		lines++
+	}
+	if lines != 20 {
+		t.Logf("Expected 20 lines, got %d", lines)
+		t.Fail()
+	}
+
+	newer_record := test_record
+	newer_record.ModifiedNanos++
+	newer_record.Data = `{"username": "bobman12", "email": "bobby@bobmail.com"}`
+	archiver.Archive(newer_record)
+
+	testReader(t, archiver, newer_record, 2)
+}
+
+// A stand-in for MinIO, which checks requests are signed with its credentials and lists one
+// object per page, so continuation tokens get followed
+func fakeS3(t *testing.T, objects map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		expected := httptest.NewRequest(r.Method, "http://"+r.Host+r.URL.EscapedPath()+"?"+r.URL.RawQuery, nil)
+		signer := NewS3Archiver("", "us-east-1", "", "", "minioadmin", "minioadmin", false)
+		amz_date, _ := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		signer.sign(expected, body, amz_date)
+
+		if r.Header.Get("Authorization") != expected.Header.Get("Authorization") {
+			t.Logf("Bad request: %s %s %s", r.Method, r.URL, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPut:
+			objects[r.URL.Path] = string(body)
+		case r.URL.Query().Get("list-type") == "2":
+			keys := []string{}
+			for object_path := range objects {
+				if key := strings.TrimPrefix(object_path, r.URL.Path+"/"); strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+
+			page, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+			fmt.Fprint(w, "<ListBucketResult>")
+			if page < len(keys) {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2020-01-31T12:00:00.000Z</LastModified></Contents>", keys[page])
+			}
+			if page+1 < len(keys) {
+				fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", page+1)
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+		default:
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, object)
+		}
+	}))
+}
+
+func Test_S3Archiver(t *testing.T) {
+	objects := map[string]string{}
+	server := fakeS3(t, objects)
+	defer server.Close()
+
+	archiver := NewS3Archiver(server.URL, "us-east-1", "users", "/expired/", "minioadmin", "minioadmin", false)
+	err := archiver.Archive(test_record)
+	if err != nil || objects["/users/expired/2020/01/31/bobman12-1580428800000000000.json"] != test_record.Data {
+		t.Logf("Object not stored: %v (err: %v)", objects, err)
+		t.Fail()
+	}
+
+	err = NewS3Archiver(server.URL, "us-east-1", "users", "", "minioadmin", "wrongsecret", false).Archive(test_record)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Logf("Expected a 403 error, got: %v", err)
+		t.Fail()
+	}
+
+	newer_record := test_record
+	newer_record.ModifiedNanos++
+	newer_record.Data = `{"username": "bobman12", "email": "bobby@bobmail.com"}`
+	NewS3Archiver(server.URL, "us-east-1", "users", "expired", "minioadmin", "minioadmin", true).Archive(newer_record)
+	other_record := test_record
+	other_record.Username = "bobman1"
+	archiver.Archive(other_record)
+
+	testReader(t, archiver, newer_record, 2)
+}
+
+// testReader checks a reader lists expected_count records for bobman12, newest_record first
+func testReader(t *testing.T, reader Reader, newest_record Record, expected_count int) {
+	records, err := reader.List("bobman12")
+	if err != nil || len(records) != expected_count {
+		t.Logf("Expected %d records, got %v (err: %v)", expected_count, records, err)
+		t.FailNow()
+	}
+
+	if records[0].ModifiedNanos != newest_record.ModifiedNanos || records[1].ModifiedNanos >= records[0].ModifiedNanos {
+		t.Logf("Records not newest first: %v", records)
+		t.Fail()
+	}
+
+	loaded_record, err := reader.Load(records[0])
+	if err != nil || loaded_record.Data != newest_record.Data {
+		t.Logf("Expected:\t %s \nGot:\t %s (err: %v)\n", newest_record.Data, loaded_record.Data, err)
+		t.Fail()
+	}
+
+	if records, _ = reader.List("nobody"); len(records) != 0 {
+		t.Logf("Expected no records, got %v", records)
+		t.Fail()
+	}
+}
+
+func Test_signingKey(t *testing.T) {
+	// From the AWS Signature Version 4 documentation
+	signing_key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	expected_key := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+
+	if hex.EncodeToString(signing_key) != expected_key {
+		t.Logf("Expected:\t %s \nGot:\t %x\n", expected_key, signing_key)
+		t.Fail()
+	}
+}
+
+type flakyArchiver struct {
+	failures *int
+}
+
+func (archiver flakyArchiver) Archive(record Record) error {
+	if *archiver.failures > 0 {
+		*archiver.failures--
+		return errors.New("Archive unavailable")
+	}
+
+	return nil
+}
+
+func Test_RetryingArchiver(t *testing.T) {
+	failures := 2
+	failures_before := archiveFailures.Value()
+	retries_before := archiveRetries.Value()
+
+	// Retries happen in the background, so the caller doesn't wait for them
+	retrying := NewRetryingArchiver(flakyArchiver{&failures}, 3, 100*time.Millisecond)
+	started := time.Now()
+	if err := retrying.Archive(test_record); err != nil || time.Since(started) >= 100*time.Millisecond {
+		t.Logf("Expected the record to be left to retry without waiting, got: %v after %s", err, time.Since(started))
+		t.Fail()
+	}
+	retrying.Wait()
+	if failures != 0 || archiveFailures.Value() != failures_before {
+		t.Logf("Expected success on the third attempt, %d failures left", failures)
+		t.Fail()
+	}
+
+	failures = 3
+	retrying = NewRetryingArchiver(flakyArchiver{&failures}, 3, time.Millisecond)
+	retrying.Archive(test_record)
+	retrying.Wait()
+
+	if archiveRetries.Value()-retries_before != 4 || archiveFailures.Value()-failures_before != 1 {
+		t.Logf("Expected 4 retries and 1 failure, got %d and %d", archiveRetries.Value()-retries_before, archiveFailures.Value()-failures_before)
+		t.Fail()
+	}
+
+	// Records aren't left to retry once too many are waiting
+	failures = maxPendingRetries + 1
+	retrying = NewRetryingArchiver(flakyArchiver{&failures}, 2, time.Hour)
+	for i := 0; i < maxPendingRetries; i++ {
+		retrying.pending <- struct{}{}
+	}
+	if err := retrying.Archive(test_record); err == nil {
+		t.Logf("Expected the failure to be returned with too many records waiting")
+		t.Fail()
+	}
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileArchiver writes each record to its own file, dir/yyyy/mm/dd/username-nanos.json(.gz).
+// Files are written under a temporary name, synced and renamed into place, so a crash never
+// leaves a partial file behind.
+type FileArchiver struct {
+	dir      string
+	compress bool
+}
+
+func NewFileArchiver(dir string, compress bool) FileArchiver {
+	var new_file_archiver FileArchiver
+
+	new_file_archiver.dir = dir
+	new_file_archiver.compress = compress
+
+	return new_file_archiver
+}
+
+func (archiver FileArchiver) Archive(record Record) error {
+	contents, name, err := record.encode(archiver.compress)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(archiver.dir, filepath.FromSlash(record.datePath()))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	temp_file, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp_file.Name())
+
+	_, err = temp_file.Write(contents)
+	if err == nil {
+		err = temp_file.Sync()
+	}
+	if close_err := temp_file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(temp_file.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	dir_file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dir_file.Close()
+
+	return dir_file.Sync()
+}
+
+// List finds a username's records anywhere under dir, including ones persisted directly in dir
+// before records were partitioned by date. A record's ExpiredAt is its file's modification time.
+func (archiver FileArchiver) List(username string) ([]Record, error) {
+	records := []Record{}
+
+	err := filepath.Walk(archiver.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if modified_nanos, ok := parseName(username, info.Name()); ok {
+			records = append(records, Record{
+				Username:      username,
+				ModifiedNanos: modified_nanos,
+				ExpiredAt:     info.ModTime(),
+				location:      path,
+			})
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sortNewestFirst(records)
+
+	return records, nil
+}
+
+func (archiver FileArchiver) Load(record Record) (Record, error) {
+	contents, err := ioutil.ReadFile(record.location)
+	if err != nil {
+		return record, err
+	}
+
+	record.Data, err = decode(contents, record.location)
+
+	return record, err
+}
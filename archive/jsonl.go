@@ -0,0 +1,129 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// JSONLArchiver appends each record to a single file as one line of JSON
+type JSONLArchiver struct {
+	path string
+	// Serializes appends from this process, so lines never interleave
+	lock *sync.Mutex
+}
+
+type jsonlRecord struct {
+	Username      string    `json:"username"`
+	ModifiedNanos int64     `json:"modified_nanos"`
+	ExpiredAt     time.Time `json:"expired_at"`
+	// Kept as a string, as stored users aren't guaranteed to be valid JSON
+	Data string `json:"data"`
+}
+
+func NewJSONLArchiver(path string) JSONLArchiver {
+	var new_jsonl_archiver JSONLArchiver
+
+	new_jsonl_archiver.path = path
+	new_jsonl_archiver.lock = &sync.Mutex{}
+
+	return new_jsonl_archiver
+}
+
+func (archiver JSONLArchiver) Archive(record Record) error {
+	line, err := json.Marshal(jsonlRecord{
+		Username:      record.Username,
+		ModifiedNanos: record.ModifiedNanos,
+		ExpiredAt:     record.ExpiredAt.UTC(),
+		Data:          record.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	archiver.lock.Lock()
+	defer archiver.lock.Unlock()
+
+	file, err := os.OpenFile(archiver.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+
+	return err
+}
+
+// scan calls found with each record of username in the file, in the order they were appended
+func (archiver JSONLArchiver) scan(username string, found func(jsonlRecord)) error {
+	file, err := os.Open(archiver.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Lines can be longer than a bufio.Scanner allows
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		var record jsonlRecord
+		if len(line) > 0 && json.Unmarshal(line, &record) == nil && record.Username == username {
+			found(record)
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (archiver JSONLArchiver) List(username string) ([]Record, error) {
+	records := []Record{}
+	// A retried append can leave the same record on two lines
+	listed := map[int64]bool{}
+
+	err := archiver.scan(username, func(record jsonlRecord) {
+		if !listed[record.ModifiedNanos] {
+			listed[record.ModifiedNanos] = true
+			records = append(records, Record{Username: record.Username, ModifiedNanos: record.ModifiedNanos, ExpiredAt: record.ExpiredAt})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortNewestFirst(records)
+
+	return records, nil
+}
+
+// Load returns the last line appended for the record, should it have been archived twice
+func (archiver JSONLArchiver) Load(record Record) (Record, error) {
+	found := false
+
+	err := archiver.scan(record.Username, func(line jsonlRecord) {
+		if line.ModifiedNanos == record.ModifiedNanos {
+			record.Data = line.Data
+			found = true
+		}
+	})
+	if err == nil && !found {
+		err = os.ErrNotExist
+	}
+
+	return record, err
+}
@@ -0,0 +1,244 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// S3Archiver puts each record into an S3 compatible bucket as
+// prefix/yyyy/mm/dd/username-nanos.json(.gz). Requests use path style addressing and are signed
+// with AWS Signature Version 4, which AWS, MinIO and most other implementations accept.
+type S3Archiver struct {
+	client     *http.Client
+	endpoint   string
+	region     string
+	bucket     string
+	prefix     string
+	access_key string
+	secret_key string
+	compress   bool
+}
+
+// NewS3Archiver takes the endpoint as a URL, e.g. https://s3.eu-west-1.amazonaws.com or
+// http://localhost:9000 for a local MinIO
+func NewS3Archiver(endpoint string, region string, bucket string, prefix string, access_key string, secret_key string, compress bool) S3Archiver {
+	var new_s3_archiver S3Archiver
+
+	new_s3_archiver.client = &http.Client{Timeout: 30 * time.Second}
+	new_s3_archiver.endpoint = strings.TrimSuffix(endpoint, "/")
+	new_s3_archiver.region = region
+	new_s3_archiver.bucket = bucket
+	new_s3_archiver.prefix = strings.Trim(prefix, "/")
+	new_s3_archiver.access_key = access_key
+	new_s3_archiver.secret_key = secret_key
+	new_s3_archiver.compress = compress
+
+	return new_s3_archiver
+}
+
+func (archiver S3Archiver) Archive(record Record) error {
+	contents, name, err := record.encode(archiver.compress)
+	if err != nil {
+		return err
+	}
+
+	key := record.datePath() + "/" + name
+	if archiver.prefix != "" {
+		key = archiver.prefix + "/" + key
+	}
+
+	content_type := "application/json"
+	if archiver.compress {
+		content_type = "application/gzip"
+	}
+
+	response, err := archiver.do(http.MethodPut, key, nil, contents, content_type)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through every object under the prefix, as records are partitioned by date rather
+// than username. A record's ExpiredAt is its object's LastModified.
+func (archiver S3Archiver) List(username string) ([]Record, error) {
+	records := []Record{}
+	query := url.Values{"list-type": {"2"}}
+	if archiver.prefix != "" {
+		query.Set("prefix", archiver.prefix+"/")
+	}
+
+	for {
+		response, err := archiver.do(http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var page listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			if modified_nanos, ok := parseName(username, path.Base(object.Key)); ok {
+				records = append(records, Record{
+					Username:      username,
+					ModifiedNanos: modified_nanos,
+					ExpiredAt:     object.LastModified,
+					location:      object.Key,
+				})
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+
+	sortNewestFirst(records)
+
+	return records, nil
+}
+
+func (archiver S3Archiver) Load(record Record) (Record, error) {
+	response, err := archiver.do(http.MethodGet, record.location, nil, nil, "")
+	if err != nil {
+		return record, err
+	}
+	defer response.Body.Close()
+
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return record, err
+	}
+
+	record.Data, err = decode(contents, record.location)
+
+	return record, err
+}
+
+// do sends a signed request for a key in the bucket ("" for the bucket itself), returning an
+// error for anything but a 2xx response
+func (archiver S3Archiver) do(method string, key string, query url.Values, contents []byte, content_type string) (*http.Response, error) {
+	object_path := "/" + archiver.bucket
+	if key != "" {
+		object_path += "/" + key
+	}
+
+	request, err := http.NewRequest(method, archiver.endpoint+s3Escape(object_path), bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	// Signature Version 4 wants spaces as %20, not the + url.Values encodes them as
+	request.URL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	if content_type != "" {
+		request.Header.Set("Content-Type", content_type)
+	}
+	archiver.sign(request, contents, time.Now())
+
+	response, err := archiver.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s returned %s: %s", method, object_path, response.Status, body)
+	}
+
+	return response, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to a request, signing its host,
+// payload hash and date
+func (archiver S3Archiver) sign(request *http.Request, payload []byte, now time.Time) {
+	amz_date := now.UTC().Format("20060102T150405Z")
+	scope := amz_date[:8] + "/" + archiver.region + "/s3/aws4_request"
+	payload_hash := sha256Hex(payload)
+
+	request.Header.Set("X-Amz-Date", amz_date)
+	request.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_request := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + payload_hash,
+		"x-amz-date:" + amz_date,
+		"",
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	string_to_sign := strings.Join([]string{"AWS4-HMAC-SHA256", amz_date, scope, sha256Hex([]byte(canonical_request))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(signingKey(archiver.secret_key, amz_date[:8], archiver.region, "s3"), string_to_sign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+archiver.access_key+"/"+scope+
+		", SignedHeaders="+signed_headers+", Signature="+signature)
+}
+
+// signingKey derives the Signature Version 4 key for a day, region and service
+func signingKey(secret_key string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret_key), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape escapes a path the way Signature Version 4 expects, everything but unreserved
+// characters and slashes
+func s3Escape(path string) string {
+	var escaped strings.Builder
+
+	for _, c := range []byte(path) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+)
+
+/*
+The audit log records every change made to a user, by requests and by expiry alike:
+
+RedisStreamLog	- a Redis Stream of every event, and one per username, shared by every replica
+MemoryLog		- a slice, for tests and the memory backend
+
+Events are read back oldest first, paged by the ID of the last event read.
+*/
+
+// Operations recorded in Event.Operation
+const (
+	OperationCreate     = "create"
+	OperationEdit       = "edit"
+	OperationPatch      = "patch"
+	OperationDelete     = "delete"
+	OperationHardDelete = "hard_delete"
+	OperationUndelete   = "undelete"
+	OperationRestore    = "restore"
+	OperationRevert     = "revert"
+	OperationExpire     = "expire"
+	OperationPurge      = "purge"
+	// An email verified with an emailed token
+	OperationVerifyEmail = "verify_email"
+	// A password set, changed or reset, and a login lockout lifted, which record no changes
+	OperationPasswordChange = "password_change"
+	OperationPasswordReset  = "password_reset"
+	OperationUnlock         = "unlock"
+)
+
+// Event is one change made to a user. ID is assigned by the Log, and orders events by time.
+type Event struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"operation"`
+	Username  string    `json:"username"`
+	Changes   []Change  `json:"changes"`
+	RequestID string    `json:"request_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+}
+
+// Change is a field of the user document which changed, addressed by its JSON pointer.
+// Before is missing for an added field, and After for a removed one.
+type Change struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Log stores events, it must be safe to use concurrently
+type Log interface {
+	Append(Event) (Event, error)
+	// History returns up to limit events for a username, oldest first, starting after the event
+	// with ID after ("" to start from the first)
+	History(username string, after string, limit int) ([]Event, error)
+	// Since returns up to limit events for every user from since on, oldest first, starting
+	// after the event with ID after ("" to start from since)
+	Since(since time.Time, after string, limit int) ([]Event, error)
+}
+
+var ErrInvalidID = errors.New("Invalid event ID")
+
+// IDs have the Redis Stream ID format, unix milliseconds and a sequence number, e.g. 1580428800000-0
+func parseID(id string) (int64, int64, error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 2 {
+		return 0, 0, ErrInvalidID
+	}
+
+	millis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || millis < 0 {
+		return 0, 0, ErrInvalidID
+	}
+	sequence, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || sequence < 0 {
+		return 0, 0, ErrInvalidID
+	}
+
+	return millis, sequence, nil
+}
+
+func formatID(millis int64, sequence int64) string {
+	return strconv.FormatInt(millis, 10) + "-" + strconv.FormatInt(sequence, 10)
+}
+
+// nextID returns the smallest ID after id, for reading on from it
+func nextID(id string) (string, error) {
+	millis, sequence, err := parseID(id)
+	if err != nil {
+		return "", err
+	}
+
+	return formatID(millis, sequence+1), nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Diff compares two user documents field by field, "" standing for no user. Objects are compared
+// member by member, anything else as a whole.
+func Diff(before_json string, after_json string) []Change {
+	before_fields := map[string]json.RawMessage{}
+	after_fields := map[string]json.RawMessage{}
+	flatten("", json.RawMessage(before_json), before_fields)
+	flatten("", json.RawMessage(after_json), after_fields)
+
+	changes := []Change{}
+	for field, before := range before_fields {
+		if after, ok := after_fields[field]; !ok || !bytes.Equal(before, after) {
+			changes = append(changes, Change{Field: field, Before: before, After: after_fields[field]})
+		}
+	}
+	for field, after := range after_fields {
+		if _, ok := before_fields[field]; !ok {
+			changes = append(changes, Change{Field: field, After: after})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+// flatten adds the leaves of a JSON value to fields by their JSON pointer, compacted so
+// formatting doesn't count as a change
+func flatten(pointer string, value json.RawMessage, fields map[string]json.RawMessage) {
+	if len(bytes.TrimSpace(value)) == 0 {
+		return
+	}
+
+	var members map[string]json.RawMessage
+	if json.Unmarshal(value, &members) == nil && members != nil {
+		for member, member_value := range members {
+			escaped_member := strings.NewReplacer("~", "~0", "/", "~1").Replace(member)
+			flatten(pointer+"/"+escaped_member, member_value, fields)
+		}
+		return
+	}
+
+	// Stored users aren't guaranteed to be valid JSON, anything else is kept as a string
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, value) != nil {
+		fields[pointer], _ = json.Marshal(string(value))
+		return
+	}
+	fields[pointer] = compacted.Bytes()
+}
+
+// ArchiveRecorder records an expire or purge event for every user an Archiver archives, as
+// that's how storage backends dispose of users they remove themselves
+type ArchiveRecorder struct {
+	archiver archive.Archiver
+	audit    Log
+}
+
+func NewArchiveRecorder(archiver archive.Archiver, audit Log) ArchiveRecorder {
+	var new_archive_recorder ArchiveRecorder
+
+	new_archive_recorder.archiver = archiver
+	new_archive_recorder.audit = audit
+
+	return new_archive_recorder
+}
+
+// Archive only records the event once the user is archived, so the log never tells of an
+// archived user which wasn't
+func (recorder ArchiveRecorder) Archive(record archive.Record) error {
+	if err := recorder.archiver.Archive(record); err != nil {
+		return err
+	}
+
+	operation := OperationExpire
+	if record.Reason == archive.ReasonPurged {
+		operation = OperationPurge
+	}
+
+	_, err := recorder.audit.Append(Event{
+		Time:      record.ExpiredAt,
+		Actor:     "system",
+		Operation: operation,
+		Username:  record.Username,
+		Changes:   Diff(record.Data, ""),
+	})
+	if err != nil {
+		log.Printf("Audit event for %s of %s was not recorded: %s", operation, record.Username, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+)
+
+// The Redis Stream test needs a Redis 5 or later to run against, set AUDIT_TEST_REDIS to the
+// address of one it may write to, e.g. AUDIT_TEST_REDIS="localhost:6379"
+
+func Test_Diff(t *testing.T) {
+	test_cases := []struct {
+		before   string
+		after    string
+		expected []Change
+	}{
+		{`{"a": 1}`, `{"a":1}`, []Change{}},
+		{"", `{"a":1,"b":{"c":"d"}}`, []Change{{Field: "/a", After: []byte(`1`)}, {Field: "/b/c", After: []byte(`"d"`)}}},
+		{`{"a":1,"b":{"c":"d"}}`, "", []Change{{Field: "/a", Before: []byte(`1`)}, {Field: "/b/c", Before: []byte(`"d"`)}}},
+		{`{"a":[1,2],"b/c":true}`, `{"a":[1,3],"b/c":true}`, []Change{{Field: "/a", Before: []byte(`[1,2]`), After: []byte(`[1,3]`)}}},
+		{`{"b/c":true}`, `{"b/c":false}`, []Change{{Field: "/b~1c", Before: []byte(`true`), After: []byte(`false`)}}},
+		{`not json`, `{"a":1}`, []Change{{Field: "", Before: []byte(`"not json"`)}, {Field: "/a", After: []byte(`1`)}}},
+	}
+
+	for _, test_case := range test_cases {
+		changes := Diff(test_case.before, test_case.after)
+
+		matches := len(changes) == len(test_case.expected)
+		for i := 0; matches && i < len(changes); i++ {
+			matches = changes[i].Field == test_case.expected[i].Field &&
+				string(changes[i].Before) == string(test_case.expected[i].Before) &&
+				string(changes[i].After) == string(test_case.expected[i].After)
+		}
+		if !matches {
+			t.Logf("Diff(%s, %s)\nExpected: %+v\nGot: %+v", test_case.before, test_case.after, test_case.expected, changes)
+			t.Fail()
+		}
+	}
+}
+
+func testLog(t *testing.T, audit_log Log, prefix string) {
+	start := time.Now().Add(-time.Second)
+
+	for i := 0; i < 5; i++ {
+		username := prefix + "billy" + strconv.Itoa(i%2)
+		event, err := audit_log.Append(Event{Time: time.Now(), Actor: "test", Operation: OperationCreate, Username: username})
+		if err != nil || event.ID == "" {
+			t.Logf("Expected an ID, got: %v %s", err, event.ID)
+			t.FailNow()
+		}
+	}
+
+	// billy0 has events 0, 2 and 4
+	first_page, err := audit_log.History(prefix+"billy0", "", 2)
+	if err != nil || len(first_page) != 2 {
+		t.Logf("Expected 2 events, got: %v %+v", err, first_page)
+		t.FailNow()
+	}
+	second_page, err := audit_log.History(prefix+"billy0", first_page[1].ID, 2)
+	if err != nil || len(second_page) != 1 || second_page[0].Username != prefix+"billy0" || second_page[0].ID == first_page[1].ID {
+		t.Logf("Expected the last event, got: %v %+v", err, second_page)
+		t.Fail()
+	}
+
+	every_event, err := audit_log.Since(start, "", 100)
+	if err != nil || len(every_event) < 5 {
+		t.Logf("Expected at least 5 events, got: %v %+v", err, every_event)
+		t.Fail()
+	}
+	for i := 1; i < len(every_event); i++ {
+		previous_millis, previous_sequence, _ := parseID(every_event[i-1].ID)
+		millis, sequence, _ := parseID(every_event[i].ID)
+		if millis < previous_millis || millis == previous_millis && sequence <= previous_sequence {
+			t.Logf("Expected events in order, got: %s then %s", every_event[i-1].ID, every_event[i].ID)
+			t.Fail()
+		}
+	}
+
+	if future, _ := audit_log.Since(time.Now().Add(time.Hour), "", 100); len(future) != 0 {
+		t.Logf("Expected no events from the future, got: %+v", future)
+		t.Fail()
+	}
+
+	if _, err = audit_log.History(prefix+"billy0", "bob", 2); err != ErrInvalidID {
+		t.Logf("Expected ErrInvalidID, got: %v", err)
+		t.Fail()
+	}
+}
+
+func Test_MemoryLog(t *testing.T) {
+	testLog(t, NewMemoryLog(), "")
+}
+
+func Test_RedisStreamLog(t *testing.T) {
+	address := os.Getenv("AUDIT_TEST_REDIS")
+	if address == "" {
+		t.Skip("AUDIT_TEST_REDIS not set")
+	}
+
+	audit_log, err := NewRedisStreamLog(address, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit_log.Close()
+
+	// Streams can't be emptied without deleting other tests' events, so usernames are unique
+	testLog(t, audit_log, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+type testArchiver struct {
+	err error
+}
+
+func (archiver testArchiver) Archive(archive.Record) error {
+	return archiver.err
+}
+
+func Test_ArchiveRecorder(t *testing.T) {
+	audit_log := NewMemoryLog()
+	expired_at := time.Now()
+
+	// Users which weren't archived aren't recorded as they were
+	err := NewArchiveRecorder(testArchiver{os.ErrPermission}, audit_log).Archive(archive.Record{Username: "billy2000", Data: `{"username":"billy2000"}`, ExpiredAt: expired_at, Reason: archive.ReasonExpired})
+	if err != os.ErrPermission {
+		t.Logf("Expected the archiver's error, got: %v", err)
+		t.Fail()
+	}
+	if events, _ := audit_log.History("billy2000", "", 10); len(events) != 0 {
+		t.Logf("Expected no event for a failed archive, got: %+v", events)
+		t.Fail()
+	}
+
+	recorder := NewArchiveRecorder(testArchiver{}, audit_log)
+	recorder.Archive(archive.Record{Username: "billy2000", Data: `{"username":"billy2000"}`, ExpiredAt: expired_at, Reason: archive.ReasonExpired})
+	recorder.Archive(archive.Record{Username: "billy2000", Data: `{"username":"billy2000"}`, ExpiredAt: expired_at, Reason: archive.ReasonPurged})
+
+	events, _ := audit_log.History("billy2000", "", 10)
+	if len(events) != 2 || events[0].Operation != OperationExpire || events[1].Operation != OperationPurge ||
+		events[0].Actor != "system" || !events[0].Time.Equal(expired_at) || len(events[0].Changes) != 1 {
+		t.Logf("Expected an expire and a purge event, got: %+v", events)
+		t.Fail()
+	}
+}
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryLog keeps events in memory, they're lost when the process exits
+type MemoryLog struct {
+	lock   *sync.Mutex
+	events *[]Event
+}
+
+func NewMemoryLog() MemoryLog {
+	var new_memory_log MemoryLog
+
+	new_memory_log.lock = &sync.Mutex{}
+	new_memory_log.events = &[]Event{}
+
+	return new_memory_log
+}
+
+// Append assigns IDs the way Redis does, the event's time in milliseconds and a sequence number
+// for events in the same millisecond, never going backwards
+func (audit_log MemoryLog) Append(event Event) (Event, error) {
+	audit_log.lock.Lock()
+	defer audit_log.lock.Unlock()
+
+	millis, sequence := unixMillis(time.Now()), int64(0)
+	if len(*audit_log.events) > 0 {
+		last_millis, last_sequence, _ := parseID((*audit_log.events)[len(*audit_log.events)-1].ID)
+		if millis <= last_millis {
+			millis, sequence = last_millis, last_sequence+1
+		}
+	}
+
+	event.ID = formatID(millis, sequence)
+	*audit_log.events = append(*audit_log.events, event)
+
+	return event, nil
+}
+
+func (audit_log MemoryLog) History(username string, after string, limit int) ([]Event, error) {
+	return audit_log.read(after, 0, limit, func(event Event) bool {
+		return event.Username == username
+	})
+}
+
+func (audit_log MemoryLog) Since(since time.Time, after string, limit int) ([]Event, error) {
+	return audit_log.read(after, unixMillis(since), limit, func(Event) bool {
+		return true
+	})
+}
+
+// read returns up to limit matching events with IDs after after, or from from_millis on if
+// after is ""
+func (audit_log MemoryLog) read(after string, from_millis int64, limit int, matches func(Event) bool) ([]Event, error) {
+	var from_sequence int64
+	if after != "" {
+		next_id, err := nextID(after)
+		if err != nil {
+			return nil, err
+		}
+		from_millis, from_sequence, _ = parseID(next_id)
+	}
+
+	audit_log.lock.Lock()
+	defer audit_log.lock.Unlock()
+
+	events := []Event{}
+	for _, event := range *audit_log.events {
+		if len(events) == limit {
+			break
+		}
+
+		millis, sequence, _ := parseID(event.ID)
+		if millis < from_millis || millis == from_millis && sequence < from_sequence {
+			continue
+		}
+		if matches(event) {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
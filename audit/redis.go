@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStreamLog appends every event to the user_audit stream, and to a user_audit:{username}
+// stream for reading a user's history without scanning everyone's. Needs Redis 5 or later.
+type RedisStreamLog struct {
+	client *redis.Client
+}
+
+func NewRedisStreamLog(address string, password string, database int, maxretries int) (RedisStreamLog, error) {
+	var new_redis_stream_log RedisStreamLog
+
+	new_redis_stream_log.client = redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+
+	return new_redis_stream_log, new_redis_stream_log.client.Ping().Err()
+}
+
+// Close closes the client
+func (audit_log RedisStreamLog) Close() error {
+	return audit_log.client.Close()
+}
+
+// KEYS: user_audit, user_audit:{username}
+// ARGV: event json
+// Adds an event to both streams under the ID Redis gives it in the first, so the two agree.
+// Returns the ID.
+var appendEventScript = redis.NewScript(`
+redis.replicate_commands()
+local id = redis.call('XADD', KEYS[1], '*', 'event', ARGV[1])
+redis.call('XADD', KEYS[2], id, 'event', ARGV[1])
+return id
+`)
+
+func (audit_log RedisStreamLog) Append(event Event) (Event, error) {
+	// The ID is left out of the stored event, as the stream entry carries it
+	event.ID = ""
+	event_json, err := json.Marshal(event)
+	if err != nil {
+		return event, err
+	}
+
+	event.ID, err = appendEventScript.Run(audit_log.client, []string{"user_audit", "user_audit:" + event.Username}, event_json).String()
+
+	return event, err
+}
+
+func (audit_log RedisStreamLog) History(username string, after string, limit int) ([]Event, error) {
+	return audit_log.read("user_audit:"+username, after, "-", limit)
+}
+
+func (audit_log RedisStreamLog) Since(since time.Time, after string, limit int) ([]Event, error) {
+	return audit_log.read("user_audit", after, strconv.FormatInt(unixMillis(since), 10), limit)
+}
+
+// read returns up to limit events from a stream with IDs after after, or from start if after is ""
+func (audit_log RedisStreamLog) read(stream string, after string, start string, limit int) ([]Event, error) {
+	if after != "" {
+		var err error
+		if start, err = nextID(after); err != nil {
+			return nil, err
+		}
+	}
+
+	messages, err := audit_log.client.XRangeN(stream, start, "+", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	for _, message := range messages {
+		var event Event
+		event_json, _ := message.Values["event"].(string)
+		if err = json.Unmarshal([]byte(event_json), &event); err != nil {
+			return nil, err
+		}
+		event.ID = message.ID
+		events = append(events, event)
+	}
+
+	return events, nil
+}
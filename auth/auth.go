@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+Callers authenticate with either of:
+
+API keys	- random keys issued by the service, sent as "Authorization: Bearer <key>", in the
+			  X-API-Key header or as ?access_token=. Only their SHA-256 hashes are kept, in a KeyStore:
+			  RedisKeyStore shared by every replica, or MemoryKeyStore for tests and development.
+JWTs		- bearer tokens issued elsewhere, verified by a JWTVerifier against an HMAC secret or
+			  the public keys in a JWKS file.
+Sessions	- JWTs issued by Sessions to users logging in with their passwords.
+
+The Principal they authenticate as is put in the request's context for handlers.
+*/
+
+// Methods of authentication in Principal.Method
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// RoleAdmin may manage API keys
+const RoleAdmin = "admin"
+
+var ErrUnauthenticated = errors.New("Authentication is required")
+
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Principal is who a request was made by. Subject is the JWT's sub, or api_key:<name> for keys.
+type Principal struct {
+	Subject string   `json:"subject"`
+	Method  string   `json:"method"`
+	Roles   []string `json:"roles"`
+}
+
+// HasRole reports whether the principal was granted a role
+func (principal Principal) HasRole(role string) bool {
+	for _, granted := range principal.Roles {
+		if granted == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal a request was authenticated as
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal a request was authenticated as, if it was
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+
+	return principal, ok
+}
+
+// Authenticator checks a request's credentials against API keys, JWTs and session tokens. Any may
+// be left out, a nil keys or zero verifier or sessions accepting none.
+type Authenticator struct {
+	keys     KeyStore
+	verifier JWTVerifier
+	sessions Sessions
+}
+
+func NewAuthenticator(keys KeyStore, verifier JWTVerifier, sessions Sessions) Authenticator {
+	var new_authenticator Authenticator
+
+	new_authenticator.keys = keys
+	new_authenticator.verifier = verifier
+	new_authenticator.sessions = sessions
+
+	return new_authenticator
+}
+
+// Authenticate returns the principal a request's credentials belong to, ErrUnauthenticated if it
+// has none, or ErrInvalidCredentials. Bearer tokens shaped like JWTs are verified as JWTs.
+func (authenticator Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if api_key := r.Header.Get("X-API-Key"); api_key != "" {
+		return authenticator.authenticateKey(api_key)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	// RFC 6750's query parameter, for clients such as EventSource which can't set headers
+	if authorization == "" && r.URL.Query().Get("access_token") != "" {
+		authorization = "Bearer " + r.URL.Query().Get("access_token")
+	}
+	if authorization == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
+		return Principal{}, ErrInvalidCredentials
+	}
+	token := strings.TrimSpace(parts[1])
+
+	if strings.Count(token, ".") == 2 {
+		principal, err := authenticator.verifier.Verify(token)
+		if err == ErrInvalidCredentials && authenticator.sessions.Enabled() {
+			return authenticator.sessions.Verify(token)
+		}
+		return principal, err
+	}
+
+	return authenticator.authenticateKey(token)
+}
+
+func (authenticator Authenticator) authenticateKey(plaintext string) (Principal, error) {
+	if authenticator.keys == nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+
+	api_key, err := authenticator.keys.GetKeyByHash(HashKey(plaintext))
+	if err == ErrKeyNotFound {
+		return Principal{}, ErrInvalidCredentials
+	} else if err != nil {
+		return Principal{}, err
+	}
+
+	return api_key.Principal(), nil
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Clock skew allowed between this service and token issuers
+const jwtLeeway = 30 * time.Second
+
+// JWTVerifier verifies bearer tokens signed with an HMAC secret (HS256, HS384, HS512) or any of
+// the RSA (RS*, PS*) and EC (ES*) keys in a JWKS file. Tokens must have a sub and an exp, and
+// the issuer and audience if they're set. Roles are read from the roles claim, a list of strings.
+type JWTVerifier struct {
+	hmac_secret []byte
+	// Public keys by their kid
+	keys     map[string]interface{}
+	methods  []string
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifier accepts tokens signed with hmac_secret, or with the keys in the JWKS file at
+// jwks_path, either of which may be ""
+func NewJWTVerifier(hmac_secret string, jwks_path string, issuer string, audience string) (JWTVerifier, error) {
+	var new_jwt_verifier JWTVerifier
+
+	new_jwt_verifier.keys = make(map[string]interface{})
+	new_jwt_verifier.issuer = issuer
+	new_jwt_verifier.audience = audience
+
+	if hmac_secret != "" {
+		new_jwt_verifier.hmac_secret = []byte(hmac_secret)
+		new_jwt_verifier.methods = append(new_jwt_verifier.methods, "HS256", "HS384", "HS512")
+	}
+
+	if jwks_path != "" {
+		jwks, err := ioutil.ReadFile(jwks_path)
+		if err != nil {
+			return new_jwt_verifier, err
+		}
+		if new_jwt_verifier.keys, err = parseJWKS(jwks); err != nil {
+			return new_jwt_verifier, fmt.Errorf("%s: %s", jwks_path, err)
+		}
+	}
+
+	has_rsa, has_ec := false, false
+	for _, key := range new_jwt_verifier.keys {
+		switch key.(type) {
+		case *rsa.PublicKey:
+			has_rsa = true
+		case *ecdsa.PublicKey:
+			has_ec = true
+		}
+	}
+	if has_rsa {
+		new_jwt_verifier.methods = append(new_jwt_verifier.methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512")
+	}
+	if has_ec {
+		new_jwt_verifier.methods = append(new_jwt_verifier.methods, "ES256", "ES384", "ES512")
+	}
+
+	return new_jwt_verifier, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS reads the RSA and EC public keys from a JSON Web Key Set, skipping encryption keys
+func parseJWKS(jwks []byte) (map[string]interface{}, error) {
+	var key_set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &key_set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, key := range key_set.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+
+		var public_key interface{}
+		var err error
+		switch key.Kty {
+		case "RSA":
+			public_key, err = rsaKey(key)
+		case "EC":
+			public_key, err = ecKey(key)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %s", key.Kid, err)
+		}
+		keys[key.Kid] = public_key
+	}
+
+	return keys, nil
+}
+
+func decodeBigInt(encoded string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+func rsaKey(key jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(key.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(key.E)
+	if err != nil || !e.IsInt64() {
+		return nil, errors.New("invalid exponent")
+	}
+
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecKey(key jsonWebKey) (*ecdsa.PublicKey, error) {
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	curve, ok := curves[key.Crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+	}
+
+	x, err := decodeBigInt(key.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(key.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// publicKey finds the key a token was signed with by its kid, or the only key of its type if
+// it has no kid
+func (verifier JWTVerifier) publicKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return verifier.hmac_secret, nil
+	}
+
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, exists := verifier.keys[kid]; exists {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	// The keys are all RSA or EC
+	_, wants_ec := token.Method.(*jwt.SigningMethodECDSA)
+	var only interface{}
+	for _, key := range verifier.keys {
+		if _, is_ec := key.(*ecdsa.PublicKey); is_ec != wants_ec {
+			continue
+		}
+		if only != nil {
+			return nil, errors.New("token has no kid")
+		}
+		only = key
+	}
+	if only == nil {
+		return nil, errors.New("no key for the token")
+	}
+
+	return only, nil
+}
+
+// Verify returns the principal a token was issued to, or ErrInvalidCredentials
+func (verifier JWTVerifier) Verify(token_string string) (Principal, error) {
+	if len(verifier.methods) == 0 {
+		return Principal{}, ErrInvalidCredentials
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(verifier.methods), jwt.WithExpirationRequired(), jwt.WithLeeway(jwtLeeway)}
+	if verifier.issuer != "" {
+		options = append(options, jwt.WithIssuer(verifier.issuer))
+	}
+	if verifier.audience != "" {
+		options = append(options, jwt.WithAudience(verifier.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token_string, claims, verifier.publicKey, options...); err != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return Principal{}, ErrInvalidCredentials
+	}
+
+	principal := Principal{Subject: subject, Method: MethodJWT, Roles: []string{}}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, role)
+			}
+		}
+	}
+
+	return principal, nil
+}
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("API key not found")
+
+// Prefix of every key, so they're recognisable in config and logs
+const keyPrefix = "uk_"
+
+// Keys chosen by operators must be at least this long, as they're hashed with a fast hash
+const minKeyLength = 32
+
+var errKeyTooShort = errors.New("API keys must be at least 32 characters")
+
+// APIKey is an issued key. Only its hash is kept, Prefix being enough of it to tell keys apart.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Hash      string    `json:"hash"`
+	Roles     []string  `json:"roles"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Principal is who a request authenticated with the key was made by
+func (api_key APIKey) Principal() Principal {
+	return Principal{Subject: "api_key:" + api_key.Name, Method: MethodAPIKey, Roles: api_key.Roles}
+}
+
+// KeyStore keeps API keys, it must be safe to use concurrently
+type KeyStore interface {
+	CreateKey(APIKey) error
+	// GetKeyByHash returns the key with a hash, or ErrKeyNotFound
+	GetKeyByHash(string) (APIKey, error)
+	// ListKeys returns every key, oldest first
+	ListKeys() ([]APIKey, error)
+	// DeleteKey revokes a key by its ID, or returns ErrKeyNotFound
+	DeleteKey(string) error
+}
+
+// HashKey returns the hash keys are stored and looked up by. Keys are random, so a fast hash is
+// as good as a slow one.
+func HashKey(plaintext string) string {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// NewKey issues a key, returning it and what's kept of it. The key itself can't be recovered.
+func NewKey(name string, roles []string) (string, APIKey) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	plaintext := keyPrefix + hex.EncodeToString(secret)
+
+	return plaintext, keyOf(plaintext, name, roles)
+}
+
+// EnsureKey stores a key chosen by an operator rather than issued, unless it's stored already.
+// It lets the first admin in when keys are kept in memory, where create-api-key can't add one.
+func EnsureKey(keys KeyStore, plaintext string, name string, roles []string) error {
+	if len(plaintext) < minKeyLength {
+		return errKeyTooShort
+	}
+
+	api_key := keyOf(plaintext, name, roles)
+	if _, err := keys.GetKeyByHash(api_key.Hash); err != ErrKeyNotFound {
+		return err
+	}
+
+	return keys.CreateKey(api_key)
+}
+
+// keyOf returns what's kept of a key
+func keyOf(plaintext string, name string, roles []string) APIKey {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	api_key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Prefix:    plaintext[:len(keyPrefix)+8],
+		Hash:      HashKey(plaintext),
+		Roles:     roles,
+		CreatedAt: time.Now().UTC(),
+	}
+	if api_key.Roles == nil {
+		api_key.Roles = []string{}
+	}
+
+	return api_key
+}
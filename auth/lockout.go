@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy allows a username UserFailures failed logins within Window, and a client IP
+// IPFailures, locking them out for Duration at the next attempt. The IP limit is higher, as many
+// users may share an address.
+type LockoutPolicy struct {
+	UserFailures int
+	IPFailures   int
+	Window       time.Duration
+	Duration     time.Duration
+}
+
+// DefaultLockoutPolicy allows 5 failures per username and 50 per IP in 15 minutes
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{UserFailures: 5, IPFailures: 50, Window: 15 * time.Minute, Duration: 15 * time.Minute}
+}
+
+// Lockout counts login attempts, locking usernames and client IPs out when they fail too often.
+// Attempts are counted before their password is checked, so concurrent guesses can't all get past
+// the check before any of them is counted. Durations returned are how long until a login may be
+// tried again, 0 if it may now.
+type Lockout interface {
+	// Attempt counts a login attempt by username from ip, returning its ID and how long they're
+	// locked out for. An attempt over either limit starts the lock and is refused, as are those
+	// made during it, which aren't counted.
+	Attempt(username string, ip string) (string, time.Duration, error)
+	// Succeed forgets username's failures once an attempt logs in, and uncounts it from its ip
+	Succeed(username string, ip string, attempt string) error
+	// Unlock lifts a username's lock and forgets its failures
+	Unlock(username string) error
+}
+
+// NewAttemptID returns a random ID for an attempt, so attempts at the same moment are each counted
+func NewAttemptID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// loginAttempt is an attempt MemoryLockout has counted
+type loginAttempt struct {
+	id string
+	at time.Time
+}
+
+// MemoryLockout keeps attempts in the process, so each replica counts its own. RedisLockout in
+// redisutil is shared by every replica.
+type MemoryLockout struct {
+	lock   *sync.Mutex
+	policy LockoutPolicy
+	// Attempts within the window, oldest first, by "user:<username>" or "ip:<ip>"
+	attempts map[string][]loginAttempt
+	// When locks end, by the same keys
+	locked_until map[string]time.Time
+	// When attempts and locks which have ended were last swept
+	swept_at *time.Time
+}
+
+func NewMemoryLockout(policy LockoutPolicy) MemoryLockout {
+	var new_memory_lockout MemoryLockout
+
+	new_memory_lockout.lock = &sync.Mutex{}
+	new_memory_lockout.policy = policy
+	new_memory_lockout.attempts = make(map[string][]loginAttempt)
+	new_memory_lockout.locked_until = make(map[string]time.Time)
+	new_memory_lockout.swept_at = &time.Time{}
+
+	return new_memory_lockout
+}
+
+func (lockout MemoryLockout) lockedFor(key string, now time.Time) time.Duration {
+	locked_until, exists := lockout.locked_until[key]
+	if !exists || !now.Before(locked_until) {
+		delete(lockout.locked_until, key)
+		return 0
+	}
+
+	return locked_until.Sub(now)
+}
+
+// sweep forgets the attempts which have fallen out of the window and the locks which have ended,
+// so usernames and IPs which aren't tried again don't stay in memory. It runs at most once a
+// window, as it goes through every key.
+func (lockout MemoryLockout) sweep(now time.Time) {
+	if now.Before(lockout.swept_at.Add(lockout.policy.Window)) {
+		return
+	}
+	*lockout.swept_at = now
+
+	for key, attempts := range lockout.attempts {
+		if len(attempts) == 0 || !attempts[len(attempts)-1].at.After(now.Add(-lockout.policy.Window)) {
+			delete(lockout.attempts, key)
+		}
+	}
+	for key, locked_until := range lockout.locked_until {
+		if !now.Before(locked_until) {
+			delete(lockout.locked_until, key)
+		}
+	}
+}
+
+// count records an attempt against key, locking it if that's more than limit within the window
+func (lockout MemoryLockout) count(key string, limit int, attempt loginAttempt) {
+	attempts := lockout.attempts[key]
+	for len(attempts) > 0 && !attempts[0].at.After(attempt.at.Add(-lockout.policy.Window)) {
+		attempts = attempts[1:]
+	}
+	attempts = append(attempts, attempt)
+
+	if len(attempts) > limit {
+		lockout.locked_until[key] = attempt.at.Add(lockout.policy.Duration)
+		delete(lockout.attempts, key)
+		return
+	}
+	lockout.attempts[key] = attempts
+}
+
+func (lockout MemoryLockout) Attempt(username string, ip string) (string, time.Duration, error) {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	attempt := loginAttempt{id: NewAttemptID(), at: time.Now()}
+	lockout.sweep(attempt.at)
+	if locked_for := maxDuration(lockout.lockedFor("user:"+username, attempt.at), lockout.lockedFor("ip:"+ip, attempt.at)); locked_for > 0 {
+		return attempt.id, locked_for, nil
+	}
+
+	lockout.count("user:"+username, lockout.policy.UserFailures, attempt)
+	lockout.count("ip:"+ip, lockout.policy.IPFailures, attempt)
+
+	return attempt.id, maxDuration(lockout.lockedFor("user:"+username, attempt.at), lockout.lockedFor("ip:"+ip, attempt.at)), nil
+}
+
+func (lockout MemoryLockout) Succeed(username string, ip string, attempt string) error {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	delete(lockout.attempts, "user:"+username)
+
+	attempts := lockout.attempts["ip:"+ip]
+	for i := range attempts {
+		if attempts[i].id == attempt {
+			lockout.attempts["ip:"+ip] = append(attempts[:i:i], attempts[i+1:]...)
+			break
+		}
+	}
+	if len(lockout.attempts["ip:"+ip]) == 0 {
+		delete(lockout.attempts, "ip:"+ip)
+	}
+
+	return nil
+}
+
+func (lockout MemoryLockout) Unlock(username string) error {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	delete(lockout.attempts, "user:"+username)
+	delete(lockout.locked_until, "user:"+username)
+
+	return nil
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryKeyStore keeps keys in memory, they're lost when the process exits
+type MemoryKeyStore struct {
+	lock *sync.Mutex
+	keys map[string]APIKey
+}
+
+func NewMemoryKeyStore() MemoryKeyStore {
+	var new_memory_key_store MemoryKeyStore
+
+	new_memory_key_store.lock = &sync.Mutex{}
+	new_memory_key_store.keys = make(map[string]APIKey)
+
+	return new_memory_key_store
+}
+
+func (keys MemoryKeyStore) CreateKey(api_key APIKey) error {
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	keys.keys[api_key.ID] = api_key
+
+	return nil
+}
+
+func (keys MemoryKeyStore) GetKeyByHash(hash string) (APIKey, error) {
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	for _, api_key := range keys.keys {
+		if api_key.Hash == hash {
+			return api_key, nil
+		}
+	}
+
+	return APIKey{}, ErrKeyNotFound
+}
+
+func (keys MemoryKeyStore) ListKeys() ([]APIKey, error) {
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	api_keys := []APIKey{}
+	for _, api_key := range keys.keys {
+		api_keys = append(api_keys, api_key)
+	}
+	sortKeys(api_keys)
+
+	return api_keys, nil
+}
+
+func (keys MemoryKeyStore) DeleteKey(id string) error {
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	if _, exists := keys.keys[id]; !exists {
+		return ErrKeyNotFound
+	}
+	delete(keys.keys, id)
+
+	return nil
+}
+
+// sortKeys puts keys oldest first
+func sortKeys(api_keys []APIKey) {
+	sort.Slice(api_keys, func(i, j int) bool {
+		if api_keys[i].CreatedAt.Equal(api_keys[j].CreatedAt) {
+			return api_keys[i].ID < api_keys[j].ID
+		}
+		return api_keys[i].CreatedAt.Before(api_keys[j].CreatedAt)
+	})
+}
+
+// MemoryTokenStore keeps unused tokens in memory, so a token can only be redeemed at the replica
+// which issued it
+type MemoryTokenStore struct {
+	lock *sync.Mutex
+	// When unused tokens expire, by ID
+	unused map[string]time.Time
+}
+
+func NewMemoryTokenStore() MemoryTokenStore {
+	var new_memory_token_store MemoryTokenStore
+
+	new_memory_token_store.lock = &sync.Mutex{}
+	new_memory_token_store.unused = make(map[string]time.Time)
+
+	return new_memory_token_store
+}
+
+func (store MemoryTokenStore) SaveToken(id string, ttl time.Duration) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	// Expired tokens are only removed here, which is as often as they're added
+	for unused_id, expires_at := range store.unused {
+		if !now.Before(expires_at) {
+			delete(store.unused, unused_id)
+		}
+	}
+	store.unused[id] = now.Add(ttl)
+
+	return nil
+}
+
+func (store MemoryTokenStore) UseToken(id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	expires_at, unused := store.unused[id]
+	delete(store.unused, id)
+
+	return unused && time.Now().Before(expires_at), nil
+}
+
+// MemorySessionStore keeps session generations in memory, so sessions are only revoked at the
+// replica which revoked them
+type MemorySessionStore struct {
+	lock        *sync.Mutex
+	generations map[string]int64
+}
+
+func NewMemorySessionStore() MemorySessionStore {
+	var new_memory_session_store MemorySessionStore
+
+	new_memory_session_store.lock = &sync.Mutex{}
+	new_memory_session_store.generations = make(map[string]int64)
+
+	return new_memory_session_store
+}
+
+func (store MemorySessionStore) Generation(username string) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.generations[username], nil
+}
+
+func (store MemorySessionStore) Revoke(username string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.generations[username]++
+
+	return nil
+}
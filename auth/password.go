@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters, OWASP's minimum of 19 MiB of memory and 2 passes
+const (
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var errInvalidHash = errors.New("Invalid password hash")
+
+// PasswordStore keeps users' password hashes apart from their profiles, so they're never returned
+// with them. Hashes are removed with their users when they expire, are purged or are erased.
+type PasswordStore interface {
+	SetPasswordHash(username string, hash string) error
+	// GetPasswordHash returns dberrors.ErrNoPassword if the user has no password
+	GetPasswordHash(username string) (string, error)
+	DeletePasswordHash(username string) error
+}
+
+// HashPassword hashes a password with argon2id and a random salt, in the PHC string format
+// $argon2id$v=19$m=...,t=...,p=...$<salt>$<hash>
+func HashPassword(password string) string {
+	salt := make([]byte, argon2SaltLen)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// CheckPassword reports whether a password matches a hash from HashPassword, with the parameters
+// in the hash so they can be raised without invalidating existing ones
+func CheckPassword(hash string, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errInvalidHash
+	}
+
+	var version int
+	var memory, passes uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads); err != nil {
+		return false, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, errInvalidHash
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, passes, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// Checked against for users without a password, so logins take as long either way
+var decoyHash = HashPassword("decoy password")
+
+// VerifyPassword reports whether a password matches a hash, "" standing for a user without a
+// password. That's checked against a decoy, so it takes as long as a wrong password.
+func VerifyPassword(hash string, password string) bool {
+	if hash == "" {
+		CheckPassword(decoyHash, password)
+		return false
+	}
+
+	matches, err := CheckPassword(hash, password)
+
+	return err == nil && matches
+}
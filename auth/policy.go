@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Scopes granted to roles. Reading or writing a user other than the principal's own (its
+// Subject) needs ScopeUsersAdmin as well, as do listing users and erasing them for good.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeUsersAdmin = "users:admin"
+)
+
+var Scopes = []string{ScopeUsersRead, ScopeUsersWrite, ScopeUsersAdmin}
+
+// RoleUser may read and write their own user
+const RoleUser = "user"
+
+// Policy grants roles their scopes. Principals without any roles are given DefaultRoles, so
+// tokens from an issuer that doesn't set roles are regular users.
+type Policy struct {
+	DefaultRoles []string            `json:"default_roles"`
+	Roles        map[string][]string `json:"roles"`
+}
+
+// DefaultPolicy is used when there's no policy file: admins have every scope, and users and
+// principals without roles may read and write their own user
+func DefaultPolicy() Policy {
+	return Policy{
+		DefaultRoles: []string{RoleUser},
+		Roles: map[string][]string{
+			RoleAdmin: {ScopeUsersRead, ScopeUsersWrite, ScopeUsersAdmin},
+			RoleUser:  {ScopeUsersRead, ScopeUsersWrite},
+		},
+	}
+}
+
+// LoadPolicy reads a policy from a JSON file, e.g.
+//
+//	{"default_roles": ["user"], "roles": {"admin": ["users:read", "users:write", "users:admin"],
+//	"user": ["users:read", "users:write"], "support": ["users:read", "users:admin"]}}
+func LoadPolicy(path string) (Policy, error) {
+	var policy Policy
+
+	policy_json, err := ioutil.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err = json.Unmarshal(policy_json, &policy); err != nil {
+		return policy, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for role, scopes := range policy.Roles {
+		for _, scope := range scopes {
+			known := false
+			for _, known_scope := range Scopes {
+				known = known || scope == known_scope
+			}
+			if !known {
+				return policy, fmt.Errorf("%s: role %q has unknown scope %q", path, role, scope)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// Scopes returns every scope granted to a principal's roles. Roles the policy doesn't list
+// grant nothing.
+func (policy Policy) Scopes(principal Principal) map[string]bool {
+	roles := principal.Roles
+	if len(roles) == 0 {
+		roles = policy.DefaultRoles
+	}
+
+	scopes := map[string]bool{}
+	for _, role := range roles {
+		for _, scope := range policy.Roles[role] {
+			scopes[scope] = true
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisKeyStore keeps keys in the api_keys hash, ID -> APIKey JSON, indexed by the api_key_hashes
+// hash, key hash -> ID
+type RedisKeyStore struct {
+	client *redis.Client
+}
+
+func NewRedisKeyStore(address string, password string, database int, maxretries int) (RedisKeyStore, error) {
+	var new_redis_key_store RedisKeyStore
+
+	new_redis_key_store.client = redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+
+	return new_redis_key_store, new_redis_key_store.client.Ping().Err()
+}
+
+// Close closes the client
+func (keys RedisKeyStore) Close() error {
+	return keys.client.Close()
+}
+
+func (keys RedisKeyStore) CreateKey(api_key APIKey) error {
+	api_key_json, err := json.Marshal(api_key)
+	if err != nil {
+		return err
+	}
+
+	_, err = keys.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet("api_keys", api_key.ID, api_key_json)
+		pipe.HSet("api_key_hashes", api_key.Hash, api_key.ID)
+		return nil
+	})
+
+	return err
+}
+
+func (keys RedisKeyStore) getKey(id string) (APIKey, error) {
+	var api_key APIKey
+
+	api_key_json, err := keys.client.HGet("api_keys", id).Result()
+	if err == redis.Nil {
+		return api_key, ErrKeyNotFound
+	} else if err != nil {
+		return api_key, err
+	}
+
+	return api_key, json.Unmarshal([]byte(api_key_json), &api_key)
+}
+
+func (keys RedisKeyStore) GetKeyByHash(hash string) (APIKey, error) {
+	id, err := keys.client.HGet("api_key_hashes", hash).Result()
+	if err == redis.Nil {
+		return APIKey{}, ErrKeyNotFound
+	} else if err != nil {
+		return APIKey{}, err
+	}
+
+	return keys.getKey(id)
+}
+
+func (keys RedisKeyStore) ListKeys() ([]APIKey, error) {
+	api_key_jsons, err := keys.client.HGetAll("api_keys").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	api_keys := []APIKey{}
+	for _, api_key_json := range api_key_jsons {
+		var api_key APIKey
+		if err = json.Unmarshal([]byte(api_key_json), &api_key); err != nil {
+			return nil, err
+		}
+		api_keys = append(api_keys, api_key)
+	}
+	sortKeys(api_keys)
+
+	return api_keys, nil
+}
+
+// KEYS: api_keys, api_key_hashes
+// ARGV: key ID, key hash
+// Deletes a key and its index entry together
+var deleteKeyScript = redis.NewScript(`
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[2])
+return 1
+`)
+
+func (keys RedisKeyStore) DeleteKey(id string) error {
+	api_key, err := keys.getKey(id)
+	if err != nil {
+		return err
+	}
+
+	return deleteKeyScript.Run(keys.client, []string{"api_keys", "api_key_hashes"}, id, api_key.Hash).Err()
+}
+
+// RedisTokenStore keeps unused tokens as email_token:{id} keys expiring with them, so a token
+// issued by any replica can be redeemed at any other
+type RedisTokenStore struct {
+	client *redis.Client
+}
+
+func NewRedisTokenStore(address string, password string, database int, maxretries int) (RedisTokenStore, error) {
+	var new_redis_token_store RedisTokenStore
+
+	new_redis_token_store.client = redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+
+	return new_redis_token_store, new_redis_token_store.client.Ping().Err()
+}
+
+// Close closes the client
+func (store RedisTokenStore) Close() error {
+	return store.client.Close()
+}
+
+func (store RedisTokenStore) SaveToken(id string, ttl time.Duration) error {
+	return store.client.Set("email_token:"+id, "1", ttl).Err()
+}
+
+// UseToken deletes the token's key, which only one of any concurrent redemptions can do
+func (store RedisTokenStore) UseToken(id string) (bool, error) {
+	deleted, err := store.client.Del("email_token:" + id).Result()
+
+	return deleted == 1, err
+}
+
+// RedisSessionStore keeps session generations as session_generation:{username} keys, so sessions
+// revoked at any replica are revoked at every one
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+func NewRedisSessionStore(address string, password string, database int, maxretries int) (RedisSessionStore, error) {
+	var new_redis_session_store RedisSessionStore
+
+	new_redis_session_store.client = redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+
+	return new_redis_session_store, new_redis_session_store.client.Ping().Err()
+}
+
+// Close closes the client
+func (store RedisSessionStore) Close() error {
+	return store.client.Close()
+}
+
+func (store RedisSessionStore) Generation(username string) (int64, error) {
+	generation, err := store.client.Get("session_generation:" + username).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return generation, err
+}
+
+func (store RedisSessionStore) Revoke(username string) error {
+	return store.client.Incr("session_generation:" + username).Err()
+}
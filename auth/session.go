@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MethodSession is the Principal.Method of session tokens issued by POST /login
+const MethodSession = "session"
+
+// Issuer and audience of session tokens, which tell them apart from other JWTs
+const sessionIssuer = "userapi"
+
+var ErrSessionsDisabled = errors.New("Logins are not enabled")
+
+// SessionStore keeps each username's session generation, which revoking its sessions moves on.
+// It must be safe to use concurrently.
+type SessionStore interface {
+	// Generation returns the generation of a username's sessions, 0 if they were never revoked
+	Generation(username string) (int64, error)
+	// Revoke moves a username's sessions to the next generation
+	Revoke(username string) error
+}
+
+// sessionClaims are a session token's claims. Only tokens of the username's current generation
+// are valid.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	Generation int64 `json:"gen"`
+}
+
+// Sessions issues and verifies the HS256 signed JWTs users log in for, whose sub is their
+// username. Principals from them have no roles, so they're granted the policy's default roles.
+type Sessions struct {
+	secret   []byte
+	ttl      time.Duration
+	verifier JWTVerifier
+	store    SessionStore
+}
+
+// NewSessions signs session tokens lasting ttl with secret. Without a secret none are issued.
+// Without a store sessions can't be revoked, and last until they expire.
+func NewSessions(secret string, ttl time.Duration, store SessionStore) Sessions {
+	var new_sessions Sessions
+
+	new_sessions.secret = []byte(secret)
+	new_sessions.ttl = ttl
+	new_sessions.store = store
+	if secret != "" {
+		new_sessions.verifier, _ = NewJWTVerifier(secret, "", sessionIssuer, sessionIssuer)
+	}
+
+	return new_sessions
+}
+
+func (sessions Sessions) Enabled() bool {
+	return len(sessions.secret) > 0
+}
+
+// Issue returns a session token for username, and when it expires
+func (sessions Sessions) Issue(username string) (string, time.Time, error) {
+	if !sessions.Enabled() {
+		return "", time.Time{}, ErrSessionsDisabled
+	}
+
+	generation, err := sessions.generation(username)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expires_at := now.Add(sessions.ttl).Truncate(time.Second)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessionIssuer,
+			Audience:  jwt.ClaimStrings{sessionIssuer},
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires_at),
+		},
+		Generation: generation,
+	})
+
+	signed, err := token.SignedString(sessions.secret)
+
+	return signed, expires_at, err
+}
+
+// Verify returns the principal a session token was issued to, or ErrInvalidCredentials
+func (sessions Sessions) Verify(token string) (Principal, error) {
+	principal, err := sessions.verifier.Verify(token)
+	if err != nil {
+		return principal, err
+	}
+
+	// The signature was checked above
+	var claims sessionClaims
+	if _, _, err = jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	generation, err := sessions.generation(principal.Subject)
+	if err != nil {
+		return Principal{}, err
+	}
+	if claims.Generation != generation {
+		return Principal{}, ErrInvalidCredentials
+	}
+
+	principal.Method = MethodSession
+	// Roles are only granted to sessions by the policy
+	principal.Roles = []string{}
+
+	return principal, nil
+}
+
+func (sessions Sessions) generation(username string) (int64, error) {
+	if sessions.store == nil {
+		return 0, nil
+	}
+
+	return sessions.store.Generation(username)
+}
+
+// Revoke ends every session issued to username so far, for when its password changes or it's
+// deleted
+func (sessions Sessions) Revoke(username string) error {
+	if sessions.store == nil {
+		return nil
+	}
+
+	return sessions.store.Revoke(username)
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Purposes emailed tokens are issued for. A token for one can't be redeemed for the other.
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+var ErrInvalidToken = errors.New("Token is invalid, expired or already used")
+
+var ErrTokensDisabled = errors.New("Email tokens are not enabled")
+
+// Token is what an emailed token proves: that whoever has it receives mail at Email, which was
+// Username's email when it was issued
+type Token struct {
+	ID        string `json:"jti"`
+	Purpose   string `json:"purpose"`
+	Username  string `json:"sub"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenStore remembers which tokens haven't been redeemed, so each is only redeemed once. It must
+// be safe to use concurrently.
+type TokenStore interface {
+	// SaveToken records a token's ID as unused until ttl passes
+	SaveToken(id string, ttl time.Duration) error
+	// UseToken marks a token used, returning false if it already was, has expired or was never
+	// saved
+	UseToken(id string) (bool, error)
+}
+
+// Tokens issues the tokens emailed to users to verify their email and reset their password.
+// They're the encoded Token, a dot and its HMAC-SHA256, so they can be checked before they're
+// redeemed.
+type Tokens struct {
+	secret []byte
+	ttl    time.Duration
+	store  TokenStore
+}
+
+// NewTokens signs tokens lasting ttl with secret. Without a secret or a store none are issued.
+func NewTokens(secret string, ttl time.Duration, store TokenStore) Tokens {
+	var new_tokens Tokens
+
+	new_tokens.secret = []byte(secret)
+	new_tokens.ttl = ttl
+	new_tokens.store = store
+
+	return new_tokens
+}
+
+func (tokens Tokens) Enabled() bool {
+	return len(tokens.secret) > 0 && tokens.store != nil
+}
+
+// TTL is how long issued tokens last
+func (tokens Tokens) TTL() time.Duration {
+	return tokens.ttl
+}
+
+func (tokens Tokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, tokens.secret)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token for purpose, proving username receives mail at email
+func (tokens Tokens) Issue(purpose string, username string, email string) (string, error) {
+	if !tokens.Enabled() {
+		return "", ErrTokensDisabled
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	token := Token{
+		ID:        hex.EncodeToString(id),
+		Purpose:   purpose,
+		Username:  username,
+		Email:     email,
+		ExpiresAt: time.Now().Add(tokens.ttl).Unix(),
+	}
+
+	token_json, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	if err = tokens.store.SaveToken(token.ID, tokens.ttl); err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(token_json)
+
+	return payload + "." + tokens.sign(payload), nil
+}
+
+// Check returns what a token for purpose proves, or ErrInvalidToken, without redeeming it. It may
+// have been redeemed already.
+func (tokens Tokens) Check(purpose string, signed string) (Token, error) {
+	var token Token
+
+	if !tokens.Enabled() {
+		return token, ErrTokensDisabled
+	}
+
+	dot := strings.IndexByte(signed, '.')
+	if dot < 0 || !hmac.Equal([]byte(signed[dot+1:]), []byte(tokens.sign(signed[:dot]))) {
+		return token, ErrInvalidToken
+	}
+
+	token_json, err := base64.RawURLEncoding.DecodeString(signed[:dot])
+	if err != nil || json.Unmarshal(token_json, &token) != nil {
+		return Token{}, ErrInvalidToken
+	}
+	if token.Purpose != purpose || time.Now().Unix() >= token.ExpiresAt {
+		return Token{}, ErrInvalidToken
+	}
+
+	return token, nil
+}
+
+// Redeem checks a token for purpose and uses it up, returning ErrInvalidToken if it was already
+func (tokens Tokens) Redeem(purpose string, signed string) (Token, error) {
+	token, err := tokens.Check(purpose, signed)
+	if err != nil {
+		return token, err
+	}
+
+	unused, err := tokens.store.UseToken(token.ID)
+	if err != nil {
+		return Token{}, err
+	}
+	if !unused {
+		return Token{}, ErrInvalidToken
+	}
+
+	return token, nil
+}
@@ -0,0 +1,957 @@
+package boltstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+/*
+Embedded bbolt implementation of handlers.DatabaseInterface, for running the service without any
+external services, e.g. in development or CI. bbolt locks its file, so only one process can use it.
+
+Buckets:
+users	- username -> record, versions come from the bucket sequence so are never reused
+emails	- normalized email -> username, enforcing unique emails
+expiry	- big endian expiry nanos + username -> nothing, in expiry order
+deleted	- username -> tombstone, soft deleted users in the recycle bin
+purge	- big endian purge nanos + username -> nothing, in purge order
+history	- username -> bucket of big endian version -> record, the user's earlier versions
+webhooks	- subscription ID -> events.Subscription
+deliveries	- subscription ID -> bucket of big endian sequence -> events.Delivery, the latest attempts
+passwords	- username -> password hash
+
+Users expire as their validation.Expiry says, data_ttl seconds after their last modification by
+default, and are handed to the archiver like RedisHashConn does. Expiry is driven by the expiry bucket,
+so it survives restarts. Soft deleted users are purged and archived the same way after retention
+seconds in the recycle bin. Earlier versions are kept as the history policy says.
+*/
+
+// How often expired users are looked for
+const reapInterval = time.Second
+
+var (
+	usersBucket      = []byte("users")
+	emailsBucket     = []byte("emails")
+	expiryBucket     = []byte("expiry")
+	deletedBucket    = []byte("deleted")
+	purgeBucket      = []byte("purge")
+	historyBucket    = []byte("history")
+	webhooksBucket   = []byte("webhooks")
+	deliveriesBucket = []byte("deliveries")
+	passwordsBucket  = []byte("passwords")
+)
+
+var errUserNotFound = errors.New("User not found")
+
+type record struct {
+	Data          string `json:"data"`
+	Version       uint64 `json:"version"`
+	ModifiedNanos int64  `json:"modified_nanos"`
+	// Encoded validation.Expiry, and its deadline or 0 if the user never expires
+	Expiry       string `json:"expiry,omitempty"`
+	ExpiresNanos int64  `json:"expires_nanos"`
+}
+
+// tombstone is a soft deleted user in the recycle bin
+type tombstone struct {
+	record
+	DeletedNanos int64  `json:"deleted_nanos"`
+	DeletedBy    string `json:"deleted_by"`
+	PurgeNanos   int64  `json:"purge_nanos"`
+}
+
+type BoltStore struct {
+	db        *bolt.DB
+	data_ttl  int
+	retention int
+	history   versions.Policy
+	archiver  archive.Archiver
+	stop      chan bool
+}
+
+func NewBoltStore(path string, data_ttl int, retention int, history versions.Policy, archiver archive.Archiver) (BoltStore, error) {
+	var new_bolt_store BoltStore
+
+	// Fail rather than wait forever if another process has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return new_bolt_store, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, emailsBucket, expiryBucket, deletedBucket, purgeBucket, historyBucket, webhooksBucket, deliveriesBucket, passwordsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return new_bolt_store, err
+	}
+
+	new_bolt_store.db = db
+	new_bolt_store.data_ttl = data_ttl
+	new_bolt_store.retention = retention
+	new_bolt_store.history = history
+	new_bolt_store.archiver = archiver
+	new_bolt_store.stop = make(chan bool)
+
+	go new_bolt_store.reapExpired()
+
+	return new_bolt_store, nil
+}
+
+// Close stops expiring users and closes the database file
+func (store BoltStore) Close() error {
+	close(store.stop)
+
+	return store.db.Close()
+}
+
+func getRecord(tx *bolt.Tx, username string) (record, bool) {
+	var stored record
+
+	encoded := tx.Bucket(usersBucket).Get([]byte(username))
+	if encoded == nil || json.Unmarshal(encoded, &stored) != nil {
+		return stored, false
+	}
+
+	return stored, true
+}
+
+func getTombstone(tx *bolt.Tx, username string) (tombstone, bool) {
+	var deleted tombstone
+
+	encoded := tx.Bucket(deletedBucket).Get([]byte(username))
+	if encoded == nil || json.Unmarshal(encoded, &deleted) != nil {
+		return deleted, false
+	}
+
+	return deleted, true
+}
+
+func expiryKey(stored record, username string) []byte {
+	return timeKey(stored.ExpiresNanos, username)
+}
+
+// timeKey orders keys by time, then username
+func timeKey(nanos int64, username string) []byte {
+	key := make([]byte, 8, 8+len(username))
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+
+	return append(key, username...)
+}
+
+func (store BoltStore) GetUser(username string) (string, error) {
+	user_json_string, _, err := store.GetUserWithVersion(username)
+
+	return user_json_string, err
+}
+
+func (store BoltStore) GetUserWithVersion(username string) (string, string, error) {
+	var stored record
+	var exists bool
+
+	store.db.View(func(tx *bolt.Tx) error {
+		stored, exists = getRecord(tx, username)
+		return nil
+	})
+	if !exists {
+		return "", "", errUserNotFound
+	}
+
+	return stored.Data, strconv.FormatUint(stored.Version, 10), nil
+}
+
+func (stored record) asVersion() versions.Version {
+	return versions.Version{Version: strconv.FormatUint(stored.Version, 10), Data: stored.Data, ModifiedAt: time.Unix(0, stored.ModifiedNanos)}
+}
+
+// earlierVersions returns a user's earlier versions newest first, however many are stored
+func earlierVersions(tx *bolt.Tx, username string) []versions.Version {
+	earlier := []versions.Version{}
+
+	user_history := tx.Bucket(historyBucket).Bucket([]byte(username))
+	if user_history == nil {
+		return earlier
+	}
+
+	history_cursor := user_history.Cursor()
+	for key, encoded := history_cursor.Last(); key != nil; key, encoded = history_cursor.Prev() {
+		var stored record
+		if json.Unmarshal(encoded, &stored) == nil {
+			earlier = append(earlier, stored.asVersion())
+		}
+	}
+
+	return earlier
+}
+
+func (store BoltStore) GetUserVersions(username string) ([]versions.Version, error) {
+	var user_versions []versions.Version
+
+	store.db.View(func(tx *bolt.Tx) error {
+		stored, exists := getRecord(tx, username)
+		if !exists {
+			return nil
+		}
+
+		earlier := earlierVersions(tx, username)
+		user_versions = append([]versions.Version{stored.asVersion()}, earlier[:store.history.Keep(earlier, time.Now())]...)
+		return nil
+	})
+	if user_versions == nil {
+		return nil, errUserNotFound
+	}
+
+	return user_versions, nil
+}
+
+// keepVersion adds the version of a user being replaced to its history, and drops the versions
+// the history policy no longer keeps
+func (store BoltStore) keepVersion(tx *bolt.Tx, username string, previous record) error {
+	if store.history.MaxVersions == 0 {
+		return nil
+	}
+
+	user_history, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(username))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(previous)
+	if err != nil {
+		return err
+	}
+	if err = user_history.Put(versionKey(previous.Version), encoded); err != nil {
+		return err
+	}
+
+	earlier := earlierVersions(tx, username)
+	for _, dropped := range earlier[store.history.Keep(earlier, time.Now()):] {
+		version, _ := strconv.ParseUint(dropped.Version, 10, 64)
+		if err = user_history.Delete(versionKey(version)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func versionKey(version uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, version)
+
+	return key
+}
+
+// forgetVersions drops a user's history when it's gone for good
+func forgetVersions(tx *bolt.Tx, username string) error {
+	err := tx.Bucket(historyBucket).DeleteBucket([]byte(username))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (store BoltStore) GetUserExpiry(username string) (validation.Expiry, time.Time, error) {
+	var stored record
+	var exists bool
+
+	store.db.View(func(tx *bolt.Tx) error {
+		stored, exists = getRecord(tx, username)
+		return nil
+	})
+	if !exists {
+		return validation.Expiry{}, time.Time{}, errUserNotFound
+	}
+
+	expiry, err := validation.ParseExpiry(stored.Expiry)
+	if err != nil || stored.ExpiresNanos == 0 {
+		return expiry, time.Time{}, err
+	}
+
+	return expiry, time.Unix(0, stored.ExpiresNanos), nil
+}
+
+func (store BoltStore) GetUserByEmail(email string) (string, error) {
+	var stored record
+	var exists bool
+
+	store.db.View(func(tx *bolt.Tx) error {
+		username := tx.Bucket(emailsBucket).Get([]byte(validation.NormalizeEmail(email)))
+		if username != nil {
+			stored, exists = getRecord(tx, string(username))
+		}
+		return nil
+	})
+	if !exists {
+		return "", errUserNotFound
+	}
+
+	return stored.Data, nil
+}
+
+func (store BoltStore) SetUser(username string, user_json_string string) error {
+	_, err := store.SetUserIfVersion(username, user_json_string, "", validation.Expiry{})
+
+	return err
+}
+
+func (store BoltStore) SetUserIfVersion(username string, user_json_string string, version string, expiry validation.Expiry) (string, error) {
+	var new_version string
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		stored, exists := getRecord(tx, username)
+		if version != "" && (!exists || strconv.FormatUint(stored.Version, 10) != version) {
+			return dberrors.ErrVersionMismatch
+		}
+
+		var err error
+		new_version, err = store.put(tx, username, user_json_string, expiry)
+		return err
+	})
+
+	return new_version, err
+}
+
+func (store BoltStore) CreateUser(username string, user_json_string string, expiry validation.Expiry) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		// A user in the recycle bin keeps its username until it's purged
+		if _, exists := getRecord(tx, username); exists {
+			return dberrors.ErrUserExists
+		}
+		if _, deleted := getTombstone(tx, username); deleted {
+			return dberrors.ErrUserExists
+		}
+
+		_, err := store.put(tx, username, user_json_string, expiry)
+		return err
+	})
+}
+
+// put writes a user and its index entries, replacing any previous ones
+func (store BoltStore) put(tx *bolt.Tx, username string, user_json_string string, expiry validation.Expiry) (string, error) {
+	users := tx.Bucket(usersBucket)
+	emails := tx.Bucket(emailsBucket)
+
+	email := validation.NormalizeEmail(validation.ParseUserFields(user_json_string).Email)
+	if email != "" {
+		owner := emails.Get([]byte(email))
+		if owner != nil && string(owner) != username {
+			return "", dberrors.ErrEmailTaken
+		}
+	}
+
+	if previous, exists := getRecord(tx, username); exists {
+		if err := store.keepVersion(tx, username, previous); err != nil {
+			return "", err
+		}
+	}
+	if err := unindex(tx, username); err != nil {
+		return "", err
+	}
+
+	version, err := users.NextSequence()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	stored := record{
+		Data:          user_json_string,
+		Version:       version,
+		ModifiedNanos: now.UnixNano(),
+		Expiry:        expiry.String(),
+	}
+	if expires_at, expires := expiry.Deadline(now, store.data_ttl); expires {
+		stored.ExpiresNanos = expires_at.UnixNano()
+	}
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return "", err
+	}
+
+	if err = users.Put([]byte(username), encoded); err != nil {
+		return "", err
+	}
+	if email != "" {
+		if err = emails.Put([]byte(email), []byte(username)); err != nil {
+			return "", err
+		}
+	}
+	if stored.ExpiresNanos != 0 {
+		if err = tx.Bucket(expiryBucket).Put(expiryKey(stored, username), nil); err != nil {
+			return "", err
+		}
+	}
+
+	return strconv.FormatUint(version, 10), nil
+}
+
+// unindex removes a user's email and expiry entries, if it exists
+func unindex(tx *bolt.Tx, username string) error {
+	stored, exists := getRecord(tx, username)
+	if !exists {
+		return nil
+	}
+
+	email := validation.NormalizeEmail(validation.ParseUserFields(stored.Data).Email)
+	if email != "" {
+		emails := tx.Bucket(emailsBucket)
+		if owner := emails.Get([]byte(email)); string(owner) == username {
+			if err := emails.Delete([]byte(email)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Bucket(expiryBucket).Delete(expiryKey(stored, username))
+}
+
+func (store BoltStore) DeleteUser(username string) error {
+	return store.DeleteUserIfVersion(username, "")
+}
+
+// DeleteUserIfVersion erases a user, and any soft deleted user in the recycle bin under its
+// username when version is ""
+func (store BoltStore) DeleteUserIfVersion(username string, version string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		stored, exists := getRecord(tx, username)
+		deleted, is_deleted := getTombstone(tx, username)
+		if !exists && (version != "" || !is_deleted) {
+			return errUserNotFound
+		}
+		if version != "" && strconv.FormatUint(stored.Version, 10) != version {
+			return dberrors.ErrVersionMismatch
+		}
+
+		if version == "" && is_deleted {
+			if err := unbin(tx, username, deleted); err != nil {
+				return err
+			}
+		}
+		if err := unindex(tx, username); err != nil {
+			return err
+		}
+		if err := forgetVersions(tx, username); err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).Delete([]byte(username))
+	})
+}
+
+func (store BoltStore) SoftDeleteUserIfVersion(username string, version string, actor string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		stored, exists := getRecord(tx, username)
+		if !exists {
+			return errUserNotFound
+		}
+		if version != "" && strconv.FormatUint(stored.Version, 10) != version {
+			return dberrors.ErrVersionMismatch
+		}
+
+		if err := unindex(tx, username); err != nil {
+			return err
+		}
+		if err := tx.Bucket(usersBucket).Delete([]byte(username)); err != nil {
+			return err
+		}
+		// Replaces any user deleted before under the username
+		if previous, exists := getTombstone(tx, username); exists {
+			if err := unbin(tx, username, previous); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		deleted := tombstone{
+			record:       stored,
+			DeletedNanos: now.UnixNano(),
+			DeletedBy:    actor,
+			PurgeNanos:   now.Add(time.Duration(store.retention) * time.Second).UnixNano(),
+		}
+		encoded, err := json.Marshal(deleted)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Bucket(deletedBucket).Put([]byte(username), encoded); err != nil {
+			return err
+		}
+		return tx.Bucket(purgeBucket).Put(timeKey(deleted.PurgeNanos, username), nil)
+	})
+}
+
+func (store BoltStore) GetDeletion(username string) (time.Time, string, error) {
+	var deleted tombstone
+	var exists bool
+
+	store.db.View(func(tx *bolt.Tx) error {
+		deleted, exists = getTombstone(tx, username)
+		return nil
+	})
+	if !exists {
+		return time.Time{}, "", dberrors.ErrNotDeleted
+	}
+
+	return time.Unix(0, deleted.DeletedNanos), deleted.DeletedBy, nil
+}
+
+func (store BoltStore) UndeleteUser(username string) (string, error) {
+	var data string
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		deleted, exists := getTombstone(tx, username)
+		if !exists {
+			return dberrors.ErrNotDeleted
+		}
+		if _, exists = getRecord(tx, username); exists {
+			return dberrors.ErrUserExists
+		}
+
+		expiry, err := validation.ParseExpiry(deleted.Expiry)
+		if err != nil {
+			return err
+		}
+		if _, err = store.put(tx, username, deleted.Data, expiry); err != nil {
+			return err
+		}
+
+		data = deleted.Data
+		return unbin(tx, username, deleted)
+	})
+
+	return data, err
+}
+
+// unbin removes a user from the recycle bin
+func unbin(tx *bolt.Tx, username string, deleted tombstone) error {
+	if err := tx.Bucket(purgeBucket).Delete(timeKey(deleted.PurgeNanos, username)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(deletedBucket).Delete([]byte(username))
+}
+
+// ListUsers pages through users in username order, the cursor is the last username returned
+func (store BoltStore) ListUsers(cursor string, limit int) ([]string, string, error) {
+	last_username, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", errors.New("Invalid cursor")
+	}
+
+	users := []string{}
+	next_cursor := ""
+
+	err = store.db.View(func(tx *bolt.Tx) error {
+		users_cursor := tx.Bucket(usersBucket).Cursor()
+
+		username, encoded := users_cursor.Seek(last_username)
+		if username != nil && bytes.Equal(username, last_username) {
+			username, encoded = users_cursor.Next()
+		}
+
+		for ; username != nil; username, encoded = users_cursor.Next() {
+			if len(users) == limit {
+				next_cursor = base64.RawURLEncoding.EncodeToString(last_username)
+				break
+			}
+
+			var stored record
+			if err := json.Unmarshal(encoded, &stored); err != nil {
+				return err
+			}
+			users = append(users, stored.Data)
+			last_username = append([]byte{}, username...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return users, next_cursor, nil
+}
+
+// SearchUsers supports the same filters as RedisHashConn.SearchUsers, by scanning every user.
+// Matches are ordered by username and the cursor is the offset into that ordering.
+func (store BoltStore) SearchUsers(filters map[string]string, cursor string, limit int) ([]string, string, error) {
+	offset := 0
+	if cursor != "" {
+		decoded_cursor, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded_cursor))
+		}
+		if err != nil || offset < 0 {
+			return nil, "", errors.New("Invalid cursor")
+		}
+	}
+
+	users := []string{}
+	next_cursor := ""
+	matched := 0
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_ []byte, encoded []byte) error {
+			var stored record
+			if err := json.Unmarshal(encoded, &stored); err != nil {
+				return err
+			}
+			if !validation.ParseUserFields(stored.Data).MatchesFilters(filters) {
+				return nil
+			}
+
+			matched++
+			if matched > offset+limit {
+				next_cursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + limit)))
+			} else if matched > offset {
+				users = append(users, stored.Data)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return users, next_cursor, nil
+}
+
+func (store BoltStore) reapExpired() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.stop:
+			return
+		case <-ticker.C:
+			store.expire()
+			store.purge()
+		}
+	}
+}
+
+// expire deletes users past their expiry and archives them, like RedisHashConn.expire
+func (store BoltStore) expire() {
+	expired := map[string]record{}
+	now := time.Now().UnixNano()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		expiry_cursor := tx.Bucket(expiryBucket).Cursor()
+
+		for key, _ := expiry_cursor.First(); key != nil; key, _ = expiry_cursor.Next() {
+			if int64(binary.BigEndian.Uint64(key[:8])) > now {
+				break
+			}
+			username := string(key[8:])
+			if stored, exists := getRecord(tx, username); exists {
+				expired[username] = stored
+			}
+		}
+
+		for username := range expired {
+			if err := unindex(tx, username); err != nil {
+				return err
+			}
+			if err := forgetVersions(tx, username); err != nil {
+				return err
+			}
+			if err := tx.Bucket(usersBucket).Delete([]byte(username)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(passwordsBucket).Delete([]byte(username)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for username, stored := range expired {
+		err = store.archiver.Archive(archive.Record{Username: username, Data: stored.Data, ModifiedNanos: stored.ModifiedNanos, ExpiredAt: time.Now(), Reason: archive.ReasonExpired})
+		if err != nil {
+			log.Printf("Expired user %s was not archived: %s\nData: %s", username, err, stored.Data)
+		}
+	}
+}
+
+// purge deletes users which have been in the recycle bin for the retention period and archives them
+func (store BoltStore) purge() {
+	purged := map[string]tombstone{}
+	now := time.Now().UnixNano()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		purge_cursor := tx.Bucket(purgeBucket).Cursor()
+
+		for key, _ := purge_cursor.First(); key != nil; key, _ = purge_cursor.Next() {
+			if int64(binary.BigEndian.Uint64(key[:8])) > now {
+				break
+			}
+			username := string(key[8:])
+			if deleted, exists := getTombstone(tx, username); exists {
+				purged[username] = deleted
+			}
+		}
+
+		for username, deleted := range purged {
+			if err := unbin(tx, username, deleted); err != nil {
+				return err
+			}
+			if err := forgetVersions(tx, username); err != nil {
+				return err
+			}
+			if err := tx.Bucket(passwordsBucket).Delete([]byte(username)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for username, deleted := range purged {
+		err = store.archiver.Archive(archive.Record{Username: username, Data: deleted.Data, ModifiedNanos: deleted.ModifiedNanos, ExpiredAt: time.Now(), Reason: archive.ReasonPurged})
+		if err != nil {
+			log.Printf("Purged user %s was not archived: %s\nData: %s", username, err, deleted.Data)
+		}
+	}
+}
+
+func (store BoltStore) CreateSubscription(subscription events.Subscription) error {
+	encoded, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(subscription.ID), encoded)
+	})
+}
+
+func getSubscription(tx *bolt.Tx, id string) (events.Subscription, error) {
+	var subscription events.Subscription
+
+	encoded := tx.Bucket(webhooksBucket).Get([]byte(id))
+	if encoded == nil {
+		return subscription, dberrors.ErrSubscriptionNotFound
+	}
+
+	return subscription, json.Unmarshal(encoded, &subscription)
+}
+
+func (store BoltStore) GetSubscription(id string) (events.Subscription, error) {
+	var subscription events.Subscription
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		subscription, err = getSubscription(tx, id)
+		return err
+	})
+
+	return subscription, err
+}
+
+// ListSubscriptions returns every subscription, oldest first
+func (store BoltStore) ListSubscriptions() ([]events.Subscription, error) {
+	subscriptions := []events.Subscription{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(_ []byte, encoded []byte) error {
+			var subscription events.Subscription
+			if err := json.Unmarshal(encoded, &subscription); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are random IDs, so the order is only in the subscriptions
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].ID < subscriptions[j].ID
+		}
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+
+	return subscriptions, nil
+}
+
+func (store BoltStore) UpdateSubscription(subscription events.Subscription) error {
+	encoded, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getSubscription(tx, subscription.ID); err != nil {
+			return err
+		}
+		return tx.Bucket(webhooksBucket).Put([]byte(subscription.ID), encoded)
+	})
+}
+
+func (store BoltStore) RotateSubscriptionSecret(id string, secret string, now time.Time) (events.Subscription, error) {
+	var subscription events.Subscription
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if subscription, err = getSubscription(tx, id); err != nil {
+			return err
+		}
+		subscription.Rotate(secret, now)
+
+		encoded, err := json.Marshal(subscription)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(webhooksBucket).Put([]byte(id), encoded)
+	})
+
+	return subscription, err
+}
+
+func (store BoltStore) DeleteSubscription(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getSubscription(tx, id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(webhooksBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		err := tx.Bucket(deliveriesBucket).DeleteBucket([]byte(id))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// RecordDelivery appends a delivery to the subscription's bucket, dropping the oldest beyond
+// events.MaxDeliveries
+func (store BoltStore) RecordDelivery(delivery events.Delivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getSubscription(tx, delivery.SubscriptionID); err != nil {
+			return err
+		}
+
+		deliveries, err := tx.Bucket(deliveriesBucket).CreateBucketIfNotExists([]byte(delivery.SubscriptionID))
+		if err != nil {
+			return err
+		}
+
+		sequence, err := deliveries.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err = deliveries.Put(versionKey(sequence), encoded); err != nil {
+			return err
+		}
+
+		// Collected first, as deleting while iterating moves the cursor
+		dropped := [][]byte{}
+		kept := 0
+		deliveries_cursor := deliveries.Cursor()
+		for key, _ := deliveries_cursor.Last(); key != nil; key, _ = deliveries_cursor.Prev() {
+			if kept++; kept > events.MaxDeliveries {
+				dropped = append(dropped, key)
+			}
+		}
+		for _, key := range dropped {
+			if err = deliveries.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListDeliveries returns a subscription's latest deliveries, newest first
+func (store BoltStore) ListDeliveries(id string, limit int) ([]events.Delivery, error) {
+	deliveries := []events.Delivery{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if _, err := getSubscription(tx, id); err != nil {
+			return err
+		}
+
+		subscription_deliveries := tx.Bucket(deliveriesBucket).Bucket([]byte(id))
+		if subscription_deliveries == nil {
+			return nil
+		}
+
+		deliveries_cursor := subscription_deliveries.Cursor()
+		for key, encoded := deliveries_cursor.Last(); key != nil && len(deliveries) < limit; key, encoded = deliveries_cursor.Prev() {
+			var delivery events.Delivery
+			if err := json.Unmarshal(encoded, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (store BoltStore) SetPasswordHash(username string, hash string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(passwordsBucket).Put([]byte(username), []byte(hash))
+	})
+}
+
+func (store BoltStore) GetPasswordHash(username string) (string, error) {
+	var hash string
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(passwordsBucket).Get([]byte(username))
+		if encoded == nil {
+			return dberrors.ErrNoPassword
+		}
+		hash = string(encoded)
+		return nil
+	})
+
+	return hash, err
+}
+
+func (store BoltStore) DeletePasswordHash(username string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(passwordsBucket).Delete([]byte(username))
+	})
+}
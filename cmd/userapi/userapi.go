@@ -4,15 +4,35 @@ import (
 	//	"encoding/json"
 
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/boltstore"
+	"github.com/Haelium/User-Manager-API/events"
 	"github.com/Haelium/User-Manager-API/handlers"
+	"github.com/Haelium/User-Manager-API/mailer"
+	"github.com/Haelium/User-Manager-API/memstore"
+	"github.com/Haelium/User-Manager-API/pgstore"
 	"github.com/Haelium/User-Manager-API/redisutil"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
 )
 
+// Events GET /users/events can resume from when there's no user_events stream
+const streamMemoryLen = 10000
+
 func main() {
 	redisAddrPtr := flag.String("redis_address", "localhost", "Redis server address")
 	redisPortPtr := flag.String("redis_port", "6379", "Redis server port")
@@ -20,33 +40,464 @@ func main() {
 	redisDBIndexPtr := flag.Int("redis_db_index", 0, "Redis database index")
 	redisMaxRetries := flag.Int("redis_max_retries", 5, "Number of times redis will retry a command")
 
+	postgresDSNPtr := flag.String("postgres_dsn", "postgres://localhost/userapi?sslmode=disable", "Postgres connection string")
+
+	boltPathPtr := flag.String("bolt_path", "userapi.db", "Path to the bolt database file")
+
+	backendPtr := flag.String("backend", "redis", "Storage backend: redis, postgres, bolt or memory")
 	appListenPortPtr := flag.String("listen_port", "8080", "Port which service listens on")
-	appDataTTLSeconds := flag.Int("data_ttl", 60, "time before data expires (seconds)")
-	appDataPersistPath := flag.String("persist_path", "/opt/userapidata/", "path to directory to save data")
+	appDataTTLSeconds := flag.Int("data_ttl", 60, "default time before data expires (seconds), users may set their own")
+	appDeletedRetentionSeconds := flag.Int("deleted_retention", 7*24*60*60, "time deleted users can be undeleted for (seconds)")
+	appUserVersions := flag.Int("user_versions", 10, "Number of earlier versions kept per user")
+	appUserVersionsAgeSeconds := flag.Int("user_versions_age", 30*24*60*60, "time earlier versions of users are kept for (seconds), 0 for no limit")
+	appDataPersistPath := flag.String("persist_path", "/opt/userapidata/", "path to directory to archive expired users in")
+
+	archiveBackendPtr := flag.String("archive", "file", "Archive for expired users: file, s3 or jsonl")
+	archiveGzipPtr := flag.Bool("archive_gzip", false, "gzip archived users (file and s3)")
+	archiveJSONLPathPtr := flag.String("archive_jsonl_path", "/opt/userapidata/expired_users.jsonl", "File to append expired users to")
+	archiveAttemptsPtr := flag.Int("archive_attempts", 5, "Number of times archiving a user is attempted")
+	s3EndpointPtr := flag.String("s3_endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint URL")
+	s3RegionPtr := flag.String("s3_region", "us-east-1", "S3 region")
+	s3BucketPtr := flag.String("s3_bucket", "", "S3 bucket")
+	s3PrefixPtr := flag.String("s3_prefix", "", "Prefix of archived user keys in the bucket")
+	s3AccessKeyPathPtr := flag.String("s3_access_key_file", "", "File holding the S3 access key, $S3_ACCESS_KEY without one")
+	s3SecretKeyPathPtr := flag.String("s3_secret_key_file", "", "File holding the S3 secret key, $S3_SECRET_KEY without one")
+
+	auditBackendPtr := flag.String("audit", "", "Audit log of user changes: redis or memory, by default memory with the bolt and memory backends and redis otherwise")
+
+	eventsPtr := flag.String("events", "", "Comma separated publishers of user change events: pubsub, stream and webhook")
+	webhookAttemptsPtr := flag.Int("webhook_attempts", 5, "Number of times delivering an event to a webhook is attempted")
+
+	authPtr := flag.Bool("auth", true, "Require an API key or JWT on every request")
+	apiKeysPtr := flag.String("api_keys", "", "Store of API keys: redis or memory, by default memory with the bolt and memory backends and redis otherwise")
+	adminKeyPathPtr := flag.String("admin_key_file", "", "File holding an API key with the admin role the service accepts, $ADMIN_API_KEY without one, at least 32 characters. It lets the first admin in when API keys are kept in memory")
+	jwtSecretPathPtr := flag.String("jwt_secret_file", "", "File holding the HMAC secret JWTs may be signed with, $JWT_SECRET without one")
+	jwtJWKSPathPtr := flag.String("jwt_jwks_path", "", "JWKS file of public keys JWTs may be signed with")
+	jwtIssuerPtr := flag.String("jwt_issuer", "", "Required iss of JWTs, if set")
+	jwtAudiencePtr := flag.String("jwt_audience", "", "Required aud of JWTs, if set")
+	policyPathPtr := flag.String("policy_path", "", "JSON file granting roles their scopes, admin and user roles by default")
+	sessionSecretPathPtr := flag.String("session_secret_file", "", "File holding the HMAC secret session tokens from POST /login are signed with, $SESSION_SECRET without one. Logins are disabled without a secret")
+	sessionTTLSeconds := flag.Int("session_ttl", 60*60, "time session tokens last (seconds)")
+	sessionStorePtr := flag.String("sessions", "", "Store of session generations, which changing a password or deleting a user moves on to revoke its sessions: redis or memory, by default memory with the bolt and memory backends and redis otherwise")
+	lockoutPtr := flag.String("lockout", "", "Counts of failed logins shared by replicas in redis, or kept by each in memory, or none. By default memory with the bolt and memory backends and redis otherwise")
+	lockoutUserFailuresPtr := flag.Int("lockout_user_failures", 5, "Failed logins within the window a username is locked out after")
+	lockoutIPFailuresPtr := flag.Int("lockout_ip_failures", 50, "Failed logins within the window a client IP is locked out after")
+	lockoutWindowSeconds := flag.Int("lockout_window", 15*60, "time failed logins are counted for (seconds)")
+	lockoutDurationSeconds := flag.Int("lockout_duration", 15*60, "time usernames and client IPs are locked out for (seconds)")
+	trustedProxiesPtr := flag.String("trusted_proxies", "", "Comma separated CIDRs of proxies, such as an ingress, whose X-Forwarded-For gives the client IP that logins are locked out and changes recorded by")
+	emailTokensPtr := flag.String("email_tokens", "", "Store of unused email verification and password reset tokens: redis or memory, by default memory with the bolt and memory backends and redis otherwise")
+	emailTokenSecretPathPtr := flag.String("email_token_secret_file", "", "File holding the HMAC secret emailed tokens are signed with, $EMAIL_TOKEN_SECRET without one. Email verification and password resets are disabled without a secret")
+	emailTokenTTLSeconds := flag.Int("email_token_ttl", 60*60, "time emailed tokens last (seconds)")
+	mailerPtr := flag.String("mailer", "file", "How emails are sent: smtp, or file to append them to -mail_path")
+	mailPathPtr := flag.String("mail_path", "", "File emails are appended to with -mailer=file, they're logged without one")
+	mailFromPtr := flag.String("mail_from", "userapi@localhost", "Address emails are sent from")
+	smtpAddressPtr := flag.String("smtp_address", "localhost:25", "SMTP server address, host:port")
+	smtpUsernamePtr := flag.String("smtp_username", "", "SMTP username, if the server needs one")
+	smtpPasswordPathPtr := flag.String("smtp_password_file", "", "File holding the SMTP password, $SMTP_PASSWORD without one")
+	breachedPasswordsPathPtr := flag.String("breached_passwords_path", "", "File of breached passwords users may not choose, one per line")
 
 	flag.Parse()
 
-	user_db, err := redisutil.NewRedisHashConn(
-		(*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries, *appDataTTLSeconds, *appDataPersistPath,
-	)
+	var api_keys auth.KeyStore
+
+	api_keys_store := storeFor(*apiKeysPtr, *backendPtr)
+
+	switch api_keys_store {
+	case "redis":
+		redis_keys, err := auth.NewRedisKeyStore((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the API key store", err)
+		}
+		api_keys = redis_keys
+	case "memory":
+		api_keys = auth.NewMemoryKeyStore()
+	default:
+		log.Panicf("Exit: unknown API key store %s", api_keys_store)
+	}
+
+	// userapi [flags] create-api-key <name> [roles] issues a key, to bootstrap the first admin
+	if flag.Arg(0) == "create-api-key" {
+		if api_keys_store == "memory" {
+			log.Fatal("Exit: API keys kept in memory are lost when create-api-key exits, use -api_keys=redis or give the service an admin key with $ADMIN_API_KEY or -admin_key_file")
+		}
+		createAPIKey(api_keys, flag.Args()[1:])
+		return
+	}
+
+	if admin_key := secret(*adminKeyPathPtr, "ADMIN_API_KEY"); admin_key != "" {
+		if err := auth.EnsureKey(api_keys, admin_key, "admin", []string{auth.RoleAdmin}); err != nil {
+			log.Panicf("Exit: %s\nError adding the admin API key", err)
+		}
+	}
+
+	jwt_verifier, err := auth.NewJWTVerifier(secret(*jwtSecretPathPtr, "JWT_SECRET"), *jwtJWKSPathPtr, *jwtIssuerPtr, *jwtAudiencePtr)
 	if err != nil {
-		log.Panicf("Exit: %s\nError connecting to redis", err)
+		log.Panicf("Exit: %s\nError reading the JWKS file", err)
+	}
+
+	var session_store auth.SessionStore
+
+	switch storeFor(*sessionStorePtr, *backendPtr) {
+	case "redis":
+		redis_sessions, err := auth.NewRedisSessionStore((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the session store", err)
+		}
+		session_store = redis_sessions
+	case "memory":
+		session_store = auth.NewMemorySessionStore()
+	default:
+		log.Panicf("Exit: unknown session store %s", *sessionStorePtr)
 	}
+	sessions := auth.NewSessions(secret(*sessionSecretPathPtr, "SESSION_SECRET"), time.Duration(*sessionTTLSeconds)*time.Second, session_store)
 
-	handler := handlers.NewHandler(user_db)
+	var token_store auth.TokenStore
+
+	switch storeFor(*emailTokensPtr, *backendPtr) {
+	case "redis":
+		redis_tokens, err := auth.NewRedisTokenStore((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the email token store", err)
+		}
+		token_store = redis_tokens
+	case "memory":
+		token_store = auth.NewMemoryTokenStore()
+	default:
+		log.Panicf("Exit: unknown email token store %s", *emailTokensPtr)
+	}
+	email_tokens := auth.NewTokens(secret(*emailTokenSecretPathPtr, "EMAIL_TOKEN_SECRET"), time.Duration(*emailTokenTTLSeconds)*time.Second, token_store)
+
+	var user_mailer mailer.Mailer
+
+	switch *mailerPtr {
+	case "smtp":
+		user_mailer = mailer.NewSMTPMailer(*smtpAddressPtr, *smtpUsernamePtr, secret(*smtpPasswordPathPtr, "SMTP_PASSWORD"), *mailFromPtr)
+	case "file":
+		user_mailer = mailer.NewFileMailer(*mailPathPtr, *mailFromPtr)
+	default:
+		log.Panicf("Exit: unknown mailer %s", *mailerPtr)
+	}
+
+	if *breachedPasswordsPathPtr != "" {
+		breached, err := validation.LoadBreachedPasswords(*breachedPasswordsPathPtr)
+		if err != nil {
+			log.Panicf("Exit: %s\nError reading the breached passwords file", err)
+		}
+		log.Printf("Loaded %d breached passwords", breached)
+	}
+
+	policy := auth.DefaultPolicy()
+	if *policyPathPtr != "" {
+		if policy, err = auth.LoadPolicy(*policyPathPtr); err != nil {
+			log.Panicf("Exit: %s\nError reading the policy file", err)
+		}
+	}
+
+	var audit_log audit.Log
+
+	switch storeFor(*auditBackendPtr, *backendPtr) {
+	case "redis":
+		stream_log, err := audit.NewRedisStreamLog((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the audit log", err)
+		}
+		audit_log = stream_log
+	case "memory":
+		audit_log = audit.NewMemoryLog()
+	default:
+		log.Panicf("Exit: unknown audit log %s", *auditBackendPtr)
+	}
+
+	publisher := events.Publishers{}
+	var webhook_subscriptions *events.PendingSubscriptions
+	var event_stream events.EventStream
+
+	for _, publisher_name := range strings.Split(*eventsPtr, ",") {
+		var err error
+
+		switch publisher_name {
+		case "":
+		case "pubsub":
+			var pubsub_publisher events.RedisPubSubPublisher
+			pubsub_publisher, err = events.NewRedisPubSubPublisher((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+			publisher = append(publisher, pubsub_publisher)
+		case "stream":
+			var stream_publisher events.RedisStreamPublisher
+			stream_publisher, err = events.NewRedisStreamPublisher((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries)
+			publisher = append(publisher, stream_publisher)
+			event_stream = stream_publisher
+		case "webhook":
+			// Subscriptions are kept by the backend, which is connected once it's given every publisher
+			pending_subscriptions := events.NewPendingSubscriptions()
+			webhook_subscriptions = &pending_subscriptions
+			publisher = append(publisher, events.NewWebhookPublisher(pending_subscriptions, *webhookAttemptsPtr, time.Second))
+		default:
+			log.Panicf("Exit: unknown event publisher %s", publisher_name)
+		}
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the %s event publisher", err, publisher_name)
+		}
+	}
+	// GET /users/events follows the user_events stream, or only this replica's events without it
+	if event_stream == nil {
+		log.Print("No stream in -events, GET /users/events only streams changes made through this replica")
+		memory_stream := events.NewMemoryStream(streamMemoryLen)
+		publisher = append(publisher, memory_stream)
+		event_stream = memory_stream
+	}
+
+	var archiver archive.Archiver
+
+	switch *archiveBackendPtr {
+	case "file":
+		archiver = archive.NewFileArchiver(*appDataPersistPath, *archiveGzipPtr)
+	case "s3":
+		archiver = archive.NewS3Archiver(*s3EndpointPtr, *s3RegionPtr, *s3BucketPtr, *s3PrefixPtr, secret(*s3AccessKeyPathPtr, "S3_ACCESS_KEY"), secret(*s3SecretKeyPathPtr, "S3_SECRET_KEY"), *archiveGzipPtr)
+	case "jsonl":
+		archiver = archive.NewJSONLArchiver(*archiveJSONLPathPtr)
+	default:
+		log.Panicf("Exit: unknown archive %s", *archiveBackendPtr)
+	}
+	// Every archiver can be read back, but retries only matter when archiving
+	archived, _ := archiver.(archive.Reader)
+	// Backends remove expired and purged users themselves, the archiver is where they're seen
+	archiver = audit.NewArchiveRecorder(archiver, audit_log)
+	archiver = events.NewArchivePublisher(archiver, publisher)
+	// Outermost, so users archived by a retry are recorded and published then
+	archiver = archive.NewRetryingArchiver(archiver, *archiveAttemptsPtr, time.Second)
+
+	history := versions.Policy{MaxVersions: *appUserVersions, MaxAge: time.Duration(*appUserVersionsAgeSeconds) * time.Second}
+
+	var user_db handlers.DatabaseInterface
+
+	switch *backendPtr {
+	case "redis":
+		user_db, err = redisutil.NewRedisHashConn(
+			(*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries, *appDataTTLSeconds, *appDeletedRetentionSeconds, history, archiver,
+		)
+	case "postgres":
+		user_db, err = pgstore.NewPostgresConn(*postgresDSNPtr, *appDataTTLSeconds, *appDeletedRetentionSeconds, history, archiver)
+	case "bolt":
+		user_db, err = boltstore.NewBoltStore(*boltPathPtr, *appDataTTLSeconds, *appDeletedRetentionSeconds, history, archiver)
+	case "memory":
+		user_db = memstore.NewMemStore(*appDataTTLSeconds, *appDeletedRetentionSeconds, history, archiver)
+	default:
+		log.Panicf("Exit: unknown backend %s", *backendPtr)
+	}
+	if err != nil {
+		log.Panicf("Exit: %s\nError connecting to %s", err, *backendPtr)
+	}
+	if webhook_subscriptions != nil {
+		webhook_subscriptions.Connect(user_db)
+	}
+
+	lockout_policy := auth.LockoutPolicy{
+		UserFailures: *lockoutUserFailuresPtr,
+		IPFailures:   *lockoutIPFailuresPtr,
+		Window:       time.Duration(*lockoutWindowSeconds) * time.Second,
+		Duration:     time.Duration(*lockoutDurationSeconds) * time.Second,
+	}
+	var lockout auth.Lockout
+
+	switch storeFor(*lockoutPtr, *backendPtr) {
+	case "redis":
+		// Shares the backend's client when it's Redis too
+		if redis_conn, ok := user_db.(redisutil.RedisHashConn); ok {
+			lockout = redis_conn.Lockout(lockout_policy)
+			break
+		}
+		redis_lockout, err := redisutil.NewRedisLockout((*redisAddrPtr)+":"+(*redisPortPtr), *redisPassPtr, *redisDBIndexPtr, *redisMaxRetries, lockout_policy)
+		if err != nil {
+			log.Panicf("Exit: %s\nError connecting to the lockout store", err)
+		}
+		lockout = redis_lockout
+	case "memory":
+		lockout = auth.NewMemoryLockout(lockout_policy)
+	case "none":
+	default:
+		log.Panicf("Exit: unknown lockout %s", *lockoutPtr)
+	}
+
+	// userapi [flags] restore <username> [modified_nanos] restores an expired user and exits
+	if flag.Arg(0) == "restore" {
+		restore(user_db, archived, sessions, audit_log, flag.Args()[1:])
+		return
+	}
+
+	handler := handlers.NewHandler(user_db, archived, audit_log, publisher, events.NewFollower(event_stream), api_keys, policy, sessions, lockout, email_tokens, user_mailer)
 
 	router := mux.NewRouter()
+	if *trustedProxiesPtr != "" {
+		trusted_proxies := []*net.IPNet{}
+		for _, cidr := range strings.Split(*trustedProxiesPtr, ",") {
+			_, trusted_proxy, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Panicf("Exit: %s\nError reading -trusted_proxies", err)
+			}
+			trusted_proxies = append(trusted_proxies, trusted_proxy)
+		}
+		router.Use(handlers.TrustProxies(trusted_proxies))
+	}
+	router.Use(handlers.RequestID)
+
+	router.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	router.HandleFunc("/login/", handler.Login).Methods(http.MethodPost)
+	// Emailed tokens are the only credentials these take
+	router.HandleFunc("/verify-email", handler.VerifyEmail).Methods(http.MethodPost)
+	router.HandleFunc("/verify-email/", handler.VerifyEmail).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset", handler.RequestPasswordReset).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset/", handler.RequestPasswordReset).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset/confirm", handler.ResetPassword).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset/confirm/", handler.ResetPassword).Methods(http.MethodPost)
+
+	// Every other route needs credentials
+	api := router.PathPrefix("/").Subrouter()
+	if *authPtr {
+		api.Use(handlers.Authenticate(auth.NewAuthenticator(api_keys, jwt_verifier, sessions)))
+	} else {
+		log.Print("-auth=false, requests are not authenticated")
+	}
 
-	router.HandleFunc("/user", handler.CreateUser).Methods(http.MethodPost)
-	router.HandleFunc("/user/", handler.CreateUser).Methods(http.MethodPost)
-	router.HandleFunc("/user/{username}", handler.GetUser).Methods(http.MethodGet)
-	router.HandleFunc("/user/{username}/", handler.GetUser).Methods(http.MethodGet)
-	router.HandleFunc("/user/{username}", handler.DeleteUser).Methods(http.MethodDelete)
-	router.HandleFunc("/user/{username}/", handler.DeleteUser).Methods(http.MethodDelete)
-	router.HandleFunc("/user/{username}", handler.EditUser).Methods(http.MethodPut)
-	router.HandleFunc("/user/{username}/", handler.EditUser).Methods(http.MethodPut)
+	api.HandleFunc("/user", handler.CreateUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/", handler.CreateUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}", handler.GetUser).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}/", handler.GetUser).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}", handler.DeleteUser).Methods(http.MethodDelete)
+	api.HandleFunc("/user/{username}/", handler.DeleteUser).Methods(http.MethodDelete)
+	api.HandleFunc("/user/{username}/undelete", handler.UndeleteUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/undelete/", handler.UndeleteUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/versions", handler.GetUserVersions).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}/versions/", handler.GetUserVersions).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}/revert", handler.RevertUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/revert/", handler.RevertUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/password", handler.ChangePassword).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/password/", handler.ChangePassword).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/unlock", handler.UnlockUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/unlock/", handler.UnlockUser).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/verify-email", handler.RequestEmailVerification).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/verify-email/", handler.RequestEmailVerification).Methods(http.MethodPost)
+	api.HandleFunc("/user/{username}/history", handler.GetUserHistory).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}/history/", handler.GetUserHistory).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}", handler.EditUser).Methods(http.MethodPut)
+	api.HandleFunc("/user/{username}/", handler.EditUser).Methods(http.MethodPut)
+	api.HandleFunc("/user/{username}", handler.PatchUser).Methods(http.MethodPatch)
+	api.HandleFunc("/user/{username}/", handler.PatchUser).Methods(http.MethodPatch)
+	api.HandleFunc("/users", handler.ListUsers).Methods(http.MethodGet)
+	api.HandleFunc("/users/", handler.ListUsers).Methods(http.MethodGet)
+	api.HandleFunc("/users/events", handler.StreamEvents).Methods(http.MethodGet)
+	api.HandleFunc("/users/events/", handler.StreamEvents).Methods(http.MethodGet)
+	api.HandleFunc("/users/by-email/{email}", handler.GetUserByEmail).Methods(http.MethodGet)
+	api.HandleFunc("/users/by-email/{email}/", handler.GetUserByEmail).Methods(http.MethodGet)
+	api.HandleFunc("/users/{username}/restore", handler.RestoreUser).Methods(http.MethodPost)
+	api.HandleFunc("/users/{username}/restore/", handler.RestoreUser).Methods(http.MethodPost)
+	api.HandleFunc("/archive/{username}", handler.GetArchive).Methods(http.MethodGet)
+	api.HandleFunc("/archive/{username}/", handler.GetArchive).Methods(http.MethodGet)
+	api.HandleFunc("/audit", handler.GetAudit).Methods(http.MethodGet)
+	api.HandleFunc("/audit/", handler.GetAudit).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks", handler.CreateWebhook).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks/", handler.CreateWebhook).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks", handler.ListWebhooks).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/", handler.ListWebhooks).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/{id}", handler.GetWebhook).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/{id}/", handler.GetWebhook).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/{id}", handler.DeleteWebhook).Methods(http.MethodDelete)
+	api.HandleFunc("/webhooks/{id}/", handler.DeleteWebhook).Methods(http.MethodDelete)
+	api.HandleFunc("/webhooks/{id}/rotate-secret", handler.RotateWebhookSecret).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks/{id}/rotate-secret/", handler.RotateWebhookSecret).Methods(http.MethodPost)
+	api.HandleFunc("/webhooks/{id}/deliveries", handler.GetWebhookDeliveries).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/{id}/deliveries/", handler.GetWebhookDeliveries).Methods(http.MethodGet)
+	api.HandleFunc("/api-keys", handler.CreateAPIKey).Methods(http.MethodPost)
+	api.HandleFunc("/api-keys/", handler.CreateAPIKey).Methods(http.MethodPost)
+	api.HandleFunc("/api-keys", handler.ListAPIKeys).Methods(http.MethodGet)
+	api.HandleFunc("/api-keys/", handler.ListAPIKeys).Methods(http.MethodGet)
+	api.HandleFunc("/api-keys/{id}", handler.DeleteAPIKey).Methods(http.MethodDelete)
+	api.HandleFunc("/api-keys/{id}/", handler.DeleteAPIKey).Methods(http.MethodDelete)
+	api.HandleFunc("/debug/vars", handler.DebugVars).Methods(http.MethodGet)
 
 	//	router.PathPrefix("/").Handler(catchAllHandler)
 
 	log.Fatal(http.ListenAndServe(":"+(*appListenPortPtr), router))
 }
+
+// storeFor returns the store a flag chooses, or by default Redis unless the backend is one which
+// needs no external services, where it's memory
+func storeFor(store string, backend string) string {
+	if store != "" {
+		return store
+	}
+	if backend == "bolt" || backend == "memory" {
+		return "memory"
+	}
+
+	return "redis"
+}
+
+// secret reads a secret from the file at path, or the environment variable env without one. Flags
+// would show it to anyone who can list processes.
+func secret(path string, env string) string {
+	if path == "" {
+		return os.Getenv(env)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panicf("Exit: %s\nError reading the secret in %s", err, path)
+	}
+
+	return strings.TrimSpace(string(contents))
+}
+
+func restore(user_db handlers.DatabaseInterface, archived archive.Reader, sessions auth.Sessions, audit_log audit.Log, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("Usage: userapi [flags] restore <username> [modified_nanos]")
+	}
+
+	var modified_nanos int64
+	if len(args) == 2 {
+		var err error
+		if modified_nanos, err = strconv.ParseInt(args[1], 10, 64); err != nil || modified_nanos <= 0 {
+			log.Fatalf("Exit: modified_nanos must be a positive integer, got %s", args[1])
+		}
+	}
+
+	user_json_string, err := handlers.RestoreUser(user_db, archived, sessions, args[0], modified_nanos)
+	if err != nil {
+		log.Fatalf("Exit: %s\nError restoring %s", err, args[0])
+	}
+
+	actor := "cli"
+	if os.Getenv("USER") != "" {
+		actor = "cli:" + os.Getenv("USER")
+	}
+	_, err = audit_log.Append(audit.Event{
+		Time:      time.Now().UTC(),
+		Actor:     actor,
+		Operation: audit.OperationRestore,
+		Username:  args[0],
+		Changes:   audit.Diff("", user_json_string),
+	})
+	if err != nil {
+		log.Printf("Audit event for restore of %s was not recorded: %s", args[0], err)
+	}
+
+	fmt.Println(user_json_string)
+}
+
+func createAPIKey(api_keys auth.KeyStore, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("Usage: userapi [flags] create-api-key <name> [comma separated roles]")
+	}
+
+	roles := []string{}
+	if len(args) == 2 && args[1] != "" {
+		roles = strings.Split(args[1], ",")
+	}
+
+	plaintext, api_key := auth.NewKey(args[0], roles)
+	if err := api_keys.CreateKey(api_key); err != nil {
+		log.Fatalf("Exit: %s\nError creating API key %s", err, args[0])
+	}
+
+	// Only the key's hash is kept, so this is the one chance to copy it
+	fmt.Println(plaintext)
+}
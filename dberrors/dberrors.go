@@ -0,0 +1,17 @@
+package dberrors
+
+import "errors"
+
+// Errors returned by DatabaseInterface implementations which handlers map to specific responses
+
+var ErrEmailTaken = errors.New("Email address is already in use")
+
+var ErrUserExists = errors.New("User already exists")
+
+var ErrVersionMismatch = errors.New("User has been modified since the given version")
+
+var ErrNotDeleted = errors.New("User is not in the recycle bin")
+
+var ErrSubscriptionNotFound = errors.New("Webhook subscription not found")
+
+var ErrNoPassword = errors.New("User has no password")
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/audit"
+)
+
+/*
+Change events tell downstream services about users as they change, rather than them polling:
+
+RedisPubSubPublisher	- PUBLISHes to the user_events channel, for subscribers listening now
+RedisStreamPublisher	- XADDs to the user_events stream, for consumers reading at their own pace
+WebhookPublisher		- POSTs to subscribed URLs, signed and retried with exponential backoff,
+						  subscriptions being kept in a SubscriptionStore
+
+Publishers fans an event out to several of them.
+*/
+
+// Types of Event
+const (
+	TypeCreated = "user.created"
+	TypeUpdated = "user.updated"
+	TypeDeleted = "user.deleted"
+	TypeExpired = "user.expired"
+)
+
+// Event is a change to a user. User is the user after the change, or before it for deletions
+// and expiries, and Changes the fields which changed.
+type Event struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	Username string          `json:"username"`
+	User     json.RawMessage `json:"user,omitempty"`
+	Changes  []audit.Change  `json:"changes"`
+}
+
+// EventPublisher delivers events, it must be safe to use concurrently
+type EventPublisher interface {
+	Publish(Event) error
+}
+
+// NewEvent builds an event with a random ID for a change from before_json to after_json, ""
+// standing for no user
+func NewEvent(event_type string, username string, before_json string, after_json string) Event {
+	event := Event{
+		ID:       NewID(),
+		Type:     event_type,
+		Time:     time.Now().UTC(),
+		Username: username,
+		Changes:  audit.Diff(before_json, after_json),
+	}
+
+	user_json := after_json
+	if user_json == "" {
+		user_json = before_json
+	}
+	if json.Valid([]byte(user_json)) {
+		event.User = json.RawMessage(user_json)
+	}
+
+	return event
+}
+
+// Publishers publishes every event to each of its publishers, returning the last error
+type Publishers []EventPublisher
+
+func (publishers Publishers) Publish(event Event) error {
+	var last_err error
+	for _, publisher := range publishers {
+		if err := publisher.Publish(event); err != nil {
+			log.Printf("Event %s for %s was not published: %s", event.Type, event.Username, err)
+			last_err = err
+		}
+	}
+
+	return last_err
+}
+
+// ArchivePublisher publishes user.expired for every expired user an Archiver archives, as
+// storage backends expire users themselves. Users purged from the recycle bin had user.deleted
+// published when they were deleted.
+type ArchivePublisher struct {
+	archiver  archive.Archiver
+	publisher EventPublisher
+}
+
+func NewArchivePublisher(archiver archive.Archiver, publisher EventPublisher) ArchivePublisher {
+	var new_archive_publisher ArchivePublisher
+
+	new_archive_publisher.archiver = archiver
+	new_archive_publisher.publisher = publisher
+
+	return new_archive_publisher
+}
+
+// Archive only publishes the event once the user is archived, so subscribers can restore it
+func (archive_publisher ArchivePublisher) Archive(record archive.Record) error {
+	if err := archive_publisher.archiver.Archive(record); err != nil {
+		return err
+	}
+
+	if record.Reason == archive.ReasonExpired {
+		event := NewEvent(TypeExpired, record.Username, record.Data, "")
+		event.Time = record.ExpiredAt.UTC()
+		// Publishers log their own failures
+		archive_publisher.publisher.Publish(event)
+	}
+
+	return nil
+}
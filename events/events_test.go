@@ -0,0 +1,386 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+)
+
+// The Redis tests need a Redis 5 or later to run against, set EVENTS_TEST_REDIS to the address of
+// one they may write to, e.g. EVENTS_TEST_REDIS="localhost:6379"
+
+// publishedEvents keeps the events published to it
+type publishedEvents struct {
+	lock   *sync.Mutex
+	events *[]Event
+	err    error
+}
+
+func newPublishedEvents(err error) publishedEvents {
+	return publishedEvents{&sync.Mutex{}, &[]Event{}, err}
+}
+
+func (published publishedEvents) Publish(event Event) error {
+	published.lock.Lock()
+	defer published.lock.Unlock()
+
+	*published.events = append(*published.events, event)
+	return published.err
+}
+
+func Test_NewEvent(t *testing.T) {
+	created := NewEvent(TypeCreated, "billy2000", "", `{"username":"billy2000"}`)
+	if created.ID == "" || string(created.User) != `{"username":"billy2000"}` || len(created.Changes) != 1 {
+		t.Logf("Expected the created user, got: %+v", created)
+		t.Fail()
+	}
+
+	deleted := NewEvent(TypeDeleted, "billy2000", `{"username":"billy2000"}`, "")
+	if deleted.ID == created.ID || string(deleted.User) != `{"username":"billy2000"}` {
+		t.Logf("Expected the deleted user with a new ID, got: %+v", deleted)
+		t.Fail()
+	}
+
+	// Users which aren't valid JSON are left out, rather than breaking the event
+	broken := NewEvent(TypeUpdated, "billy2000", "", `{"username":`)
+	if _, err := json.Marshal(broken); err != nil || broken.User != nil {
+		t.Logf("Expected no user, got: %s (err: %v)", broken.User, err)
+		t.Fail()
+	}
+}
+
+type testArchiver struct {
+	err error
+}
+
+func (archiver testArchiver) Archive(archive.Record) error {
+	return archiver.err
+}
+
+func Test_Publishers(t *testing.T) {
+	failing := newPublishedEvents(errors.New("Unavailable"))
+	working := newPublishedEvents(nil)
+
+	if err := (Publishers{failing, working}).Publish(NewEvent(TypeCreated, "billy2000", "", "{}")); err == nil {
+		t.Logf("Expected the failure to be returned")
+		t.Fail()
+	}
+	if len(*failing.events) != 1 || len(*working.events) != 1 {
+		t.Logf("Expected every publisher to get the event, got: %d and %d", len(*failing.events), len(*working.events))
+		t.Fail()
+	}
+
+	// Only expired users which were archived are published, purged ones aren't
+	published := newPublishedEvents(nil)
+	expired_at := time.Now()
+
+	if err := NewArchivePublisher(testArchiver{os.ErrPermission}, published).Archive(archive.Record{Username: "billy1000", Data: "{}", ExpiredAt: expired_at, Reason: archive.ReasonExpired}); err != os.ErrPermission {
+		t.Logf("Expected the archiver's error, got: %v", err)
+		t.Fail()
+	}
+	archive_publisher := NewArchivePublisher(testArchiver{}, published)
+	archive_publisher.Archive(archive.Record{Username: "billy2000", Data: "{}", ExpiredAt: expired_at, Reason: archive.ReasonExpired})
+	archive_publisher.Archive(archive.Record{Username: "billy3000", Data: "{}", ExpiredAt: expired_at, Reason: archive.ReasonPurged})
+
+	if len(*published.events) != 1 || (*published.events)[0].Username != "billy2000" || (*published.events)[0].Type != TypeExpired || !(*published.events)[0].Time.Equal(expired_at) {
+		t.Logf("Expected one user.expired event, got: %+v", *published.events)
+		t.Fail()
+	}
+}
+
+// testSubscriptions keeps subscriptions and their deliveries in memory
+type testSubscriptions struct {
+	lock          *sync.Mutex
+	subscriptions []Subscription
+	deliveries    map[string][]Delivery
+}
+
+func (subscriptions testSubscriptions) ListSubscriptions() ([]Subscription, error) {
+	return subscriptions.subscriptions, nil
+}
+
+func (subscriptions testSubscriptions) GetSubscription(id string) (Subscription, error) {
+	for _, subscription := range subscriptions.subscriptions {
+		if subscription.ID == id {
+			return subscription, nil
+		}
+	}
+
+	return Subscription{}, dberrors.ErrSubscriptionNotFound
+}
+
+func (subscriptions testSubscriptions) RecordDelivery(delivery Delivery) error {
+	subscriptions.lock.Lock()
+	defer subscriptions.lock.Unlock()
+
+	subscriptions.deliveries[delivery.SubscriptionID] = append(subscriptions.deliveries[delivery.SubscriptionID], delivery)
+	return nil
+}
+
+func Test_Subscription(t *testing.T) {
+	subscription := Subscription{Types: []string{TypeCreated, TypeDeleted}, Secret: "old"}
+	if !subscription.Wants(TypeDeleted) || subscription.Wants(TypeUpdated) || !(Subscription{}).Wants(TypeExpired) {
+		t.Logf("Expected only subscribed types to be wanted")
+		t.Fail()
+	}
+
+	now := time.Now()
+	subscription.Rotate("new", now)
+	body := []byte("{}")
+	signature := subscription.sign(now, body)
+	if signature != Sign("new", now, body)+strings.TrimPrefix(Sign("old", now, body), "t="+strconv.FormatInt(now.Unix(), 10)) {
+		t.Logf("Expected signatures with both secrets during the grace period, got: %s", signature)
+		t.Fail()
+	}
+	if signature = subscription.sign(now.Add(RotationGrace), body); signature != Sign("new", now.Add(RotationGrace), body) {
+		t.Logf("Expected a signature with the new secret after the grace period, got: %s", signature)
+		t.Fail()
+	}
+}
+
+func Test_WebhookPublisher(t *testing.T) {
+	lock := &sync.Mutex{}
+	attempts := 0
+	received := []Event{}
+
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		attempts++
+		// The first delivery fails, to be retried
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var event Event
+		json.Unmarshal(body, &event)
+
+		signature := r.Header.Get("X-Webhook-Signature")
+		timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+		if signature != Sign("secret", time.Unix(timestamp, 0), body) || r.Header.Get("X-Webhook-Event") != event.Type || r.Header.Get("X-Webhook-ID") != event.ID {
+			t.Logf("Expected a signed request, got: %v", r.Header)
+			t.Fail()
+		}
+
+		received = append(received, event)
+	}))
+	defer subscriber.Close()
+
+	subscriptions := testSubscriptions{lock: &sync.Mutex{}, deliveries: map[string][]Delivery{}}
+	subscriptions.subscriptions = []Subscription{
+		{ID: "1", URL: subscriber.URL, Secret: "secret"},
+		// Never delivered
+		{ID: "2", URL: "http://127.0.0.1:1/", Secret: "secret", Types: []string{TypeUpdated}},
+		// Not subscribed to updates
+		{ID: "3", URL: subscriber.URL, Secret: "secret", Types: []string{TypeCreated}},
+	}
+	// Events published before the subscriptions are connected wait for them
+	pending := NewPendingSubscriptions()
+	publisher := NewWebhookPublisher(pending, 3, 10*time.Millisecond)
+
+	event := NewEvent(TypeUpdated, "billy2000", `{"username":"billy2000"}`, `{"username":"billy2000","email":"bob@bobmail.bob"}`)
+	published := make(chan error)
+	go func() {
+		published <- publisher.Publish(event)
+	}()
+	pending.Connect(subscriptions)
+	if err := <-published; err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	publisher.Wait()
+
+	if attempts != 2 || len(received) != 1 || received[0].ID != event.ID || received[0].Changes[0].Field != "/email" {
+		t.Logf("Expected the event after a retry, got %d attempts: %+v", attempts, received)
+		t.Fail()
+	}
+
+	delivered := subscriptions.deliveries["1"]
+	if len(delivered) != 2 || delivered[0].Delivered || delivered[0].StatusCode != http.StatusServiceUnavailable || !delivered[1].Delivered || delivered[1].Attempt != 2 || delivered[1].EventID != event.ID {
+		t.Logf("Expected a failed then a successful delivery, got: %+v", delivered)
+		t.Fail()
+	}
+	failed := subscriptions.deliveries["2"]
+	if len(failed) != 3 || failed[2].Delivered || failed[2].Error == "" || len(subscriptions.deliveries["3"]) != 0 {
+		t.Logf("Expected 3 failed deliveries and none for other types, got: %+v", subscriptions.deliveries)
+		t.Fail()
+	}
+
+	// Signatures depend on the secret, time and body
+	sent_at := time.Now()
+	signature := Sign("secret", sent_at, []byte("{}"))
+	for _, other := range []string{Sign("other", sent_at, []byte("{}")), Sign("secret", sent_at.Add(time.Second), []byte("{}")), Sign("secret", sent_at, []byte("[]"))} {
+		if other == signature {
+			t.Logf("Expected a different signature, got: %s", other)
+			t.Fail()
+		}
+	}
+}
+
+func Test_RedisPublishers(t *testing.T) {
+	address := os.Getenv("EVENTS_TEST_REDIS")
+	if address == "" {
+		t.Skip("EVENTS_TEST_REDIS not set")
+	}
+
+	pubsub_publisher, err := NewRedisPubSubPublisher(address, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pubsub_publisher.Close()
+
+	subscription := pubsub_publisher.client.Subscribe("user_events")
+	defer subscription.Close()
+	if _, err = subscription.Receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := NewEvent(TypeCreated, "billy2000", "", `{"username":"billy2000"}`)
+	if err = pubsub_publisher.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := subscription.ReceiveMessage()
+	var received Event
+	if err == nil {
+		err = json.Unmarshal([]byte(message.Payload), &received)
+	}
+	if err != nil || received.ID != event.ID {
+		t.Logf("Expected the published event, got: %+v (err: %v)", received, err)
+		t.Fail()
+	}
+
+	stream_publisher, err := NewRedisStreamPublisher(address, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream_publisher.Close()
+
+	before, err := stream_publisher.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stream_publisher.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := stream_publisher.client.XRevRangeN("user_events", "+", "-", 1).Result()
+	if err != nil || len(entries) != 1 || entries[0].Values["username"] != "billy2000" || entries[0].Values["type"] != TypeCreated {
+		t.Logf("Expected the published event, got: %+v (err: %v)", entries, err)
+		t.Fail()
+	}
+
+	streamed, err := stream_publisher.Read(before, 10, time.Second)
+	if err != nil || len(streamed) != 1 || streamed[0].Event.ID != event.ID || streamed[0].StreamID != entries[0].ID {
+		t.Logf("Expected to read the published event back, got: %+v (err: %v)", streamed, err)
+		t.Fail()
+	}
+	if streamed, err = stream_publisher.Read(entries[0].ID, 10, 0); err != nil || len(streamed) != 0 {
+		t.Logf("Expected nothing after the newest event, got: %+v (err: %v)", streamed, err)
+		t.Fail()
+	}
+}
+
+func Test_MemoryStream(t *testing.T) {
+	stream := NewMemoryStream(3)
+
+	if latest, _ := stream.Latest(); latest != "0-0" {
+		t.Logf("Expected an empty stream to be at 0-0, got: %s", latest)
+		t.Fail()
+	}
+	if _, err := stream.Read("latest", 10, 0); err != ErrInvalidPosition {
+		t.Logf("Expected ErrInvalidPosition, got: %v", err)
+		t.Fail()
+	}
+
+	for i := 0; i < 4; i++ {
+		stream.Publish(NewEvent(TypeCreated, fmt.Sprintf("user%d", i), "", "{}"))
+	}
+
+	// Only the newest 3 are kept
+	streamed, _ := stream.Read("0-0", 10, 0)
+	if len(streamed) != 3 || streamed[0].Event.Username != "user1" || streamed[2].StreamID != "4-0" {
+		t.Logf("Expected the newest 3 events, got: %+v", streamed)
+		t.Fail()
+	}
+	if streamed, _ = stream.Read("2-0", 1, 0); len(streamed) != 1 || streamed[0].StreamID != "3-0" {
+		t.Logf("Expected the event after 2-0, got: %+v", streamed)
+		t.Fail()
+	}
+
+	// Blocked reads wake up for new events
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stream.Publish(NewEvent(TypeDeleted, "user0", "{}", ""))
+	}()
+	if streamed, _ = stream.Read("4-0", 10, 5*time.Second); len(streamed) != 1 || streamed[0].Event.Type != TypeDeleted {
+		t.Logf("Expected the event published while waiting, got: %+v", streamed)
+		t.Fail()
+	}
+}
+
+func Test_Follower(t *testing.T) {
+	stream := NewMemoryStream(100)
+	for i := 0; i < 3; i++ {
+		stream.Publish(NewEvent(TypeCreated, fmt.Sprintf("user%d", i), "", "{}"))
+	}
+
+	follower := NewFollower(stream)
+	defer follower.Close()
+
+	if _, _, err := follower.Listen("1"); err != ErrInvalidPosition {
+		t.Logf("Expected ErrInvalidPosition, got: %v", err)
+		t.Fail()
+	}
+
+	resumed, stop_resumed, _ := follower.Listen("1-0")
+	defer stop_resumed()
+	live, stop_live, _ := follower.Listen("")
+
+	// Only events after the follower started reach listeners without a position
+	time.Sleep(20 * time.Millisecond)
+	stream.Publish(NewEvent(TypeUpdated, "user0", "{}", "{}"))
+
+	expected := []string{"2-0", "3-0", "4-0"}
+	for _, stream_id := range expected {
+		select {
+		case streamed_event := <-resumed:
+			if streamed_event.StreamID != stream_id {
+				t.Logf("Expected %s, got: %+v", stream_id, streamed_event)
+				t.Fail()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s, got nothing", stream_id)
+		}
+	}
+
+	select {
+	case streamed_event := <-live:
+		if streamed_event.StreamID != "4-0" || streamed_event.Event.Type != TypeUpdated {
+			t.Logf("Expected only the new event, got: %+v", streamed_event)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the new event, got nothing")
+	}
+
+	// Stopping closes the channel
+	stop_live()
+	for range live {
+	}
+}
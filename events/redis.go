@@ -0,0 +1,136 @@
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Stream entries kept, approximately, before the oldest are trimmed
+const streamMaxLen = 100000
+
+// newClient connects like audit.NewRedisStreamLog
+func newClient(address string, password string, database int, maxretries int) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+
+	return client, client.Ping().Err()
+}
+
+// RedisPubSubPublisher publishes events as JSON to the user_events channel. Subscribers which
+// aren't listening miss them.
+type RedisPubSubPublisher struct {
+	client *redis.Client
+}
+
+func NewRedisPubSubPublisher(address string, password string, database int, maxretries int) (RedisPubSubPublisher, error) {
+	var new_pubsub_publisher RedisPubSubPublisher
+
+	client, err := newClient(address, password, database, maxretries)
+	new_pubsub_publisher.client = client
+
+	return new_pubsub_publisher, err
+}
+
+func (publisher RedisPubSubPublisher) Publish(event Event) error {
+	event_json, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return publisher.client.Publish("user_events", event_json).Err()
+}
+
+// Close closes the client
+func (publisher RedisPubSubPublisher) Close() error {
+	return publisher.client.Close()
+}
+
+// RedisStreamPublisher adds events to the user_events stream, with the type and username as
+// fields of their own so consumers can filter without decoding the event. It's an EventStream
+// of the same stream, so every replica sees the events of all of them. Needs Redis 5 or later.
+type RedisStreamPublisher struct {
+	client *redis.Client
+}
+
+func NewRedisStreamPublisher(address string, password string, database int, maxretries int) (RedisStreamPublisher, error) {
+	var new_stream_publisher RedisStreamPublisher
+
+	client, err := newClient(address, password, database, maxretries)
+	new_stream_publisher.client = client
+
+	return new_stream_publisher, err
+}
+
+func (publisher RedisStreamPublisher) Publish(event Event) error {
+	event_json, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return publisher.client.XAdd(&redis.XAddArgs{
+		Stream:       "user_events",
+		MaxLenApprox: streamMaxLen,
+		Values: map[string]interface{}{
+			"type":     event.Type,
+			"username": event.Username,
+			"event":    event_json,
+		},
+	}).Err()
+}
+
+// Close closes the client
+func (publisher RedisStreamPublisher) Close() error {
+	return publisher.client.Close()
+}
+
+func (publisher RedisStreamPublisher) Latest() (string, error) {
+	messages, err := publisher.client.XRevRangeN("user_events", "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "0-0", err
+	}
+
+	return messages[0].ID, nil
+}
+
+func (publisher RedisStreamPublisher) Read(after string, limit int, block time.Duration) ([]StreamedEvent, error) {
+	if _, _, err := parsePosition(after); err != nil {
+		return nil, err
+	}
+
+	// XREAD only blocks when it's given a BLOCK, which go-redis leaves out when it's negative
+	if block <= 0 {
+		block = -1
+	}
+
+	streams, err := publisher.client.XRead(&redis.XReadArgs{
+		Streams: []string{"user_events", after},
+		Count:   int64(limit),
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return []StreamedEvent{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	streamed := []StreamedEvent{}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			event_json, _ := message.Values["event"].(string)
+
+			streamed_event := StreamedEvent{StreamID: message.ID}
+			if err = json.Unmarshal([]byte(event_json), &streamed_event.Event); err != nil {
+				return nil, err
+			}
+			streamed = append(streamed, streamed_event)
+		}
+	}
+
+	return streamed, nil
+}
@@ -0,0 +1,317 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidPosition is returned for stream positions which aren't IDs of the form
+// <milliseconds>-<sequence>, as Redis Stream entry IDs are
+var ErrInvalidPosition = errors.New("Invalid event stream position")
+
+// StreamedEvent is an event with its position in a stream, which readers resume after
+type StreamedEvent struct {
+	StreamID string `json:"stream_id"`
+	Event    Event  `json:"event"`
+}
+
+// EventStream is a stream of events which can be read from any position still in it
+type EventStream interface {
+	// Latest returns the position of the newest event, "0-0" if there are none
+	Latest() (string, error)
+	// Read returns up to a limit of events after a position, oldest first, waiting up to block
+	// for one if there are none yet. It never waits if block is 0.
+	Read(after string, limit int, block time.Duration) ([]StreamedEvent, error)
+}
+
+// parsePosition splits a stream position into its milliseconds and sequence
+func parsePosition(position string) (uint64, uint64, error) {
+	parts := strings.SplitN(position, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, ErrInvalidPosition
+	}
+
+	milliseconds, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidPosition
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidPosition
+	}
+
+	return milliseconds, sequence, nil
+}
+
+// positionAfter reports whether a valid position comes after another
+func positionAfter(position string, after string) bool {
+	milliseconds, sequence, _ := parsePosition(position)
+	after_milliseconds, after_sequence, _ := parsePosition(after)
+
+	return milliseconds > after_milliseconds || milliseconds == after_milliseconds && sequence > after_sequence
+}
+
+// MemoryStream keeps the latest events in memory, for running a single replica without Redis
+// and for tests. It's an EventPublisher, so events are added by publishing them.
+type MemoryStream struct {
+	lock   *sync.Mutex
+	events *[]StreamedEvent
+	last   *uint64
+	// Closed and replaced whenever an event is added, waking blocked readers
+	added   *chan bool
+	max_len int
+}
+
+// NewMemoryStream keeps up to max_len events
+func NewMemoryStream(max_len int) MemoryStream {
+	var new_memory_stream MemoryStream
+
+	added := make(chan bool)
+	new_memory_stream.lock = &sync.Mutex{}
+	new_memory_stream.events = &[]StreamedEvent{}
+	new_memory_stream.last = new(uint64)
+	new_memory_stream.added = &added
+	new_memory_stream.max_len = max_len
+
+	return new_memory_stream
+}
+
+func (stream MemoryStream) Publish(event Event) error {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	*stream.last++
+	*stream.events = append(*stream.events, StreamedEvent{StreamID: fmt.Sprintf("%d-0", *stream.last), Event: event})
+	if len(*stream.events) > stream.max_len {
+		*stream.events = (*stream.events)[len(*stream.events)-stream.max_len:]
+	}
+
+	close(*stream.added)
+	added := make(chan bool)
+	*stream.added = added
+
+	return nil
+}
+
+func (stream MemoryStream) Latest() (string, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	return fmt.Sprintf("%d-0", *stream.last), nil
+}
+
+func (stream MemoryStream) Read(after string, limit int, block time.Duration) ([]StreamedEvent, error) {
+	if _, _, err := parsePosition(after); err != nil {
+		return nil, err
+	}
+
+	streamed, added := stream.readAfter(after, limit)
+	if len(streamed) > 0 || block <= 0 {
+		return streamed, nil
+	}
+
+	select {
+	case <-added:
+	case <-time.After(block):
+	}
+	streamed, _ = stream.readAfter(after, limit)
+
+	return streamed, nil
+}
+
+// readAfter returns the events after a position, and the channel closed when the next is added
+func (stream MemoryStream) readAfter(after string, limit int) ([]StreamedEvent, chan bool) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	streamed := []StreamedEvent{}
+	for _, streamed_event := range *stream.events {
+		if len(streamed) < limit && positionAfter(streamed_event.StreamID, after) {
+			streamed = append(streamed, streamed_event)
+		}
+	}
+
+	return streamed, *stream.added
+}
+
+// Events buffered for each listener, one which falls further behind is disconnected
+const listenerBuffer = 256
+
+// Events read from the stream at a time
+const followBatchSize = 100
+
+// Listener gives out the events in a stream
+type Listener interface {
+	// Listen returns a channel of the events after a position, "" for only those yet to come,
+	// and a function to stop listening. The channel is closed if the listener falls too far behind.
+	Listen(after string) (<-chan StreamedEvent, func(), error)
+}
+
+// Follower reads new events from a stream as they're added, handing each to every listener. One
+// reader per replica, rather than one per listener, keeps the connections to the stream down.
+type Follower struct {
+	stream    EventStream
+	lock      *sync.Mutex
+	listeners map[chan StreamedEvent]bool
+	stop      chan bool
+}
+
+// NewFollower starts following the stream from its newest event
+func NewFollower(stream EventStream) Follower {
+	var new_follower Follower
+
+	new_follower.stream = stream
+	new_follower.lock = &sync.Mutex{}
+	new_follower.listeners = make(map[chan StreamedEvent]bool)
+	new_follower.stop = make(chan bool)
+
+	go new_follower.follow()
+
+	return new_follower
+}
+
+// Close stops following the stream, closing every listener's channel
+func (follower Follower) Close() {
+	close(follower.stop)
+
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+
+	for listener := range follower.listeners {
+		close(listener)
+		delete(follower.listeners, listener)
+	}
+}
+
+func (follower Follower) follow() {
+	position := ""
+	for {
+		select {
+		case <-follower.stop:
+			return
+		default:
+		}
+
+		var err error
+		if position == "" {
+			position, err = follower.stream.Latest()
+		}
+
+		var streamed []StreamedEvent
+		if err == nil {
+			streamed, err = follower.stream.Read(position, followBatchSize, time.Second)
+		}
+		if err != nil {
+			log.Printf("Reading the event stream failed: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, streamed_event := range streamed {
+			follower.broadcast(streamed_event)
+			position = streamed_event.StreamID
+		}
+	}
+}
+
+func (follower Follower) broadcast(streamed_event StreamedEvent) {
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+
+	for listener := range follower.listeners {
+		select {
+		case listener <- streamed_event:
+		default:
+			// Too far behind, it can resume from the last event it got
+			close(listener)
+			delete(follower.listeners, listener)
+		}
+	}
+}
+
+func (follower Follower) remove(listener chan StreamedEvent) {
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+
+	if follower.listeners[listener] {
+		close(listener)
+		delete(follower.listeners, listener)
+	}
+}
+
+// Listen starts with the events already in the stream after a position, then goes on to new ones.
+// New events are listened for before reading the old, so none are missed between the two.
+func (follower Follower) Listen(after string) (<-chan StreamedEvent, func(), error) {
+	live := make(chan StreamedEvent, listenerBuffer)
+	follower.lock.Lock()
+	follower.listeners[live] = true
+	follower.lock.Unlock()
+
+	var earlier []StreamedEvent
+	if after != "" {
+		var err error
+		if earlier, err = follower.stream.Read(after, followBatchSize, 0); err != nil {
+			follower.remove(live)
+			return nil, nil, err
+		}
+	}
+
+	listened := make(chan StreamedEvent)
+	done := make(chan bool)
+	stop_once := &sync.Once{}
+	stop := func() {
+		stop_once.Do(func() {
+			close(done)
+			follower.remove(live)
+		})
+	}
+
+	go func() {
+		defer close(listened)
+
+		send := func(streamed_event StreamedEvent) bool {
+			select {
+			case listened <- streamed_event:
+				after = streamed_event.StreamID
+				return true
+			case <-done:
+				return false
+			}
+		}
+
+		// Catching up a page at a time, as there may be many more than fit in a listener's buffer
+		for len(earlier) > 0 {
+			for _, streamed_event := range earlier {
+				if !send(streamed_event) {
+					return
+				}
+			}
+			if len(earlier) < followBatchSize {
+				break
+			}
+
+			var err error
+			if earlier, err = follower.stream.Read(after, followBatchSize, 0); err != nil {
+				log.Printf("Reading the event stream failed: %s", err)
+				return
+			}
+		}
+
+		for streamed_event := range live {
+			// Skipping the events already sent while catching up
+			if after != "" && !positionAfter(streamed_event.StreamID, after) {
+				continue
+			}
+			if !send(streamed_event) {
+				return
+			}
+		}
+	}()
+
+	return listened, stop, nil
+}
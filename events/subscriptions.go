@@ -0,0 +1,152 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Types lists every type of Event, in the order they're documented
+var Types = []string{TypeCreated, TypeUpdated, TypeDeleted, TypeExpired}
+
+// MaxDeliveries is how many of the latest delivery attempts are kept per subscription
+const MaxDeliveries = 100
+
+// RotationGrace is how long requests are signed with a subscription's previous secret as well as
+// its new one after the secret is rotated, so subscribers can switch over without missing events
+const RotationGrace = 24 * time.Hour
+
+// Subscription is a URL events of the chosen types are POSTed to, signed with its secret
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Types of Event delivered, every type when empty
+	Types     []string  `json:"types"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	// The secret before the last rotation, also signing requests until PreviousSecretExpires
+	PreviousSecret        string    `json:"previous_secret,omitempty"`
+	PreviousSecretExpires time.Time `json:"previous_secret_expires,omitempty"`
+}
+
+// Wants reports whether events of a type are delivered to the subscription
+func (subscription Subscription) Wants(event_type string) bool {
+	if len(subscription.Types) == 0 {
+		return true
+	}
+
+	for _, subscribed_type := range subscription.Types {
+		if subscribed_type == event_type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rotate replaces the subscription's secret, keeping the old one for RotationGrace
+func (subscription *Subscription) Rotate(secret string, now time.Time) {
+	subscription.PreviousSecret = subscription.Secret
+	subscription.PreviousSecretExpires = now.Add(RotationGrace).UTC()
+	subscription.Secret = secret
+}
+
+// Delivery is one attempt at delivering an event to a subscription. StatusCode is 0 if no
+// response was received, and Error says why an attempt which wasn't Delivered failed.
+type Delivery struct {
+	SubscriptionID string    `json:"subscription_id"`
+	EventID        string    `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	Attempt        int       `json:"attempt"`
+	Time           time.Time `json:"time"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Delivered      bool      `json:"delivered"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Subscriptions are what WebhookPublisher reads subscriptions from and records deliveries in
+type Subscriptions interface {
+	// ListSubscriptions returns every subscription, oldest first
+	ListSubscriptions() ([]Subscription, error)
+	// GetSubscription returns a subscription, or dberrors.ErrSubscriptionNotFound
+	GetSubscription(string) (Subscription, error)
+	// RecordDelivery keeps a delivery attempt, dropping all but the latest MaxDeliveries of
+	// the subscription's, or returns dberrors.ErrSubscriptionNotFound
+	RecordDelivery(Delivery) error
+}
+
+// SubscriptionStore is implemented by every storage backend, so replicas share subscriptions
+type SubscriptionStore interface {
+	Subscriptions
+	// CreateSubscription stores a new subscription
+	CreateSubscription(Subscription) error
+	// UpdateSubscription replaces a subscription, or returns dberrors.ErrSubscriptionNotFound
+	UpdateSubscription(Subscription) error
+	// RotateSubscriptionSecret rotates a subscription's secret to a new one at a time like
+	// Subscription.Rotate, in one operation so concurrent rotations and updates all take effect.
+	// Returns the rotated subscription, or dberrors.ErrSubscriptionNotFound.
+	RotateSubscriptionSecret(id string, secret string, now time.Time) (Subscription, error)
+	// DeleteSubscription erases a subscription and its deliveries, or returns
+	// dberrors.ErrSubscriptionNotFound
+	DeleteSubscription(string) error
+	// ListDeliveries returns up to a limit of a subscription's latest delivery attempts, newest
+	// first, or dberrors.ErrSubscriptionNotFound
+	ListDeliveries(string, int) ([]Delivery, error)
+}
+
+// PendingSubscriptions reads subscriptions from a store connected after the WebhookPublisher
+// reading them is made. Storage backends keep subscriptions, but are given every publisher when
+// they're made, to publish the users they expire. Reads wait until the store is connected.
+type PendingSubscriptions struct {
+	store     *Subscriptions
+	connected chan struct{}
+}
+
+func NewPendingSubscriptions() PendingSubscriptions {
+	var new_pending_subscriptions PendingSubscriptions
+
+	new_pending_subscriptions.store = new(Subscriptions)
+	new_pending_subscriptions.connected = make(chan struct{})
+
+	return new_pending_subscriptions
+}
+
+// Connect sets the store subscriptions are read from, it must be called exactly once
+func (pending PendingSubscriptions) Connect(store Subscriptions) {
+	*pending.store = store
+	close(pending.connected)
+}
+
+func (pending PendingSubscriptions) wait() Subscriptions {
+	<-pending.connected
+
+	return *pending.store
+}
+
+func (pending PendingSubscriptions) ListSubscriptions() ([]Subscription, error) {
+	return pending.wait().ListSubscriptions()
+}
+
+func (pending PendingSubscriptions) GetSubscription(id string) (Subscription, error) {
+	return pending.wait().GetSubscription(id)
+}
+
+func (pending PendingSubscriptions) RecordDelivery(delivery Delivery) error {
+	return pending.wait().RecordDelivery(delivery)
+}
+
+// NewID returns a random ID for an event or subscription
+func NewID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// NewSecret returns a random secret to sign a subscription's requests with
+func NewSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	return "whsec_" + hex.EncodeToString(secret)
+}
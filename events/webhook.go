@@ -0,0 +1,178 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/dberrors"
+)
+
+var (
+	webhookDeliveries = expvar.NewInt("webhook_deliveries")
+	webhookRetries    = expvar.NewInt("webhook_retries")
+	webhookFailures   = expvar.NewInt("webhook_failures")
+)
+
+// WebhookPublisher POSTs each event as JSON to every subscription wanting its type, in the
+// background so publishing never waits on a subscriber. Each request carries the event's type and
+// ID in the X-Webhook-Event and X-Webhook-ID headers, and is signed in X-Webhook-Signature, see
+// Sign. Deliveries which fail or get a non-2xx response are retried with exponential backoff,
+// and every attempt is recorded with the subscriptions.
+type WebhookPublisher struct {
+	client        *http.Client
+	subscriptions Subscriptions
+	attempts      int
+	backoff       time.Duration
+	pending       *sync.WaitGroup
+}
+
+// NewWebhookPublisher makes up to attempts attempts at delivering each event to each
+// subscription, waiting backoff after the first failure and doubling the wait after each one
+// after that, like archive.RetryingArchiver
+func NewWebhookPublisher(subscriptions Subscriptions, attempts int, backoff time.Duration) WebhookPublisher {
+	var new_webhook_publisher WebhookPublisher
+
+	new_webhook_publisher.client = &http.Client{Timeout: 10 * time.Second}
+	new_webhook_publisher.subscriptions = subscriptions
+	new_webhook_publisher.attempts = attempts
+	new_webhook_publisher.backoff = backoff
+	new_webhook_publisher.pending = &sync.WaitGroup{}
+
+	return new_webhook_publisher
+}
+
+// Sign returns the X-Webhook-Signature of a request body sent at a time, t=<unix seconds>,
+// v1=<hex HMAC-SHA256 of "<unix seconds>.<body>" keyed with the secret>. Subscribers should
+// compute the same and reject old timestamps, so requests can't be replayed.
+func Sign(secret string, sent_at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(sent_at.Unix(), 10)
+
+	return "t=" + timestamp + ",v1=" + signature(secret, timestamp, body)
+}
+
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign signs a request to a subscription, adding a second v1 signature with its previous secret
+// while that's still in its grace period
+func (subscription Subscription) sign(sent_at time.Time, body []byte) string {
+	signed := Sign(subscription.Secret, sent_at, body)
+	if subscription.PreviousSecret != "" && sent_at.Before(subscription.PreviousSecretExpires) {
+		signed += ",v1=" + signature(subscription.PreviousSecret, strconv.FormatInt(sent_at.Unix(), 10), body)
+	}
+
+	return signed
+}
+
+func (publisher WebhookPublisher) Publish(event Event) error {
+	event_json, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := publisher.subscriptions.ListSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		if !subscription.Wants(event.Type) {
+			continue
+		}
+		publisher.pending.Add(1)
+		go publisher.deliver(subscription, event, event_json, 1, publisher.backoff)
+	}
+
+	return nil
+}
+
+// deliver makes an attempt at delivering an event, scheduling the next one if it fails
+func (publisher WebhookPublisher) deliver(subscription Subscription, event Event, event_json []byte, attempt int, wait time.Duration) {
+	status_code, err := publisher.post(subscription, event, event_json)
+
+	delivery := Delivery{
+		SubscriptionID: subscription.ID,
+		EventID:        event.ID,
+		EventType:      event.Type,
+		Attempt:        attempt,
+		Time:           time.Now().UTC(),
+		StatusCode:     status_code,
+		Delivered:      err == nil,
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if record_err := publisher.subscriptions.RecordDelivery(delivery); record_err != nil && record_err != dberrors.ErrSubscriptionNotFound {
+		log.Printf("Delivery of %s to %s was not recorded: %s", event.ID, subscription.URL, record_err)
+	}
+
+	if err == nil {
+		webhookDeliveries.Add(1)
+		publisher.pending.Done()
+		return
+	}
+
+	log.Printf("Delivering %s to %s failed (attempt %d of %d): %s", event.ID, subscription.URL, attempt, publisher.attempts, err)
+	if attempt >= publisher.attempts {
+		webhookFailures.Add(1)
+		publisher.pending.Done()
+		return
+	}
+
+	webhookRetries.Add(1)
+	time.AfterFunc(wait, func() {
+		// Retries go to the subscription as it is now, unless it's been deleted since
+		current, err := publisher.subscriptions.GetSubscription(subscription.ID)
+		if err == dberrors.ErrSubscriptionNotFound {
+			publisher.pending.Done()
+			return
+		} else if err == nil {
+			subscription = current
+		}
+		publisher.deliver(subscription, event, event_json, attempt+1, wait*2)
+	})
+}
+
+// post returns the status code of the subscriber's response, 0 if there wasn't one
+func (publisher WebhookPublisher) post(subscription Subscription, event Event, event_json []byte) (int, error) {
+	request, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(event_json))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Event", event.Type)
+	request.Header.Set("X-Webhook-ID", event.ID)
+	request.Header.Set("X-Webhook-Signature", subscription.sign(time.Now(), event_json))
+
+	response, err := publisher.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("Subscriber responded %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Wait blocks until every event published so far has been delivered or run out of attempts
+func (publisher WebhookPublisher) Wait() {
+	publisher.pending.Wait()
+}
@@ -0,0 +1,22 @@
+module github.com/Haelium/User-Manager-API
+
+go 1.26.0
+
+require (
+	github.com/alicebob/miniredis/v2 v2.35.0
+	github.com/bsm/redislock v0.4.3
+	github.com/fergusstrange/embedded-postgres v1.34.0
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang-jwt/jwt/v5 v5.3.1
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.12.3
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/crypto v0.57.0
+)
+
+require (
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	github.com/yuin/gopher-lua v1.1.2 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+)
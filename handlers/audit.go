@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+)
+
+type auditEvents struct {
+	Events     []audit.Event `json:"events"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// RequestID passes on the X-Request-ID header, generating one if the client didn't send it, so
+// audit events can be matched to requests
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request_id := r.Header.Get("X-Request-ID")
+		if request_id == "" {
+			random_bytes := make([]byte, 16)
+			rand.Read(random_bytes)
+			request_id = hex.EncodeToString(random_bytes)
+			r.Header.Set("X-Request-ID", request_id)
+		}
+
+		w.Header().Set("X-Request-ID", request_id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TrustProxies takes the client's address from X-Forwarded-For on requests forwarded by proxies
+// in trusted, such as an ingress, so logins are counted and changes recorded against clients
+// rather than the proxy every request comes through. The address taken is the one nearest the
+// proxies that isn't one of them, as clients can send whatever they like before it.
+func TrustProxies(trusted []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isTrustedProxy(trusted, clientIP(r)) {
+				forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+				for i := len(forwarded) - 1; i >= 0; i-- {
+					address := strings.TrimSpace(forwarded[i])
+					if net.ParseIP(address) == nil {
+						break
+					}
+					r.RemoteAddr = address
+					if !isTrustedProxy(trusted, address) {
+						break
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isTrustedProxy(trusted []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	for _, network := range trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// record appends an event for a change a request has made, "" standing for no user, and
+// publishes its change event. The change has already been made, so failing to record it is
+// logged rather than failing the request.
+func (handler RequestHandler) record(r *http.Request, operation string, username string, before_json string, after_json string) {
+	handler.publish(operation, username, before_json, after_json)
+	if handler.audit == nil {
+		return
+	}
+
+	_, err := handler.audit.Append(audit.Event{
+		Time:      time.Now().UTC(),
+		Actor:     requestActor(r),
+		Operation: operation,
+		Username:  username,
+		Changes:   audit.Diff(before_json, after_json),
+		RequestID: r.Header.Get("X-Request-ID"),
+		ClientIP:  clientIP(r),
+	})
+	if err != nil {
+		log.Printf("Audit event for %s of %s was not recorded: %s", operation, username, err)
+	}
+}
+
+// writeEvents responds with a page of events, with a cursor for the next if the page is full
+func writeEvents(w http.ResponseWriter, events []audit.Event, limit int) {
+	response := auditEvents{Events: events}
+	if len(events) == limit {
+		response.NextCursor = events[len(events)-1].ID
+	}
+
+	response_json, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response_json)
+}
+
+// GetUserHistory lists a user's events oldest first, including those of a user that no longer
+// exists
+func (handler RequestHandler) GetUserHistory(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersRead, username) {
+		return
+	}
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	events := []audit.Event{}
+	if handler.audit != nil {
+		events, err = handler.audit.History(username, r.URL.Query().Get("cursor"), limit)
+		if err == audit.ErrInvalidID {
+			responseErrorBadRequest(w, errors.New("cursor is not a valid event ID"))
+			return
+		} else if err != nil {
+			responseErrorInternal(w, err)
+			return
+		}
+	}
+
+	writeEvents(w, events, limit)
+}
+
+// GetAudit lists every user's events from ?since=, an RFC 3339 time, oldest first
+func (handler RequestHandler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersRead, "") {
+		return
+	}
+	limit, err := pageLimit(r)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var since time.Time
+	if r.URL.Query().Get("since") != "" {
+		since, err = time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+		if err != nil {
+			responseErrorBadRequest(w, errors.New("since must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	events := []audit.Event{}
+	if handler.audit != nil {
+		events, err = handler.audit.Since(since, r.URL.Query().Get("cursor"), limit)
+		if err == audit.ErrInvalidID {
+			responseErrorBadRequest(w, errors.New("cursor is not a valid event ID"))
+			return
+		} else if err != nil {
+			responseErrorInternal(w, err)
+			return
+		}
+	}
+
+	writeEvents(w, events, limit)
+}
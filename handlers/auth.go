@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/auth"
+)
+
+// Longest name an API key may be given
+const maxKeyNameLength = 64
+
+var errInsufficientScope = errors.New("The credentials lack the scope given in details")
+
+var errAPIKeysDisabled = errors.New("API keys are not enabled")
+
+var errInvalidKeyName = errors.New("name must be 1 to 64 characters")
+
+var errInvalidRole = errors.New("roles may not be empty strings")
+
+// apiKeyRequest is the body of POST /api-keys
+type apiKeyRequest struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// apiKey is a key as returned, the key itself only when it's created
+type apiKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Roles     []string  `json:"roles"`
+	CreatedAt time.Time `json:"created_at"`
+	Key       string    `json:"key,omitempty"`
+}
+
+type apiKeyList struct {
+	APIKeys []apiKey `json:"api_keys"`
+}
+
+func asAPIKey(key auth.APIKey, plaintext string) apiKey {
+	return apiKey{
+		ID:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Roles:     key.Roles,
+		CreatedAt: key.CreatedAt.UTC(),
+		Key:       plaintext,
+	}
+}
+
+// Authenticate is middleware rejecting requests without valid credentials, and putting the
+// principal of those with them in the request's context
+func Authenticate(authenticator auth.Authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticator.Authenticate(r)
+			if err == auth.ErrUnauthenticated || err == auth.ErrInvalidCredentials {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="userapi"`)
+				responseErrorUnauthorized(w, err)
+				return
+			} else if err != nil {
+				responseErrorInternal(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+// authorize responds with a problem unless the request's principal has scope, and
+// auth.ScopeUsersAdmin too unless username is their own. "" stands for every user, as when
+// listing them. Without authentication every request is allowed.
+func (handler RequestHandler) authorize(w http.ResponseWriter, r *http.Request, scope string, username string) bool {
+	principal, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return true
+	}
+
+	needed := []string{scope}
+	if scope != auth.ScopeUsersAdmin && (username == "" || username != principal.Subject) {
+		needed = append(needed, auth.ScopeUsersAdmin)
+	}
+
+	granted := handler.policy.Scopes(principal)
+	for _, needed_scope := range needed {
+		if !granted[needed_scope] {
+			responseErrorForbidden(w, detailedError{errInsufficientScope, map[string]interface{}{"scope": needed_scope}})
+			return false
+		}
+	}
+
+	return true
+}
+
+// requireAdmin responds with a problem unless API keys are enabled and the request was made by
+// an admin. Without authentication there's no admin, so keys can only be created from the CLI.
+func (handler RequestHandler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if handler.keys == nil {
+		responseErrorNotFound(w, errAPIKeysDisabled)
+		return false
+	}
+
+	if _, ok := auth.PrincipalFrom(r.Context()); !ok {
+		responseErrorForbidden(w, detailedError{errInsufficientScope, map[string]interface{}{"scope": auth.ScopeUsersAdmin}})
+		return false
+	}
+
+	return handler.authorize(w, r, auth.ScopeUsersAdmin, "")
+}
+
+// validateAPIKey checks a key request, returning its roles without duplicates
+func validateAPIKey(request apiKeyRequest) ([]string, error) {
+	if request.Name == "" || len(request.Name) > maxKeyNameLength {
+		return nil, errInvalidKeyName
+	}
+
+	roles := []string{}
+	seen := map[string]bool{}
+	for _, role := range request.Roles {
+		if role == "" {
+			return nil, errInvalidRole
+		}
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+
+	return roles, nil
+}
+
+// CreateAPIKey issues a key with the given roles. This is the only time the key is shown, only
+// its hash is kept.
+func (handler RequestHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !handler.requireAdmin(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var request apiKeyRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	roles, err := validateAPIKey(request)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	plaintext, key := auth.NewKey(request.Name, roles)
+	if err = handler.keys.CreateKey(key); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api-keys/"+key.ID)
+	writeJSON(w, http.StatusCreated, asAPIKey(key, plaintext))
+}
+
+func (handler RequestHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !handler.requireAdmin(w, r) {
+		return
+	}
+
+	keys, err := handler.keys.ListKeys()
+	if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	response := apiKeyList{APIKeys: []apiKey{}}
+	for _, key := range keys {
+		response.APIKeys = append(response.APIKeys, asAPIKey(key, ""))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DeleteAPIKey revokes a key, requests made with it are rejected from then on
+func (handler RequestHandler) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !handler.requireAdmin(w, r) {
+		return
+	}
+	pathParams := mux.Vars(r)
+
+	err := handler.keys.DeleteKey(pathParams["id"])
+	if err == auth.ErrKeyNotFound {
+		responseErrorNotFound(w, err)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
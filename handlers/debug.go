@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/Haelium/User-Manager-API/auth"
+)
+
+// Variables expvar publishes in every process, which describe the process rather than the service.
+// The command line may hold secrets, so they're never served.
+var processVars = map[string]bool{"cmdline": true, "memstats": true}
+
+// DebugVars serves the service's own expvar counters, like expvar.Handler without its defaults.
+// They're only for admins.
+func (handler RequestHandler) DebugVars(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if processVars[kv.Key] {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/events"
+)
+
+// eventTypes maps the operations recorded in the audit log to the change events published for
+// them. A restored or undeleted user is created again, as far as downstream services know.
+var eventTypes = map[string]string{
+	audit.OperationCreate:      events.TypeCreated,
+	audit.OperationRestore:     events.TypeCreated,
+	audit.OperationUndelete:    events.TypeCreated,
+	audit.OperationEdit:        events.TypeUpdated,
+	audit.OperationPatch:       events.TypeUpdated,
+	audit.OperationRevert:      events.TypeUpdated,
+	audit.OperationVerifyEmail: events.TypeUpdated,
+	audit.OperationDelete:      events.TypeDeleted,
+	audit.OperationHardDelete:  events.TypeDeleted,
+}
+
+// publish publishes the change event for an operation. Erasing a user already in the recycle
+// bin publishes nothing, as its deletion already was.
+func (handler RequestHandler) publish(operation string, username string, before_json string, after_json string) {
+	event_type, ok := eventTypes[operation]
+	if handler.publisher == nil || !ok || before_json == "" && after_json == "" {
+		return
+	}
+
+	handler.publisher.Publish(events.NewEvent(event_type, username, before_json, after_json))
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/validation"
+)
+
+// The same for unknown users, users without a password and wrong passwords, so logins don't
+// reveal which usernames exist
+var errLoginFailed = errors.New("Username or password is incorrect")
+
+var errCurrentPasswordInvalid = errors.New("current_password is incorrect")
+
+var errLoginLocked = errors.New("Too many failed logins, try again after retry_after seconds")
+
+var errLockoutDisabled = errors.New("Logins are not locked out")
+
+// loginRequest is the body of POST /login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// session is the response to a successful login
+type session struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// passwordRequest is the body of POST /user/{username}/password
+type passwordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+// isAdmin reports whether a request was made by a principal who may act on any user
+func (handler RequestHandler) isAdmin(r *http.Request) bool {
+	principal, ok := auth.PrincipalFrom(r.Context())
+
+	return ok && handler.policy.Scopes(principal)[auth.ScopeUsersAdmin]
+}
+
+// Login checks a user's password, responding with a session token to send as
+// "Authorization: Bearer <token>". Soft deleted and expired users can't log in. Usernames and
+// client IPs failing too often are locked out, with 429 responses until the lock ends.
+func (handler RequestHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if !handler.sessions.Enabled() {
+		responseErrorNotFound(w, auth.ErrSessionsDisabled)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var request loginRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+	username := strings.ToLower(request.Username)
+	ip := clientIP(r)
+
+	// Attempts are counted before the slow password check, so concurrent guesses can't all pass
+	// the limit. Locked out logins aren't checked at all, even with the right password.
+	attempt := ""
+	if handler.lockout != nil {
+		var locked_for time.Duration
+		attempt, locked_for, err = handler.lockout.Attempt(username, ip)
+		if err != nil {
+			responseErrorInternal(w, err)
+			return
+		}
+		if locked_for > 0 {
+			responseErrorTooManyRequests(w, errLoginLocked, locked_for)
+			return
+		}
+	}
+
+	hash := ""
+	if _, err = handler.db.GetUser(username); err == nil {
+		hash, err = handler.db.GetPasswordHash(username)
+		if err != nil && err != dberrors.ErrNoPassword {
+			responseErrorInternal(w, err)
+			return
+		}
+	}
+
+	if !auth.VerifyPassword(hash, request.Password) {
+		responseErrorUnauthorized(w, errLoginFailed)
+		return
+	}
+	if handler.lockout != nil {
+		if err = handler.lockout.Succeed(username, ip, attempt); err != nil {
+			log.Printf("Failed logins of %s were not reset: %s", username, err)
+		}
+	}
+
+	token, expires_at, err := handler.sessions.Issue(username)
+	if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, session{Token: token, TokenType: "Bearer", ExpiresAt: expires_at.UTC()})
+}
+
+// ChangePassword sets a user's password and revokes its sessions, including the one changing it.
+// Unless the user has none yet, or the request is made by an admin, the current password must be
+// given too.
+func (handler RequestHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+
+	if _, err := handler.db.GetUser(username); err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var request passwordRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	if err = validation.ValidatePassword(request.Password, username); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	hash, err := handler.db.GetPasswordHash(username)
+	if err != nil && err != dberrors.ErrNoPassword {
+		responseErrorInternal(w, err)
+		return
+	}
+	if err == nil && !handler.isAdmin(r) && !auth.VerifyPassword(hash, request.CurrentPassword) {
+		responseErrorForbidden(w, errCurrentPasswordInvalid)
+		return
+	}
+
+	if err = handler.db.SetPasswordHash(username, auth.HashPassword(request.Password)); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	if err = handler.sessions.Revoke(username); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	handler.record(r, audit.OperationPasswordChange, username, "", "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockUser lets a locked out username log in again straight away. Locks on client IPs are left
+// to end on their own.
+func (handler RequestHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+
+	if handler.lockout == nil {
+		responseErrorNotFound(w, errLockoutDisabled)
+		return
+	}
+
+	if err := handler.lockout.Unlock(username); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	handler.record(r, audit.OperationUnlock, username, "", "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/patch"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+// problem is an RFC 7807 problem details object. Code, Field, Details and Errors are extension
+// members, Code is always set so clients can branch on it instead of matching on Detail.
+// When validation fails on several fields, each one is listed in Errors with its JSON pointer.
+type problem struct {
+	Type    string                 `json:"type"`
+	Title   string                 `json:"title"`
+	Status  int                    `json:"status"`
+	Detail  string                 `json:"detail"`
+	Code    string                 `json:"code"`
+	Field   string                 `json:"field,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Errors  []*validation.Error    `json:"errors,omitempty"`
+}
+
+const codeValidationFailed = "VALIDATION_FAILED"
+
+var errUserNotFound = errors.New("User not found")
+
+var errUserDeleted = errors.New("User has been deleted")
+
+// detailedError adds extension details to the response for an error with a code in errorCodes
+type detailedError struct {
+	err     error
+	details map[string]interface{}
+}
+
+func (detailed detailedError) Error() string {
+	return detailed.err.Error()
+}
+
+// Codes for errors from outside the validation package, which carries its own
+var errorCodes = map[error]string{
+	errUserNotFound:                  "USER_NOT_FOUND",
+	errNotArchived:                   "ARCHIVE_NOT_FOUND",
+	errUserDeleted:                   "USER_DELETED",
+	dberrors.ErrNotDeleted:           "USER_NOT_DELETED",
+	versions.ErrVersionNotFound:      "VERSION_NOT_FOUND",
+	dberrors.ErrUserExists:           "USER_EXISTS",
+	dberrors.ErrEmailTaken:           "EMAIL_TAKEN",
+	dberrors.ErrVersionMismatch:      "VERSION_MISMATCH",
+	patch.ErrTestFailed:              "PATCH_TEST_FAILED",
+	dberrors.ErrSubscriptionNotFound: "WEBHOOK_NOT_FOUND",
+	errInvalidWebhookURL:             "INVALID_WEBHOOK_URL",
+	errInvalidEventType:              "INVALID_EVENT_TYPE",
+	errInvalidEventID:                "INVALID_EVENT_ID",
+	errStreamingDisabled:             "STREAMING_DISABLED",
+	auth.ErrUnauthenticated:          "UNAUTHENTICATED",
+	auth.ErrInvalidCredentials:       "INVALID_CREDENTIALS",
+	auth.ErrKeyNotFound:              "API_KEY_NOT_FOUND",
+	errInsufficientScope:             "INSUFFICIENT_SCOPE",
+	errAPIKeysDisabled:               "API_KEYS_DISABLED",
+	errInvalidKeyName:                "INVALID_KEY_NAME",
+	errInvalidRole:                   "INVALID_ROLE",
+	errLoginFailed:                   "LOGIN_FAILED",
+	errCurrentPasswordInvalid:        "CURRENT_PASSWORD_INVALID",
+	auth.ErrSessionsDisabled:         "LOGIN_DISABLED",
+	errLoginLocked:                   "LOGIN_LOCKED",
+	errLockoutDisabled:               "LOCKOUT_DISABLED",
+	auth.ErrInvalidToken:             "TOKEN_INVALID",
+	auth.ErrTokensDisabled:           "EMAIL_TOKENS_DISABLED",
+	errEmailAlreadyVerified:          "EMAIL_ALREADY_VERIFIED",
+}
+
+// Fallback codes for errors with no specific code
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           "BAD_REQUEST",
+	http.StatusUnauthorized:         "UNAUTHORIZED",
+	http.StatusForbidden:            "FORBIDDEN",
+	http.StatusNotFound:             "NOT_FOUND",
+	http.StatusConflict:             "CONFLICT",
+	http.StatusPreconditionFailed:   "PRECONDITION_FAILED",
+	http.StatusUnsupportedMediaType: "UNSUPPORTED_MEDIA_TYPE",
+	http.StatusTooManyRequests:      "TOO_MANY_REQUESTS",
+	http.StatusInternalServerError:  "INTERNAL_ERROR",
+}
+
+// writeProblem is the single encoder for error responses
+func writeProblem(w http.ResponseWriter, status int, err error) {
+	response := problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   statusCodes[status],
+	}
+
+	if validation_errs, ok := err.(validation.Errors); ok {
+		response.Errors = validation_errs
+		response.Code = codeValidationFailed
+		if len(validation_errs) == 1 {
+			err = validation_errs[0]
+		}
+	}
+
+	switch err := err.(type) {
+	case validation.Errors:
+	case *validation.Error:
+		response.Code = err.Code
+		response.Field = err.Field
+		response.Details = err.Details
+	case detailedError:
+		response.Code = errorCodes[err.err]
+		response.Details = err.details
+	default:
+		if code, ok := errorCodes[err]; ok {
+			response.Code = code
+		}
+	}
+
+	body, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
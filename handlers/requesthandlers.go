@@ -1,14 +1,27 @@
 package handlers
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/mailer"
+	"github.com/Haelium/User-Manager-API/patch"
 	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
 )
 
 /*
@@ -31,60 +44,243 @@ user: {
 	shipping address
 }
 
-POST /user/							- Create user 				- Takes json struct
+POST /user/							- Create user 				- Takes json struct, 409 if username or email is taken
 GET /user/{username}				- Gets user 				- Returns json struct
 DELETE /user/{username}				- Deletes user 				- Returns json struct
-PUT /user/{username}				- Updates user				- Takes json struct
+PUT /user/{username}				- Replaces user				- Takes complete json struct
+PATCH /user/{username}				- Partially updates user	- Takes application/merge-patch+json (RFC 7396)
+									  or application/json-patch+json (RFC 6902), returns json struct
+GET /users?cursor=&limit=			- Lists users				- Returns page of json structs and next cursor
+GET /users?email=&country=&region=&name_prefix=
+									- Searches users			- Filters are ANDed, paged like the listing
+GET /users/by-email/{email}			- Gets user by email		- Returns json struct
+POST /user/{username}/undelete		- Undeletes user			- Takes it out of the recycle bin, returns json struct
+GET /user/{username}?version=N		- Gets an earlier version	- Or ?as_of= an RFC 3339 time, returns json struct
+GET /user/{username}/versions		- Lists user's versions		- Current first, then earlier versions newest first
+POST /user/{username}/revert?version=N
+									- Reverts user				- To an earlier version, or ?as_of=, returns json struct
+GET /user/{username}/history?cursor=&limit=
+									- Lists a user's audit log	- Oldest first, paged by event ID
+GET /audit?since=&cursor=&limit=	- Lists the audit log		- Of every user from an RFC 3339 time on
+GET /archive/{username}				- Lists archived versions	- Of an expired user, newest first
+POST /users/{username}/restore		- Restores expired user		- Newest archived version, or ?modified_nanos=
+
+Emails are unique across users, compared case insensitively on the domain part.
+
+GET /user/{username} returns the user's version as an ETag and honours If-None-Match with 304.
+PUT, PATCH and DELETE honour If-Match with 412, and PUT and PATCH never overwrite a concurrent edit.
+
+DELETE /user/{username} moves the user to a recycle bin, where it can be undeleted until the
+server's retention period passes and it's archived like an expired user. Until then GET reports
+who deleted it and when, and its username can't be reused. DELETE /user/{username}?hard=true
+erases a user, or a user in the recycle bin, for good.
+
+Every write keeps the version it replaces, as many and for as long as the server's history policy
+says. Reverting validates the earlier version like a PUT and stores it as a new version, keeping
+the user's expiry, and honours If-Match.
+
+Every change to a user, including expiry, is recorded in the audit log with the fields changed.
+Requests are identified by their X-Request-ID header, which is generated if missing and always
+returned. Changes are also published as user.created, user.updated, user.deleted and user.expired
+events for downstream services.
+
+Users' emails are verified by redeeming a token emailed to them, which sets "verified_email": true.
+Only the server sets it, and a PUT or PATCH changing the email clears it.
+
+Users expire after the server's default ttl, restarted by every write. POST, PUT and PATCH bodies
+may instead set one of "ttl_seconds": 3600, "expires_at": "2030-01-01T00:00:00Z" or
+"permanent": true, and "permanent": false returns to the default. These members aren't stored
+with the user, and a write without them keeps the user's current expiry. GET /user/{username}
+reports the remaining lifetime in the User-Expires-At and User-Expires-In (seconds, or "never")
+headers.
 
 */
 
 type DatabaseInterface interface {
+	// SetUser stores a user unconditionally, with the default expiry
 	SetUser(string, string) error
 	GetUser(string) (string, error)
 	DeleteUser(string) error
+	// ListUsers takes an opaque cursor ("" to start) and a page size, and returns the page
+	// of users and the cursor for the next page ("" when there are no more users)
+	ListUsers(string, int) ([]string, string, error)
+	// SearchUsers takes a map of searchFilters to values, matching users on all of them,
+	// and pages like ListUsers
+	SearchUsers(map[string]string, string, int) ([]string, string, error)
+	// GetUserByEmail returns the user owning an email address. SetUser returns
+	// dberrors.ErrEmailTaken rather than give a user an email another user owns.
+	GetUserByEmail(string) (string, error)
+	// CreateUser atomically stores a user with an expiry only if the username is free,
+	// returning dberrors.ErrUserExists otherwise
+	CreateUser(string, string, validation.Expiry) error
+	// GetUserWithVersion returns a user and its current version
+	GetUserWithVersion(string) (string, string, error)
+	// SetUserIfVersion and DeleteUserIfVersion only act if the user is at the given version
+	// ("" for any), returning dberrors.ErrVersionMismatch otherwise. SetUserIfVersion replaces
+	// the user's expiry too, and returns the new version.
+	SetUserIfVersion(string, string, string, validation.Expiry) (string, error)
+	DeleteUserIfVersion(string, string) error
+	// GetUserExpiry returns a user's expiry and when it's due to expire (zero if never)
+	GetUserExpiry(string) (validation.Expiry, time.Time, error)
+	// SoftDeleteUserIfVersion moves a user at the given version ("" for any) to the recycle bin,
+	// recording who deleted it. The username stays taken until the user is purged after the
+	// retention period. DeleteUser and DeleteUserIfVersion with "" erase it from the bin too.
+	SoftDeleteUserIfVersion(string, string, string) error
+	// GetDeletion returns when and by whom a user in the recycle bin was deleted, or
+	// dberrors.ErrNotDeleted
+	GetDeletion(string) (time.Time, string, error)
+	// UndeleteUser takes a user out of the recycle bin with its expiry restarted, returning it,
+	// or dberrors.ErrNotDeleted
+	UndeleteUser(string) (string, error)
+	// GetUserVersions returns a user's current version, then the earlier versions its history
+	// policy keeps, newest first
+	GetUserVersions(string) ([]versions.Version, error)
+	// Webhook subscriptions are stored with users, so every replica delivers to the same ones
+	events.SubscriptionStore
+	// Password hashes are stored apart from users, so they're never returned with them
+	auth.PasswordStore
+}
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// Query parameters accepted by GET /users as search filters
+var searchFilters = []string{"email", "country", "region", "name_prefix"}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type userPage struct {
+	Users      []json.RawMessage `json:"users"`
+	NextCursor string            `json:"next_cursor"`
 }
 
 type RequestHandler struct {
 	db DatabaseInterface
+	// Where expired users can be restored from, nil if they can't be
+	archived  archive.Reader
+	audit     audit.Log
+	publisher events.EventPublisher
+	// Where GET /users/events gets events from, nil if they can't be streamed
+	listener events.Listener
+	// API keys managed at /api-keys, nil if they aren't enabled
+	keys auth.KeyStore
+	// Scopes granted to authenticated principals' roles
+	policy auth.Policy
+	// Issues session tokens from POST /login, if it's enabled
+	sessions auth.Sessions
+	// Locks out logins which fail too often, nil if they never are
+	lockout auth.Lockout
+	// Issues the tokens emailed to verify emails and reset passwords, if it's enabled
+	tokens auth.Tokens
+	// Sends those emails, nil if none are sent
+	mailer mailer.Mailer
 	// Log level?
 	// Log path?
 }
 
-func NewHandler(db DatabaseInterface) RequestHandler {
+func NewHandler(db DatabaseInterface, archived archive.Reader, audit_log audit.Log, publisher events.EventPublisher, listener events.Listener, keys auth.KeyStore, policy auth.Policy, sessions auth.Sessions, lockout auth.Lockout, tokens auth.Tokens, user_mailer mailer.Mailer) RequestHandler {
 	var handler RequestHandler
 	handler.db = db
+	handler.archived = archived
+	handler.audit = audit_log
+	handler.publisher = publisher
+	handler.listener = listener
+	handler.keys = keys
+	handler.policy = policy
+	handler.sessions = sessions
+	handler.lockout = lockout
+	handler.tokens = tokens
+	handler.mailer = user_mailer
 
 	return handler
 }
 
 func responseErrorBadRequest(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusBadRequest)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
-	return
+	writeProblem(w, http.StatusBadRequest, err)
+}
+
+func responseErrorUnauthorized(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusUnauthorized, err)
 }
 
 func responseErrorNotFound(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
-	return
+	writeProblem(w, http.StatusNotFound, err)
 }
 
 func responseErrorForbidden(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusForbidden)
+	writeProblem(w, http.StatusForbidden, err)
+}
+
+func responseErrorConflict(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusConflict, err)
+}
+
+func responseErrorPreconditionFailed(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusPreconditionFailed, err)
+}
+
+func responseErrorUnsupportedMediaType(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusUnsupportedMediaType, err)
+}
+
+// responseErrorTooManyRequests tells the client to wait retry_after, rounded up to whole seconds
+func responseErrorTooManyRequests(w http.ResponseWriter, err error, retry_after time.Duration) {
+	seconds := int64((retry_after + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeProblem(w, http.StatusTooManyRequests, detailedError{err, map[string]interface{}{"retry_after": seconds}})
+}
+
+func responseErrorInternal(w http.ResponseWriter, err error) {
+	writeProblem(w, http.StatusInternalServerError, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	response_json, _ := json.Marshal(response)
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
-	return
+	w.WriteHeader(status)
+	w.Write(response_json)
+}
+
+func versionETag(version string) string {
+	return `"` + version + `"`
+}
+
+// etagMatches checks an If-Match or If-None-Match header against a version. Weak and strong
+// validators are treated alike, as each version is only ever stored with one representation.
+func etagMatches(header string, version string) bool {
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" || etag == versionETag(version) {
+			return true
+		}
+	}
+
+	return false
 }
 
+// EditUser replaces a user with the request body, which must be a complete, valid user
 func (handler RequestHandler) EditUser(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
 	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
 
-	user_json_string, err := handler.db.GetUser(username)
+	old_user_json, version, err := handler.db.GetUserWithVersion(username)
 	if err != nil {
-		responseErrorNotFound(w, err)
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	if if_match := r.Header.Get("If-Match"); if_match != "" && !etagMatches(if_match, version) {
+		responseErrorPreconditionFailed(w, dberrors.ErrVersionMismatch)
+		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
@@ -93,21 +289,145 @@ func (handler RequestHandler) EditUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	new_user_body_json, err := validation.ModifyUser(user_json_string, string(body))
+	new_user_json, expiry, err := validation.ExtractExpiry(string(body))
 	if err != nil {
 		responseErrorBadRequest(w, err)
 		return
 	}
 
-	err = handler.db.SetUser(username, string(new_user_body_json))
+	new_version, new_user_json, ok := handler.storeUpdatedUser(w, username, old_user_json, new_user_json, version, expiry)
+	if !ok {
+		return
+	}
+	handler.record(r, audit.OperationEdit, username, old_user_json, new_user_json)
+
+	w.Header().Set("ETag", versionETag(new_version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("Created user"))
+}
+
+// PatchUser applies a JSON Merge Patch or JSON Patch, chosen by Content-Type, to a user and
+// returns the result
+func (handler RequestHandler) PatchUser(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+
+	content_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if content_type != mergePatchContentType && content_type != jsonPatchContentType {
+		responseErrorUnsupportedMediaType(w, fmt.Errorf("Content-Type must be %s or %s", mergePatchContentType, jsonPatchContentType))
+		return
+	}
+
+	user_json_string, version, err := handler.db.GetUserWithVersion(username)
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	if if_match := r.Header.Get("If-Match"); if_match != "" && !etagMatches(if_match, version) {
+		responseErrorPreconditionFailed(w, dberrors.ErrVersionMismatch)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		responseErrorBadRequest(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	// Patches address the canonical field names, whatever the user was created with
+	old_user_json := user_json_string
+	user_json_string, err = validation.NormalizeUser(user_json_string)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var patched_user []byte
+	if content_type == mergePatchContentType {
+		patched_user, err = patch.MergePatch([]byte(user_json_string), body)
+	} else {
+		patched_user, err = patch.JSONPatch([]byte(user_json_string), body)
+	}
+	if err == patch.ErrTestFailed {
+		responseErrorConflict(w, err)
+		return
+	} else if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	// Patches may set the expiry like a PUT body
+	patched_user_json, expiry, err := validation.ExtractExpiry(string(patched_user))
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	// Stored in schema order, which also drops any members the schema doesn't know
+	normalized_user, err := validation.NormalizeUser(patched_user_json)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	new_version, normalized_user, ok := handler.storeUpdatedUser(w, username, old_user_json, normalized_user, version, expiry)
+	if !ok {
+		return
+	}
+	patched_user = []byte(normalized_user)
+	handler.record(r, audit.OperationPatch, username, old_user_json, string(patched_user))
+
+	w.Header().Set("ETag", versionETag(new_version))
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("Created user"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(patched_user)
+}
+
+// storeUpdatedUser validates the new document for an existing user and writes it only if the
+// user is still at version, so a concurrent edit is never lost. A nil expiry keeps the user's
+// current one. The user's email stays verified only if it's unchanged, and the document stored
+// is returned with its new version. On failure it writes the error response itself and returns
+// false.
+func (handler RequestHandler) storeUpdatedUser(w http.ResponseWriter, username string, old_user_json string, new_user_json string, version string, expiry *validation.Expiry) (string, string, bool) {
+	if err := validation.RejectPassword(new_user_json); err != nil {
+		responseErrorBadRequest(w, err)
+		return "", "", false
+	}
+
+	err := validation.ValidateUserUpdate(username, new_user_json)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return "", "", false
+	}
+	new_user_json = validation.KeepEmailVerified(old_user_json, new_user_json)
+
+	if expiry == nil {
+		current_expiry, _, err := handler.db.GetUserExpiry(username)
+		if err != nil {
+			responseErrorNotFound(w, errUserNotFound)
+			return "", "", false
+		}
+		expiry = &current_expiry
+	}
+
+	new_version, err := handler.db.SetUserIfVersion(username, new_user_json, version, *expiry)
+	if err == dberrors.ErrVersionMismatch {
+		responseErrorPreconditionFailed(w, err)
+		return "", "", false
+	} else if err == dberrors.ErrEmailTaken {
+		responseErrorConflict(w, err)
+		return "", "", false
+	} else if err != nil {
+		responseErrorBadRequest(w, err)
+		return "", "", false
+	}
+
+	return new_version, new_user_json, true
 }
 
 func (handler RequestHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
@@ -117,41 +437,137 @@ func (handler RequestHandler) CreateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	username, err := validation.ValidateUser(string(body))
+	user_json_string, expiry, err := validation.ExtractExpiry(string(body))
 	if err != nil {
 		responseErrorBadRequest(w, err)
 		return
 	}
+	if expiry == nil {
+		expiry = &validation.Expiry{}
+	}
 
-	existing_user, _ := handler.db.GetUser(username)
-	if existing_user != "" {
-		responseErrorForbidden(w, errors.New("User already exists"))
+	user_json_string, password, err := validation.ExtractPassword(user_json_string)
+	if err != nil {
+		responseErrorBadRequest(w, err)
 		return
 	}
+	// Emails are only verified with a token sent to them
+	user_json_string = validation.SetEmailVerified(user_json_string, false)
 
-	err = handler.db.SetUser(username, string(body))
+	username, err := validation.ValidateUser(user_json_string)
 	if err != nil {
 		responseErrorBadRequest(w, err)
 		return
 	}
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+	if password != nil {
+		if err = validation.ValidatePassword(*password, username); err != nil {
+			responseErrorBadRequest(w, err)
+			return
+		}
+	}
+
+	err = handler.db.CreateUser(username, user_json_string, *expiry)
+	if err == dberrors.ErrUserExists || err == dberrors.ErrEmailTaken {
+		responseErrorConflict(w, err)
+		return
+	} else if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+	// Sessions of an earlier user of the same name, which expired without revoking them, mustn't
+	// authenticate as this one. It has no password yet, so none of its own are revoked.
+	if err = handler.sessions.Revoke(username); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	// Replacing any hash left by an earlier user of the same name
+	if password != nil {
+		err = handler.db.SetPasswordHash(username, auth.HashPassword(*password))
+	} else {
+		err = handler.db.DeletePasswordHash(username)
+	}
+	if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	handler.record(r, audit.OperationCreate, username, "", user_json_string)
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte("Created user"))
 }
 
 func (handler RequestHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
 	username := pathParams["username"]
-	user_json_string, err := handler.db.GetUser(username)
+	if !handler.authorize(w, r, auth.ScopeUsersRead, username) {
+		return
+	}
+	if r.URL.Query().Get("version") != "" || r.URL.Query().Get("as_of") != "" {
+		handler.getUserVersion(w, r, username)
+		return
+	}
+
+	user_json_string, version, err := handler.db.GetUserWithVersion(username)
 
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"error": "User not found"}`))
+		if deleted_at, deleted_by, err := handler.db.GetDeletion(username); err == nil {
+			responseErrorNotFound(w, detailedError{errUserDeleted, map[string]interface{}{
+				"deleted_at": deleted_at.UTC().Format(time.RFC3339),
+				"deleted_by": deleted_by,
+			}})
+			return
+		}
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(version))
+	if _, expires_at, err := handler.db.GetUserExpiry(username); err == nil {
+		setExpiryHeaders(w, expires_at)
+	}
+	if if_none_match := r.Header.Get("If-None-Match"); if_none_match != "" && etagMatches(if_none_match, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(user_json_string))
+}
+
+// setExpiryHeaders reports how long a user has left, expires_at is zero if it never expires
+func setExpiryHeaders(w http.ResponseWriter, expires_at time.Time) {
+	if expires_at.IsZero() {
+		w.Header().Set("User-Expires-In", "never")
+		return
+	}
+
+	expires_in := time.Until(expires_at).Round(time.Second) / time.Second
+	if expires_in < 0 {
+		expires_in = 0
+	}
+
+	w.Header().Set("User-Expires-At", expires_at.UTC().Format(time.RFC3339))
+	w.Header().Set("User-Expires-In", strconv.FormatInt(int64(expires_in), 10))
+}
+
+func (handler RequestHandler) GetUserByEmail(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersRead, "") {
+		return
+	}
+	pathParams := mux.Vars(r)
+	email := pathParams["email"]
+	user_json_string, err := handler.db.GetUserByEmail(email)
+
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
 	} else {
-		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(user_json_string))
 	}
 }
@@ -159,15 +575,152 @@ func (handler RequestHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 func (handler RequestHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
 	username := pathParams["username"]
-	err := handler.db.DeleteUser(username)
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+	hard := r.URL.Query().Get("hard") == "true"
+	// Only admins erase users for good, even their own
+	if hard && !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	operation := audit.OperationDelete
+	if hard {
+		operation = audit.OperationHardDelete
+	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"error": "User not found"}`))
+	user_json_string, version, err := handler.db.GetUserWithVersion(username)
+	if err != nil && hard {
+		// The user may only be in the recycle bin
+		err = handler.db.DeleteUser(username)
+	} else if err == nil {
+		expected_version := ""
+		if if_match := r.Header.Get("If-Match"); if_match != "" {
+			if !etagMatches(if_match, version) {
+				responseErrorPreconditionFailed(w, dberrors.ErrVersionMismatch)
+				return
+			}
+			expected_version = version
+		}
+
+		if hard {
+			err = handler.db.DeleteUserIfVersion(username, expected_version)
+		} else {
+			err = handler.db.SoftDeleteUserIfVersion(username, expected_version, requestActor(r))
+		}
+	}
+
+	if err == dberrors.ErrVersionMismatch {
+		responseErrorPreconditionFailed(w, err)
+	} else if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
 	} else {
-		w.WriteHeader(http.StatusOK)
+		if hard {
+			if err = handler.db.DeletePasswordHash(username); err != nil {
+				log.Printf("Password of erased user %s was not deleted: %s", username, err)
+			}
+		}
+		if err = handler.sessions.Revoke(username); err != nil {
+			log.Printf("Sessions of deleted user %s were not revoked: %s", username, err)
+		}
+		handler.record(r, operation, username, user_json_string, "")
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{\"deleted\":\"" + username + "\"}"))
 	}
 }
+
+func (handler RequestHandler) UndeleteUser(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+
+	user_json_string, err := handler.db.UndeleteUser(username)
+	if err == dberrors.ErrNotDeleted {
+		responseErrorNotFound(w, err)
+		return
+	} else if err == dberrors.ErrUserExists || err == dberrors.ErrEmailTaken {
+		responseErrorConflict(w, err)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	handler.record(r, audit.OperationUndelete, username, "", user_json_string)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(user_json_string))
+}
+
+// requestActor identifies who made a request, for the record kept of changes and deletions:
+// the authenticated principal, or the client's address if authentication is off
+func requestActor(r *http.Request) string {
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+		return principal.Subject
+	}
+
+	return r.RemoteAddr
+}
+
+// pageLimit returns the page size asked for with ?limit=, or the default
+func pageLimit(r *http.Request) (int, error) {
+	if r.URL.Query().Get("limit") == "" {
+		return defaultPageSize, nil
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+
+	return limit, nil
+}
+
+func (handler RequestHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersRead, "") {
+		return
+	}
+	query := r.URL.Query()
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	filters := map[string]string{}
+	for _, filter := range searchFilters {
+		if value := query.Get(filter); value != "" {
+			filters[filter] = value
+		}
+	}
+
+	var users []string
+	var next_cursor string
+	if len(filters) > 0 {
+		users, next_cursor, err = handler.db.SearchUsers(filters, query.Get("cursor"), limit)
+	} else {
+		users, next_cursor, err = handler.db.ListUsers(query.Get("cursor"), limit)
+	}
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	page := userPage{Users: []json.RawMessage{}, NextCursor: next_cursor}
+	for _, user_json_string := range users {
+		page.Users = append(page.Users, json.RawMessage(user_json_string))
+	}
+
+	page_json, err := json.Marshal(page)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(page_json)
+}
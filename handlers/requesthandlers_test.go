@@ -1,51 +1,46 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
-)
-
-// Using a mock object for database
-
-type UserMap struct {
-	users map[string]string
-}
+	"github.com/gorilla/websocket"
 
-func NewUserMap() UserMap {
-	var newUserMap UserMap
-	newUserMap.users = make(map[string]string)
-
-	return newUserMap
-}
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/mailer"
+	"github.com/Haelium/User-Manager-API/memstore"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
 
-func (db UserMap) SetUser(username string, user_json_string string) error {
-	db.users[username] = user_json_string
-	return nil
-}
+// Keeps 2 earlier versions of each user
+var test_history = versions.Policy{MaxVersions: 2}
 
-func (db UserMap) GetUser(username string) (string, error) {
-	user, exists := db.users[username]
-	if exists == false {
-		return "", errors.New("User not found")
-	} else {
-		return user, nil
-	}
+func Router(user_db DatabaseInterface) *mux.Router {
+	return archiveRouter(user_db, nil)
 }
 
-func (db UserMap) DeleteUser(username string) error {
-	_, err := db.GetUser(username)
-	delete(db.users, username)
-
-	return err
+func archiveRouter(user_db DatabaseInterface, archived archive.Reader) *mux.Router {
+	return testRouter(user_db, archived, audit.NewMemoryLog(), nil, nil, nil)
 }
 
-func Router(user_db UserMap) *mux.Router {
-	handler := NewHandler(user_db)
+func testRouter(user_db DatabaseInterface, archived archive.Reader, audit_log audit.Log, publisher events.EventPublisher, listener events.Listener, keys auth.KeyStore) *mux.Router {
+	handler := NewHandler(user_db, archived, audit_log, publisher, listener, keys, auth.DefaultPolicy(), auth.NewSessions("session secret", time.Hour, nil), nil, auth.Tokens{}, nil)
 
 	router := mux.NewRouter()
 
@@ -55,13 +50,46 @@ func Router(user_db UserMap) *mux.Router {
 	router.HandleFunc("/user/{username}/", handler.GetUser).Methods(http.MethodGet)
 	router.HandleFunc("/user/{username}", handler.DeleteUser).Methods(http.MethodDelete)
 	router.HandleFunc("/user/{username}/", handler.DeleteUser).Methods(http.MethodDelete)
+	router.HandleFunc("/user/{username}/undelete", handler.UndeleteUser).Methods(http.MethodPost)
 	router.HandleFunc("/user/{username}", handler.EditUser).Methods(http.MethodPut)
 	router.HandleFunc("/user/{username}/", handler.EditUser).Methods(http.MethodPut)
+	router.HandleFunc("/user/{username}", handler.PatchUser).Methods(http.MethodPatch)
+	router.HandleFunc("/user/{username}/", handler.PatchUser).Methods(http.MethodPatch)
+	router.HandleFunc("/users", handler.ListUsers).Methods(http.MethodGet)
+	router.HandleFunc("/users/", handler.ListUsers).Methods(http.MethodGet)
+	router.HandleFunc("/users/by-email/{email}", handler.GetUserByEmail).Methods(http.MethodGet)
+	router.HandleFunc("/users/by-email/{email}/", handler.GetUserByEmail).Methods(http.MethodGet)
+	router.HandleFunc("/users/{username}/restore", handler.RestoreUser).Methods(http.MethodPost)
+	router.HandleFunc("/users/events", handler.StreamEvents).Methods(http.MethodGet)
+	router.HandleFunc("/archive/{username}", handler.GetArchive).Methods(http.MethodGet)
+	router.HandleFunc("/user/{username}/history", handler.GetUserHistory).Methods(http.MethodGet)
+	router.HandleFunc("/user/{username}/versions", handler.GetUserVersions).Methods(http.MethodGet)
+	router.HandleFunc("/user/{username}/revert", handler.RevertUser).Methods(http.MethodPost)
+	router.HandleFunc("/audit", handler.GetAudit).Methods(http.MethodGet)
+	router.HandleFunc("/webhooks", handler.CreateWebhook).Methods(http.MethodPost)
+	router.HandleFunc("/webhooks", handler.ListWebhooks).Methods(http.MethodGet)
+	router.HandleFunc("/webhooks/{id}", handler.GetWebhook).Methods(http.MethodGet)
+	router.HandleFunc("/webhooks/{id}", handler.DeleteWebhook).Methods(http.MethodDelete)
+	router.HandleFunc("/webhooks/{id}/rotate-secret", handler.RotateWebhookSecret).Methods(http.MethodPost)
+	router.HandleFunc("/webhooks/{id}/deliveries", handler.GetWebhookDeliveries).Methods(http.MethodGet)
+	router.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	router.HandleFunc("/user/{username}/password", handler.ChangePassword).Methods(http.MethodPost)
+	router.HandleFunc("/api-keys", handler.CreateAPIKey).Methods(http.MethodPost)
+	router.HandleFunc("/api-keys", handler.ListAPIKeys).Methods(http.MethodGet)
+	router.HandleFunc("/api-keys/{id}", handler.DeleteAPIKey).Methods(http.MethodDelete)
 
 	return router
 }
+
+// storedUser returns a user straight from the database, or "" if it doesn't exist
+func storedUser(user_db DatabaseInterface, username string) string {
+	user_json_string, _ := user_db.GetUser(username)
+
+	return user_json_string
+}
+
 func Test_Create(t *testing.T) {
-	user_db := NewUserMap()
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	test_user := []byte(`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
 
@@ -79,18 +107,18 @@ func Test_Create(t *testing.T) {
 		t.Fail()
 	}
 
-	if user_db.users["billy2000"] != string(test_user) {
+	if storedUser(user_db, "billy2000") != string(test_user) {
 		t.Logf("Input corrupted")
 		t.Fail()
 	}
 }
 
 func Test_Get(t *testing.T) {
-	user_db := NewUserMap()
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	test_user := []byte(`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
 
-	user_db.users["billy2000"] = string(test_user)
+	user_db.SetUser("billy2000", string(test_user))
 
 	// Test get here
 	request, _ := http.NewRequest("GET", "/user/billy2000/", nil)
@@ -109,32 +137,34 @@ func Test_Get(t *testing.T) {
 }
 
 func Test_Delete(t *testing.T) {
-	user_db := NewUserMap()
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	test_user := []byte(`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
 
-	user_db.users["billy2000"] = string(test_user)
+	user_db.SetUser("billy2000", string(test_user))
 
 	// Test get here
 	request, _ := http.NewRequest("DELETE", "/user/billy2000/", nil)
 	response := httptest.NewRecorder()
 	Router(user_db).ServeHTTP(response, request)
 
-	_, exists := user_db.users["billy2000"]
-
-	if exists != false {
+	if _, err := user_db.GetUser("billy2000"); err == nil {
 		t.Logf("User was not deleted")
 		t.Fail()
 	}
+	if content_type := response.Header().Get("Content-Type"); content_type != "application/json" {
+		t.Logf("Expected a JSON response, got Content-Type %q", content_type)
+		t.Fail()
+	}
 }
 
 func Test_Edit(t *testing.T) {
-	user_db := NewUserMap()
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	test_user := []byte(`{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","Line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`)
 	test_user_mod := []byte(`{"username":"billy2000","fullname":"Robert Newname","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`)
 
-	user_db.users["billy2000"] = string(test_user)
+	user_db.SetUser("billy2000", string(test_user))
 
 	// Test get here
 	request, _ := http.NewRequest("PUT", "/user/billy2000/", bytes.NewBuffer(test_user_mod))
@@ -146,8 +176,1648 @@ func Test_Edit(t *testing.T) {
 		t.Fail()
 	}
 
-	if user_db.users["billy2000"] != string(test_user_mod) {
-		t.Logf("User was not updated correctly\nExpected: %s\nGot: %s\n", user_db.users["billy2000"], string(test_user_mod))
+	if storedUser(user_db, "billy2000") != string(test_user_mod) {
+		t.Logf("User was not updated correctly\nExpected: %s\nGot: %s\n", storedUser(user_db, "billy2000"), string(test_user_mod))
+		t.Fail()
+	}
+}
+
+func Test_List(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	for i := 0; i < 5; i++ {
+		username := fmt.Sprintf("billy200%d", i)
+		user_db.SetUser(username, fmt.Sprintf(`{"username":"%s"}`, username))
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		request, _ := http.NewRequest("GET", "/users?limit=2&cursor="+cursor, nil)
+		response := httptest.NewRecorder()
+		Router(user_db).ServeHTTP(response, request)
+
+		if response.Code != 200 {
+			t.Logf("Expected: %d\nGot %d\n", 200, response.Code)
+			t.FailNow()
+		}
+
+		var page struct {
+			Users []struct {
+				Username string `json:"username"`
+			} `json:"users"`
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &page); err != nil {
+			t.Logf("Invalid response body %s: %s", response.Body, err)
+			t.FailNow()
+		}
+
+		if len(page.Users) > 2 {
+			t.Logf("Page size exceeded limit: %d", len(page.Users))
+			t.Fail()
+		}
+		for _, user := range page.Users {
+			seen[user.Username] = true
+		}
+
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	if len(seen) != 5 {
+		t.Logf("Expected %d users, got %d", 5, len(seen))
+		t.Fail()
+	}
+
+	request, _ := http.NewRequest("GET", "/users?limit=0", nil)
+	response := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+	if response.Code != 400 {
+		t.Logf("Expected: %d\nGot %d\n", 400, response.Code)
+		t.Fail()
+	}
+}
+
+func Test_Search(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	user_db.SetUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
+	user_db.SetUser("billy3000", `{"username": "billy3000", "fullname": "Bill Bobson", "email": "Bill@bobmail.bob", "address": {"name": "Bill", "Line 1": "45 Bobstreet", "region": "Billville", "country": "Bobland"}}`)
+	user_db.SetUser("jcdenton", `{"username": "jcdenton", "fullname": "JC Denton", "email": "jc@unatco.org", "address": {"name": "JC", "Line 1": "Liberty Island", "region": "New York", "country": "USA"}}`)
+
+	expected_matches := map[string]int{
+		"/users?country=bobland":                 2,
+		"/users?country=Bobland&region=bobville": 1,
+		"/users?name_prefix=bo":                  1,
+		"/users?name_prefix=bi&country=usa":      0,
+		"/users?email=jc@UNATCO.ORG":             1,
+		"/users?email=JC@unatco.org":             0,
+	}
+
+	for url, expected := range expected_matches {
+		request, _ := http.NewRequest("GET", url, nil)
+		response := httptest.NewRecorder()
+		Router(user_db).ServeHTTP(response, request)
+
+		var page struct {
+			Users []json.RawMessage `json:"users"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &page)
+
+		if response.Code != 200 || len(page.Users) != expected {
+			t.Logf("%s\nExpected: %d users\nGot %d: %s\n", url, expected, response.Code, response.Body)
+			t.Fail()
+		}
+	}
+}
+
+func Test_UniqueEmail(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	user_db.SetUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
+
+	test_user := []byte(`{"username": "billy3000", "fullname": "Bill Bobson", "email": "Bob@BOBMAIL.bob", "address": {"name": "Bill", "Line 1": "45 Bobstreet", "region": "Bobville", "country": "Bobland"}}`)
+	request, _ := http.NewRequest("POST", "/user", bytes.NewBuffer(test_user))
+	response := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 409 {
+		t.Logf("Expected: %d\nGot %d\n", 409, response.Code)
+		t.Fail()
+	}
+	if _, err := user_db.GetUser("billy3000"); err == nil {
+		t.Logf("User with duplicate email was created")
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("GET", "/users/by-email/Bob@Bobmail.bob", nil)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 200 || response.Body.String() != storedUser(user_db, "billy2000") || response.Header().Get("Content-Type") != "application/json" {
+		t.Logf("Expected: %d %s\nGot %d %s (Content-Type %q)\n", 200, storedUser(user_db, "billy2000"), response.Code, response.Body, response.Header().Get("Content-Type"))
+		t.Fail()
+	}
+}
+
+func Test_CreateRace(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := Router(user_db)
+
+	responses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			test_user := []byte(fmt.Sprintf(`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob%d@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`, i))
+			request, _ := http.NewRequest("POST", "/user", bytes.NewBuffer(test_user))
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			responses <- response.Code
+		}(i)
+	}
+
+	created := 0
+	for i := 0; i < 10; i++ {
+		code := <-responses
+		if code == 201 {
+			created++
+		} else if code != 409 {
+			t.Logf("Unexpected response code: %d", code)
+			t.Fail()
+		}
+	}
+
+	if created != 1 {
+		t.Logf("Expected exactly 1 user created, got %d", created)
+		t.Fail()
+	}
+}
+
+func Test_ETags(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	test_user := []byte(`{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`)
+	user_db.SetUser("billy2000", string(test_user))
+
+	request, _ := http.NewRequest("GET", "/user/billy2000", nil)
+	response := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	etag := response.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Logf("Expected ETag: %s\nGot: %s\n", `"1"`, etag)
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("GET", "/user/billy2000", nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 304 || response.Body.Len() != 0 {
+		t.Logf("Expected: %d with no body\nGot %d: %s\n", 304, response.Code, response.Body)
+		t.Fail()
+	}
+
+	// An edit against a stale ETag must be rejected and leave the user untouched
+	test_user_mod := []byte(`{"username":"billy2000","fullname":"Robert Newname","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`)
+	request, _ = http.NewRequest("PUT", "/user/billy2000", bytes.NewBuffer(test_user_mod))
+	request.Header.Set("If-Match", `"0"`)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 412 || storedUser(user_db, "billy2000") != string(test_user) {
+		t.Logf("Expected: %d\nGot %d\n", 412, response.Code)
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("PUT", "/user/billy2000", bytes.NewBuffer(test_user_mod))
+	request.Header.Set("If-Match", etag)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 201 || response.Header().Get("ETag") != `"2"` {
+		t.Logf("Expected: %d with ETag %s\nGot %d with ETag %s\n", 201, `"2"`, response.Code, response.Header().Get("ETag"))
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("DELETE", "/user/billy2000", nil)
+	request.Header.Set("If-Match", etag)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 412 {
+		t.Logf("Expected: %d\nGot %d\n", 412, response.Code)
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("DELETE", "/user/billy2000", nil)
+	request.Header.Set("If-Match", `"2"`)
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if _, err := user_db.GetUser("billy2000"); response.Code != 200 || err == nil {
+		t.Logf("Expected: %d and user deleted\nGot %d\n", 200, response.Code)
+		t.Fail()
+	}
+}
+
+func Test_ProblemResponses(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	test_cases := []struct {
+		body          string
+		expected_code string
+	}{
+		// The decoding error message quotes the offending character, which used to break the JSON
+		{`{key: "val"}`, "INVALID_JSON"},
+		{`{"username": "billy", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`, "USERNAME_TOO_SHORT"},
+		{`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`, "EMAIL_INVALID"},
+	}
+
+	for _, test_case := range test_cases {
+		request, _ := http.NewRequest("POST", "/user", bytes.NewBuffer([]byte(test_case.body)))
+		response := httptest.NewRecorder()
+		Router(user_db).ServeHTTP(response, request)
+
+		var problem struct {
+			Status int    `json:"status"`
+			Code   string `json:"code"`
+			Detail string `json:"detail"`
+		}
+		err := json.Unmarshal(response.Body.Bytes(), &problem)
+
+		if err != nil || response.Header().Get("Content-Type") != "application/problem+json" {
+			t.Logf("Invalid problem response %s (err: %v)", response.Body, err)
+			t.Fail()
+		}
+		if response.Code != 400 || problem.Status != 400 || problem.Code != test_case.expected_code {
+			t.Logf("Expected: %d %s\nGot %d %s\n", 400, test_case.expected_code, response.Code, problem.Code)
+			t.Fail()
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/user/nobodyhere", nil)
+	response := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if !strings.Contains(response.Body.String(), `"code":"USER_NOT_FOUND"`) {
+		t.Logf("Expected USER_NOT_FOUND, got: %s", response.Body)
+		t.Fail()
+	}
+
+	// Every invalid field is listed with its JSON pointer
+	request, _ = http.NewRequest("POST", "/user", bytes.NewBuffer([]byte(`{"username": "billy", "email": "Bob@bobmail"}`)))
+	response = httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	var problem struct {
+		Code   string `json:"code"`
+		Errors []struct {
+			Code  string `json:"code"`
+			Field string `json:"field"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &problem)
+
+	if problem.Code != "VALIDATION_FAILED" || len(problem.Errors) != 7 || problem.Errors[0].Field != "/username" {
+		t.Logf("Expected USER_NOT_FOUND, got: %s", response.Body)
+		t.Fail()
+	}
+}
+
+func Test_Patch(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	user_db.SetUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "line 2": "Bobtown", "region": "Bobville", "country": "Bobland"}}`)
+
+	test_cases := []struct {
+		content_type  string
+		body          string
+		expected_code int
+		expected_user string
+	}{
+		// Clearing an optional field leaves the rest of the address alone
+		{
+			"application/merge-patch+json",
+			`{"fullname": "Robert Bobson", "address": {"line 2": null}}`,
+			200,
+			`{"username":"billy2000","fullname":"Robert Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`,
+		},
+		{
+			"application/json-patch+json",
+			`[{"op": "test", "path": "/fullname", "value": "Robert Bobson"}, {"op": "replace", "path": "/address/region", "value": "Robtown"}]`,
+			200,
+			`{"username":"billy2000","fullname":"Robert Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Robtown","country":"Bobland"}}`,
+		},
+		{"application/json-patch+json", `[{"op": "test", "path": "/fullname", "value": "Bob Bobson"}]`, 409, ""},
+		{"application/json-patch+json", `[{"op": "remove", "path": "/address/country"}]`, 400, ""},
+		{"application/merge-patch+json", `{"username": "billy3000"}`, 400, ""},
+		{"application/json", `{"fullname": "Robert Bobson"}`, 415, ""},
+	}
+
+	for _, test_case := range test_cases {
+		old_user := storedUser(user_db, "billy2000")
+
+		request, _ := http.NewRequest("PATCH", "/user/billy2000", bytes.NewBuffer([]byte(test_case.body)))
+		request.Header.Set("Content-Type", test_case.content_type)
+		response := httptest.NewRecorder()
+		Router(user_db).ServeHTTP(response, request)
+
+		if response.Code != test_case.expected_code {
+			t.Logf("%s\nExpected: %d\nGot %d: %s\n", test_case.body, test_case.expected_code, response.Code, response.Body)
+			t.Fail()
+		}
+
+		expected_user := test_case.expected_user
+		if expected_user == "" {
+			expected_user = old_user
+		}
+		if storedUser(user_db, "billy2000") != expected_user {
+			t.Logf("%s\nExpected: %s\nGot: %s\n", test_case.body, expected_user, storedUser(user_db, "billy2000"))
+			t.Fail()
+		}
+	}
+}
+
+func Test_EditReplacesUser(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	user_db.SetUser("billy2000", `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`)
+
+	// A partial document is no longer merged into the stored user
+	request, _ := http.NewRequest("PUT", "/user/billy2000", bytes.NewBuffer([]byte(`{"fullname": "Robert Newname"}`)))
+	response := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(response, request)
+
+	if response.Code != 400 {
+		t.Logf("Expected: %d\nGot %d\n", 400, response.Code)
+		t.Fail()
+	}
+}
+
+func Test_Expiry(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := Router(user_db)
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+
+	request, _ := http.NewRequest("POST", "/user", bytes.NewBuffer([]byte(strings.Replace(stored_user, `"username"`, `"permanent":true,"username"`, 1))))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	// Expiry members aren't stored with the user
+	if response.Code != 201 || storedUser(user_db, "billy2000") != stored_user {
+		t.Logf("Expected: %d %s\nGot: %d %s\n", 201, stored_user, response.Code, storedUser(user_db, "billy2000"))
+		t.Fail()
+	}
+
+	test_cases := []struct {
+		method              string
+		content_type        string
+		body                string
+		expected_code       int
+		expected_expires_in string
+	}{
+		{"GET", "", "", 200, "never"},
+		// A write without expiry members keeps the current expiry
+		{"PUT", "application/json", stored_user, 201, "never"},
+		{"PATCH", "application/merge-patch+json", `{"ttl_seconds": 3600}`, 200, "3600"},
+		{"PATCH", "application/merge-patch+json", `{"fullname": "Robert Bobson"}`, 200, "3600"},
+		{"PUT", "application/json", strings.Replace(stored_user, `"username"`, `"permanent":false,"username"`, 1), 201, "60"},
+		{"PUT", "application/json", strings.Replace(stored_user, `"username"`, `"permanent":true,"ttl_seconds":60,"username"`, 1), 400, "60"},
+	}
+
+	for _, test_case := range test_cases {
+		request, _ := http.NewRequest(test_case.method, "/user/billy2000", bytes.NewBuffer([]byte(test_case.body)))
+		request.Header.Set("Content-Type", test_case.content_type)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != test_case.expected_code {
+			t.Logf("%s %s\nExpected: %d\nGot: %d %s\n", test_case.method, test_case.body, test_case.expected_code, response.Code, response.Body)
+			t.Fail()
+		}
+
+		request, _ = http.NewRequest("GET", "/user/billy2000", nil)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if expires_in := response.Header().Get("User-Expires-In"); expires_in != test_case.expected_expires_in {
+			t.Logf("%s %s\nExpected: %s\nGot: %s\n", test_case.method, test_case.body, test_case.expected_expires_in, expires_in)
+			t.Fail()
+		}
+	}
+
+	request, _ = http.NewRequest("GET", "/user/billy2000", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	if response.Header().Get("User-Expires-At") == "" {
+		t.Logf("Expected an expiry time, got: %v", response.Header())
+		t.Fail()
+	}
+}
+
+func Test_Restore(t *testing.T) {
+	archive_dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(archive_dir)
+
+	archiver := archive.NewFileArchiver(archive_dir, false)
+	user_db := memstore.NewMemStore(60, 60, test_history, archiver)
+	router := archiveRouter(user_db, archiver)
+
+	older_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	newer_user := strings.Replace(older_user, "Bob Bobson", "Robert Bobson", 1)
+	archiver.Archive(archive.Record{Username: "billy2000", Data: older_user, ModifiedNanos: 1580428800000000000, ExpiredAt: time.Now()})
+	archiver.Archive(archive.Record{Username: "billy2000", Data: newer_user, ModifiedNanos: 1580428900000000000, ExpiredAt: time.Now()})
+	archiver.Archive(archive.Record{Username: "broken", Data: `{"username":"broken"}`, ModifiedNanos: 1580428800000000000, ExpiredAt: time.Now()})
+
+	request, _ := http.NewRequest("GET", "/archive/billy2000", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var listed archivedVersions
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	if response.Code != 200 || len(listed.Versions) != 2 || listed.Versions[0].ModifiedNanos != 1580428900000000000 {
+		t.Logf("Expected 2 versions newest first, got: %d %s", response.Code, response.Body)
+		t.Fail()
+	}
+
+	test_cases := []struct {
+		method        string
+		path          string
+		expected_code int
+		expected_user string
+	}{
+		{"GET", "/archive/nobody", 404, ""},
+		{"POST", "/users/nobody/restore", 404, ""},
+		{"POST", "/users/broken/restore", 400, ""},
+		{"POST", "/users/billy2000/restore?modified_nanos=bob", 400, ""},
+		{"POST", "/users/billy2000/restore?modified_nanos=1", 404, ""},
+		{"POST", "/users/billy2000/restore?modified_nanos=1580428800000000000", 201, older_user},
+		// The username is taken by the restored user
+		{"POST", "/users/billy2000/restore", 409, older_user},
+		// A soft deleted user keeps its username
+		{"DELETE", "/user/billy2000", 200, ""},
+		{"POST", "/users/billy2000/restore", 409, ""},
+		{"DELETE", "/user/billy2000?hard=true", 200, ""},
+		{"POST", "/users/billy2000/restore", 201, newer_user},
+	}
+
+	for _, test_case := range test_cases {
+		request, _ := http.NewRequest(test_case.method, test_case.path, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != test_case.expected_code || storedUser(user_db, "billy2000") != test_case.expected_user {
+			t.Logf("%s %s\nExpected: %d %s\nGot: %d %s\n", test_case.method, test_case.path, test_case.expected_code, test_case.expected_user, response.Code, storedUser(user_db, "billy2000"))
+			t.Fail()
+		}
+	}
+}
+
+func Test_SoftDelete(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := Router(user_db)
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	other_user := strings.Replace(stored_user, "billy2000", "billy3000", 1)
+	user_db.SetUser("billy2000", stored_user)
+
+	test_cases := []struct {
+		method        string
+		path          string
+		body          string
+		expected_code int
+		expected_user string
+	}{
+		{"DELETE", "/user/billy2000", "", 200, ""},
+		{"DELETE", "/user/billy2000", "", 404, ""},
+		// The username stays taken while the user is in the recycle bin
+		{"POST", "/user", stored_user, 409, ""},
+		{"POST", "/user/billy2000/undelete", "", 200, stored_user},
+		{"POST", "/user/billy2000/undelete", "", 404, stored_user},
+		// The email doesn't
+		{"DELETE", "/user/billy2000", "", 200, ""},
+		{"POST", "/user", other_user, 201, ""},
+		{"POST", "/user/billy2000/undelete", "", 409, ""},
+		{"DELETE", "/user/billy3000?hard=true", "", 200, ""},
+		{"POST", "/user/billy2000/undelete", "", 200, stored_user},
+		{"DELETE", "/user/billy2000?hard=true", "", 200, ""},
+		{"POST", "/user/billy2000/undelete", "", 404, ""},
+		{"DELETE", "/user/billy2000?hard=true", "", 404, ""},
+		{"POST", "/user", stored_user, 201, stored_user},
+		// Erasing a user in the recycle bin
+		{"DELETE", "/user/billy2000", "", 200, ""},
+		{"DELETE", "/user/billy2000?hard=true", "", 200, ""},
+		{"POST", "/user/billy2000/undelete", "", 404, ""},
+	}
+
+	for _, test_case := range test_cases {
+		request, _ := http.NewRequest(test_case.method, test_case.path, bytes.NewBuffer([]byte(test_case.body)))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != test_case.expected_code || storedUser(user_db, "billy2000") != test_case.expected_user {
+			t.Logf("%s %s\nExpected: %d %s\nGot: %d %s\n", test_case.method, test_case.path, test_case.expected_code, test_case.expected_user, response.Code, storedUser(user_db, "billy2000"))
+			t.Fail()
+		}
+	}
+
+	user_db.SetUser("billy2000", stored_user)
+	request, _ := http.NewRequest("DELETE", "/user/billy2000", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	// GET reports the deletion
+	request, _ = http.NewRequest("GET", "/user/billy2000", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var deleted_problem problem
+	json.Unmarshal(response.Body.Bytes(), &deleted_problem)
+	if response.Code != 404 || deleted_problem.Code != "USER_DELETED" || deleted_problem.Details["deleted_by"] != "192.0.2.1:1234" {
+		t.Logf("Expected a USER_DELETED problem, got: %d %s", response.Code, response.Body)
+		t.Fail()
+	}
+}
+
+func Test_Audit(t *testing.T) {
+	audit_log := audit.NewMemoryLog()
+	user_db := memstore.NewMemStore(60, 60, test_history, audit.NewArchiveRecorder(archive.NewFileArchiver(t.TempDir(), false), audit_log))
+	router := testRouter(user_db, nil, audit_log, nil, nil, nil)
+	router.Use(RequestID)
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	edited_user := strings.Replace(stored_user, "Bob Bobson", "Robert Bobson", 1)
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/user", stored_user},
+		{"PUT", "/user/billy2000", edited_user},
+		{"PATCH", "/user/billy2000", `[{"op":"replace","path":"/address/region","value":"Robville"}]`},
+		{"DELETE", "/user/billy2000", ""},
+		{"POST", "/user/billy2000/undelete", ""},
+		{"DELETE", "/user/billy2000?hard=true", ""},
+		// Failed requests aren't recorded
+		{"DELETE", "/user/billy2000", ""},
+	}
+
+	for _, test_request := range requests {
+		request, _ := http.NewRequest(test_request.method, test_request.path, bytes.NewBuffer([]byte(test_request.body)))
+		request.Header.Set("Content-Type", "application/json-patch+json")
+		request.RemoteAddr = "192.0.2.1:1234"
+		if test_request.method == "PUT" {
+			request.Header.Set("X-Request-ID", "edit-request")
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Header().Get("X-Request-ID") == "" {
+			t.Logf("%s %s\nExpected an X-Request-ID, got: %v", test_request.method, test_request.path, response.Header())
+			t.Fail()
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/user/billy2000/history", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var history auditEvents
+	json.Unmarshal(response.Body.Bytes(), &history)
+
+	expected_operations := []string{"create", "edit", "patch", "delete", "undelete", "hard_delete"}
+	if response.Code != 200 || len(history.Events) != len(expected_operations) || history.NextCursor != "" {
+		t.Logf("Expected %d events, got: %d %s", len(expected_operations), response.Code, response.Body)
+		t.FailNow()
+	}
+	for i, event := range history.Events {
+		if event.Operation != expected_operations[i] || event.ClientIP != "192.0.2.1" || event.RequestID == "" {
+			t.Logf("Expected a %s event from 192.0.2.1, got: %+v", expected_operations[i], event)
+			t.Fail()
+		}
+	}
+
+	edit := history.Events[1]
+	if edit.RequestID != "edit-request" || len(edit.Changes) != 1 || edit.Changes[0].Field != "/fullname" ||
+		string(edit.Changes[0].Before) != `"Bob Bobson"` || string(edit.Changes[0].After) != `"Robert Bobson"` {
+		t.Logf("Expected the edit to change /fullname, got: %+v", edit)
+		t.Fail()
+	}
+	if patch := history.Events[2]; len(patch.Changes) != 1 || patch.Changes[0].Field != "/address/region" {
+		t.Logf("Expected the patch to change /address/region, got: %+v", patch)
+		t.Fail()
+	}
+
+	// Paging
+	request, _ = http.NewRequest("GET", "/audit?limit=4&since=2000-01-01T00:00:00Z", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var first_page auditEvents
+	json.Unmarshal(response.Body.Bytes(), &first_page)
+	if response.Code != 200 || len(first_page.Events) != 4 || first_page.NextCursor != first_page.Events[3].ID {
+		t.Logf("Expected a page of 4 events, got: %d %s", response.Code, response.Body)
+		t.FailNow()
+	}
+
+	request, _ = http.NewRequest("GET", "/audit?limit=4&cursor="+first_page.NextCursor, nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var second_page auditEvents
+	json.Unmarshal(response.Body.Bytes(), &second_page)
+	if response.Code != 200 || len(second_page.Events) != 2 || second_page.NextCursor != "" || second_page.Events[0].Operation != "undelete" {
+		t.Logf("Expected the last 2 events, got: %d %s", response.Code, response.Body)
+		t.Fail()
+	}
+
+	for _, path := range []string{"/audit?cursor=bob", "/audit?since=yesterday", "/user/billy2000/history?limit=0"} {
+		request, _ = http.NewRequest("GET", path, nil)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != 400 {
+			t.Logf("GET %s\nExpected: 400\nGot: %d %s", path, response.Code, response.Body)
+			t.Fail()
+		}
+	}
+}
+
+func Test_Versions(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := Router(user_db)
+
+	first_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	second_user := strings.Replace(first_user, "Bob@bobmail.bob", "Robert@bobmail.bob", 1)
+	third_user := strings.Replace(second_user, "44 Bobstreet", "45 Bobstreet", 1)
+	user_db.SetUser("billy2000", first_user)
+	first_version, _ := user_db.GetUserVersions("billy2000")
+	time.Sleep(10 * time.Millisecond)
+	user_db.SetUser("billy2000", second_user)
+	user_db.SetUser("billy2000", third_user)
+
+	request, _ := http.NewRequest("GET", "/user/billy2000/versions", nil)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var listed userVersions
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	if response.Code != 200 || len(listed.Versions) != 3 || !listed.Versions[0].Current || listed.Versions[1].Current {
+		t.Logf("Expected 3 versions, the current first, got: %d %s", response.Code, response.Body)
+		t.FailNow()
+	}
+
+	as_of := first_version[0].ModifiedAt.Add(5 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	test_cases := []struct {
+		method        string
+		path          string
+		expected_code int
+		expected_body string
+	}{
+		{"GET", "/user/billy2000?version=" + listed.Versions[1].Version, 200, second_user},
+		{"GET", "/user/billy2000?as_of=" + as_of, 200, first_user},
+		{"GET", "/user/billy2000?as_of=2000-01-01T00:00:00Z", 404, ""},
+		{"GET", "/user/billy2000?as_of=yesterday", 400, ""},
+		{"GET", "/user/billy2000?version=12345", 404, ""},
+		{"GET", "/user/billy2000?version=1&as_of=2000-01-01T00:00:00Z", 400, ""},
+		{"GET", "/user/nobody/versions", 404, ""},
+		{"POST", "/user/billy2000/revert", 400, ""},
+		{"POST", "/user/billy2000/revert?version=12345", 404, ""},
+		{"POST", "/user/nobody/revert?version=1", 404, ""},
+		{"POST", "/user/billy2000/revert?as_of=" + as_of, 200, first_user},
+	}
+
+	for _, test_case := range test_cases {
+		request, _ := http.NewRequest(test_case.method, test_case.path, nil)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != test_case.expected_code || (test_case.expected_body != "" && response.Body.String() != test_case.expected_body) {
+			t.Logf("%s %s\nExpected: %d %s\nGot: %d %s\n", test_case.method, test_case.path, test_case.expected_code, test_case.expected_body, response.Code, response.Body)
+			t.Fail()
+		}
+	}
+
+	// Reverting stores the earlier version as the newest, keeping what it replaced
+	if current, _ := user_db.GetUser("billy2000"); current != first_user {
+		t.Logf("Expected the user to be reverted, got: %s", current)
+		t.Fail()
+	}
+	if user_versions, _ := user_db.GetUserVersions("billy2000"); len(user_versions) != 3 || user_versions[1].Data != third_user {
+		t.Logf("Expected the reverted version to be kept, got: %+v", user_versions)
+		t.Fail()
+	}
+
+	// Reverting honours If-Match, and the earlier email must still be free
+	request, _ = http.NewRequest("POST", "/user/billy2000/revert?version="+listed.Versions[0].Version, nil)
+	request.Header.Set("If-Match", `"12345"`)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != 412 {
+		t.Logf("Expected 412, got: %d %s", response.Code, response.Body)
+		t.Fail()
+	}
+
+	user_db.SetUser("billy3000", strings.Replace(third_user, "billy2000", "billy3000", 1))
+	request, _ = http.NewRequest("POST", "/user/billy2000/revert?version="+listed.Versions[0].Version, nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != 409 {
+		t.Logf("Expected 409, got: %d %s", response.Code, response.Body)
 		t.Fail()
 	}
 }
+
+// publishedEvents keeps the events published to it
+type publishedEvents struct {
+	events *[]events.Event
+}
+
+func (published publishedEvents) Publish(event events.Event) error {
+	*published.events = append(*published.events, event)
+	return nil
+}
+
+func Test_Events(t *testing.T) {
+	published := publishedEvents{&[]events.Event{}}
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := testRouter(user_db, nil, nil, published, nil, nil)
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	edited_user := strings.Replace(stored_user, "Bob@bobmail.bob", "Robert@bobmail.bob", 1)
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/user", stored_user},
+		{"PUT", "/user/billy2000", edited_user},
+		{"DELETE", "/user/billy2000", ""},
+		{"POST", "/user/billy2000/undelete", ""},
+		{"DELETE", "/user/billy2000", ""},
+		// Erasing the deleted user isn't another deletion
+		{"DELETE", "/user/billy2000?hard=true", ""},
+		// Failed requests publish nothing
+		{"PUT", "/user/billy2000", edited_user},
+	}
+
+	for _, test_request := range requests {
+		request, _ := http.NewRequest(test_request.method, test_request.path, bytes.NewBuffer([]byte(test_request.body)))
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	expected_types := []string{events.TypeCreated, events.TypeUpdated, events.TypeDeleted, events.TypeCreated, events.TypeDeleted}
+	if len(*published.events) != len(expected_types) {
+		t.Logf("Expected %d events, got: %+v", len(expected_types), *published.events)
+		t.FailNow()
+	}
+	for i, event := range *published.events {
+		if event.Type != expected_types[i] || event.Username != "billy2000" || event.ID == "" || len(event.User) == 0 {
+			t.Logf("Expected a %s event for billy2000, got: %+v", expected_types[i], event)
+			t.Fail()
+		}
+	}
+
+	updated := (*published.events)[1]
+	if string(updated.User) != edited_user || len(updated.Changes) != 1 || updated.Changes[0].Field != "/email" {
+		t.Logf("Expected the update to change /email, got: %+v", updated)
+		t.Fail()
+	}
+	if deleted := (*published.events)[2]; string(deleted.User) != edited_user {
+		t.Logf("Expected the deleted user, got: %s", deleted.User)
+		t.Fail()
+	}
+}
+
+func Test_Webhooks(t *testing.T) {
+	received := make(chan string, 10)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Webhook-Event")
+	}))
+	defer subscriber.Close()
+
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	publisher := events.NewWebhookPublisher(user_db, 1, time.Millisecond)
+	router := testRouter(user_db, nil, nil, publisher, nil, nil)
+
+	invalid := map[string]string{
+		`{"url": "ftp://example.com/"}`:                              "INVALID_WEBHOOK_URL",
+		`{"url": "/relative"}`:                                       "INVALID_WEBHOOK_URL",
+		`{"url": "https://example.com/", "types": ["user.renamed"]}`: "INVALID_EVENT_TYPE",
+		`{"url": "https://example.com/", "types": "user.created"}`:   "BAD_REQUEST",
+	}
+	for body, code := range invalid {
+		request, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(body)))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), code) {
+			t.Logf("Expected 400 %s for %s, got %d: %s", code, body, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	request, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(`{"url": "`+subscriber.URL+`", "types": ["user.created", "user.created"]}`)))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var created webhook
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if response.Code != http.StatusCreated || created.ID == "" || created.Secret == "" || len(created.Types) != 1 || response.Header().Get("Location") != "/webhooks/"+created.ID {
+		t.Logf("Expected a created webhook with a secret, got %d: %s", response.Code, response.Body.String())
+		t.FailNow()
+	}
+
+	// Secrets are never shown again
+	for _, path := range []string{"/webhooks", "/webhooks/" + created.ID} {
+		request, _ = http.NewRequest("GET", path, nil)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), created.ID) || strings.Contains(response.Body.String(), created.Secret) {
+			t.Logf("Expected the webhook without its secret from %s, got %d: %s", path, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	// Only subscribed types are delivered, and every attempt is recorded
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	request, _ = http.NewRequest("POST", "/user", bytes.NewBuffer([]byte(stored_user)))
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	request, _ = http.NewRequest("PUT", "/user/billy2000", bytes.NewBuffer([]byte(strings.Replace(stored_user, "Bob@", "Robert@", 1))))
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	publisher.Wait()
+	if len(received) != 1 || <-received != events.TypeCreated {
+		t.Logf("Expected only user.created to be delivered, got %d deliveries", len(received))
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("GET", "/webhooks/"+created.ID+"/deliveries", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var deliveries webhookDeliveries
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if response.Code != http.StatusOK || len(deliveries.Deliveries) != 1 || !deliveries.Deliveries[0].Delivered || deliveries.Deliveries[0].StatusCode != http.StatusOK {
+		t.Logf("Expected one successful delivery, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("POST", "/webhooks/"+created.ID+"/rotate-secret", nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+
+	var rotated webhook
+	json.Unmarshal(response.Body.Bytes(), &rotated)
+	if response.Code != http.StatusOK || rotated.Secret == "" || rotated.Secret == created.Secret || rotated.PreviousSecretExpires == nil {
+		t.Logf("Expected a new secret, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if subscription, _ := user_db.GetSubscription(created.ID); subscription.Secret != rotated.Secret || subscription.PreviousSecret != created.Secret {
+		t.Logf("Expected the rotated secret to be stored, got: %+v", subscription)
+		t.Fail()
+	}
+
+	request, _ = http.NewRequest("DELETE", "/webhooks/"+created.ID, nil)
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Logf("Expected 204, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	for _, path := range []string{"/webhooks/" + created.ID, "/webhooks/" + created.ID + "/deliveries"} {
+		request, _ = http.NewRequest("GET", path, nil)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "WEBHOOK_NOT_FOUND") {
+			t.Logf("Expected 404 WEBHOOK_NOT_FOUND from %s, got %d: %s", path, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+// readSSE reads the next event from a Server-Sent Events stream, skipping comments
+func readSSE(reader *bufio.Reader) (map[string]string, error) {
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fields, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			return fields, nil
+		}
+		if parts := strings.SplitN(line, ": ", 2); len(parts) == 2 && parts[0] != "" {
+			fields[parts[0]] = parts[1]
+		}
+	}
+}
+
+func Test_StreamEvents(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	stream := events.NewMemoryStream(100)
+	follower := events.NewFollower(stream)
+	defer follower.Close()
+
+	server := httptest.NewServer(testRouter(user_db, nil, nil, stream, follower, nil))
+	defer server.Close()
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	change := func(method string, path string, body string) {
+		request, _ := http.NewRequest(method, server.URL+path, bytes.NewBuffer([]byte(body)))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	for query, code := range map[string]string{"?types=user.renamed": "INVALID_EVENT_TYPE", "?last_event_id=latest": "INVALID_EVENT_ID"} {
+		response, err := http.Get(server.URL + "/users/events" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), code) {
+			t.Logf("Expected 400 %s for %s, got %d: %s", code, query, response.StatusCode, body)
+			t.Fail()
+		}
+	}
+
+	response, err := http.Get(server.URL + "/users/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Logf("Expected an event stream, got: %v", response.Header)
+		t.Fail()
+	}
+	// Waiting for the listener to be registered, as it only gets events from then on
+	time.Sleep(50 * time.Millisecond)
+
+	change("POST", "/user", stored_user)
+	change("PUT", "/user/billy2000", strings.Replace(stored_user, "Bob@", "Robert@", 1))
+	change("DELETE", "/user/billy2000", "")
+
+	reader := bufio.NewReader(response.Body)
+	ids := []string{}
+	for _, event_type := range []string{events.TypeCreated, events.TypeUpdated, events.TypeDeleted} {
+		fields, err := readSSE(reader)
+		var event events.Event
+		json.Unmarshal([]byte(fields["data"]), &event)
+		if err != nil || fields["event"] != event_type || fields["id"] == "" || event.Type != event_type || event.Username != "billy2000" {
+			t.Logf("Expected a %s event, got: %v (err: %v)", event_type, fields, err)
+			t.FailNow()
+		}
+		ids = append(ids, fields["id"])
+	}
+
+	// Reconnecting resumes after the last event received, with only the types asked for
+	request, _ := http.NewRequest("GET", server.URL+"/users/events?types=user.deleted", nil)
+	request.Header.Set("Last-Event-ID", ids[0])
+	resumed, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+
+	fields, err := readSSE(bufio.NewReader(resumed.Body))
+	if err != nil || fields["id"] != ids[2] || fields["event"] != events.TypeDeleted {
+		t.Logf("Expected the missed deletion, got: %v (err: %v)", fields, err)
+		t.Fail()
+	}
+
+	// The WebSocket variant sends the same events as JSON messages
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/users/events?last_event_id="+ids[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var streamed_event events.StreamedEvent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err = conn.ReadJSON(&streamed_event); err != nil || streamed_event.StreamID != ids[2] || streamed_event.Event.Type != events.TypeDeleted {
+		t.Logf("Expected the deletion over the WebSocket, got: %+v (err: %v)", streamed_event, err)
+		t.Fail()
+	}
+
+	// Without a listener there's nothing to stream
+	request, _ = http.NewRequest("GET", "/users/events", nil)
+	recorder := httptest.NewRecorder()
+	Router(user_db).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), "STREAMING_DISABLED") {
+		t.Logf("Expected 404 STREAMING_DISABLED, got %d: %s", recorder.Code, recorder.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_Auth(t *testing.T) {
+	keys := auth.NewMemoryKeyStore()
+	admin_plaintext, admin_key := auth.NewKey("admin", []string{auth.RoleAdmin})
+	keys.CreateKey(admin_key)
+	reader_plaintext, reader_key := auth.NewKey("reader", nil)
+	keys.CreateKey(reader_key)
+
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	audit_log := audit.NewMemoryLog()
+	router := testRouter(user_db, nil, audit_log, nil, nil, keys)
+	router.Use(Authenticate(auth.NewAuthenticator(keys, auth.JWTVerifier{}, auth.Sessions{})))
+
+	send := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	unauthenticated := map[string]string{"": "UNAUTHENTICATED", "uk_guess": "INVALID_CREDENTIALS"}
+	for key, code := range unauthenticated {
+		response := send("GET", "/users", key, "")
+		if response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), code) || response.Header().Get("WWW-Authenticate") == "" {
+			t.Logf("Expected 401 %s with %q, got %d: %s", code, key, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	// Changes are recorded as made by the principal
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	if response := send("POST", "/user", admin_plaintext, stored_user); response.Code != http.StatusCreated {
+		t.Logf("Expected the user to be created, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	history, _ := audit_log.History("billy2000", "", 10)
+	if len(history) != 1 || history[0].Actor != "api_key:admin" {
+		t.Logf("Expected the change to be made by api_key:admin, got: %+v", history)
+		t.Fail()
+	}
+
+	// Only admins manage keys
+	for _, request := range [][]string{{"POST", "/api-keys"}, {"GET", "/api-keys"}, {"DELETE", "/api-keys/" + admin_key.ID}} {
+		if response := send(request[0], request[1], reader_plaintext, `{"name": "mine"}`); response.Code != http.StatusForbidden || !strings.Contains(response.Body.String(), "INSUFFICIENT_SCOPE") {
+			t.Logf("Expected 403 for %s %s, got %d: %s", request[0], request[1], response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	invalid := map[string]string{
+		`{"name": ""}`: "INVALID_KEY_NAME",
+		`{"name": "` + strings.Repeat("a", 65) + `"}`: "INVALID_KEY_NAME",
+		`{"name": "reports", "roles": [""]}`:          "INVALID_ROLE",
+	}
+	for body, code := range invalid {
+		if response := send("POST", "/api-keys", admin_plaintext, body); response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), code) {
+			t.Logf("Expected 400 %s for %s, got %d: %s", code, body, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	response := send("POST", "/api-keys", admin_plaintext, `{"name": "reports", "roles": ["auditor", "auditor"]}`)
+	var created apiKey
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if response.Code != http.StatusCreated || created.Key == "" || len(created.Roles) != 1 || response.Header().Get("Location") != "/api-keys/"+created.ID {
+		t.Logf("Expected a created key, got %d: %s", response.Code, response.Body.String())
+		t.FailNow()
+	}
+	if response = send("GET", "/api-keys", created.Key, ""); response.Code != http.StatusForbidden {
+		t.Logf("Expected the created key to authenticate, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Neither keys nor their hashes are listed
+	response = send("GET", "/api-keys", admin_plaintext, "")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), created.ID) || strings.Contains(response.Body.String(), created.Key) || strings.Contains(response.Body.String(), auth.HashKey(created.Key)) {
+		t.Logf("Expected the keys without secrets, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	if response = send("DELETE", "/api-keys/"+created.ID, admin_plaintext, ""); response.Code != http.StatusNoContent {
+		t.Logf("Expected the key to be deleted, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = send("GET", "/users", created.Key, ""); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected a deleted key to be rejected, got %d", response.Code)
+		t.Fail()
+	}
+	if response = send("DELETE", "/api-keys/"+created.ID, admin_plaintext, ""); response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "API_KEY_NOT_FOUND") {
+		t.Logf("Expected 404 API_KEY_NOT_FOUND, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_Authorization(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	router := testRouter(user_db, nil, nil, nil, nil, auth.NewMemoryKeyStore())
+
+	billy := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	alice := strings.Replace(strings.Replace(billy, "billy2000", "alice2000", 1), "Bob@", "Alice@", 1)
+	admin := auth.Principal{Subject: "ops", Method: auth.MethodJWT, Roles: []string{auth.RoleAdmin}}
+	// No roles, so the default user role
+	user := auth.Principal{Subject: "billy2000", Method: auth.MethodJWT}
+	guest := auth.Principal{Subject: "billy2000", Method: auth.MethodJWT, Roles: []string{"guest"}}
+
+	requests := []struct {
+		principal auth.Principal
+		method    string
+		path      string
+		body      string
+		status    int
+		scope     string
+	}{
+		{user, "POST", "/user", billy, http.StatusCreated, ""},
+		{user, "POST", "/user", alice, http.StatusForbidden, auth.ScopeUsersAdmin},
+		{admin, "POST", "/user", alice, http.StatusCreated, ""},
+		{user, "GET", "/user/billy2000", "", http.StatusOK, ""},
+		{user, "GET", "/user/billy2000/history", "", http.StatusOK, ""},
+		{user, "PUT", "/user/billy2000", strings.Replace(billy, "Bob@", "Robert@", 1), http.StatusCreated, ""},
+		{user, "GET", "/user/alice2000", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "PUT", "/user/alice2000", alice, http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "DELETE", "/user/alice2000", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "GET", "/users", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "GET", "/audit", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "GET", "/webhooks", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{user, "DELETE", "/user/billy2000?hard=true", "", http.StatusForbidden, auth.ScopeUsersAdmin},
+		{guest, "GET", "/user/billy2000", "", http.StatusForbidden, auth.ScopeUsersRead},
+		{admin, "GET", "/user/billy2000", "", http.StatusOK, ""},
+		{admin, "GET", "/users", "", http.StatusOK, ""},
+		{user, "DELETE", "/user/billy2000", "", http.StatusOK, ""},
+		{user, "POST", "/user/billy2000/undelete", "", http.StatusOK, ""},
+		{admin, "DELETE", "/user/alice2000?hard=true", "", http.StatusOK, ""},
+	}
+
+	for _, test_request := range requests {
+		request, _ := http.NewRequest(test_request.method, test_request.path, bytes.NewBuffer([]byte(test_request.body)))
+		request = request.WithContext(auth.WithPrincipal(request.Context(), test_request.principal))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		if response.Code != test_request.status || !strings.Contains(response.Body.String(), test_request.scope) {
+			t.Logf("Expected %d %s for %s %s by %+v, got %d: %s", test_request.status, test_request.scope, test_request.method, test_request.path, test_request.principal, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func Test_Passwords(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	sessions := auth.NewSessions("session secret", time.Hour, auth.NewMemorySessionStore())
+	handler := NewHandler(user_db, nil, audit.NewMemoryLog(), nil, nil, nil, auth.DefaultPolicy(), sessions, nil, auth.Tokens{}, nil)
+
+	// Laid out like cmd/userapi, logins being the only route without credentials
+	router := mux.NewRouter()
+	router.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	api := router.PathPrefix("/").Subrouter()
+	api.Use(Authenticate(auth.NewAuthenticator(nil, auth.JWTVerifier{}, sessions)))
+	api.HandleFunc("/user/{username}", handler.GetUser).Methods(http.MethodGet)
+	api.HandleFunc("/user/{username}", handler.EditUser).Methods(http.MethodPut)
+	api.HandleFunc("/user/{username}", handler.DeleteUser).Methods(http.MethodDelete)
+	api.HandleFunc("/user/{username}/password", handler.ChangePassword).Methods(http.MethodPost)
+
+	send := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	login := func(username string, password string) (session, *httptest.ResponseRecorder) {
+		var logged_in session
+		response := send("POST", "/login", "", `{"username": "`+username+`", "password": "`+password+`"}`)
+		json.Unmarshal(response.Body.Bytes(), &logged_in)
+		return logged_in, response
+	}
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	create := func(user_json string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/user", bytes.NewBuffer([]byte(user_json)))
+		response := httptest.NewRecorder()
+		handler.CreateUser(response, request)
+		return response
+	}
+
+	if response := create(strings.Replace(stored_user, `{"username"`, `{"password":"short","username"`, 1)); response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "PASSWORD_TOO_SHORT") {
+		t.Logf("Expected 400 PASSWORD_TOO_SHORT, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response := create(strings.Replace(stored_user, `{"username"`, `{"password":"correct horse battery","username"`, 1)); response.Code != http.StatusCreated {
+		t.Logf("Expected the user to be created, got %d: %s", response.Code, response.Body.String())
+		t.FailNow()
+	}
+
+	// The password is kept apart from the user, hashed
+	hash, _ := user_db.GetPasswordHash("billy2000")
+	if stored := storedUser(user_db, "billy2000"); stored != stored_user || !strings.HasPrefix(hash, "$argon2id$") {
+		t.Logf("Expected the user without its password and a hash, got: %s %s", stored, hash)
+		t.Fail()
+	}
+
+	// A password member in another case is still taken out and hashed
+	alice_user := strings.Replace(strings.Replace(stored_user, "billy2000", "alice2000", 1), "Bob@bobmail.bob", "alice@alicemail.com", 1)
+	create(strings.Replace(alice_user, `{"username"`, `{"Password":"alice horse battery","username"`, 1))
+	alice_hash, _ := user_db.GetPasswordHash("alice2000")
+	if stored := storedUser(user_db, "alice2000"); stored != alice_user || !strings.HasPrefix(alice_hash, "$argon2id$") {
+		t.Logf("Expected the user without its Password and a hash, got: %s %s", stored, alice_hash)
+		t.Fail()
+	}
+
+	failed := map[string]string{"billy2000": "wrong horse battery", "nobody2000": "correct horse battery"}
+	for username, password := range failed {
+		if _, response := login(username, password); response.Code != http.StatusUnauthorized || !strings.Contains(response.Body.String(), "LOGIN_FAILED") {
+			t.Logf("Expected 401 LOGIN_FAILED for %s, got %d: %s", username, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	logged_in, response := login("Billy2000", "correct horse battery")
+	if response.Code != http.StatusOK || logged_in.Token == "" || logged_in.TokenType != "Bearer" || !logged_in.ExpiresAt.After(time.Now()) {
+		t.Logf("Expected a session, got %d: %s", response.Code, response.Body.String())
+		t.FailNow()
+	}
+	if response = send("GET", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusOK || strings.Contains(response.Body.String(), "password") {
+		t.Logf("Expected the session to read its own user without a password, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = send("PUT", "/user/billy2000", logged_in.Token, strings.Replace(stored_user, `{"username"`, `{"password":"correct horse battery","username"`, 1)); response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "PASSWORD_NOT_EDITABLE") {
+		t.Logf("Expected 400 PASSWORD_NOT_EDITABLE, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	changes := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"current_password": "wrong horse battery", "password": "new horse battery"}`, http.StatusForbidden, "CURRENT_PASSWORD_INVALID"},
+		{`{"password": "new horse battery"}`, http.StatusForbidden, "CURRENT_PASSWORD_INVALID"},
+		{`{"current_password": "correct horse battery", "password": "billy2000 horse"}`, http.StatusBadRequest, "PASSWORD_IS_USERNAME"},
+		{`{"current_password": "correct horse battery", "password": "new horse battery"}`, http.StatusNoContent, ""},
+	}
+	for _, change := range changes {
+		if response = send("POST", "/user/billy2000/password", logged_in.Token, change.body); response.Code != change.status || !strings.Contains(response.Body.String(), change.code) {
+			t.Logf("Expected %d %s for %s, got %d: %s", change.status, change.code, change.body, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	if _, response = login("billy2000", "correct horse battery"); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected the old password to be rejected, got %d", response.Code)
+		t.Fail()
+	}
+	// Changing the password logs out every session
+	if response = send("GET", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected the session from before the change to be revoked, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	logged_in, response = login("billy2000", "new horse battery")
+	if response.Code != http.StatusOK {
+		t.Logf("Expected the new password to log in, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// So does deleting the user
+	if response = send("DELETE", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusOK {
+		t.Logf("Expected the session to delete its own user, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = send("GET", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected the deleted user's session to be revoked, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Nor do the sessions of a user which expired authenticate as another user of the same name
+	user_db.DeleteUser("billy2000")
+	create(strings.Replace(stored_user, `{"username"`, `{"password":"new horse battery","username"`, 1))
+	logged_in, _ = login("billy2000", "new horse battery")
+	// Creating a user whose username is taken leaves the existing user's sessions alone
+	if response = create(stored_user); response.Code != http.StatusConflict {
+		t.Logf("Expected 409 for a taken username, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = send("GET", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusOK {
+		t.Logf("Expected the existing user's session to stay valid, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	user_db.DeleteUser("billy2000")
+	create(stored_user)
+	if response = send("GET", "/user/billy2000", logged_in.Token, ""); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected the session of the earlier user to be revoked, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Recreating a user without a password doesn't inherit the old one
+	if _, response = login("billy2000", "new horse battery"); response.Code != http.StatusUnauthorized {
+		t.Logf("Expected a recreated user to have no password, got %d", response.Code)
+		t.Fail()
+	}
+
+	// Without a session secret there are no logins
+	disabled := NewHandler(user_db, nil, nil, nil, nil, nil, auth.DefaultPolicy(), auth.Sessions{}, nil, auth.Tokens{}, nil)
+	request, _ := http.NewRequest("POST", "/login", bytes.NewBuffer([]byte(`{"username": "billy2000", "password": "new horse battery"}`)))
+	response = httptest.NewRecorder()
+	disabled.Login(response, request)
+	if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "LOGIN_DISABLED") {
+		t.Logf("Expected 404 LOGIN_DISABLED, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_TrustProxies(t *testing.T) {
+	_, ingress, _ := net.ParseCIDR("10.0.0.0/8")
+	var client_ip string
+	trusting := TrustProxies([]*net.IPNet{ingress})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client_ip = clientIP(r)
+	}))
+
+	requests := []struct {
+		remote_addr string
+		forwarded   []string
+		client_ip   string
+	}{
+		{"10.0.0.1:4000", []string{"192.0.2.1"}, "192.0.2.1"},
+		// Addresses sent by the client before the one the proxies added aren't trusted
+		{"10.0.0.1:4000", []string{"203.0.113.9, 192.0.2.1, 10.0.0.2"}, "192.0.2.1"},
+		{"10.0.0.1:4000", []string{"203.0.113.9", "192.0.2.1"}, "192.0.2.1"},
+		{"10.0.0.1:4000", []string{"not an address"}, "10.0.0.1"},
+		{"10.0.0.1:4000", nil, "10.0.0.1"},
+		// Nor is X-Forwarded-For from anyone but the proxies
+		{"192.0.2.1:4000", []string{"203.0.113.9"}, "192.0.2.1"},
+	}
+	for _, test_request := range requests {
+		request, _ := http.NewRequest("POST", "/login", nil)
+		request.RemoteAddr = test_request.remote_addr
+		for _, forwarded := range test_request.forwarded {
+			request.Header.Add("X-Forwarded-For", forwarded)
+		}
+		trusting.ServeHTTP(httptest.NewRecorder(), request)
+
+		if client_ip != test_request.client_ip {
+			t.Logf("Expected %s from %s forwarding %v, got %s", test_request.client_ip, test_request.remote_addr, test_request.forwarded, client_ip)
+			t.Fail()
+		}
+	}
+}
+
+func Test_Lockout(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	policy := auth.LockoutPolicy{UserFailures: 3, IPFailures: 5, Window: time.Minute, Duration: time.Minute}
+	handler := NewHandler(user_db, nil, audit.NewMemoryLog(), nil, nil, nil, auth.DefaultPolicy(), auth.NewSessions("session secret", time.Hour, nil), auth.NewMemoryLockout(policy), auth.Tokens{}, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	router.HandleFunc("/user/{username}/unlock", handler.UnlockUser).Methods(http.MethodPost)
+
+	user_db.CreateUser("billy2000", `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`, validation.Expiry{})
+	user_db.SetPasswordHash("billy2000", auth.HashPassword("correct horse battery"))
+
+	login := func(username string, password string, ip string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/login", bytes.NewBuffer([]byte(`{"username": "`+username+`", "password": "`+password+`"}`)))
+		request.RemoteAddr = ip + ":4000"
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	unlock := func(principal auth.Principal) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", "/user/billy2000/unlock", nil)
+		request = request.WithContext(auth.WithPrincipal(request.Context(), principal))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	for i := 0; i < policy.UserFailures; i++ {
+		if response := login("billy2000", "wrong horse battery", "10.0.0.1"); response.Code != http.StatusUnauthorized {
+			t.Logf("Expected failure %d to be 401, got %d: %s", i+1, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+
+	// Locked out even with the right password, from any address
+	response := login("billy2000", "correct horse battery", "10.0.0.2")
+	if response.Code != http.StatusTooManyRequests || !strings.Contains(response.Body.String(), "LOGIN_LOCKED") || response.Header().Get("Retry-After") != "60" {
+		t.Logf("Expected 429 LOGIN_LOCKED with Retry-After: 60, got %d %s: %s", response.Code, response.Header().Get("Retry-After"), response.Body.String())
+		t.Fail()
+	}
+
+	if response = unlock(auth.Principal{Subject: "billy2000", Method: auth.MethodJWT}); response.Code != http.StatusForbidden {
+		t.Logf("Expected a user to be refused unlocking themself, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = unlock(auth.Principal{Subject: "ops", Method: auth.MethodJWT, Roles: []string{auth.RoleAdmin}}); response.Code != http.StatusNoContent {
+		t.Logf("Expected an admin to unlock the user, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = login("billy2000", "correct horse battery", "10.0.0.2"); response.Code != http.StatusOK {
+		t.Logf("Expected the unlocked user to log in, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Failures across usernames lock out the address, but not the usernames elsewhere
+	for i := 0; i < policy.IPFailures; i++ {
+		login("nobody"+strconv.Itoa(i), "wrong horse battery", "10.0.0.3")
+	}
+	if response = login("billy2000", "correct horse battery", "10.0.0.3"); response.Code != http.StatusTooManyRequests {
+		t.Logf("Expected the address to be locked out, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response = login("billy2000", "correct horse battery", "10.0.0.4"); response.Code != http.StatusOK {
+		t.Logf("Expected another address to log in, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	disabled := NewHandler(user_db, nil, nil, nil, nil, nil, auth.DefaultPolicy(), auth.Sessions{}, nil, auth.Tokens{}, nil)
+	request, _ := http.NewRequest("POST", "/user/billy2000/unlock", nil)
+	response = httptest.NewRecorder()
+	disabled.UnlockUser(response, request)
+	if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "LOCKOUT_DISABLED") {
+		t.Logf("Expected 404 LOCKOUT_DISABLED, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+}
+
+// sentMail is a mailer.Mailer keeping what it's sent instead
+type sentMail struct {
+	messages *[]mailer.Message
+}
+
+func (sent sentMail) Send(message mailer.Message) error {
+	*sent.messages = append(*sent.messages, message)
+	return nil
+}
+
+// mailedToken returns the token in the last email sent, on the line after the first blank one
+func (sent sentMail) mailedToken() string {
+	if len(*sent.messages) == 0 {
+		return ""
+	}
+	body := (*sent.messages)[len(*sent.messages)-1].Body
+
+	return strings.SplitN(strings.SplitN(body, "\n\n", 2)[1], "\n", 2)[0]
+}
+
+func Test_EmailTokens(t *testing.T) {
+	user_db := memstore.NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	sent := sentMail{&[]mailer.Message{}}
+	tokens := auth.NewTokens("token secret", time.Hour, auth.NewMemoryTokenStore())
+	sessions := auth.NewSessions("session secret", time.Hour, nil)
+	handler := NewHandler(user_db, nil, audit.NewMemoryLog(), nil, nil, nil, auth.DefaultPolicy(), sessions, nil, tokens, sent)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	router.HandleFunc("/verify-email", handler.VerifyEmail).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset", handler.RequestPasswordReset).Methods(http.MethodPost)
+	router.HandleFunc("/password-reset/confirm", handler.ResetPassword).Methods(http.MethodPost)
+	router.HandleFunc("/user", handler.CreateUser).Methods(http.MethodPost)
+	router.HandleFunc("/user/{username}", handler.EditUser).Methods(http.MethodPut)
+	router.HandleFunc("/user/{username}", handler.PatchUser).Methods(http.MethodPatch)
+	router.HandleFunc("/user/{username}/verify-email", handler.RequestEmailVerification).Methods(http.MethodPost)
+
+	user := auth.Principal{Subject: "billy2000", Method: auth.MethodSession}
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		request = request.WithContext(auth.WithPrincipal(request.Context(), user))
+		if method == http.MethodPatch {
+			request.Header.Set("Content-Type", mergePatchContentType)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	stored_user := `{"username":"billy2000","fullname":"Bob Bobson","email":"Bob@bobmail.bob","address":{"name":"Bob","line 1":"44 Bobstreet","region":"Bobville","country":"Bobland"}}`
+	// Users can't verify their own email
+	if response := send("POST", "/user", strings.Replace(stored_user, `{"username"`, `{"verified_email":true,"Verified_Email":true,"username"`, 1)); response.Code != http.StatusCreated {
+		t.Logf("Expected the user to be created, got %d: %s", response.Code, response.Body.String())
+		t.FailNow()
+	}
+	if stored := storedUser(user_db, "billy2000"); stored != stored_user {
+		t.Logf("Expected the user stored unverified, got: %s", stored)
+		t.Fail()
+	}
+
+	// Resets are only sent to verified emails
+	if response := send("POST", "/password-reset", `{"email": "Bob@bobmail.bob"}`); response.Code != http.StatusAccepted || len(*sent.messages) != 0 {
+		t.Logf("Expected 202 and no email for an unverified email, got %d and %d emails", response.Code, len(*sent.messages))
+		t.Fail()
+	}
+
+	if response := send("POST", "/user/billy2000/verify-email", ""); response.Code != http.StatusAccepted || len(*sent.messages) != 1 || (*sent.messages)[0].To != "Bob@bobmail.bob" {
+		t.Logf("Expected a verification email to Bob@bobmail.bob, got %d: %+v", response.Code, *sent.messages)
+		t.FailNow()
+	}
+	token := sent.mailedToken()
+
+	verifications := []struct {
+		token  string
+		status int
+		code   string
+	}{
+		{"not.a token", http.StatusBadRequest, "TOKEN_INVALID"},
+		{token, http.StatusNoContent, ""},
+		{token, http.StatusBadRequest, "TOKEN_INVALID"},
+	}
+	for _, verification := range verifications {
+		if response := send("POST", "/verify-email", `{"token": "`+verification.token+`"}`); response.Code != verification.status || !strings.Contains(response.Body.String(), verification.code) {
+			t.Logf("Expected %d %s for %s, got %d: %s", verification.status, verification.code, verification.token, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+	if stored := storedUser(user_db, "billy2000"); !validation.EmailVerified(stored) {
+		t.Logf("Expected the email to be verified, got: %s", stored)
+		t.Fail()
+	}
+	if response := send("POST", "/user/billy2000/verify-email", ""); response.Code != http.StatusConflict || !strings.Contains(response.Body.String(), "EMAIL_ALREADY_VERIFIED") {
+		t.Logf("Expected 409 EMAIL_ALREADY_VERIFIED, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Edits keep the verification until they change the email
+	if response := send("PUT", "/user/billy2000", strings.Replace(strings.Replace(stored_user, "Bob@bobmail.bob", "bobby@bobmail.bob", 1), `{"username"`, `{"VERIFIED_EMAIL":true,"username"`, 1)); response.Code != http.StatusCreated || validation.EmailVerified(storedUser(user_db, "billy2000")) {
+		t.Logf("Expected changing the email to unverify it whatever the body says, got %d: %s", response.Code, storedUser(user_db, "billy2000"))
+		t.Fail()
+	}
+	send("PUT", "/user/billy2000", stored_user)
+	send("POST", "/user/billy2000/verify-email", "")
+	send("POST", "/verify-email", `{"token": "`+sent.mailedToken()+`"}`)
+	if response := send("PUT", "/user/billy2000", strings.Replace(stored_user, "Bob Bobson", "Robert Bobson", 1)); response.Code != http.StatusCreated || !validation.EmailVerified(storedUser(user_db, "billy2000")) {
+		t.Logf("Expected an edit keeping the email to stay verified, got %d: %s", response.Code, storedUser(user_db, "billy2000"))
+		t.Fail()
+	}
+
+	// Resetting the password
+	sent_before := len(*sent.messages)
+	send("POST", "/password-reset", `{"email": "Bob@bobmail.bob"}`)
+	if len(*sent.messages) != sent_before+1 || (*sent.messages)[sent_before].Subject != "Reset your password" {
+		t.Logf("Expected a reset email, got: %+v", *sent.messages)
+		t.FailNow()
+	}
+	token = sent.mailedToken()
+	resets := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"token": "` + token + `", "password": "short"}`, http.StatusBadRequest, "PASSWORD_TOO_SHORT"},
+		{`{"token": "` + token + `", "password": "reset horse battery"}`, http.StatusNoContent, ""},
+		{`{"token": "` + token + `", "password": "reset horse battery"}`, http.StatusBadRequest, "TOKEN_INVALID"},
+	}
+	for _, reset := range resets {
+		if response := send("POST", "/password-reset/confirm", reset.body); response.Code != reset.status || !strings.Contains(response.Body.String(), reset.code) {
+			t.Logf("Expected %d %s for %s, got %d: %s", reset.status, reset.code, reset.body, response.Code, response.Body.String())
+			t.Fail()
+		}
+	}
+	if response := send("POST", "/login", `{"username": "billy2000", "password": "reset horse battery"}`); response.Code != http.StatusOK {
+		t.Logf("Expected the reset password to log in, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	// Tokens sent to an email are refused once it's changed, and the change unverifies the user
+	send("POST", "/password-reset", `{"email": "Bob@bobmail.bob"}`)
+	token = sent.mailedToken()
+	if response := send("PATCH", "/user/billy2000", `{"email": "bobby@bobmail.bob"}`); response.Code != http.StatusOK || strings.Contains(response.Body.String(), "verified_email") {
+		t.Logf("Expected changing the email to unverify it, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+	if response := send("POST", "/password-reset/confirm", `{"token": "`+token+`", "password": "other horse battery"}`); response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "TOKEN_INVALID") {
+		t.Logf("Expected a token for the old email to be refused, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	disabled := NewHandler(user_db, nil, nil, nil, nil, nil, auth.DefaultPolicy(), sessions, nil, auth.Tokens{}, nil)
+	request, _ := http.NewRequest("POST", "/password-reset", bytes.NewBuffer([]byte(`{"email": "bobby@bobmail.bob"}`)))
+	response := httptest.NewRecorder()
+	disabled.RequestPasswordReset(response, request)
+	if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "EMAIL_TOKENS_DISABLED") {
+		t.Logf("Expected 404 EMAIL_TOKENS_DISABLED, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_DebugVars(t *testing.T) {
+	handler := NewHandler(nil, nil, nil, nil, nil, nil, auth.DefaultPolicy(), auth.Sessions{}, nil, auth.Tokens{}, nil)
+	debug_vars := func(principal auth.Principal) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", "/debug/vars", nil)
+		request = request.WithContext(auth.WithPrincipal(request.Context(), principal))
+		response := httptest.NewRecorder()
+		handler.DebugVars(response, request)
+		return response
+	}
+
+	if response := debug_vars(auth.Principal{Subject: "billy2000", Method: auth.MethodSession}); response.Code != http.StatusForbidden {
+		t.Logf("Expected a user to be refused, got %d: %s", response.Code, response.Body.String())
+		t.Fail()
+	}
+
+	response := debug_vars(auth.Principal{Subject: "ops", Method: auth.MethodJWT, Roles: []string{auth.RoleAdmin}})
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(response.Body.Bytes(), &vars); err != nil || response.Code != http.StatusOK {
+		t.Logf("Expected a JSON object, got %d: %s (err: %v)", response.Code, response.Body.String(), err)
+		t.FailNow()
+	}
+	if _, ok := vars["archive_users_archived"]; !ok {
+		t.Logf("Expected the archive counters, got: %s", response.Body.String())
+		t.Fail()
+	}
+	for _, process_var := range []string{"cmdline", "memstats"} {
+		if _, ok := vars[process_var]; ok {
+			t.Logf("Expected %s not to be served", process_var)
+			t.Fail()
+		}
+	}
+}
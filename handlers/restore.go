@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/validation"
+)
+
+var errNotArchived = errors.New("User has no archived versions")
+
+type archivedVersion struct {
+	ModifiedNanos int64     `json:"modified_nanos"`
+	ModifiedAt    time.Time `json:"modified_at"`
+	ExpiredAt     time.Time `json:"expired_at"`
+}
+
+type archivedVersions struct {
+	Username string            `json:"username"`
+	Versions []archivedVersion `json:"versions"`
+}
+
+// RestoreUser re-creates an expired user from its archived version last modified at
+// modified_nanos, or its newest archived version if modified_nanos is 0. The user gets the
+// default expiry and no password, and isn't restored if the username or its email has been
+// taken since. Sessions issued to the username before are revoked.
+func RestoreUser(db DatabaseInterface, archived archive.Reader, sessions auth.Sessions, username string, modified_nanos int64) (string, error) {
+	if archived == nil {
+		return "", errNotArchived
+	}
+
+	records, err := archived.List(username)
+	if err != nil {
+		return "", err
+	}
+
+	var chosen_record *archive.Record
+	for i := range records {
+		if modified_nanos == 0 || records[i].ModifiedNanos == modified_nanos {
+			chosen_record = &records[i]
+			break
+		}
+	}
+	if chosen_record == nil {
+		return "", errNotArchived
+	}
+
+	record, err := archived.Load(*chosen_record)
+	if err != nil {
+		return "", err
+	}
+
+	if err = validation.ValidateUserUpdate(username, record.Data); err != nil {
+		return "", err
+	}
+
+	if err = db.CreateUser(username, record.Data, validation.Expiry{}); err != nil {
+		return "", err
+	}
+	if err = sessions.Revoke(username); err != nil {
+		return "", err
+	}
+	// Archives hold no password, so one left from before the user expired isn't brought back
+	if err = db.DeletePasswordHash(username); err != nil {
+		return "", err
+	}
+
+	return record.Data, nil
+}
+
+func (handler RequestHandler) GetArchive(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersRead, username) {
+		return
+	}
+
+	response := archivedVersions{Username: username, Versions: []archivedVersion{}}
+	if handler.archived != nil {
+		records, err := handler.archived.List(username)
+		if err != nil {
+			responseErrorInternal(w, err)
+			return
+		}
+
+		for _, record := range records {
+			response.Versions = append(response.Versions, archivedVersion{
+				ModifiedNanos: record.ModifiedNanos,
+				ModifiedAt:    time.Unix(0, record.ModifiedNanos).UTC(),
+				ExpiredAt:     record.ExpiredAt.UTC(),
+			})
+		}
+	}
+
+	if len(response.Versions) == 0 {
+		responseErrorNotFound(w, errNotArchived)
+		return
+	}
+
+	response_json, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response_json)
+}
+
+// RestoreUser takes ?modified_nanos= to restore a version other than the newest
+func (handler RequestHandler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+
+	var modified_nanos int64
+	if r.URL.Query().Get("modified_nanos") != "" {
+		var err error
+		modified_nanos, err = strconv.ParseInt(r.URL.Query().Get("modified_nanos"), 10, 64)
+		if err != nil || modified_nanos <= 0 {
+			responseErrorBadRequest(w, errors.New("modified_nanos must be a positive integer"))
+			return
+		}
+	}
+
+	user_json_string, err := RestoreUser(handler.db, handler.archived, handler.sessions, username, modified_nanos)
+	if _, invalid := err.(validation.Errors); invalid {
+		responseErrorBadRequest(w, err)
+		return
+	} else if err == errNotArchived {
+		responseErrorNotFound(w, err)
+		return
+	} else if err == dberrors.ErrUserExists || err == dberrors.ErrEmailTaken {
+		responseErrorConflict(w, err)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	handler.record(r, audit.OperationRestore, username, "", user_json_string)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(user_json_string))
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/events"
+)
+
+// How often idle streams are sent something, so proxies don't time them out
+const streamKeepalive = 15 * time.Second
+
+// How long writing to a WebSocket may take before the client is given up on
+const websocketWriteTimeout = 10 * time.Second
+
+var errStreamingDisabled = errors.New("Event streaming is not enabled")
+
+var errInvalidEventID = errors.New("Last-Event-ID must be the id of an event from this stream")
+
+// Cross origin WebSockets are refused, like the default for any request a browser makes
+var upgrader = websocket.Upgrader{}
+
+// streamedTypes reads the ?types= filter, nil standing for every type
+func streamedTypes(r *http.Request) (map[string]bool, error) {
+	if r.URL.Query().Get("types") == "" {
+		return nil, nil
+	}
+
+	requested, err := validateEventTypes(strings.Split(r.URL.Query().Get("types"), ","))
+	if err != nil {
+		return nil, err
+	}
+
+	types := map[string]bool{}
+	for _, event_type := range requested {
+		types[event_type] = true
+	}
+
+	return types, nil
+}
+
+// StreamEvents streams user change events as they happen, as Server-Sent Events or as WebSocket
+// messages if the request is a WebSocket upgrade. Each SSE event's id is its position in the
+// stream, so a client reconnecting with Last-Event-ID (or ?last_event_id=, for WebSockets) gets
+// the events it missed first. ?types= limits the stream to a comma separated list of types.
+func (handler RequestHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersRead, "") {
+		return
+	}
+	if handler.listener == nil {
+		responseErrorNotFound(w, errStreamingDisabled)
+		return
+	}
+
+	types, err := streamedTypes(r)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("last_event_id")
+	}
+
+	listened, stop, err := handler.listener.Listen(after)
+	if err == events.ErrInvalidPosition {
+		responseErrorBadRequest(w, errInvalidEventID)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	defer stop()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebSocket(w, r, listened, types)
+		return
+	}
+	streamSSE(w, r, listened, types)
+}
+
+func streamSSE(w http.ResponseWriter, r *http.Request, listened <-chan events.StreamedEvent, types map[string]bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		responseErrorInternal(w, errors.New("Streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case streamed_event, open := <-listened:
+			// Closed when the client falls behind, it reconnects with Last-Event-ID
+			if !open {
+				return
+			}
+			if types != nil && !types[streamed_event.Event.Type] {
+				continue
+			}
+
+			event_json, _ := json.Marshal(streamed_event.Event)
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", streamed_event.StreamID, streamed_event.Event.Type, event_json)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamWebSocket sends each event as a JSON message of its stream_id and event. Anything the
+// client sends is ignored, besides closing the connection.
+func streamWebSocket(w http.ResponseWriter, r *http.Request, listened <-chan events.StreamedEvent, types map[string]bool) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case streamed_event, open := <-listened:
+			if !open {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Fell behind the stream"), time.Now().Add(websocketWriteTimeout))
+				return
+			}
+			if types != nil && !types[streamed_event.Event.Type] {
+				continue
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err = conn.WriteJSON(streamed_event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/mailer"
+	"github.com/Haelium/User-Manager-API/validation"
+)
+
+var errEmailAlreadyVerified = errors.New("Email is already verified")
+
+// tokenRequest is the body of POST /verify-email and POST /password-reset/confirm, which also
+// takes the new password
+type tokenRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// passwordResetRequest is the body of POST /password-reset
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// mailToken issues a token for purpose and emails it to the address it proves
+func (handler RequestHandler) mailToken(purpose string, username string, email string) error {
+	token, err := handler.tokens.Issue(purpose, username, email)
+	if err != nil {
+		return err
+	}
+
+	minutes := int(handler.tokens.TTL().Minutes())
+	message := mailer.Message{To: email}
+	if purpose == auth.PurposeVerifyEmail {
+		message.Subject = "Verify your email address"
+		message.Body = fmt.Sprintf("To verify this is %s's email address, POST this token to /verify-email as {\"token\": \"...\"} within %d minutes:\n\n%s\n", username, minutes, token)
+	} else {
+		message.Subject = "Reset your password"
+		message.Body = fmt.Sprintf("To reset %s's password, POST this token to /password-reset/confirm as {\"token\": \"...\", \"password\": \"...\"} within %d minutes:\n\n%s\n\nIf you didn't ask to reset your password, ignore this email.\n", username, minutes, token)
+	}
+
+	return handler.mailer.Send(message)
+}
+
+// tokensEnabled writes 404 and returns false unless tokens are issued and mailed
+func (handler RequestHandler) tokensEnabled(w http.ResponseWriter) bool {
+	if !handler.tokens.Enabled() || handler.mailer == nil {
+		responseErrorNotFound(w, auth.ErrTokensDisabled)
+		return false
+	}
+
+	return true
+}
+
+// readTokenRequest decodes a request body, writing the error response itself on failure
+func readTokenRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return false
+	}
+	if err = json.Unmarshal(body, request); err != nil {
+		responseErrorBadRequest(w, err)
+		return false
+	}
+
+	return true
+}
+
+// RequestEmailVerification emails a user a token proving they receive mail at their email
+func (handler RequestHandler) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+	if !handler.tokensEnabled(w) {
+		return
+	}
+
+	user_json_string, err := handler.db.GetUser(username)
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+	if validation.EmailVerified(user_json_string) {
+		responseErrorConflict(w, errEmailAlreadyVerified)
+		return
+	}
+
+	if err = handler.mailToken(auth.PurposeVerifyEmail, strings.ToLower(username), validation.ParseUserFields(user_json_string).Email); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail redeems a verification token, marking the user's email verified if it's still the
+// one the token was sent to. It needs no credentials, the token being proof enough.
+func (handler RequestHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if !handler.tokensEnabled(w) {
+		return
+	}
+
+	var request tokenRequest
+	if !readTokenRequest(w, r, &request) {
+		return
+	}
+
+	token, err := handler.tokens.Redeem(auth.PurposeVerifyEmail, request.Token)
+	if err == auth.ErrInvalidToken {
+		responseErrorBadRequest(w, err)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	// The token is used up, so a concurrent edit is retried rather than failing it
+	for {
+		user_json_string, version, err := handler.db.GetUserWithVersion(token.Username)
+		if err != nil || !validation.SameEmail(validation.ParseUserFields(user_json_string).Email, token.Email) {
+			responseErrorBadRequest(w, auth.ErrInvalidToken)
+			return
+		}
+		if validation.EmailVerified(user_json_string) {
+			break
+		}
+
+		expiry, _, err := handler.db.GetUserExpiry(token.Username)
+		if err != nil {
+			responseErrorNotFound(w, errUserNotFound)
+			return
+		}
+
+		verified_user_json := validation.SetEmailVerified(user_json_string, true)
+		_, err = handler.db.SetUserIfVersion(token.Username, verified_user_json, version, expiry)
+		if err == dberrors.ErrVersionMismatch {
+			continue
+		} else if err != nil {
+			responseErrorInternal(w, err)
+			return
+		}
+		handler.record(r, audit.OperationVerifyEmail, token.Username, user_json_string, verified_user_json)
+		break
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestPasswordReset emails a reset token to the user with an email, if its email is verified.
+// It needs no credentials, and responds the same whether or not an email was sent, so it doesn't
+// reveal which emails users have.
+func (handler RequestHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if !handler.tokensEnabled(w) {
+		return
+	}
+
+	var request passwordResetRequest
+	if !readTokenRequest(w, r, &request) {
+		return
+	}
+
+	// Unverified emails may not be the user's, so they can't be used to take over the account
+	user_json_string, err := handler.db.GetUserByEmail(request.Email)
+	if err == nil && validation.EmailVerified(user_json_string) {
+		fields := validation.ParseUserFields(user_json_string)
+		if err = handler.mailToken(auth.PurposeResetPassword, strings.ToLower(fields.Username), fields.Email); err != nil {
+			log.Printf("Password reset for %s was not sent: %s", fields.Username, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword redeems a reset token, setting the user's password, revoking its sessions and
+// lifting any login lockout. The password is checked before the token is used up, so a rejected one can be corrected.
+func (handler RequestHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !handler.tokensEnabled(w) {
+		return
+	}
+
+	var request tokenRequest
+	if !readTokenRequest(w, r, &request) {
+		return
+	}
+
+	token, err := handler.tokens.Check(auth.PurposeResetPassword, request.Token)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	// The email may have changed since the token was sent
+	user_json_string, err := handler.db.GetUser(token.Username)
+	if err != nil || !validation.SameEmail(validation.ParseUserFields(user_json_string).Email, token.Email) {
+		responseErrorBadRequest(w, auth.ErrInvalidToken)
+		return
+	}
+
+	if err = validation.ValidatePassword(request.Password, token.Username); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	if _, err = handler.tokens.Redeem(auth.PurposeResetPassword, request.Token); err == auth.ErrInvalidToken {
+		responseErrorBadRequest(w, err)
+		return
+	} else if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	if err = handler.db.SetPasswordHash(token.Username, auth.HashPassword(request.Password)); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	if err = handler.sessions.Revoke(token.Username); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+	if handler.lockout != nil {
+		if err = handler.lockout.Unlock(token.Username); err != nil {
+			log.Printf("Lockout of %s was not lifted: %s", token.Username, err)
+		}
+	}
+	handler.record(r, audit.OperationPasswordReset, token.Username, "", "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/audit"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+type userVersion struct {
+	Version    string    `json:"version"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Current    bool      `json:"current,omitempty"`
+}
+
+type userVersions struct {
+	Username string        `json:"username"`
+	Versions []userVersion `json:"versions"`
+}
+
+// requestedVersion picks the version of a user asked for with ?version= or ?as_of=, an RFC 3339
+// time. It returns false if neither was given.
+func requestedVersion(r *http.Request, user_versions []versions.Version) (versions.Version, bool, error) {
+	query := r.URL.Query()
+
+	switch {
+	case query.Get("version") != "" && query.Get("as_of") != "":
+		return versions.Version{}, true, errors.New("Only one of version and as_of may be given")
+	case query.Get("version") != "":
+		user_version, err := versions.Find(user_versions, query.Get("version"))
+		return user_version, true, err
+	case query.Get("as_of") != "":
+		as_of, err := time.Parse(time.RFC3339, query.Get("as_of"))
+		if err != nil {
+			return versions.Version{}, true, errors.New("as_of must be an RFC 3339 time")
+		}
+		user_version, err := versions.AsOf(user_versions, as_of)
+		return user_version, true, err
+	}
+
+	return versions.Version{}, false, nil
+}
+
+func responseErrorVersion(w http.ResponseWriter, err error) {
+	if err == versions.ErrVersionNotFound {
+		responseErrorNotFound(w, err)
+		return
+	}
+	responseErrorBadRequest(w, err)
+}
+
+func (handler RequestHandler) GetUserVersions(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersRead, username) {
+		return
+	}
+
+	user_versions, err := handler.db.GetUserVersions(username)
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	response := userVersions{Username: username, Versions: []userVersion{}}
+	for i, user_version := range user_versions {
+		response.Versions = append(response.Versions, userVersion{
+			Version:    user_version.Version,
+			ModifiedAt: user_version.ModifiedAt.UTC(),
+			Current:    i == 0,
+		})
+	}
+
+	response_json, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response_json)
+}
+
+// getUserVersion serves GET /user/{username}?version= and ?as_of=, with the version as the ETag
+func (handler RequestHandler) getUserVersion(w http.ResponseWriter, r *http.Request, username string) {
+	user_versions, err := handler.db.GetUserVersions(username)
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+
+	user_version, _, err := requestedVersion(r, user_versions)
+	if err != nil {
+		responseErrorVersion(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(user_version.Version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(user_version.Data))
+}
+
+// RevertUser stores an earlier version of a user, chosen by ?version= or ?as_of=, as its newest.
+// It's validated like a PUT, keeps the user's current expiry, and honours If-Match.
+func (handler RequestHandler) RevertUser(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	username := pathParams["username"]
+	if !handler.authorize(w, r, auth.ScopeUsersWrite, username) {
+		return
+	}
+
+	user_versions, err := handler.db.GetUserVersions(username)
+	if err != nil {
+		responseErrorNotFound(w, errUserNotFound)
+		return
+	}
+	current := user_versions[0]
+
+	if if_match := r.Header.Get("If-Match"); if_match != "" && !etagMatches(if_match, current.Version) {
+		responseErrorPreconditionFailed(w, dberrors.ErrVersionMismatch)
+		return
+	}
+
+	user_version, requested, err := requestedVersion(r, user_versions)
+	if !requested {
+		err = errors.New("version or as_of must be given")
+	}
+	if err != nil {
+		responseErrorVersion(w, err)
+		return
+	}
+
+	new_version, reverted_user_json, ok := handler.storeUpdatedUser(w, username, current.Data, user_version.Data, current.Version, nil)
+	if !ok {
+		return
+	}
+	handler.record(r, audit.OperationRevert, username, current.Data, reverted_user_json)
+
+	w.Header().Set("ETag", versionETag(new_version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(reverted_user_json))
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+)
+
+var errInvalidWebhookURL = errors.New("url must be an absolute http or https URL")
+
+var errInvalidEventType = errors.New("types may only contain user.created, user.updated, user.deleted and user.expired")
+
+// webhookRequest is the body of POST /webhooks, no types subscribing to every type
+type webhookRequest struct {
+	URL   string   `json:"url"`
+	Types []string `json:"types"`
+}
+
+// webhook is a subscription as returned, its secret only when it's created or rotated
+type webhook struct {
+	ID                    string     `json:"id"`
+	URL                   string     `json:"url"`
+	Types                 []string   `json:"types"`
+	CreatedAt             time.Time  `json:"created_at"`
+	Secret                string     `json:"secret,omitempty"`
+	PreviousSecretExpires *time.Time `json:"previous_secret_expires,omitempty"`
+}
+
+type webhookList struct {
+	Webhooks []webhook `json:"webhooks"`
+}
+
+type webhookDeliveries struct {
+	ID         string            `json:"id"`
+	Deliveries []events.Delivery `json:"deliveries"`
+}
+
+func asWebhook(subscription events.Subscription, with_secret bool) webhook {
+	response := webhook{
+		ID:        subscription.ID,
+		URL:       subscription.URL,
+		Types:     subscription.Types,
+		CreatedAt: subscription.CreatedAt.UTC(),
+	}
+	if with_secret {
+		response.Secret = subscription.Secret
+	}
+	if subscription.PreviousSecret != "" && time.Now().Before(subscription.PreviousSecretExpires) {
+		previous_secret_expires := subscription.PreviousSecretExpires.UTC()
+		response.PreviousSecretExpires = &previous_secret_expires
+	}
+
+	return response
+}
+
+// validateWebhook checks a subscription request, returning its types without duplicates
+func validateWebhook(request webhookRequest) ([]string, error) {
+	parsed, err := url.Parse(request.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errInvalidWebhookURL
+	}
+
+	return validateEventTypes(request.Types)
+}
+
+// validateEventTypes checks every type is an events.Types, returning them without duplicates
+func validateEventTypes(requested []string) ([]string, error) {
+	types := []string{}
+	seen := map[string]bool{}
+	for _, event_type := range requested {
+		known := false
+		for _, known_type := range events.Types {
+			known = known || event_type == known_type
+		}
+		if !known {
+			return nil, errInvalidEventType
+		}
+		if !seen[event_type] {
+			seen[event_type] = true
+			types = append(types, event_type)
+		}
+	}
+
+	return types, nil
+}
+
+func responseErrorWebhook(w http.ResponseWriter, err error) {
+	if err == dberrors.ErrSubscriptionNotFound {
+		responseErrorNotFound(w, err)
+		return
+	}
+	responseErrorInternal(w, err)
+}
+
+// CreateWebhook subscribes a URL to events of the given types, responding with the secret its
+// requests will be signed with. This is the only time the secret is shown, besides rotations.
+func (handler RequestHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	var request webhookRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	types, err := validateWebhook(request)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	subscription := events.Subscription{
+		ID:        events.NewID(),
+		URL:       request.URL,
+		Types:     types,
+		Secret:    events.NewSecret(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err = handler.db.CreateSubscription(subscription); err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/webhooks/"+subscription.ID)
+	writeJSON(w, http.StatusCreated, asWebhook(subscription, true))
+}
+
+func (handler RequestHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	subscriptions, err := handler.db.ListSubscriptions()
+	if err != nil {
+		responseErrorInternal(w, err)
+		return
+	}
+
+	response := webhookList{Webhooks: []webhook{}}
+	for _, subscription := range subscriptions {
+		response.Webhooks = append(response.Webhooks, asWebhook(subscription, false))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (handler RequestHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	pathParams := mux.Vars(r)
+
+	subscription, err := handler.db.GetSubscription(pathParams["id"])
+	if err != nil {
+		responseErrorWebhook(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, asWebhook(subscription, false))
+}
+
+// DeleteWebhook unsubscribes a URL, deliveries already being retried stop at their next attempt
+func (handler RequestHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	pathParams := mux.Vars(r)
+
+	if err := handler.db.DeleteSubscription(pathParams["id"]); err != nil {
+		responseErrorWebhook(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RotateWebhookSecret gives a subscription a new secret. Requests are signed with the old one as
+// well for events.RotationGrace, so the subscriber can switch over without rejecting any.
+func (handler RequestHandler) RotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	pathParams := mux.Vars(r)
+
+	subscription, err := handler.db.RotateSubscriptionSecret(pathParams["id"], events.NewSecret(), time.Now())
+	if err != nil {
+		responseErrorWebhook(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, asWebhook(subscription, true))
+}
+
+// GetWebhookDeliveries lists a subscription's latest delivery attempts, newest first, up to
+// events.MaxDeliveries of which are kept
+func (handler RequestHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(w, r, auth.ScopeUsersAdmin, "") {
+		return
+	}
+	pathParams := mux.Vars(r)
+
+	limit, err := pageLimit(r)
+	if err != nil {
+		responseErrorBadRequest(w, err)
+		return
+	}
+
+	deliveries, err := handler.db.ListDeliveries(pathParams["id"], limit)
+	if err != nil {
+		responseErrorWebhook(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhookDeliveries{ID: pathParams["id"], Deliveries: deliveries})
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileMailer appends emails to a file instead of sending them, or logs them without one, for
+// running locally
+type FileMailer struct {
+	lock *sync.Mutex
+	path string
+	from string
+}
+
+// NewFileMailer appends to the file at path, "" to log instead
+func NewFileMailer(path string, from string) FileMailer {
+	var new_file_mailer FileMailer
+
+	new_file_mailer.lock = &sync.Mutex{}
+	new_file_mailer.path = path
+	new_file_mailer.from = from
+
+	return new_file_mailer
+}
+
+func (mailer FileMailer) Send(message Message) error {
+	formatted, err := format(mailer.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if mailer.path == "" {
+		log.Printf("Mail not sent:\n%s", formatted)
+		return nil
+	}
+
+	mailer.lock.Lock()
+	defer mailer.lock.Unlock()
+
+	// The emails hold tokens, so only the server's user may read them
+	mail_file, err := os.OpenFile(mailer.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = mail_file.Write(append(formatted, '\n')); err != nil {
+		mail_file.Close()
+		return err
+	}
+
+	return mail_file.Close()
+}
@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errHeaderInjection = errors.New("Mail headers may not contain line breaks")
+
+// Message is a plain text email to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails users prove they own their address with
+type Mailer interface {
+	Send(Message) error
+}
+
+// format renders a message as sent, with its headers. Addresses and subjects come from users, so
+// line breaks in them are refused rather than let them add headers.
+func format(from string, message Message, now time.Time) ([]byte, error) {
+	for _, header := range []string{from, message.To, message.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errHeaderInjection
+		}
+	}
+
+	body := strings.Replace(strings.Replace(message.Body, "\r\n", "\n", -1), "\n", "\r\n", -1)
+
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, message.To, message.Subject, now.Format(time.RFC1123Z), body)), nil
+}
@@ -0,0 +1,121 @@
+package mailer
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var test_message = Message{To: "Bob@bobmail.bob", Subject: "Verify your email", Body: "Your token:\nabc.def"}
+
+func Test_Format(t *testing.T) {
+	formatted, err := format("userapi@example.com", test_message, time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC))
+	expected := "From: userapi@example.com\r\nTo: Bob@bobmail.bob\r\nSubject: Verify your email\r\nDate: Fri, 31 Jan 2020 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\nYour token:\r\nabc.def\r\n"
+	if string(formatted) != expected || err != nil {
+		t.Logf("Expected:\n%q\nGot:\n%q (err: %v)", expected, formatted, err)
+		t.Fail()
+	}
+
+	injected := Message{To: "Bob@bobmail.bob\r\nBcc: eve@evil.example", Subject: "Hi"}
+	if _, err = format("userapi@example.com", injected, time.Now()); err != errHeaderInjection {
+		t.Logf("Expected a header injection to be refused, got: %v", err)
+		t.Fail()
+	}
+}
+
+func Test_FileMailer(t *testing.T) {
+	mail_dir, _ := ioutil.TempDir("", "mailer")
+	defer os.RemoveAll(mail_dir)
+	mail_path := filepath.Join(mail_dir, "mail.txt")
+
+	mailer := NewFileMailer(mail_path, "userapi@example.com")
+	mailer.Send(test_message)
+	mailer.Send(Message{To: "alice@alicemail.com", Subject: "Reset your password", Body: "ghi.jkl"})
+
+	mail, _ := ioutil.ReadFile(mail_path)
+	if strings.Count(string(mail), "From: userapi@example.com") != 2 || !strings.Contains(string(mail), "abc.def") || !strings.Contains(string(mail), "ghi.jkl") {
+		t.Logf("Expected both emails in the file, got:\n%s", mail)
+		t.Fail()
+	}
+	if info, _ := os.Stat(mail_path); info.Mode().Perm() != 0600 {
+		t.Logf("Expected the file to be private, got %s", info.Mode())
+		t.Fail()
+	}
+
+	if err := NewFileMailer("", "userapi@example.com").Send(test_message); err != nil {
+		t.Logf("Expected logging an email to succeed, got: %v", err)
+		t.Fail()
+	}
+}
+
+// serveSMTP accepts one message, just enough of SMTP for net/smtp, and sends back what it was given
+func serveSMTP(listener net.Listener, received chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var transcript strings.Builder
+	conn.Write([]byte("220 localhost\r\n"))
+	in_data := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		transcript.WriteString(line)
+
+		if in_data {
+			if line == ".\r\n" {
+				in_data = false
+				conn.Write([]byte("250 OK\r\n"))
+			}
+			continue
+		}
+		switch strings.ToUpper(strings.Fields(line)[0]) {
+		case "EHLO":
+			conn.Write([]byte("250 localhost\r\n"))
+		case "DATA":
+			in_data = true
+			conn.Write([]byte("354 Go ahead\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 Bye\r\n"))
+			received <- transcript.String()
+			return
+		default:
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	}
+	received <- transcript.String()
+}
+
+func Test_SMTPMailer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go serveSMTP(listener, received)
+
+	if err = NewSMTPMailer(listener.Addr().String(), "", "", "userapi@example.com").Send(test_message); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	transcript := <-received
+	for _, expected := range []string{"MAIL FROM:<userapi@example.com>", "RCPT TO:<Bob@bobmail.bob>", "Subject: Verify your email", "abc.def"} {
+		if !strings.Contains(transcript, expected) {
+			t.Logf("Expected %q to be sent, got:\n%s", expected, transcript)
+			t.Fail()
+		}
+	}
+}
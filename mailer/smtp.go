@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends through an SMTP server, which net/smtp upgrades to TLS if it offers STARTTLS
+type SMTPMailer struct {
+	address string
+	from    string
+	// nil to send without authenticating
+	auth smtp.Auth
+}
+
+// NewSMTPMailer sends from an address through the server at address, host:port. Without a
+// username it doesn't authenticate.
+func NewSMTPMailer(address string, username string, password string, from string) SMTPMailer {
+	var new_smtp_mailer SMTPMailer
+
+	new_smtp_mailer.address = address
+	new_smtp_mailer.from = from
+	if username != "" {
+		host, _, _ := net.SplitHostPort(address)
+		new_smtp_mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return new_smtp_mailer
+}
+
+func (mailer SMTPMailer) Send(message Message) error {
+	formatted, err := format(mailer.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(mailer.address, mailer.auth, mailer.from, []string{message.To}, formatted)
+}
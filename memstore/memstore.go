@@ -0,0 +1,529 @@
+package memstore
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+/*
+In-memory implementation of handlers.DatabaseInterface, for tests and local development.
+
+Everything is lost when the process exits, including pending expiries. Users expire as their
+validation.Expiry says, data_ttl seconds after their last modification by default, and are
+handed to the archiver like RedisHashConn does. Soft deleted users are kept in a recycle bin
+for retention seconds, then archived the same way. Earlier versions of each user are kept as the
+history policy says. Webhook subscriptions and password hashes are kept alongside the users.
+Lookups by anything but username scan every user, which is fine at development sizes.
+*/
+
+type record struct {
+	data           string
+	version        int64
+	modified_nanos int64
+	expiry         validation.Expiry
+	// Zero if the user never expires
+	expires_at time.Time
+}
+
+// tombstone is a soft deleted user in the recycle bin
+type tombstone struct {
+	record
+	deleted_at time.Time
+	deleted_by string
+}
+
+type MemStore struct {
+	lock    *sync.Mutex
+	users   map[string]record
+	deleted map[string]tombstone
+	// Earlier versions of each user, newest first
+	earlier map[string][]versions.Version
+	// Webhook subscriptions, and their latest deliveries newest first
+	subscriptions map[string]events.Subscription
+	deliveries    map[string][]events.Delivery
+	// Password hashes by username
+	passwords map[string]string
+	// Versions are drawn from one counter, so a recreated user never reuses an old version
+	last_version *int64
+	data_ttl     int
+	retention    int
+	history      versions.Policy
+	archiver     archive.Archiver
+}
+
+func NewMemStore(data_ttl int, retention int, history versions.Policy, archiver archive.Archiver) MemStore {
+	var new_mem_store MemStore
+
+	new_mem_store.lock = &sync.Mutex{}
+	new_mem_store.users = make(map[string]record)
+	new_mem_store.deleted = make(map[string]tombstone)
+	new_mem_store.earlier = make(map[string][]versions.Version)
+	new_mem_store.subscriptions = make(map[string]events.Subscription)
+	new_mem_store.deliveries = make(map[string][]events.Delivery)
+	new_mem_store.passwords = make(map[string]string)
+	new_mem_store.last_version = new(int64)
+	new_mem_store.data_ttl = data_ttl
+	new_mem_store.retention = retention
+	new_mem_store.history = history
+	new_mem_store.archiver = archiver
+
+	return new_mem_store
+}
+
+func (db MemStore) GetUser(username string) (string, error) {
+	user_json_string, _, err := db.GetUserWithVersion(username)
+
+	return user_json_string, err
+}
+
+func (db MemStore) GetUserWithVersion(username string) (string, string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	if !exists {
+		return "", "", errors.New("User not found")
+	}
+
+	return stored.data, strconv.FormatInt(stored.version, 10), nil
+}
+
+// GetUserVersions returns a user's current version, then its earlier versions newest first
+func (db MemStore) GetUserVersions(username string) ([]versions.Version, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	if !exists {
+		return nil, errors.New("User not found")
+	}
+
+	earlier := db.earlier[username]
+	user_versions := []versions.Version{stored.asVersion()}
+
+	return append(user_versions, earlier[:db.history.Keep(earlier, time.Now())]...), nil
+}
+
+func (stored record) asVersion() versions.Version {
+	return versions.Version{Version: strconv.FormatInt(stored.version, 10), Data: stored.data, ModifiedAt: time.Unix(0, stored.modified_nanos)}
+}
+
+func (db MemStore) GetUserExpiry(username string) (validation.Expiry, time.Time, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	if !exists {
+		return validation.Expiry{}, time.Time{}, errors.New("User not found")
+	}
+
+	return stored.expiry, stored.expires_at, nil
+}
+
+func (db MemStore) GetUserByEmail(email string) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	username := db.emailOwner(validation.NormalizeEmail(email))
+	if username == "" {
+		return "", errors.New("User not found")
+	}
+
+	return db.users[username].data, nil
+}
+
+// emailOwner returns the user with a normalized email, or "". Must be called with the lock held.
+func (db MemStore) emailOwner(email string) string {
+	if email == "" {
+		return ""
+	}
+
+	for username, stored := range db.users {
+		if validation.NormalizeEmail(validation.ParseUserFields(stored.data).Email) == email {
+			return username
+		}
+	}
+
+	return ""
+}
+
+func (db MemStore) SetUser(username string, user_json_string string) error {
+	_, err := db.SetUserIfVersion(username, user_json_string, "", validation.Expiry{})
+
+	return err
+}
+
+func (db MemStore) SetUserIfVersion(username string, user_json_string string, version string, expiry validation.Expiry) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	if version != "" && (!exists || strconv.FormatInt(stored.version, 10) != version) {
+		return "", dberrors.ErrVersionMismatch
+	}
+
+	return db.store(username, user_json_string, expiry)
+}
+
+func (db MemStore) CreateUser(username string, user_json_string string, expiry validation.Expiry) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// A user in the recycle bin keeps its username until it's purged
+	if _, exists := db.users[username]; exists {
+		return dberrors.ErrUserExists
+	}
+	if _, deleted := db.deleted[username]; deleted {
+		return dberrors.ErrUserExists
+	}
+
+	_, err := db.store(username, user_json_string, expiry)
+
+	return err
+}
+
+// store writes a user and schedules its expiry. Must be called with the lock held.
+func (db MemStore) store(username string, user_json_string string, expiry validation.Expiry) (string, error) {
+	owner := db.emailOwner(validation.NormalizeEmail(validation.ParseUserFields(user_json_string).Email))
+	if owner != "" && owner != username {
+		return "", dberrors.ErrEmailTaken
+	}
+
+	now := time.Now()
+	if previous, exists := db.users[username]; exists {
+		earlier := append([]versions.Version{previous.asVersion()}, db.earlier[username]...)
+		db.earlier[username] = earlier[:db.history.Keep(earlier, now)]
+	}
+
+	*db.last_version++
+	stored := record{data: user_json_string, version: *db.last_version, modified_nanos: now.UnixNano(), expiry: expiry}
+	if expires_at, expires := expiry.Deadline(now, db.data_ttl); expires {
+		stored.expires_at = expires_at
+		time.AfterFunc(expires_at.Sub(now), func() {
+			db.expire(username, stored.modified_nanos)
+		})
+	}
+	db.users[username] = stored
+
+	return strconv.FormatInt(stored.version, 10), nil
+}
+
+func (db MemStore) DeleteUser(username string) error {
+	return db.DeleteUserIfVersion(username, "")
+}
+
+// DeleteUserIfVersion erases a user, and any soft deleted user in the recycle bin under its
+// username when version is ""
+func (db MemStore) DeleteUserIfVersion(username string, version string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	_, deleted := db.deleted[username]
+	if !exists && (version != "" || !deleted) {
+		return errors.New("User not found")
+	}
+	if version != "" && strconv.FormatInt(stored.version, 10) != version {
+		return dberrors.ErrVersionMismatch
+	}
+
+	delete(db.users, username)
+	delete(db.earlier, username)
+	if version == "" {
+		delete(db.deleted, username)
+	}
+
+	return nil
+}
+
+func (db MemStore) SoftDeleteUserIfVersion(username string, version string, actor string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	stored, exists := db.users[username]
+	if !exists {
+		return errors.New("User not found")
+	}
+	if version != "" && strconv.FormatInt(stored.version, 10) != version {
+		return dberrors.ErrVersionMismatch
+	}
+
+	deleted_at := time.Now()
+	delete(db.users, username)
+	db.deleted[username] = tombstone{record: stored, deleted_at: deleted_at, deleted_by: actor}
+	time.AfterFunc(time.Duration(db.retention)*time.Second, func() {
+		db.purge(username, deleted_at)
+	})
+
+	return nil
+}
+
+func (db MemStore) GetDeletion(username string) (time.Time, string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	deleted, exists := db.deleted[username]
+	if !exists {
+		return time.Time{}, "", dberrors.ErrNotDeleted
+	}
+
+	return deleted.deleted_at, deleted.deleted_by, nil
+}
+
+func (db MemStore) UndeleteUser(username string) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	deleted, exists := db.deleted[username]
+	if !exists {
+		return "", dberrors.ErrNotDeleted
+	}
+	if _, exists := db.users[username]; exists {
+		return "", dberrors.ErrUserExists
+	}
+
+	if _, err := db.store(username, deleted.data, deleted.expiry); err != nil {
+		return "", err
+	}
+	delete(db.deleted, username)
+
+	return deleted.data, nil
+}
+
+// ListUsers pages through users in username order, the cursor is the offset of the next page
+func (db MemStore) ListUsers(cursor string, limit int) ([]string, string, error) {
+	return db.SearchUsers(map[string]string{}, cursor, limit)
+}
+
+// SearchUsers supports the same filters as RedisHashConn.SearchUsers, by scanning every user
+func (db MemStore) SearchUsers(filters map[string]string, cursor string, limit int) ([]string, string, error) {
+	offset := 0
+	if cursor != "" {
+		decoded_cursor, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded_cursor))
+		}
+		if err != nil || offset < 0 {
+			return nil, "", errors.New("Invalid cursor")
+		}
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	usernames := []string{}
+	for username, stored := range db.users {
+		if validation.ParseUserFields(stored.data).MatchesFilters(filters) {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+
+	users := []string{}
+	for i := offset; i < len(usernames) && len(users) < limit; i++ {
+		users = append(users, db.users[usernames[i]].data)
+	}
+
+	next_cursor := ""
+	if offset+limit < len(usernames) {
+		next_cursor = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + limit)))
+	}
+
+	return users, next_cursor, nil
+}
+
+func (db MemStore) expire(username string, modified_nanos int64) {
+	db.lock.Lock()
+
+	// If another operation has modified the data, its own timer will expire it
+	stored, exists := db.users[username]
+	if !exists || stored.modified_nanos != modified_nanos {
+		db.lock.Unlock()
+		return
+	}
+
+	delete(db.users, username)
+	delete(db.earlier, username)
+	delete(db.passwords, username)
+	db.lock.Unlock()
+
+	err := db.archiver.Archive(archive.Record{Username: username, Data: stored.data, ModifiedNanos: modified_nanos, ExpiredAt: time.Now(), Reason: archive.ReasonExpired})
+	if err != nil {
+		log.Printf("Expired user %s was not archived: %s\nData: %s", username, err, stored.data)
+	}
+}
+
+func (db MemStore) purge(username string, deleted_at time.Time) {
+	db.lock.Lock()
+
+	// The user may have been undeleted, and perhaps deleted again since
+	deleted, exists := db.deleted[username]
+	if !exists || !deleted.deleted_at.Equal(deleted_at) {
+		db.lock.Unlock()
+		return
+	}
+
+	delete(db.deleted, username)
+	delete(db.earlier, username)
+	delete(db.passwords, username)
+	db.lock.Unlock()
+
+	err := db.archiver.Archive(archive.Record{Username: username, Data: deleted.data, ModifiedNanos: deleted.modified_nanos, ExpiredAt: time.Now(), Reason: archive.ReasonPurged})
+	if err != nil {
+		log.Printf("Purged user %s was not archived: %s\nData: %s", username, err, deleted.data)
+	}
+}
+
+func (db MemStore) CreateSubscription(subscription events.Subscription) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.subscriptions[subscription.ID] = subscription
+
+	return nil
+}
+
+func (db MemStore) GetSubscription(id string) (events.Subscription, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	subscription, exists := db.subscriptions[id]
+	if !exists {
+		return events.Subscription{}, dberrors.ErrSubscriptionNotFound
+	}
+
+	return subscription, nil
+}
+
+// ListSubscriptions returns every subscription, oldest first
+func (db MemStore) ListSubscriptions() ([]events.Subscription, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	subscriptions := []events.Subscription{}
+	for _, subscription := range db.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].ID < subscriptions[j].ID
+		}
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+
+	return subscriptions, nil
+}
+
+func (db MemStore) UpdateSubscription(subscription events.Subscription) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, exists := db.subscriptions[subscription.ID]; !exists {
+		return dberrors.ErrSubscriptionNotFound
+	}
+	db.subscriptions[subscription.ID] = subscription
+
+	return nil
+}
+
+func (db MemStore) RotateSubscriptionSecret(id string, secret string, now time.Time) (events.Subscription, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	subscription, exists := db.subscriptions[id]
+	if !exists {
+		return events.Subscription{}, dberrors.ErrSubscriptionNotFound
+	}
+	subscription.Rotate(secret, now)
+	db.subscriptions[id] = subscription
+
+	return subscription, nil
+}
+
+func (db MemStore) DeleteSubscription(id string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, exists := db.subscriptions[id]; !exists {
+		return dberrors.ErrSubscriptionNotFound
+	}
+	delete(db.subscriptions, id)
+	delete(db.deliveries, id)
+
+	return nil
+}
+
+func (db MemStore) RecordDelivery(delivery events.Delivery) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, exists := db.subscriptions[delivery.SubscriptionID]; !exists {
+		return dberrors.ErrSubscriptionNotFound
+	}
+
+	deliveries := append([]events.Delivery{delivery}, db.deliveries[delivery.SubscriptionID]...)
+	if len(deliveries) > events.MaxDeliveries {
+		deliveries = deliveries[:events.MaxDeliveries]
+	}
+	db.deliveries[delivery.SubscriptionID] = deliveries
+
+	return nil
+}
+
+// ListDeliveries returns a subscription's latest deliveries, newest first
+func (db MemStore) ListDeliveries(id string, limit int) ([]events.Delivery, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if _, exists := db.subscriptions[id]; !exists {
+		return nil, dberrors.ErrSubscriptionNotFound
+	}
+
+	deliveries := db.deliveries[id]
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return append([]events.Delivery{}, deliveries...), nil
+}
+
+func (db MemStore) SetPasswordHash(username string, hash string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.passwords[username] = hash
+
+	return nil
+}
+
+func (db MemStore) GetPasswordHash(username string) (string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	hash, exists := db.passwords[username]
+	if !exists {
+		return "", dberrors.ErrNoPassword
+	}
+
+	return hash, nil
+}
+
+func (db MemStore) DeletePasswordHash(username string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	delete(db.passwords, username)
+
+	return nil
+}
@@ -0,0 +1,467 @@
+package memstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+var valid_users = map[string]string{
+	"bobman12": `{"username": "bobman12", "fullname": "Bob Bobson", "email": "bob@bobmail.com", "address": {"region": "Bobville", "country": "Bobland"}}`,
+	"jcdenton": `{"username": "jcdenton", "fullname": "JC Denton", "email": "jc@unatco.org", "address": {"region": "New York", "country": "USA"}}`,
+	"herpderp": `{"username": "herpderp", "fullname": "Herp Derp", "email": "herp@derp.io", "address": {"region": "New York", "country": "USA"}}`,
+}
+
+// Keeps 2 earlier versions of each user
+var test_history = versions.Policy{MaxVersions: 2}
+
+func Test_SetGetDelete(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	for username, userdata := range valid_users {
+		if err := conn.SetUser(username, userdata); err != nil {
+			t.Logf("err: %s", err)
+			t.Fail()
+		}
+	}
+
+	for username, expected_val := range valid_users {
+		actual_val, err := conn.GetUser(username)
+		if err != nil || actual_val != expected_val {
+			t.Logf("Expected:\t %s \nGot:\t %s (err: %v)\n", expected_val, actual_val, err)
+			t.Fail()
+		}
+	}
+
+	if err := conn.DeleteUser("bobman12"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, err := conn.GetUser("bobman12"); err == nil {
+		t.Logf("User was not deleted")
+		t.Fail()
+	}
+	if err := conn.DeleteUser("bobman12"); err == nil {
+		t.Logf("Deleting a missing user did not fail")
+		t.Fail()
+	}
+}
+
+func Test_CreateAndUniqueEmail(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	if err := conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{}); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	if err := conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{}); err != dberrors.ErrUserExists {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrUserExists, err)
+		t.Fail()
+	}
+
+	err := conn.CreateUser("bobman13", `{"username": "bobman13", "email": "bob@BOBMAIL.com"}`, validation.Expiry{})
+	if err != dberrors.ErrEmailTaken {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrEmailTaken, err)
+		t.Fail()
+	}
+
+	returned_value, err := conn.GetUserByEmail("bob@Bobmail.COM")
+	if returned_value != valid_users["bobman12"] {
+		t.Logf("Lookup by email failed: %s (err: %v)", returned_value, err)
+		t.Fail()
+	}
+}
+
+func Test_Versions(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{})
+	_, version, _ := conn.GetUserWithVersion("bobman12")
+
+	new_version, err := conn.SetUserIfVersion("bobman12", valid_users["bobman12"], version, validation.Expiry{})
+	if err != nil || new_version == version {
+		t.Logf("Expected a new version, got %s (err: %v)", new_version, err)
+		t.Fail()
+	}
+
+	if _, err = conn.SetUserIfVersion("bobman12", valid_users["bobman12"], version, validation.Expiry{}); err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrVersionMismatch, err)
+		t.Fail()
+	}
+	if err = conn.DeleteUserIfVersion("bobman12", version); err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrVersionMismatch, err)
+		t.Fail()
+	}
+	if err = conn.DeleteUserIfVersion("bobman12", new_version); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+}
+
+func Test_ListAndSearch(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	for i := 0; i < 10; i++ {
+		conn.SetUser(fmt.Sprintf("listuser%d", i), fmt.Sprintf(`{"username": "listuser%d"}`, i))
+	}
+	for username, userdata := range valid_users {
+		conn.SetUser(username, userdata)
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 20; pages++ {
+		users, next_cursor, err := conn.ListUsers(cursor, 3)
+		if err != nil || len(users) > 3 {
+			t.Logf("Bad page of %d users (err: %v)", len(users), err)
+			t.FailNow()
+		}
+		for _, user := range users {
+			seen[user] = true
+		}
+		cursor = next_cursor
+		if cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 13 {
+		t.Logf("Expected 13 users, got %d", len(seen))
+		t.Fail()
+	}
+
+	test_cases := []struct {
+		filters  map[string]string
+		expected int
+	}{
+		{map[string]string{"country": "usa"}, 2},
+		{map[string]string{"country": "USA", "region": "new york"}, 2},
+		{map[string]string{"name_prefix": "jc"}, 1},
+		{map[string]string{"name_prefix": "%"}, 0},
+		{map[string]string{"email": "bob@BOBMAIL.com"}, 1},
+		{map[string]string{"email": "BOB@bobmail.com"}, 0},
+	}
+	for _, test_case := range test_cases {
+		users, _, err := conn.SearchUsers(test_case.filters, "", 10)
+		if err != nil || len(users) != test_case.expected {
+			t.Logf("Filters: %v\nExpected: %d users\nGot: %d (err: %v)\n", test_case.filters, test_case.expected, len(users), err)
+			t.Fail()
+		}
+	}
+
+	users, cursor, _ := conn.SearchUsers(map[string]string{"country": "usa"}, "", 1)
+	more_users, last_cursor, _ := conn.SearchUsers(map[string]string{"country": "usa"}, cursor, 1)
+	if len(users) != 1 || len(more_users) != 1 || users[0] == more_users[0] || last_cursor != "" {
+		t.Logf("Paging search failed: %v %v %q", users, more_users, last_cursor)
+		t.Fail()
+	}
+}
+
+func Test_PerUserExpiry(t *testing.T) {
+	persist_dir, _ := ioutil.TempDir("", "memstore")
+	defer os.RemoveAll(persist_dir)
+
+	conn := NewMemStore(1, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+	conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{Never: true})
+	conn.CreateUser("jcdenton", valid_users["jcdenton"], validation.Expiry{TTLSeconds: 60})
+	conn.SetUser("herpderp", valid_users["herpderp"])
+	conn.SetPasswordHash("bobman12", "bob hash")
+	conn.SetPasswordHash("herpderp", "herp hash")
+	time.Sleep(3 * time.Second)
+
+	// Expired users' password hashes go with them
+	if _, err := conn.GetPasswordHash("herpderp"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected the expired user's password hash to be deleted, got: %v", err)
+		t.Fail()
+	}
+	if hash, _ := conn.GetPasswordHash("bobman12"); hash != "bob hash" {
+		t.Logf("Expected the permanent user's password hash to be kept, got: %q", hash)
+		t.Fail()
+	}
+
+	// Only the user with the default ttl expires
+	for username, expected_val := range map[string]string{"bobman12": valid_users["bobman12"], "jcdenton": valid_users["jcdenton"], "herpderp": ""} {
+		if returned_value, _ := conn.GetUser(username); returned_value != expected_val {
+			t.Logf("Expected:\t %s \nGot:\t %s\n", expected_val, returned_value)
+			t.Fail()
+		}
+	}
+
+	expiry, expires_at, err := conn.GetUserExpiry("bobman12")
+	if err != nil || !expiry.Never || !expires_at.IsZero() {
+		t.Logf("Expected a permanent user, got %v %v (err: %v)", expiry, expires_at, err)
+		t.Fail()
+	}
+
+	expiry, expires_at, err = conn.GetUserExpiry("jcdenton")
+	if err != nil || expiry.TTLSeconds != 60 || time.Until(expires_at) < 50*time.Second {
+		t.Logf("Expected a 60 second ttl, got %v %v (err: %v)", expiry, expires_at, err)
+		t.Fail()
+	}
+}
+
+func Test_expire(t *testing.T) {
+	persist_dir, _ := ioutil.TempDir("", "memstore")
+	defer os.RemoveAll(persist_dir)
+
+	conn := NewMemStore(2, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+
+	conn.SetUser("bob_should_expire", "junk data")
+	time.Sleep(1 * time.Second)
+	// Modifying the user restarts its ttl
+	conn.SetUser("bob_should_expire", "more junk data")
+	time.Sleep(1500 * time.Millisecond)
+
+	if returned_value, _ := conn.GetUser("bob_should_expire"); returned_value != "more junk data" {
+		t.Logf("Data expired before its ttl: %s", returned_value)
+		t.Fail()
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if returned_value, _ := conn.GetUser("bob_should_expire"); returned_value != "" {
+		t.Logf("Data is not being expired: %s", returned_value)
+		t.Fail()
+	}
+
+	if archived := countArchived(persist_dir); archived != 1 {
+		t.Logf("Expected 1 persisted user, got %d", archived)
+		t.Fail()
+	}
+}
+
+// countArchived counts the users archived under dir
+func Test_SoftDelete(t *testing.T) {
+	persist_dir, _ := ioutil.TempDir("", "memstore")
+	defer os.RemoveAll(persist_dir)
+
+	conn := NewMemStore(60, 1, test_history, archive.NewFileArchiver(persist_dir, false))
+
+	conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{Never: true})
+	conn.CreateUser("jcdenton", valid_users["jcdenton"], validation.Expiry{})
+
+	if err := conn.SoftDeleteUserIfVersion("bobman12", "12345", "admin"); err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected a version mismatch, got: %v", err)
+		t.Fail()
+	}
+	if err := conn.SoftDeleteUserIfVersion("bobman12", "", "admin"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	if returned_value, _ := conn.GetUser("bobman12"); returned_value != "" {
+		t.Logf("Deleted user still returned: %s", returned_value)
+		t.Fail()
+	}
+	if _, deleted_by, err := conn.GetDeletion("bobman12"); err != nil || deleted_by != "admin" {
+		t.Logf("Expected a deletion by admin, got: %s (err: %v)", deleted_by, err)
+		t.Fail()
+	}
+	if err := conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{}); err != dberrors.ErrUserExists {
+		t.Logf("Expected the username to be taken, got: %v", err)
+		t.Fail()
+	}
+
+	// Undeleted users get their expiry back
+	if returned_value, err := conn.UndeleteUser("bobman12"); err != nil || returned_value != valid_users["bobman12"] {
+		t.Logf("Expected:\t %s \nGot:\t %s (err: %v)\n", valid_users["bobman12"], returned_value, err)
+		t.Fail()
+	}
+	if expiry, _, err := conn.GetUserExpiry("bobman12"); err != nil || !expiry.Never {
+		t.Logf("Expected a permanent user, got %v (err: %v)", expiry, err)
+		t.Fail()
+	}
+	if _, err := conn.UndeleteUser("bobman12"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user not to be deleted, got: %v", err)
+		t.Fail()
+	}
+
+	// Hard deletes erase users in the recycle bin
+	conn.SoftDeleteUserIfVersion("jcdenton", "", "admin")
+	if err := conn.DeleteUser("jcdenton"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, _, err := conn.GetDeletion("jcdenton"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user to be erased, got: %v", err)
+		t.Fail()
+	}
+
+	// Users are purged and archived after the retention period
+	conn.SetPasswordHash("bobman12", "bob hash")
+	conn.SoftDeleteUserIfVersion("bobman12", "", "admin")
+	time.Sleep(3 * time.Second)
+
+	if _, _, err := conn.GetDeletion("bobman12"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user to be purged, got: %v", err)
+		t.Fail()
+	}
+	if _, err := conn.GetPasswordHash("bobman12"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected the purged user's password hash to be deleted, got: %v", err)
+		t.Fail()
+	}
+	if archived := countArchived(persist_dir); archived != 1 {
+		t.Logf("Expected 1 archived user, got %d", archived)
+		t.Fail()
+	}
+}
+
+func countArchived(dir string) int {
+	count := 0
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+
+	return count
+}
+
+func Test_UserVersions(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	for i := 0; i < 4; i++ {
+		conn.SetUser("bobman12", fmt.Sprintf(`{"username": "bobman12", "email": "bob%d@bobmail.com"}`, i))
+	}
+
+	// The current version, then the 2 earlier versions test_history keeps
+	user_versions, err := conn.GetUserVersions("bobman12")
+	if err != nil || len(user_versions) != 3 || !strings.Contains(user_versions[0].Data, "bob3@") || !strings.Contains(user_versions[2].Data, "bob1@") {
+		t.Logf("Expected 3 versions newest first, got: %+v (err: %v)", user_versions, err)
+		t.FailNow()
+	}
+	if current, _, _ := conn.GetUserWithVersion("bobman12"); current != user_versions[0].Data {
+		t.Logf("Expected the current version first, got: %s", user_versions[0].Data)
+		t.Fail()
+	}
+	if !user_versions[0].ModifiedAt.After(user_versions[1].ModifiedAt) {
+		t.Logf("Expected the current version to be newest, got: %+v", user_versions)
+		t.Fail()
+	}
+
+	// Earlier versions survive the recycle bin
+	conn.SoftDeleteUserIfVersion("bobman12", "", "admin")
+	if _, err := conn.GetUserVersions("bobman12"); err == nil {
+		t.Logf("Expected no versions for a deleted user")
+		t.Fail()
+	}
+	conn.UndeleteUser("bobman12")
+	if user_versions, _ = conn.GetUserVersions("bobman12"); len(user_versions) != 3 {
+		t.Logf("Expected 3 versions after undeleting, got: %+v", user_versions)
+		t.Fail()
+	}
+
+	// and are erased with the user
+	conn.DeleteUser("bobman12")
+	conn.SetUser("bobman12", valid_users["bobman12"])
+	if user_versions, _ = conn.GetUserVersions("bobman12"); len(user_versions) != 1 {
+		t.Logf("Expected only the current version, got: %+v", user_versions)
+		t.Fail()
+	}
+}
+
+func Test_Subscriptions(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	created_at := time.Now().UTC().Truncate(time.Millisecond)
+	for i, id := range []string{"b", "a"} {
+		subscription := events.Subscription{ID: id, URL: "https://example.com/" + id, Types: []string{events.TypeCreated}, Secret: "secret", CreatedAt: created_at.Add(time.Duration(i) * time.Second)}
+		if err := conn.CreateSubscription(subscription); err != nil {
+			t.Logf("err: %s", err)
+			t.FailNow()
+		}
+	}
+
+	subscriptions, err := conn.ListSubscriptions()
+	if err != nil || len(subscriptions) != 2 || subscriptions[0].ID != "b" || subscriptions[1].Types[0] != events.TypeCreated {
+		t.Logf("Expected 2 subscriptions oldest first, got: %+v (err: %v)", subscriptions, err)
+		t.Fail()
+	}
+
+	subscription, err := conn.RotateSubscriptionSecret("a", "new secret", created_at)
+	if err != nil || subscription.Secret != "new secret" || subscription.PreviousSecret != "secret" || subscription.URL != "https://example.com/a" {
+		t.Logf("Expected a rotated subscription, got: %+v (err: %v)", subscription, err)
+		t.Fail()
+	}
+	if subscription, err = conn.GetSubscription("a"); err != nil || subscription.Secret != "new secret" || subscription.PreviousSecret != "secret" || !subscription.PreviousSecretExpires.Equal(created_at.Add(events.RotationGrace)) {
+		t.Logf("Expected a rotated secret, got: %+v (err: %v)", subscription, err)
+		t.Fail()
+	}
+
+	for attempt := 1; attempt <= events.MaxDeliveries+2; attempt++ {
+		conn.RecordDelivery(events.Delivery{SubscriptionID: "a", EventID: "event", Attempt: attempt, Time: created_at})
+	}
+	deliveries, err := conn.ListDeliveries("a", events.MaxDeliveries+10)
+	if err != nil || len(deliveries) != events.MaxDeliveries || deliveries[0].Attempt != events.MaxDeliveries+2 || deliveries[len(deliveries)-1].Attempt != 3 {
+		t.Logf("Expected the latest %d deliveries newest first, got %d (err: %v)", events.MaxDeliveries, len(deliveries), err)
+		t.Fail()
+	}
+	if deliveries, _ = conn.ListDeliveries("a", 2); len(deliveries) != 2 {
+		t.Logf("Expected 2 deliveries, got: %+v", deliveries)
+		t.Fail()
+	}
+
+	// Deleting a subscription deletes its deliveries, and nothing can be done to it after
+	if err = conn.DeleteSubscription("a"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, err = conn.GetSubscription("a"); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	if _, err = conn.ListDeliveries("a", 10); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	if _, err = conn.RotateSubscriptionSecret("a", "newer secret", created_at); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	for _, err = range []error{conn.UpdateSubscription(subscription), conn.DeleteSubscription("a"), conn.RecordDelivery(events.Delivery{SubscriptionID: "a"})} {
+		if err != dberrors.ErrSubscriptionNotFound {
+			t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+			t.Fail()
+		}
+	}
+}
+
+func Test_Passwords(t *testing.T) {
+	conn := NewMemStore(60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	if _, err := conn.GetPasswordHash("billy2000"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected ErrNoPassword, got: %v", err)
+		t.Fail()
+	}
+
+	conn.SetPasswordHash("billy2000", "first")
+	conn.SetPasswordHash("billy2000", "second")
+	if hash, err := conn.GetPasswordHash("billy2000"); hash != "second" || err != nil {
+		t.Logf("Expected the second hash, got: %s (err: %v)", hash, err)
+		t.Fail()
+	}
+
+	if err := conn.DeletePasswordHash("billy2000"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, err := conn.GetPasswordHash("billy2000"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected ErrNoPassword after deleting, got: %v", err)
+		t.Fail()
+	}
+	if err := conn.DeletePasswordHash("billy2000"); err != nil {
+		t.Logf("Expected deleting no password to succeed, got: %v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,338 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+Generic JSON document patching, independent of the user schema:
+
+MergePatch		- RFC 7396 JSON Merge Patch (application/merge-patch+json)
+JSONPatch		- RFC 6902 JSON Patch (application/json-patch+json)
+
+Documents are decoded into interface{} trees, patched, and encoded again, so the caller is
+responsible for validating the result.
+*/
+
+// ErrTestFailed is returned when a JSON Patch "test" operation doesn't match the document
+var ErrTestFailed = errors.New("JSON Patch test operation failed")
+
+// MergePatch applies an RFC 7396 merge patch to a document. Objects are merged recursively,
+// null removes a member, and anything else replaces the target value.
+func MergePatch(document []byte, merge_patch []byte) ([]byte, error) {
+	var target interface{}
+	var patch interface{}
+
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(merge_patch, &patch); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergeValues(target, patch))
+}
+
+func mergeValues(target interface{}, patch interface{}) interface{} {
+	patch_object, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	target_object, ok := target.(map[string]interface{})
+	if !ok {
+		target_object = map[string]interface{}{}
+	}
+
+	for key, value := range patch_object {
+		if value == nil {
+			delete(target_object, key)
+		} else {
+			target_object[key] = mergeValues(target_object[key], value)
+		}
+	}
+
+	return target_object
+}
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// JSONPatch applies an RFC 6902 patch to a document. Operations are applied in order and the
+// patch is atomic: if any operation fails, the error is returned and no document is produced.
+func JSONPatch(document []byte, json_patch []byte) ([]byte, error) {
+	var target interface{}
+	var operations []operation
+
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(json_patch, &operations); err != nil {
+		return nil, err
+	}
+
+	for i, op := range operations {
+		var err error
+		target, err = applyOperation(target, op)
+		if err == ErrTestFailed {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("JSON Patch operation %d (%s): %s", i, op.Op, err)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func applyOperation(target interface{}, op operation) (interface{}, error) {
+	if op.Path == nil {
+		return nil, errors.New("missing path")
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.New("missing from")
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && len(from) == 0 {
+			return nil, errors.New("cannot move the whole document")
+		}
+		if op.Op == "move" && isPrefix(from, path) && len(from) < len(path) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+
+		value, err = getValue(target, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			target, err = modify(target, from, removeMember)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyValue(value)
+		}
+	}
+
+	// The root has no parent container, so it can only be replaced or tested
+	if len(path) == 0 {
+		switch op.Op {
+		case "add", "move", "copy", "replace":
+			return value, nil
+		case "remove":
+			return nil, errors.New("cannot remove the whole document")
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return modify(target, path, addMember(value))
+	case "remove":
+		return modify(target, path, removeMember)
+	case "replace":
+		return modify(target, path, replaceMember(value))
+	case "test":
+		current, err := getValue(target, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, ErrTestFailed
+		}
+		return target, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+func isPrefix(prefix []string, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// arrayIndex parses an array reference token, allowing "-" and len(array) only when appending
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (!appending && index == length) {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+
+	return index, nil
+}
+
+func getValue(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("path member %q not found", token)
+			}
+			node = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("path member %q not found", token)
+		}
+	}
+
+	return node, nil
+}
+
+// A memberFunc changes the member named by key in a parent container, returning the new container
+type memberFunc func(parent interface{}, key string) (interface{}, error)
+
+// modify walks to the parent of the location a non-empty pointer refers to and applies fn there.
+// Containers are rebuilt on the way back up, as inserting into a slice can move it.
+func modify(node interface{}, tokens []string, fn memberFunc) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(node, tokens[0])
+	}
+
+	child, err := getValue(node, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	new_child, err := modify(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = new_child
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(container), false)
+		container[index] = new_child
+	}
+
+	return node, nil
+}
+
+func addMember(value interface{}) memberFunc {
+	return func(parent interface{}, key string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, fmt.Errorf("cannot add member %q to a scalar", key)
+		}
+	}
+}
+
+func replaceMember(value interface{}) memberFunc {
+	return func(parent interface{}, key string) (interface{}, error) {
+		if _, err := getValue(parent, []string{key}); err != nil {
+			return nil, err
+		}
+
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[key] = value
+		case []interface{}:
+			index, _ := arrayIndex(key, len(container), false)
+			container[index] = value
+		}
+
+		return parent, nil
+	}
+}
+
+func removeMember(parent interface{}, key string) (interface{}, error) {
+	if _, err := getValue(parent, []string{key}); err != nil {
+		return nil, err
+	}
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		delete(container, key)
+		return container, nil
+	case []interface{}:
+		index, _ := arrayIndex(key, len(container), false)
+		return append(container[:index], container[index+1:]...), nil
+	}
+
+	return parent, nil
+}
+
+// copyValue deep copies a decoded value, so a "copy" doesn't alias its source
+func copyValue(value interface{}) interface{} {
+	var copied interface{}
+
+	encoded, _ := json.Marshal(value)
+	json.Unmarshal(encoded, &copied)
+
+	return copied
+}
@@ -0,0 +1,106 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func jsonEqual(a []byte, b string) bool {
+	var decoded_a interface{}
+	var decoded_b interface{}
+
+	json.Unmarshal(a, &decoded_a)
+	json.Unmarshal([]byte(b), &decoded_b)
+
+	return reflect.DeepEqual(decoded_a, decoded_b)
+}
+
+// Test cases from RFC 7396 Appendix A
+func Test_MergePatch(t *testing.T) {
+	test_cases := []struct{ document, patch, expected string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test_case := range test_cases {
+		result, err := MergePatch([]byte(test_case.document), []byte(test_case.patch))
+		if err != nil || !jsonEqual(result, test_case.expected) {
+			t.Logf("Document: %s Patch: %s\nExpected: %s\nGot: %s (err: %v)\n", test_case.document, test_case.patch, test_case.expected, result, err)
+			t.Fail()
+		}
+	}
+}
+
+// Test cases from RFC 6902 Appendix A
+func Test_JSONPatch(t *testing.T) {
+	test_cases := []struct{ document, patch, expected string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{
+			`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{
+			`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+
+	for _, test_case := range test_cases {
+		result, err := JSONPatch([]byte(test_case.document), []byte(test_case.patch))
+		if err != nil || !jsonEqual(result, test_case.expected) {
+			t.Logf("Document: %s Patch: %s\nExpected: %s\nGot: %s (err: %v)\n", test_case.document, test_case.patch, test_case.expected, result, err)
+			t.Fail()
+		}
+	}
+
+	invalid_patches := []string{
+		`[{"op":"remove","path":"/baz"}]`,
+		`[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+		`[{"op":"add","path":"/foo"}]`,
+		`[{"op":"replace","path":"/missing","value":1}]`,
+		`[{"op":"move","from":"/foo","path":"/foo/bar"}]`,
+		`[{"op":"frobnicate","path":"/foo"}]`,
+		`[{"op":"remove","path":""}]`,
+		`[{"op":"test","path":"/foo","value":"baz"}]`,
+		`{"op":"add"}`,
+	}
+
+	for _, invalid_patch := range invalid_patches {
+		result, err := JSONPatch([]byte(`{"foo":"bar"}`), []byte(invalid_patch))
+		if err == nil {
+			t.Logf("Invalid patch %s was applied: %s", invalid_patch, result)
+			t.Fail()
+		}
+	}
+
+	_, err := JSONPatch([]byte(`{"foo":"bar"}`), []byte(`[{"op":"test","path":"/foo","value":"baz"}]`))
+	if err != ErrTestFailed {
+		t.Logf("Expected: %s\nGot: %v\n", ErrTestFailed, err)
+		t.Fail()
+	}
+}
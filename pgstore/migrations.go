@@ -0,0 +1,133 @@
+package pgstore
+
+import (
+	"database/sql"
+)
+
+// Schema migrations, applied in order by migrate. Never edit a migration once released,
+// append a new one instead.
+var migrations = []string{
+	// 1: users, with the indexed fields kept in their own columns alongside the stored document
+	`CREATE TABLE users (
+		username		TEXT PRIMARY KEY,
+		data			TEXT NOT NULL,
+		email			TEXT NOT NULL,
+		fullname		TEXT NOT NULL,
+		region			TEXT NOT NULL,
+		country			TEXT NOT NULL,
+		version			BIGINT NOT NULL,
+		modified_nanos	BIGINT NOT NULL,
+		expires_at		TIMESTAMPTZ NOT NULL
+	);
+	CREATE UNIQUE INDEX users_email_key ON users (email) WHERE email <> '';
+	CREATE INDEX users_search_email ON users (lower(email));
+	CREATE INDEX users_region ON users (region);
+	CREATE INDEX users_country ON users (country);
+	CREATE INDEX users_fullname ON users (fullname text_pattern_ops);
+	CREATE INDEX users_expires_at ON users (expires_at);
+	CREATE SEQUENCE user_versions;`,
+
+	// 2: per-user expiry, encoded by validation.Expiry.String, with no expires_at for permanent users
+	`ALTER TABLE users ALTER COLUMN expires_at DROP NOT NULL;
+	ALTER TABLE users ADD COLUMN expiry TEXT NOT NULL DEFAULT '';`,
+
+	// 3: the recycle bin, soft deleted users kept until purge_at
+	`CREATE TABLE deleted_users (
+		username		TEXT PRIMARY KEY,
+		data			TEXT NOT NULL,
+		modified_nanos	BIGINT NOT NULL,
+		expiry			TEXT NOT NULL,
+		deleted_at		TIMESTAMPTZ NOT NULL,
+		deleted_by		TEXT NOT NULL,
+		purge_at		TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX deleted_users_purge_at ON deleted_users (purge_at);`,
+
+	// 4: earlier versions of users, kept by a trigger on every update and pruned by PostgresConn
+	`CREATE TABLE user_history (
+		username		TEXT NOT NULL,
+		version			BIGINT NOT NULL,
+		data			TEXT NOT NULL,
+		modified_nanos	BIGINT NOT NULL,
+		PRIMARY KEY (username, version)
+	);
+	CREATE FUNCTION keep_user_version() RETURNS TRIGGER AS $$
+	BEGIN
+		INSERT INTO user_history (username, version, data, modified_nanos)
+		VALUES (OLD.username, OLD.version, OLD.data, OLD.modified_nanos);
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+	CREATE TRIGGER users_keep_version AFTER UPDATE ON users
+		FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version) EXECUTE PROCEDURE keep_user_version();`,
+
+	// 5: webhook subscriptions, and the latest delivery attempts of each
+	`CREATE TABLE webhooks (
+		id						TEXT PRIMARY KEY,
+		url						TEXT NOT NULL,
+		types					TEXT[] NOT NULL,
+		secret					TEXT NOT NULL,
+		created_at				TIMESTAMPTZ NOT NULL,
+		previous_secret			TEXT NOT NULL DEFAULT '',
+		previous_secret_expires	TIMESTAMPTZ
+	);
+	CREATE TABLE webhook_deliveries (
+		id				BIGSERIAL PRIMARY KEY,
+		subscription_id	TEXT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event_id		TEXT NOT NULL,
+		event_type		TEXT NOT NULL,
+		attempt			INTEGER NOT NULL,
+		attempted_at	TIMESTAMPTZ NOT NULL,
+		status_code		INTEGER NOT NULL,
+		delivered		BOOLEAN NOT NULL,
+		error			TEXT NOT NULL
+	);
+	CREATE INDEX webhook_deliveries_subscription ON webhook_deliveries (subscription_id, id);`,
+
+	// 6: password hashes, apart from users so they outlive soft deletes
+	`CREATE TABLE passwords (
+		username	TEXT PRIMARY KEY,
+		hash		TEXT NOT NULL,
+		updated_at	TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`,
+
+	// 7: emails are searched normalized like users_email_key, which serves those lookups
+	`DROP INDEX IF EXISTS users_search_email;`,
+}
+
+// An arbitrary key for the advisory lock which stops replicas migrating concurrently
+const migrationLockKey = 727347001
+
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var applied int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied)
+	if err != nil {
+		return err
+	}
+
+	for version := applied + 1; version <= len(migrations); version++ {
+		if _, err = tx.Exec(migrations[version-1]); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,37 @@
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/Haelium/User-Manager-API/dberrors"
+)
+
+// Password hashes live in the passwords table, which has no foreign key to users as a soft
+// deleted user's row moves to deleted_users
+
+func (conn PostgresConn) SetPasswordHash(username string, hash string) error {
+	_, err := conn.db.Exec(`
+		INSERT INTO passwords (username, hash) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET hash = EXCLUDED.hash, updated_at = now()`,
+		username, hash,
+	)
+
+	return err
+}
+
+func (conn PostgresConn) GetPasswordHash(username string) (string, error) {
+	var hash string
+
+	err := conn.db.QueryRow(`SELECT hash FROM passwords WHERE username = $1`, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", dberrors.ErrNoPassword
+	}
+
+	return hash, err
+}
+
+func (conn PostgresConn) DeletePasswordHash(username string) error {
+	_, err := conn.db.Exec(`DELETE FROM passwords WHERE username = $1`, username)
+
+	return err
+}
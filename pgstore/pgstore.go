@@ -0,0 +1,576 @@
+package pgstore
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
+)
+
+/*
+PostgreSQL implementation of handlers.DatabaseInterface.
+
+Users live in a single table, with the fields used for lookups copied out of the stored document
+into their own columns: email is normalized and unique, fullname, region and country are lowercased
+for case insensitive searches. Versions come from a sequence, so they are never reused even if a
+user is deleted and recreated.
+
+Users expire as their validation.Expiry says, data_ttl seconds after their last modification by
+default, like RedisHashConn. Expiry is driven by the expires_at column, NULL for permanent users,
+rather than in-memory timers, so it survives restarts, and each expired row is deleted by exactly
+one replica. Soft deleted users move to the deleted_users table, and are purged and archived the
+same way once its purge_at passes. Every update keeps the version it replaces in the user_history
+table, pruned as the history policy says after each write.
+*/
+
+// How often each replica looks for expired users
+const reapInterval = time.Second
+
+type PostgresConn struct {
+	db        *sql.DB
+	data_ttl  int
+	retention int
+	history   versions.Policy
+	archiver  archive.Archiver
+	stop      chan bool
+}
+
+func NewPostgresConn(dsn string, data_ttl int, retention int, history versions.Policy, archiver archive.Archiver) (PostgresConn, error) {
+	var new_postgres_conn PostgresConn
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return new_postgres_conn, err
+	}
+
+	new_postgres_conn.db = db
+
+	err = db.Ping()
+	if err != nil {
+		return new_postgres_conn, err
+	}
+
+	err = migrate(db)
+	if err != nil {
+		return new_postgres_conn, err
+	}
+
+	new_postgres_conn.data_ttl = data_ttl
+	new_postgres_conn.retention = retention
+	new_postgres_conn.history = history
+	new_postgres_conn.archiver = archiver
+	new_postgres_conn.stop = make(chan bool)
+
+	go new_postgres_conn.reapExpired()
+
+	return new_postgres_conn, nil
+}
+
+// Close stops expiring users and closes the connection pool
+func (conn PostgresConn) Close() error {
+	close(conn.stop)
+
+	return conn.db.Close()
+}
+
+func (conn PostgresConn) GetUser(username string) (string, error) {
+	var user_json_string string
+
+	err := conn.db.QueryRow(`SELECT data FROM users WHERE username = $1`, username).Scan(&user_json_string)
+
+	return user_json_string, err
+}
+
+func (conn PostgresConn) GetUserWithVersion(username string) (string, string, error) {
+	var user_json_string string
+	var version int64
+
+	err := conn.db.QueryRow(`SELECT data, version FROM users WHERE username = $1`, username).Scan(&user_json_string, &version)
+	if err != nil {
+		return "", "", err
+	}
+
+	return user_json_string, strconv.FormatInt(version, 10), nil
+}
+
+// GetUserVersions returns a user's current version, then its earlier versions newest first. The
+// current version is always the newest, as versions come from one sequence.
+func (conn PostgresConn) GetUserVersions(username string) ([]versions.Version, error) {
+	rows, err := conn.db.Query(`
+		SELECT version, data, modified_nanos FROM users WHERE username = $1
+		UNION ALL
+		SELECT version, data, modified_nanos FROM user_history
+		WHERE username = $1 AND EXISTS (SELECT 1 FROM users WHERE username = $1)
+		ORDER BY version DESC`,
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	user_versions := []versions.Version{}
+	for rows.Next() {
+		var version, modified_nanos int64
+		var user_json_string string
+		if err = rows.Scan(&version, &user_json_string, &modified_nanos); err != nil {
+			return nil, err
+		}
+		user_versions = append(user_versions, versions.Version{Version: strconv.FormatInt(version, 10), Data: user_json_string, ModifiedAt: time.Unix(0, modified_nanos)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(user_versions) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	earlier := user_versions[1:]
+	return user_versions[:1+conn.history.Keep(earlier, time.Now())], nil
+}
+
+// pruneVersions drops the earlier versions of a user the history policy no longer keeps. The
+// write has already happened, so failures are only logged.
+func (conn PostgresConn) pruneVersions(username string) {
+	var oldest_kept int64
+	if conn.history.MaxAge > 0 {
+		oldest_kept = time.Now().Add(-conn.history.MaxAge).UnixNano()
+	}
+
+	_, err := conn.db.Exec(`
+		DELETE FROM user_history WHERE username = $1 AND (modified_nanos < $3 OR version NOT IN (
+			SELECT version FROM user_history WHERE username = $1 ORDER BY version DESC LIMIT $2
+		))`,
+		username, conn.history.MaxVersions, oldest_kept,
+	)
+	if err != nil {
+		log.Printf("Earlier versions of %s were not pruned: %s", username, err)
+	}
+}
+
+func (conn PostgresConn) GetUserExpiry(username string) (validation.Expiry, time.Time, error) {
+	var encoded_expiry string
+	var expires_at pq.NullTime
+
+	err := conn.db.QueryRow(`SELECT expiry, expires_at FROM users WHERE username = $1`, username).Scan(&encoded_expiry, &expires_at)
+	if err != nil {
+		return validation.Expiry{}, time.Time{}, err
+	}
+
+	expiry, err := validation.ParseExpiry(encoded_expiry)
+
+	return expiry, expires_at.Time, err
+}
+
+// expiresAt returns the expires_at column for a user written now, NULL if it never expires
+func (conn PostgresConn) expiresAt(expiry validation.Expiry) interface{} {
+	expires_at, expires := expiry.Deadline(time.Now(), conn.data_ttl)
+	if !expires {
+		return nil
+	}
+
+	return expires_at
+}
+
+func (conn PostgresConn) GetUserByEmail(email string) (string, error) {
+	var user_json_string string
+
+	err := conn.db.QueryRow(`SELECT data FROM users WHERE email = $1`, validation.NormalizeEmail(email)).Scan(&user_json_string)
+
+	return user_json_string, err
+}
+
+// userColumns returns the values of the indexed columns for a user document
+func userColumns(user_json_string string) (string, string, string, string) {
+	user := validation.ParseUserFields(user_json_string)
+
+	return validation.NormalizeEmail(user.Email), indexValue(user.FullName), indexValue(user.Region), indexValue(user.Country)
+}
+
+func indexValue(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func (conn PostgresConn) SetUser(username string, user_json_string string) error {
+	_, err := conn.SetUserIfVersion(username, user_json_string, "", validation.Expiry{})
+
+	return err
+}
+
+// SetUserIfVersion upserts a user when version is "", otherwise updates it only if it is at version
+func (conn PostgresConn) SetUserIfVersion(username string, user_json_string string, version string, expiry validation.Expiry) (string, error) {
+	email, fullname, region, country := userColumns(user_json_string)
+	var new_version int64
+	var err error
+
+	if version == "" {
+		err = conn.db.QueryRow(`
+			INSERT INTO users (username, data, email, fullname, region, country, version, modified_nanos, expires_at, expiry)
+			VALUES ($1, $2, $3, $4, $5, $6, nextval('user_versions'), $7, $8, $9)
+			ON CONFLICT (username) DO UPDATE SET
+				data = EXCLUDED.data, email = EXCLUDED.email, fullname = EXCLUDED.fullname,
+				region = EXCLUDED.region, country = EXCLUDED.country, version = EXCLUDED.version,
+				modified_nanos = EXCLUDED.modified_nanos, expires_at = EXCLUDED.expires_at, expiry = EXCLUDED.expiry
+			RETURNING version`,
+			username, user_json_string, email, fullname, region, country, time.Now().UnixNano(), conn.expiresAt(expiry), expiry.String(),
+		).Scan(&new_version)
+	} else {
+		err = conn.db.QueryRow(`
+			UPDATE users SET
+				data = $2, email = $3, fullname = $4, region = $5, country = $6, version = nextval('user_versions'),
+				modified_nanos = $7, expires_at = $8, expiry = $9
+			WHERE username = $1 AND version::TEXT = $10
+			RETURNING version`,
+			username, user_json_string, email, fullname, region, country, time.Now().UnixNano(), conn.expiresAt(expiry), expiry.String(), version,
+		).Scan(&new_version)
+		if err == sql.ErrNoRows {
+			return "", dberrors.ErrVersionMismatch
+		}
+	}
+
+	if err != nil {
+		return "", translateError(err)
+	}
+	conn.pruneVersions(username)
+
+	return strconv.FormatInt(new_version, 10), nil
+}
+
+// CreateUser fails with dberrors.ErrUserExists while the username is in the recycle bin too
+func (conn PostgresConn) CreateUser(username string, user_json_string string, expiry validation.Expiry) error {
+	email, fullname, region, country := userColumns(user_json_string)
+
+	result, err := conn.db.Exec(`
+		INSERT INTO users (username, data, email, fullname, region, country, version, modified_nanos, expires_at, expiry)
+		SELECT $1, $2, $3, $4, $5, $6, nextval('user_versions'), $7, $8, $9
+		WHERE NOT EXISTS (SELECT 1 FROM deleted_users WHERE username = $1)`,
+		username, user_json_string, email, fullname, region, country, time.Now().UnixNano(), conn.expiresAt(expiry), expiry.String(),
+	)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if created, err := result.RowsAffected(); err != nil || created == 0 {
+		return dberrors.ErrUserExists
+	}
+
+	return nil
+}
+
+// translateError maps unique constraint violations to the errors handlers expect
+func translateError(err error) error {
+	if pq_err, ok := err.(*pq.Error); ok && pq_err.Code == "23505" {
+		if pq_err.Constraint == "users_email_key" {
+			return dberrors.ErrEmailTaken
+		}
+		return dberrors.ErrUserExists
+	}
+
+	return err
+}
+
+func (conn PostgresConn) DeleteUser(username string) error {
+	return conn.DeleteUserIfVersion(username, "")
+}
+
+// DeleteUserIfVersion erases a user, and any soft deleted user in the recycle bin under its
+// username when version is ""
+func (conn PostgresConn) DeleteUserIfVersion(username string, version string) error {
+	var deleted int
+
+	err := conn.db.QueryRow(`
+		WITH live AS (
+			DELETE FROM users WHERE username = $1 AND ($2 = '' OR version::TEXT = $2) RETURNING 1
+		), bin AS (
+			DELETE FROM deleted_users WHERE username = $1 AND $2 = '' RETURNING 1
+		), forgotten AS (
+			DELETE FROM user_history WHERE username = $1 AND (EXISTS (SELECT 1 FROM live) OR EXISTS (SELECT 1 FROM bin))
+		)
+		SELECT (SELECT count(*) FROM live) + (SELECT count(*) FROM bin)`,
+		username, version,
+	).Scan(&deleted)
+	if err != nil || deleted > 0 {
+		return err
+	}
+
+	return conn.notDeleted(username)
+}
+
+// notDeleted explains why nothing was deleted, either the user doesn't exist or it's at another version
+func (conn PostgresConn) notDeleted(username string) error {
+	if _, err := conn.GetUser(username); err != nil {
+		return err
+	}
+
+	return dberrors.ErrVersionMismatch
+}
+
+// SoftDeleteUserIfVersion moves a user to the deleted_users table, replacing any user deleted
+// before under its username
+func (conn PostgresConn) SoftDeleteUserIfVersion(username string, version string, actor string) error {
+	result, err := conn.db.Exec(`
+		WITH moved AS (
+			DELETE FROM users WHERE username = $1 AND ($2 = '' OR version::TEXT = $2)
+			RETURNING username, data, modified_nanos, expiry
+		)
+		INSERT INTO deleted_users (username, data, modified_nanos, expiry, deleted_at, deleted_by, purge_at)
+		SELECT username, data, modified_nanos, expiry, now(), $3::TEXT, now() + $4::INTEGER * INTERVAL '1 second' FROM moved
+		ON CONFLICT (username) DO UPDATE SET
+			data = EXCLUDED.data, modified_nanos = EXCLUDED.modified_nanos, expiry = EXCLUDED.expiry,
+			deleted_at = EXCLUDED.deleted_at, deleted_by = EXCLUDED.deleted_by, purge_at = EXCLUDED.purge_at`,
+		username, version, actor, conn.retention,
+	)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 1 {
+		return err
+	}
+
+	return conn.notDeleted(username)
+}
+
+func (conn PostgresConn) GetDeletion(username string) (time.Time, string, error) {
+	var deleted_at time.Time
+	var deleted_by string
+
+	err := conn.db.QueryRow(`SELECT deleted_at, deleted_by FROM deleted_users WHERE username = $1`, username).Scan(&deleted_at, &deleted_by)
+	if err == sql.ErrNoRows {
+		return deleted_at, "", dberrors.ErrNotDeleted
+	}
+
+	return deleted_at, deleted_by, err
+}
+
+// UndeleteUser moves a user back from the deleted_users table, restarting its expiry
+func (conn PostgresConn) UndeleteUser(username string) (string, error) {
+	tx, err := conn.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var user_json_string, encoded_expiry string
+	var modified_nanos int64
+	err = tx.QueryRow(`DELETE FROM deleted_users WHERE username = $1 RETURNING data, modified_nanos, expiry`, username).Scan(&user_json_string, &modified_nanos, &encoded_expiry)
+	if err == sql.ErrNoRows {
+		return "", dberrors.ErrNotDeleted
+	} else if err != nil {
+		return "", err
+	}
+
+	expiry, err := validation.ParseExpiry(encoded_expiry)
+	if err != nil {
+		return "", err
+	}
+
+	email, fullname, region, country := userColumns(user_json_string)
+	_, err = tx.Exec(`
+		INSERT INTO users (username, data, email, fullname, region, country, version, modified_nanos, expires_at, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, nextval('user_versions'), $7, $8, $9)`,
+		username, user_json_string, email, fullname, region, country, time.Now().UnixNano(), conn.expiresAt(expiry), expiry.String(),
+	)
+	if err != nil {
+		return "", translateError(err)
+	}
+
+	return user_json_string, tx.Commit()
+}
+
+// ListUsers pages through users in username order, the cursor is the last username returned
+func (conn PostgresConn) ListUsers(cursor string, limit int) ([]string, string, error) {
+	last_username, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", errors.New("Invalid cursor")
+	}
+
+	rows, err := conn.db.Query(`SELECT username, data FROM users WHERE username > $1 ORDER BY username LIMIT $2`, string(last_username), limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return scanPage(rows, limit, func(username string, _ int) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(username))
+	})
+}
+
+// SearchUsers supports the same filters as RedisHashConn.SearchUsers, using the indexed columns.
+// Matches are ordered by username and the cursor is the offset into that ordering.
+func (conn PostgresConn) SearchUsers(filters map[string]string, cursor string, limit int) ([]string, string, error) {
+	offset := 0
+	if cursor != "" {
+		decoded_cursor, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded_cursor))
+		}
+		if err != nil || offset < 0 {
+			return nil, "", errors.New("Invalid cursor")
+		}
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	add_condition := func(condition string, value string) {
+		args = append(args, value)
+		conditions = append(conditions, strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), -1))
+	}
+
+	if value, ok := filters["email"]; ok {
+		add_condition(`email = ?`, validation.NormalizeEmail(value))
+	}
+	if value, ok := filters["country"]; ok {
+		add_condition(`country = ?`, indexValue(value))
+	}
+	if value, ok := filters["region"]; ok {
+		add_condition(`region = ?`, indexValue(value))
+	}
+	if value, ok := filters["name_prefix"]; ok {
+		escaped_prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(indexValue(value))
+		add_condition(`fullname LIKE ?`, escaped_prefix+"%")
+	}
+
+	if len(conditions) == 0 {
+		return nil, "", errors.New("No search filters given")
+	}
+
+	args = append(args, limit+1, offset)
+	rows, err := conn.db.Query(
+		`SELECT username, data FROM users WHERE `+strings.Join(conditions, " AND ")+
+			` ORDER BY username LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return scanPage(rows, limit, func(_ string, count int) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + count)))
+	})
+}
+
+// scanPage reads up to limit users from rows selected with LIMIT limit+1. If the extra row is
+// there, another page follows and next_cursor builds its cursor from the last username returned.
+func scanPage(rows *sql.Rows, limit int, next_cursor func(string, int) string) ([]string, string, error) {
+	defer rows.Close()
+
+	users := []string{}
+	last_username := ""
+	more := false
+	for rows.Next() {
+		if len(users) == limit {
+			more = true
+			break
+		}
+
+		var user_json_string string
+		if err := rows.Scan(&last_username, &user_json_string); err != nil {
+			return nil, "", err
+		}
+		users = append(users, user_json_string)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if !more {
+		return users, "", nil
+	}
+
+	return users, next_cursor(last_username, len(users)), nil
+}
+
+func (conn PostgresConn) reapExpired() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.stop:
+			return
+		case <-ticker.C:
+			conn.expire()
+			conn.purge()
+		}
+	}
+}
+
+// expire deletes users past their expiry and archives them, like RedisHashConn.expire.
+// SKIP LOCKED lets replicas reap concurrently without ever deleting the same row twice.
+func (conn PostgresConn) expire() {
+	rows, err := conn.db.Query(`
+		WITH expired AS (
+			DELETE FROM users WHERE username IN (
+				SELECT username FROM users WHERE expires_at <= now() ORDER BY expires_at LIMIT 100 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING username, data, modified_nanos
+		), forgotten AS (
+			DELETE FROM user_history WHERE username IN (SELECT username FROM expired)
+		), unset AS (
+			DELETE FROM passwords WHERE username IN (SELECT username FROM expired)
+		)
+		SELECT username, data, modified_nanos FROM expired`)
+	if err != nil {
+		return
+	}
+	expired := []archive.Record{}
+	for rows.Next() {
+		record := archive.Record{ExpiredAt: time.Now(), Reason: archive.ReasonExpired}
+		if rows.Scan(&record.Username, &record.Data, &record.ModifiedNanos) != nil {
+			continue
+		}
+		expired = append(expired, record)
+	}
+	rows.Close()
+
+	// Archived once the rows are deleted, as retries can take a while
+	for _, record := range expired {
+		if err = conn.archiver.Archive(record); err != nil {
+			log.Printf("Expired user %s was not archived: %s\nData: %s", record.Username, err, record.Data)
+		}
+	}
+}
+
+// purge deletes users past their purge_at from the recycle bin and archives them, like expire
+func (conn PostgresConn) purge() {
+	rows, err := conn.db.Query(`
+		WITH purged AS (
+			DELETE FROM deleted_users WHERE username IN (
+				SELECT username FROM deleted_users WHERE purge_at <= now() ORDER BY purge_at LIMIT 100 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING username, data, modified_nanos
+		), forgotten AS (
+			DELETE FROM user_history WHERE username IN (SELECT username FROM purged)
+		), unset AS (
+			DELETE FROM passwords WHERE username IN (SELECT username FROM purged)
+		)
+		SELECT username, data, modified_nanos FROM purged`)
+	if err != nil {
+		return
+	}
+	purged := []archive.Record{}
+	for rows.Next() {
+		record := archive.Record{ExpiredAt: time.Now(), Reason: archive.ReasonPurged}
+		if rows.Scan(&record.Username, &record.Data, &record.ModifiedNanos) != nil {
+			continue
+		}
+		purged = append(purged, record)
+	}
+	rows.Close()
+
+	for _, record := range purged {
+		if err = conn.archiver.Archive(record); err != nil {
+			log.Printf("Purged user %s was not archived: %s\nData: %s", record.Username, err, record.Data)
+		}
+	}
+}
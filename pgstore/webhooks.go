@@ -0,0 +1,180 @@
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+)
+
+/*
+Webhook subscriptions live in the webhooks table, and their delivery attempts in
+webhook_deliveries, which is trimmed to the latest events.MaxDeliveries of each subscription as
+they're recorded and cascades when a subscription is deleted.
+*/
+
+const subscriptionColumns = `id, url, types, secret, created_at, previous_secret, previous_secret_expires`
+
+// nullableTime stores the zero time as NULL
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+func (conn PostgresConn) CreateSubscription(subscription events.Subscription) error {
+	_, err := conn.db.Exec(`INSERT INTO webhooks (`+subscriptionColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		subscription.ID, subscription.URL, pq.Array(append([]string{}, subscription.Types...)), subscription.Secret, subscription.CreatedAt,
+		subscription.PreviousSecret, nullableTime(subscription.PreviousSecretExpires),
+	)
+
+	return err
+}
+
+// scanner is a *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanSubscription(row scanner) (events.Subscription, error) {
+	var subscription events.Subscription
+	var previous_secret_expires sql.NullTime
+
+	err := row.Scan(&subscription.ID, &subscription.URL, pq.Array(&subscription.Types), &subscription.Secret, &subscription.CreatedAt,
+		&subscription.PreviousSecret, &previous_secret_expires,
+	)
+	if err == sql.ErrNoRows {
+		return subscription, dberrors.ErrSubscriptionNotFound
+	}
+	if previous_secret_expires.Valid {
+		subscription.PreviousSecretExpires = previous_secret_expires.Time
+	}
+
+	return subscription, err
+}
+
+func (conn PostgresConn) GetSubscription(id string) (events.Subscription, error) {
+	return scanSubscription(conn.db.QueryRow(`SELECT `+subscriptionColumns+` FROM webhooks WHERE id = $1`, id))
+}
+
+// ListSubscriptions returns every subscription, oldest first
+func (conn PostgresConn) ListSubscriptions() ([]events.Subscription, error) {
+	rows, err := conn.db.Query(`SELECT ` + subscriptionColumns + ` FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []events.Subscription{}
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func (conn PostgresConn) UpdateSubscription(subscription events.Subscription) error {
+	result, err := conn.db.Exec(`
+		UPDATE webhooks SET url = $2, types = $3, secret = $4, previous_secret = $5, previous_secret_expires = $6
+		WHERE id = $1`,
+		subscription.ID, subscription.URL, pq.Array(append([]string{}, subscription.Types...)), subscription.Secret,
+		subscription.PreviousSecret, nullableTime(subscription.PreviousSecretExpires),
+	)
+	if err != nil {
+		return err
+	}
+
+	return subscriptionAffected(result)
+}
+
+// RotateSubscriptionSecret moves the secret to previous_secret in the same UPDATE, where secret
+// is still the one being replaced
+func (conn PostgresConn) RotateSubscriptionSecret(id string, secret string, now time.Time) (events.Subscription, error) {
+	return scanSubscription(conn.db.QueryRow(`
+		UPDATE webhooks SET previous_secret = secret, previous_secret_expires = $3, secret = $2
+		WHERE id = $1
+		RETURNING `+subscriptionColumns,
+		id, secret, now.Add(events.RotationGrace).UTC(),
+	))
+}
+
+func subscriptionAffected(result sql.Result) error {
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return dberrors.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+func (conn PostgresConn) DeleteSubscription(id string) error {
+	result, err := conn.db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return subscriptionAffected(result)
+}
+
+// RecordDelivery inserts a delivery, then drops the subscription's beyond events.MaxDeliveries
+func (conn PostgresConn) RecordDelivery(delivery events.Delivery) error {
+	_, err := conn.db.Exec(`
+		INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, attempt, attempted_at, status_code, delivered, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		delivery.SubscriptionID, delivery.EventID, delivery.EventType, delivery.Attempt, delivery.Time, delivery.StatusCode, delivery.Delivered, delivery.Error,
+	)
+	// A foreign key violation, the subscription has been deleted
+	if pq_err, ok := err.(*pq.Error); ok && pq_err.Code == "23503" {
+		return dberrors.ErrSubscriptionNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = conn.db.Exec(`
+		DELETE FROM webhook_deliveries WHERE subscription_id = $1 AND id <= (
+			SELECT id FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id DESC OFFSET $2 LIMIT 1
+		)`,
+		delivery.SubscriptionID, events.MaxDeliveries,
+	)
+
+	return err
+}
+
+// ListDeliveries returns a subscription's latest deliveries, newest first
+func (conn PostgresConn) ListDeliveries(id string, limit int) ([]events.Delivery, error) {
+	if _, err := conn.GetSubscription(id); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.db.Query(`
+		SELECT subscription_id, event_id, event_type, attempt, attempted_at, status_code, delivered, error
+		FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id DESC LIMIT $2`,
+		id, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []events.Delivery{}
+	for rows.Next() {
+		var delivery events.Delivery
+		err = rows.Scan(&delivery.SubscriptionID, &delivery.EventID, &delivery.EventType, &delivery.Attempt, &delivery.Time, &delivery.StatusCode, &delivery.Delivered, &delivery.Error)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,115 @@
+package redisutil
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/auth"
+)
+
+/*
+RedisLockout is an auth.Lockout shared by every replica. Attempts within the window are kept in
+the login_failures:user:{username} and login_failures:ip:{ip} sorted sets, scored by their time in
+milliseconds, and counted by a script so concurrent attempts can't all pass the limit. Locks are
+the login_lock:user:{username} and login_lock:ip:{ip} keys, which expire when the lock ends.
+*/
+type RedisLockout struct {
+	client *redis.Client
+	policy auth.LockoutPolicy
+}
+
+// Lockout counts failed logins with the connection's client
+func (db RedisHashConn) Lockout(policy auth.LockoutPolicy) RedisLockout {
+	return RedisLockout{client: db.client, policy: policy}
+}
+
+// NewRedisLockout connects a lockout of its own, for backends other than Redis
+func NewRedisLockout(address string, password string, database int, maxretries int, policy auth.LockoutPolicy) (RedisLockout, error) {
+	var new_lockout RedisLockout
+
+	new_lockout.client = redis.NewClient(&redis.Options{
+		Addr:       address,
+		Password:   password,
+		DB:         database,
+		MaxRetries: maxretries,
+	})
+	new_lockout.policy = policy
+
+	_, err := new_lockout.client.Ping().Result()
+
+	return new_lockout, err
+}
+
+func (lockout RedisLockout) Close() error {
+	return lockout.client.Close()
+}
+
+func lockoutKeys(username string, ip string) []string {
+	return []string{"login_failures:user:" + username, "login_failures:ip:" + ip, "login_lock:user:" + username, "login_lock:ip:" + ip}
+}
+
+// millisDuration converts a PTTL reply, negative for no lock, to how long is left of a lock
+func millisDuration(millis int64) time.Duration {
+	if millis < 0 {
+		return 0
+	}
+
+	return time.Duration(millis) * time.Millisecond
+}
+
+// KEYS: login_failures:user:{username}, login_failures:ip:{ip}, login_lock:user:{username},
+// login_lock:ip:{ip}
+// ARGV: time of the attempt in milliseconds, window in milliseconds, failures a username is
+// allowed, failures an IP is allowed, lock duration in milliseconds, attempt ID
+// Returns the milliseconds left of the longer lock, or a negative number if neither is locked.
+// Attempts while locked aren't counted.
+var attemptLoginScript = redis.NewScript(`
+local locked = math.max(redis.call('PTTL', KEYS[3]), redis.call('PTTL', KEYS[4]))
+if locked > 0 then
+	return locked
+end
+for i = 1, 2 do
+	redis.call('ZREMRANGEBYSCORE', KEYS[i], '-inf', tonumber(ARGV[1]) - tonumber(ARGV[2]))
+	redis.call('ZADD', KEYS[i], ARGV[1], ARGV[6])
+	redis.call('PEXPIRE', KEYS[i], ARGV[2])
+	if redis.call('ZCARD', KEYS[i]) > tonumber(ARGV[2 + i]) then
+		redis.call('SET', KEYS[i + 2], '1', 'PX', ARGV[5])
+		redis.call('DEL', KEYS[i])
+		locked = math.max(locked, tonumber(ARGV[5]))
+	end
+end
+return locked
+`)
+
+func (lockout RedisLockout) Attempt(username string, ip string) (string, time.Duration, error) {
+	attempt := auth.NewAttemptID()
+
+	locked, err := attemptLoginScript.Run(lockout.client, lockoutKeys(username, ip),
+		unixMillis(time.Now()), lockout.policy.Window.Milliseconds(), lockout.policy.UserFailures, lockout.policy.IPFailures,
+		lockout.policy.Duration.Milliseconds(), attempt,
+	).Int64()
+	if err != nil {
+		return attempt, 0, err
+	}
+
+	return attempt, millisDuration(locked), nil
+}
+
+func (lockout RedisLockout) Succeed(username string, ip string, attempt string) error {
+	keys := lockoutKeys(username, ip)
+
+	_, err := lockout.client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(keys[0])
+		pipe.ZRem(keys[1], attempt)
+		return nil
+	})
+
+	return err
+}
+
+func (lockout RedisLockout) Unlock(username string) error {
+	keys := lockoutKeys(username, "")
+
+	return lockout.client.Del(keys[0], keys[2]).Err()
+}
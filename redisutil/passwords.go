@@ -0,0 +1,27 @@
+package redisutil
+
+import (
+	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/dberrors"
+)
+
+// Password hashes are kept in the passwords hash, username -> hash, apart from the users' hashes
+// so they're never read with them
+
+func (db RedisHashConn) SetPasswordHash(username string, hash string) error {
+	return db.client.HSet("passwords", username, hash).Err()
+}
+
+func (db RedisHashConn) GetPasswordHash(username string) (string, error) {
+	hash, err := db.client.HGet("passwords", username).Result()
+	if err == redis.Nil {
+		return "", dberrors.ErrNoPassword
+	}
+
+	return hash, err
+}
+
+func (db RedisHashConn) DeletePasswordHash(username string) error {
+	return db.client.HDel("passwords", username).Err()
+}
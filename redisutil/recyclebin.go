@@ -0,0 +1,206 @@
+package redisutil
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/validation"
+)
+
+// tombstone is a soft deleted user, as stored in the deleted_users hash
+type tombstone struct {
+	Data          string `json:"data"`
+	ModifiedNanos int64  `json:"modified_nanos"`
+	// Encoded validation.Expiry, which the user gets back if it's undeleted
+	Expiry       string `json:"expiry,omitempty"`
+	DeletedNanos int64  `json:"deleted_nanos"`
+	DeletedBy    string `json:"deleted_by"`
+}
+
+// SoftDeleteUserIfVersion moves a user to the recycle bin if its current version matches
+// version, or unconditionally if version is "". It's purged retention seconds later.
+func (db RedisHashConn) SoftDeleteUserIfVersion(username string, version string, actor string) error {
+	for {
+		var user_cmd, modified_cmd, policy_cmd *redis.StringCmd
+		db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			user_cmd = pipe.HGet("users", username)
+			modified_cmd = pipe.HGet("modified_user_time", username)
+			policy_cmd = pipe.HGet("user_expiry_policy", username)
+			return nil
+		})
+		user_json_string, err := user_cmd.Result()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		modified_nanos, _ := strconv.ParseInt(modified_cmd.Val(), 10, 64)
+		deleted_json, err := json.Marshal(tombstone{
+			Data:          user_json_string,
+			ModifiedNanos: modified_nanos,
+			Expiry:        policy_cmd.Val(),
+			DeletedNanos:  now.UnixNano(),
+			DeletedBy:     actor,
+		})
+		if err != nil {
+			return err
+		}
+		purge_deadline := unixMillis(now.Add(time.Duration(db.retention) * time.Second))
+
+		set_keys, fullname_member := indexEntries(username, user_json_string)
+		keys := append([]string{"users", "user_emails", "user_versions", "modified_user_time", "user_expiry", "user_expiry_policy", "deleted_users", "user_purge", fullnameIndexKey}, set_keys...)
+		deleted, err := softDeleteUserScript.Run(db.client, keys,
+			username, userEmail(user_json_string), version, user_json_string, deleted_json, purge_deadline, fullname_member,
+		).Int()
+		if err != nil {
+			return err
+		}
+		switch deleted {
+		case -4:
+			// The user changed since it was read, so its tombstone and index entries have too
+			continue
+		case -2:
+			return dberrors.ErrVersionMismatch
+		}
+
+		return nil
+	}
+}
+
+func (db RedisHashConn) getTombstone(username string) (tombstone, string, error) {
+	var deleted tombstone
+
+	deleted_json, err := db.client.HGet("deleted_users", username).Result()
+	if err == redis.Nil {
+		return deleted, "", dberrors.ErrNotDeleted
+	} else if err != nil {
+		return deleted, "", err
+	}
+
+	return deleted, deleted_json, json.Unmarshal([]byte(deleted_json), &deleted)
+}
+
+func (db RedisHashConn) GetDeletion(username string) (time.Time, string, error) {
+	deleted, _, err := db.getTombstone(username)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	return time.Unix(0, deleted.DeletedNanos), deleted.DeletedBy, nil
+}
+
+// UndeleteUser takes a user out of the recycle bin, restarting its expiry
+func (db RedisHashConn) UndeleteUser(username string) (string, error) {
+	deleted, deleted_json, err := db.getTombstone(username)
+	if err != nil {
+		return "", err
+	}
+
+	expiry, err := validation.ParseExpiry(deleted.Expiry)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.storeUser(username, deleted.Data, "", "undelete", "", expiry, deleted_json)
+	if err != nil {
+		return "", err
+	}
+
+	return deleted.Data, nil
+}
+
+// KEYS: users, user_emails, user_versions, modified_user_time, user_expiry, user_expiry_policy,
+// deleted_users, user_purge, user_index:fullname, the user's index sets
+// ARGV: username, email, expected version or "", user json the caller read, tombstone json,
+// purge deadline, fullname index member or ""
+// Moves a user to the recycle bin, replacing any tombstone already there. Returns without
+// deleting anything -4 if the user has changed since the caller read it, or -2 if it isn't at the
+// expected version.
+var softDeleteUserScript = redis.NewScript(`
+if ARGV[3] ~= '' and (redis.call('HGET', KEYS[3], ARGV[1]) or '0') ~= ARGV[3] then
+	return -2
+end
+if (redis.call('HGET', KEYS[1], ARGV[1]) or '') ~= ARGV[4] then
+	return -4
+end
+
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('ZREM', KEYS[5], ARGV[1])
+redis.call('HDEL', KEYS[6], ARGV[1])
+
+if ARGV[2] ~= '' and redis.call('HGET', KEYS[2], ARGV[2]) == ARGV[1] then
+	redis.call('HDEL', KEYS[2], ARGV[2])
+end
+
+redis.call('HSET', KEYS[7], ARGV[1], ARGV[5])
+redis.call('ZADD', KEYS[8], ARGV[6], ARGV[1])
+
+for i = 10, #KEYS do
+	redis.call('ZREM', KEYS[i], ARGV[1])
+end
+if ARGV[7] ~= '' then
+	redis.call('ZREM', KEYS[9], ARGV[7])
+end
+
+return 1
+`)
+
+// KEYS: deleted_users, user_purge, user_history:{username}, passwords
+// ARGV: username, now, tombstone json the caller read
+// Purges a user and its password hash from the recycle bin if it is due and hasn't changed since the caller read it.
+// Returns 1 if it was purged, so exactly one replica archives it, or 0 if it was left alone.
+var purgeUserScript = redis.NewScript(`
+local deadline = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+
+local deleted_json = redis.call('HGET', KEYS[1], ARGV[1])
+if not deleted_json then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return 0
+end
+if deleted_json ~= ARGV[3] then
+	return 0
+end
+
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[3])
+redis.call('HDEL', KEYS[4], ARGV[1])
+
+return 1
+`)
+
+// purge deletes users past their retention in the recycle bin and archives them, like expire
+func (db RedisHashConn) purge() {
+	now := strconv.FormatInt(unixMillis(time.Now()), 10)
+
+	usernames, err := db.client.ZRangeByScore("user_purge", redis.ZRangeBy{Min: "-inf", Max: now, Count: reapBatchSize}).Result()
+	if err != nil {
+		return
+	}
+
+	for _, username := range usernames {
+		deleted_json, _ := db.client.HGet("deleted_users", username).Result()
+
+		purged, err := purgeUserScript.Run(db.client, []string{"deleted_users", "user_purge", historyKey(username), "passwords"}, username, now, deleted_json).Int()
+		if err != nil || purged != 1 {
+			continue
+		}
+
+		var deleted tombstone
+		json.Unmarshal([]byte(deleted_json), &deleted)
+		err = db.archiver.Archive(archive.Record{Username: username, Data: deleted.Data, ModifiedNanos: deleted.ModifiedNanos, ExpiredAt: time.Now(), Reason: archive.ReasonPurged})
+		if err != nil {
+			log.Printf("Purged user %s was not archived: %s\nData: %s", username, err, deleted.Data)
+		}
+	}
+}
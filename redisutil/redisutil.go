@@ -1,24 +1,42 @@
 package redisutil
 
 import (
-	"os"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bsm/redislock"
 	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
 )
 
+// How often each replica looks for expired users
+const reapInterval = time.Second
+
+// Most users expired by one replica in a single pass
+const reapBatchSize = 100
+
 type RedisHashConn struct {
-	client              *redis.Client
-	locker              *redislock.Client
-	data_ttl            int
-	timeout_threshold   int
-	persisting_filepath string
+	client            *redis.Client
+	locker            *redislock.Client
+	data_ttl          int
+	retention         int
+	history           versions.Policy
+	timeout_threshold int
+	archiver          archive.Archiver
+	stop              chan bool
 }
 
 // TODO: return err
-func NewRedisHashConn(address string, password string, database int, maxretries int, data_ttl int, persisting_filepath string) (RedisHashConn, error) {
+func NewRedisHashConn(address string, password string, database int, maxretries int, data_ttl int, retention int, history versions.Policy, archiver archive.Archiver) (RedisHashConn, error) {
 	var new_redis_conn RedisHashConn
 
 	new_client := redis.NewClient(&redis.Options{
@@ -39,58 +57,643 @@ func NewRedisHashConn(address string, password string, database int, maxretries
 
 	new_redis_conn.locker = redislock.New(new_client)
 	new_redis_conn.data_ttl = data_ttl
-	new_redis_conn.persisting_filepath = persisting_filepath
+	new_redis_conn.retention = retention
+	new_redis_conn.history = history
+	new_redis_conn.archiver = archiver
+	new_redis_conn.stop = make(chan bool)
+
+	err = new_redis_conn.scheduleUnscheduled()
+	if err != nil {
+		return new_redis_conn, err
+	}
+
+	err = new_redis_conn.indexUnindexed()
+	if err != nil {
+		return new_redis_conn, err
+	}
+
+	go new_redis_conn.reapExpired()
 
 	return new_redis_conn, nil
 }
 
+// Close stops expiring users and closes the client
+func (db RedisHashConn) Close() error {
+	close(db.stop)
+
+	return db.client.Close()
+}
+
 func (db RedisHashConn) GetUser(username string) (string, error) {
 	value, err := db.client.HGet("users", username).Result()
 
 	return value, err
 }
 
+// ListUsers returns at most limit users from the users hash using HSCAN, starting at the
+// position described by cursor. An empty cursor starts a new scan, and an empty next cursor
+// means the scan is complete.
+// HSCAN treats COUNT as a hint and small hashes come back in a single batch, so the cursor
+// token also records how many entries of the current batch have already been returned.
+func (db RedisHashConn) ListUsers(cursor string, limit int) ([]string, string, error) {
+	scan_cursor, skip, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	users := []string{}
+	for {
+		batch, next_scan_cursor, err := db.client.HScan("users", scan_cursor, "", int64(limit)).Result()
+		if err != nil {
+			return nil, "", err
+		}
+
+		// HSCAN replies with alternating field and value entries
+		values := []string{}
+		for i := 1; i < len(batch); i += 2 {
+			values = append(values, batch[i])
+		}
+		if skip > len(values) {
+			skip = len(values)
+		}
+		values = values[skip:]
+
+		remaining := limit - len(users)
+		if len(values) > remaining {
+			users = append(users, values[:remaining]...)
+			return users, encodeScanCursor(scan_cursor, skip+remaining), nil
+		}
+
+		users = append(users, values...)
+		skip = 0
+		scan_cursor = next_scan_cursor
+
+		if scan_cursor == 0 {
+			return users, "", nil
+		}
+		if len(users) == limit {
+			return users, encodeScanCursor(scan_cursor, 0), nil
+		}
+	}
+}
+
+func encodeScanCursor(scan_cursor uint64, skip int) string {
+	token := strconv.FormatUint(scan_cursor, 10) + ":" + strconv.Itoa(skip)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+func decodeScanCursor(cursor string) (uint64, int, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+
+	token, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+
+	parts := strings.Split(string(token), ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+
+	scan_cursor, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+	skip, err := strconv.Atoi(parts[1])
+	if err != nil || skip < 0 {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+
+	return scan_cursor, skip, nil
+}
+
 func (db RedisHashConn) SetUser(username string, user_json_string string) error {
+	_, err := db.SetUserIfVersion(username, user_json_string, "", validation.Expiry{})
+
+	return err
+}
+
+// SetUserIfVersion stores a user only if its current version matches version, or unconditionally
+// if version is "". Returns the new version, or dberrors.ErrVersionMismatch.
+func (db RedisHashConn) SetUserIfVersion(username string, user_json_string string, version string, expiry validation.Expiry) (string, error) {
 	lock, _ := db.locker.Obtain(username, 300*time.Second, nil)
 	defer lock.Release()
 	// Critical path here, set user, and timestamp of modification
-	err := db.client.HSet("users", username, user_json_string).Err()
-	time_of_modification_string := strconv.FormatInt(time.Now().UnixNano(), 10)
-	db.client.HSet("modified_user_time", username, time_of_modification_string)
+	old_user_json, _ := db.GetUser(username)
+
+	return db.storeUser(username, user_json_string, old_user_json, "set", version, expiry, "")
+}
 
-	go db.expire(username, time_of_modification_string)
+// CreateUser stores a new user, failing with dberrors.ErrUserExists if the username is taken.
+// The existence check and the write happen in one script, so concurrent creates on different
+// replicas can't both succeed.
+func (db RedisHashConn) CreateUser(username string, user_json_string string, expiry validation.Expiry) error {
+	_, err := db.storeUser(username, user_json_string, "", "create", "", expiry, "")
 
 	return err
 }
 
+// storeUser runs setUserScript, deleted_json is the tombstone being undeleted in "undelete" mode
+func (db RedisHashConn) storeUser(username string, user_json_string string, old_user_json string, mode string, version string, expiry validation.Expiry, deleted_json string) (string, error) {
+	time_of_modification := time.Now()
+	expiry_deadline := ""
+	if expires_at, expires := expiry.Deadline(time_of_modification, db.data_ttl); expires {
+		expiry_deadline = strconv.FormatInt(unixMillis(expires_at), 10)
+	}
+
+	oldest_kept := ""
+	if db.history.MaxAge > 0 {
+		oldest_kept = strconv.FormatInt(time_of_modification.Add(-db.history.MaxAge).UnixNano(), 10)
+	}
+
+	new_set_keys, new_fullname_member := indexEntries(username, user_json_string)
+
+	var new_version int64
+	for {
+		old_set_keys, old_fullname_member := indexEntries(username, old_user_json)
+		keys := append([]string{"users", "user_emails", "user_versions", "modified_user_time", "user_expiry", "user_expiry_policy", "deleted_users", "user_purge", historyKey(username), fullnameIndexKey}, old_set_keys...)
+
+		var err error
+		new_version, err = setUserScript.Run(db.client, append(keys, new_set_keys...),
+			username, user_json_string, userEmail(user_json_string), userEmail(old_user_json), mode, version,
+			time_of_modification.UnixNano(), expiry_deadline, expiry.String(), deleted_json, db.history.MaxVersions, oldest_kept,
+			len(old_set_keys), old_fullname_member, new_fullname_member, old_user_json,
+		).Int64()
+		if err != nil {
+			return "", err
+		}
+		if new_version != -4 {
+			break
+		}
+		// The user changed since it was read, so its index entries have too
+		old_user_json, _ = db.GetUser(username)
+	}
+	switch new_version {
+	case -3:
+		return "", dberrors.ErrNotDeleted
+	case -2:
+		return "", dberrors.ErrVersionMismatch
+	case -1:
+		return "", dberrors.ErrUserExists
+	case 0:
+		return "", dberrors.ErrEmailTaken
+	}
+
+	return strconv.FormatInt(new_version, 10), nil
+}
+
+// GetUserWithVersion returns a user together with its current version, read in one transaction
+func (db RedisHashConn) GetUserWithVersion(username string) (string, string, error) {
+	var user_cmd, version_cmd *redis.StringCmd
+
+	_, err := db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		user_cmd = pipe.HGet("users", username)
+		version_cmd = pipe.HGet("user_versions", username)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return "", "", err
+	}
+
+	user_json_string, err := user_cmd.Result()
+	if err != nil {
+		return "", "", err
+	}
+
+	// Users stored before versioning was introduced have no version yet
+	version := version_cmd.Val()
+	if version == "" {
+		version = "0"
+	}
+
+	return user_json_string, version, nil
+}
+
+func historyKey(username string) string {
+	return "user_history:" + username
+}
+
+// earlierVersion is an entry of a user_history list
+type earlierVersion struct {
+	Version       string `json:"version"`
+	ModifiedNanos int64  `json:"modified_nanos,string"`
+	Data          string `json:"data"`
+}
+
+// GetUserVersions returns a user's current version, then its earlier versions newest first, read
+// in one transaction
+func (db RedisHashConn) GetUserVersions(username string) ([]versions.Version, error) {
+	var user_cmd, version_cmd, modified_cmd *redis.StringCmd
+	var history_cmd *redis.StringSliceCmd
+
+	_, err := db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		user_cmd = pipe.HGet("users", username)
+		version_cmd = pipe.HGet("user_versions", username)
+		modified_cmd = pipe.HGet("modified_user_time", username)
+		history_cmd = pipe.LRange(historyKey(username), 0, -1)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	user_json_string, err := user_cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	version := version_cmd.Val()
+	if version == "" {
+		version = "0"
+	}
+	modified_nanos, _ := strconv.ParseInt(modified_cmd.Val(), 10, 64)
+
+	earlier := []versions.Version{}
+	for _, encoded := range history_cmd.Val() {
+		var entry earlierVersion
+		if json.Unmarshal([]byte(encoded), &entry) == nil {
+			earlier = append(earlier, versions.Version{Version: entry.Version, Data: entry.Data, ModifiedAt: time.Unix(0, entry.ModifiedNanos)})
+		}
+	}
+
+	user_versions := []versions.Version{{Version: version, Data: user_json_string, ModifiedAt: time.Unix(0, modified_nanos)}}
+
+	return append(user_versions, earlier[:db.history.Keep(earlier, time.Now())]...), nil
+}
+
+// GetUserExpiry returns a user's expiry and its deadline from the user_expiry sorted set
+func (db RedisHashConn) GetUserExpiry(username string) (validation.Expiry, time.Time, error) {
+	var exists_cmd *redis.BoolCmd
+	var policy_cmd *redis.StringCmd
+	var deadline_cmd *redis.FloatCmd
+
+	_, err := db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		exists_cmd = pipe.HExists("users", username)
+		policy_cmd = pipe.HGet("user_expiry_policy", username)
+		deadline_cmd = pipe.ZScore("user_expiry", username)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return validation.Expiry{}, time.Time{}, err
+	}
+	if !exists_cmd.Val() {
+		return validation.Expiry{}, time.Time{}, redis.Nil
+	}
+
+	expiry, err := validation.ParseExpiry(policy_cmd.Val())
+	if err != nil || deadline_cmd.Err() != nil {
+		return expiry, time.Time{}, err
+	}
+
+	return expiry, time.Unix(0, int64(deadline_cmd.Val())*int64(time.Millisecond)), nil
+}
+
 func (db RedisHashConn) DeleteUser(user string) error {
-	_, err := db.GetUser(user)
-	if err == nil {
-		db.client.HDel("users", user)
+	return db.DeleteUserIfVersion(user, "")
+}
+
+// DeleteUserIfVersion erases a user only if its current version matches version, or
+// unconditionally if version is "", when any soft deleted user in the recycle bin under its
+// username is erased too. Returns dberrors.ErrVersionMismatch on a mismatch.
+func (db RedisHashConn) DeleteUserIfVersion(user string, version string) error {
+	for {
+		user_json_string, err := db.GetUser(user)
+		if err != nil && (err != redis.Nil || version != "") {
+			return err
+		}
+
+		set_keys, fullname_member := indexEntries(user, user_json_string)
+		keys := append([]string{"users", "user_emails", "user_versions", "modified_user_time", "user_expiry", "user_expiry_policy", "deleted_users", "user_purge", historyKey(user), fullnameIndexKey}, set_keys...)
+		deleted, err := deleteUserScript.Run(db.client, keys, user, userEmail(user_json_string), version, user_json_string, fullname_member).Int()
+		if err != nil {
+			return err
+		}
+		switch deleted {
+		case -4:
+			// The user changed since it was read, so its index entries have too
+			continue
+		case -2:
+			return dberrors.ErrVersionMismatch
+		case 0:
+			return redis.Nil
+		}
+
+		return nil
 	}
+}
 
-	return err
+// GetUserByEmail looks up a user through the user_emails reverse index
+func (db RedisHashConn) GetUserByEmail(email string) (string, error) {
+	username, err := db.client.HGet("user_emails", validation.NormalizeEmail(email)).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return db.GetUser(username)
 }
 
-func (db RedisHashConn) expire(username string, time_of_modification_string string) {
+// The user_emails hash maps each normalized email address to the username which owns it.
+// It is only ever changed together with the users hash, inside these scripts, as are the
+// user_index sorted sets.
+// The user_versions hash holds a counter per username, bumped on every write. It is kept
+// when a user is deleted, so a recreated user never reuses the version of its predecessor.
+// The modified_user_time hash holds the time of each user's last write in nanoseconds, and the
+// user_expiry sorted set holds each user scored by the unix milliseconds it expires at. Permanent
+// users aren't in user_expiry. The user_expiry_policy hash holds each user's validation.Expiry,
+// users with the default expiry aren't in it.
+// The deleted_users hash holds soft deleted users as tombstones, and the user_purge sorted set
+// holds each of them scored by the unix milliseconds it's purged at. A username in the recycle
+// bin can't be created again until it's purged.
+// The user_history:{username} list holds a user's earlier versions newest first, as JSON with the
+// version and time of modification as strings. It's kept through the recycle bin, and goes when
+// the user is erased, expired or purged.
 
-	time.Sleep(time.Duration(db.data_ttl) * time.Second)
+// KEYS: users, user_emails, user_versions, modified_user_time, user_expiry, user_expiry_policy,
+// deleted_users, user_purge, user_history:{username}, user_index:fullname, the index sets of the
+// old user, then those of the new user
+// ARGV: username, user json, new email, old email, mode ("set", "create" or "undelete"), expected
+// version or "", time of modification, expiry deadline or "" if it never expires, encoded expiry,
+// tombstone json the caller read when undeleting, most earlier versions kept, modification time
+// of the oldest earlier version kept or "" for no limit, how many index sets the old user is in,
+// old fullname index member or "", new fullname index member or "", old user json the caller read
+// or "" if there was none
+// Returns the new version, or without writing anything: -4 if the user has changed since the
+// caller read it, so its old index entries are wrong, -3 if the tombstone being undeleted has
+// changed, -2 if the user doesn't exist at the expected version, -1 if creating a user which
+// already exists, 0 if the new email belongs to another user
+var setUserScript = redis.NewScript(`
+if ARGV[5] == 'set' and (redis.call('HGET', KEYS[1], ARGV[1]) or '') ~= ARGV[16] then
+	return -4
+end
+if ARGV[5] == 'undelete' and redis.call('HGET', KEYS[7], ARGV[1]) ~= ARGV[10] then
+	return -3
+end
 
-	lock, _ := db.locker.Obtain(username, 300*time.Second, nil)
-	defer lock.Release()
+if ARGV[6] ~= '' then
+	local current_version = redis.call('HGET', KEYS[3], ARGV[1]) or '0'
+	if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 or current_version ~= ARGV[6] then
+		return -2
+	end
+end
+
+local email_owner = redis.call('HGET', KEYS[2], ARGV[3])
+if email_owner and email_owner ~= ARGV[1] then
+	return 0
+end
+
+if ARGV[5] == 'create' and redis.call('HEXISTS', KEYS[7], ARGV[1]) == 1 then
+	return -1
+end
+if ARGV[5] == 'create' or ARGV[5] == 'undelete' then
+	if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+		return -1
+	end
+else
+	local previous = redis.call('HGET', KEYS[1], ARGV[1])
+	if previous and tonumber(ARGV[11]) > 0 then
+		redis.call('LPUSH', KEYS[9], cjson.encode({
+			version = redis.call('HGET', KEYS[3], ARGV[1]) or '0',
+			modified_nanos = redis.call('HGET', KEYS[4], ARGV[1]) or '0',
+			data = previous,
+		}))
+		redis.call('LTRIM', KEYS[9], 0, tonumber(ARGV[11]) - 1)
+		if ARGV[12] ~= '' then
+			local oldest = redis.call('LINDEX', KEYS[9], -1)
+			while oldest and tonumber(cjson.decode(oldest).modified_nanos) < tonumber(ARGV[12]) do
+				redis.call('RPOP', KEYS[9])
+				oldest = redis.call('LINDEX', KEYS[9], -1)
+			end
+		end
+	end
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+end
+
+if ARGV[4] ~= '' and ARGV[4] ~= ARGV[3] and redis.call('HGET', KEYS[2], ARGV[4]) == ARGV[1] then
+	redis.call('HDEL', KEYS[2], ARGV[4])
+end
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[2], ARGV[3], ARGV[1])
+end
+
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[7])
+if ARGV[8] ~= '' then
+	redis.call('ZADD', KEYS[5], ARGV[8], ARGV[1])
+else
+	redis.call('ZREM', KEYS[5], ARGV[1])
+end
+if ARGV[9] ~= '' then
+	redis.call('HSET', KEYS[6], ARGV[1], ARGV[9])
+else
+	redis.call('HDEL', KEYS[6], ARGV[1])
+end
+
+if ARGV[5] == 'undelete' then
+	redis.call('HDEL', KEYS[7], ARGV[1])
+	redis.call('ZREM', KEYS[8], ARGV[1])
+end
+
+local old_index_sets = tonumber(ARGV[13])
+for i = 11, 10 + old_index_sets do
+	redis.call('ZREM', KEYS[i], ARGV[1])
+end
+for i = 11 + old_index_sets, #KEYS do
+	redis.call('ZADD', KEYS[i], 0, ARGV[1])
+end
+if ARGV[14] ~= '' then
+	redis.call('ZREM', KEYS[10], ARGV[14])
+end
+if ARGV[15] ~= '' then
+	redis.call('ZADD', KEYS[10], 0, ARGV[15])
+end
+
+return redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+`)
+
+// KEYS: users, user_emails, user_versions, modified_user_time, user_expiry, user_expiry_policy,
+// deleted_users, user_purge, user_history:{username}, user_index:fullname, the user's index sets
+// ARGV: username, email, expected version or "", user json the caller read or "" if there was
+// none, fullname index member or ""
+// Returns without deleting anything -4 if the user has changed since the caller read it, or -2 if
+// it isn't at the expected version, otherwise how many of the user and its tombstone were deleted
+var deleteUserScript = redis.NewScript(`
+if ARGV[3] ~= '' and (redis.call('HGET', KEYS[3], ARGV[1]) or '0') ~= ARGV[3] then
+	return -2
+end
+if (redis.call('HGET', KEYS[1], ARGV[1]) or '') ~= ARGV[4] then
+	return -4
+end
+
+local deleted = redis.call('HDEL', KEYS[1], ARGV[1])
+if ARGV[3] == '' then
+	deleted = deleted + redis.call('HDEL', KEYS[7], ARGV[1])
+	redis.call('ZREM', KEYS[8], ARGV[1])
+end
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('ZREM', KEYS[5], ARGV[1])
+redis.call('HDEL', KEYS[6], ARGV[1])
+redis.call('DEL', KEYS[9])
+
+if ARGV[2] ~= '' and redis.call('HGET', KEYS[2], ARGV[2]) == ARGV[1] then
+	redis.call('HDEL', KEYS[2], ARGV[2])
+end
+
+for i = 11, #KEYS do
+	redis.call('ZREM', KEYS[i], ARGV[1])
+end
+if ARGV[5] ~= '' then
+	redis.call('ZREM', KEYS[10], ARGV[5])
+end
+
+return deleted
+`)
+
+// userEmail returns the normalized email of a stored user, or "" if it has none
+func userEmail(user_json_string string) string {
+	return validation.NormalizeEmail(validation.ParseUserFields(user_json_string).Email)
+}
+
+// KEYS: users, user_emails, modified_user_time, user_expiry, user_expiry_policy,
+// user_history:{username}, passwords, user_index:fullname, the user's index sets
+// ARGV: username, now, user json the caller read, its email, its fullname index member or ""
+// Deletes a user and its password hash if it is due to expire and hasn't changed since the caller read it. Returns 1 if
+// the user was deleted, so exactly one replica archives it, or 0 if it was left alone.
+var expireUserScript = redis.NewScript(`
+local deadline = redis.call('ZSCORE', KEYS[4], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+
+local user_json = redis.call('HGET', KEYS[1], ARGV[1])
+if not user_json then
+	redis.call('ZREM', KEYS[4], ARGV[1])
+	return 0
+end
+if user_json ~= ARGV[3] then
+	return 0
+end
+
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+redis.call('DEL', KEYS[6])
+redis.call('HDEL', KEYS[7], ARGV[1])
+
+if ARGV[4] ~= '' and redis.call('HGET', KEYS[2], ARGV[4]) == ARGV[1] then
+	redis.call('HDEL', KEYS[2], ARGV[4])
+end
+
+for i = 9, #KEYS do
+	redis.call('ZREM', KEYS[i], ARGV[1])
+end
+if ARGV[5] ~= '' then
+	redis.call('ZREM', KEYS[8], ARGV[5])
+end
+
+return 1
+`)
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// scheduleUnscheduled adds an expiry deadline for users written before expiry was kept in Redis,
+// based on their time of modification. Users which already have a deadline, or never expire,
+// are left alone.
+func (db RedisHashConn) scheduleUnscheduled() error {
+	var scan_cursor uint64
+
+	for {
+		batch, next_scan_cursor, err := db.client.HScan("modified_user_time", scan_cursor, "", 100).Result()
+		if err != nil {
+			return err
+		}
+
+		usernames := []string{}
+		for i := 0; i < len(batch); i += 2 {
+			usernames = append(usernames, batch[i])
+		}
+		policies := []interface{}{}
+		if len(usernames) > 0 {
+			policies, err = db.client.HMGet("user_expiry_policy", usernames...).Result()
+			if err != nil {
+				return err
+			}
+		}
+
+		deadlines := []redis.Z{}
+		for i := 1; i < len(batch); i += 2 {
+			if policies[i/2] == "never" {
+				continue
+			}
+			modification_nanos, err := strconv.ParseInt(batch[i], 10, 64)
+			if err != nil {
+				continue
+			}
+			expiry_deadline := time.Unix(0, modification_nanos).Add(time.Duration(db.data_ttl) * time.Second)
+			deadlines = append(deadlines, redis.Z{Score: float64(unixMillis(expiry_deadline)), Member: batch[i-1]})
+		}
+		if len(deadlines) > 0 {
+			if err = db.client.ZAddNX("user_expiry", deadlines...).Err(); err != nil {
+				return err
+			}
+		}
+
+		scan_cursor = next_scan_cursor
+		if scan_cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// reapExpired expires users until Close is called. Every replica runs it, expireUserScript makes
+// sure each user is only expired once.
+func (db RedisHashConn) reapExpired() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.expire()
+			db.purge()
+		}
+	}
+}
+
+// expire deletes users past their expiry deadline and archives them
+func (db RedisHashConn) expire() {
+	now := strconv.FormatInt(unixMillis(time.Now()), 10)
+
+	usernames, err := db.client.ZRangeByScore("user_expiry", redis.ZRangeBy{Min: "-inf", Max: now, Count: reapBatchSize}).Result()
+	if err != nil {
+		return
+	}
 
-	value, _ := db.client.HGet("modified_user_time", username).Result()
+	for _, username := range usernames {
+		var user_cmd, modified_cmd *redis.StringCmd
+		db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			user_cmd = pipe.HGet("users", username)
+			modified_cmd = pipe.HGet("modified_user_time", username)
+			return nil
+		})
+		user_data := user_cmd.Val()
 
-	// If another operation has modified the data, the value won't match this goroutines time of modification
-	// Data which has been modified will be deleted by another goroutine
-	if value == time_of_modification_string {
-		user_data, _ := db.GetUser(username)
-		db.client.HDel("modified_user_time", username)
-		db.DeleteUser(username)
+		set_keys, fullname_member := indexEntries(username, user_data)
+		keys := append([]string{"users", "user_emails", "modified_user_time", "user_expiry", "user_expiry_policy", historyKey(username), "passwords", fullnameIndexKey}, set_keys...)
+		expired, err := expireUserScript.Run(db.client, keys, username, now, user_data, userEmail(user_data), fullname_member).Int()
+		if err != nil || expired != 1 {
+			continue
+		}
 
-		// Todo: logging
-		file, _ := os.Create(db.persisting_filepath + "/" + username + "-" + time_of_modification_string + ".json")
-		file.WriteString(user_data)
-		file.Close()
+		modified_nanos, _ := strconv.ParseInt(modified_cmd.Val(), 10, 64)
+		err = db.archiver.Archive(archive.Record{Username: username, Data: user_data, ModifiedNanos: modified_nanos, ExpiredAt: time.Now(), Reason: archive.ReasonExpired})
+		if err != nil {
+			log.Printf("Expired user %s was not archived: %s\nData: %s", username, err, user_data)
+		}
 	}
 }
@@ -1,10 +1,23 @@
 package redisutil
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/Haelium/User-Manager-API/archive"
+	"github.com/Haelium/User-Manager-API/auth"
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+	"github.com/Haelium/User-Manager-API/validation"
+	"github.com/Haelium/User-Manager-API/versions"
 )
 
 var valid_users = map[string]string{
@@ -13,6 +26,9 @@ var valid_users = map[string]string{
 	"herpderp": `{"username": "herpderp", "email": "herp@derp.io"}`,
 }
 
+// Keeps 2 earlier versions of each user
+var test_history = versions.Policy{MaxVersions: 2}
+
 func Test_GetUser(t *testing.T) {
 	// Set up minikube for testing, fail if not working
 	miniredis_socket, err := miniredis.Run()
@@ -26,7 +42,7 @@ func Test_GetUser(t *testing.T) {
 		miniredis_socket.HSet("users", key, val)
 	}
 	// Start client
-	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, ".")
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	for key, expected_val := range valid_users {
 		actual_val, err := redis_client.GetUser(key)
@@ -51,7 +67,7 @@ func Test_SetUser(t *testing.T) {
 	}
 	defer miniredis_socket.Close()
 
-	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, ".")
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
 
 	for username, userdata := range valid_users {
 		redis_client.SetUser(username, userdata)
@@ -72,6 +88,355 @@ func Test_SetUser(t *testing.T) {
 	}
 }
 
+func Test_ListUsers(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	expected_users := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		user := fmt.Sprintf(`{"username": "listuser%d"}`, i)
+		miniredis_socket.HSet("users", fmt.Sprintf("listuser%d", i), user)
+		expected_users[user] = true
+	}
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	seen_users := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 20; pages++ {
+		users, next_cursor, err := redis_client.ListUsers(cursor, 3)
+		if err != nil {
+			t.Logf("err: %s", err)
+			t.FailNow()
+		}
+		if len(users) > 3 {
+			t.Logf("Page size exceeded limit: %d", len(users))
+			t.Fail()
+		}
+
+		for _, user := range users {
+			if seen_users[user] {
+				t.Logf("User returned twice: %s", user)
+				t.Fail()
+			}
+			seen_users[user] = true
+		}
+
+		cursor = next_cursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	if len(seen_users) != len(expected_users) {
+		t.Logf("Expected %d users, got %d", len(expected_users), len(seen_users))
+		t.Fail()
+	}
+
+	_, _, err = redis_client.ListUsers("not a cursor", 3)
+	if err == nil {
+		t.Logf("Invalid cursor was not rejected")
+		t.Fail()
+	}
+}
+
+func Test_SearchUsers(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	redis_client.SetUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"region": "Bobville", "country": "Bobland"}}`)
+	redis_client.SetUser("billy3000", `{"username": "billy3000", "fullname": "Bill Bobson", "email": "bill@bobmail.bob", "address": {"region": "Billville", "country": "Bobland"}}`)
+	redis_client.SetUser("jcdenton", `{"username": "jcdenton", "fullname": "JC Denton", "email": "jc@unatco.org", "address": {"region": "New York", "country": "USA"}}`)
+
+	// Moving billy3000 out of Bobland must remove the old index entry
+	redis_client.SetUser("billy3000", `{"username": "billy3000", "fullname": "Bill Bobson", "email": "bill@bobmail.bob", "address": {"region": "New York", "country": "USA"}}`)
+
+	test_cases := []struct {
+		filters  map[string]string
+		expected int
+	}{
+		{map[string]string{"country": "BOBLAND"}, 1},
+		{map[string]string{"country": "usa"}, 2},
+		{map[string]string{"country": "usa", "region": "new york"}, 2},
+		{map[string]string{"name_prefix": "b"}, 2},
+		{map[string]string{"name_prefix": "bill", "country": "usa"}, 1},
+		{map[string]string{"name_prefix": "bill", "country": "bobland"}, 0},
+		{map[string]string{"email": "Bob@BOBMAIL.bob"}, 1},
+		{map[string]string{"email": "bob@bobmail.bob"}, 0},
+	}
+
+	for _, test_case := range test_cases {
+		users, _, err := redis_client.SearchUsers(test_case.filters, "", 10)
+		if err != nil || len(users) != test_case.expected {
+			t.Logf("Filters: %v\nExpected: %d users\nGot: %d (err: %v)\n", test_case.filters, test_case.expected, len(users), err)
+			t.Fail()
+		}
+	}
+
+	// Paging through the two USA users one at a time
+	users, cursor, _ := redis_client.SearchUsers(map[string]string{"country": "usa"}, "", 1)
+	if len(users) != 1 || cursor == "" {
+		t.Logf("Expected first page with a cursor, got %d users and cursor %q", len(users), cursor)
+		t.Fail()
+	}
+	users, cursor, _ = redis_client.SearchUsers(map[string]string{"country": "usa"}, cursor, 1)
+	if len(users) != 1 || cursor != "" {
+		t.Logf("Expected last page without a cursor, got %d users and cursor %q", len(users), cursor)
+		t.Fail()
+	}
+
+	redis_client.DeleteUser("jcdenton")
+	users, _, _ = redis_client.SearchUsers(map[string]string{"name_prefix": "jc"}, "", 10)
+	if len(users) != 0 {
+		t.Logf("Deleted user is still indexed: %v", users)
+		t.Fail()
+	}
+
+	// Users stored between searches are found by the next one
+	redis_client.SetUser("herpderp", `{"username": "herpderp", "fullname": "Herp Derp", "email": "herp@derp.io", "address": {"region": "New York", "country": "USA"}}`)
+	users, _, _ = redis_client.SearchUsers(map[string]string{"country": "usa"}, "", 10)
+	if len(users) != 2 {
+		t.Logf("Expected billy3000 and herpderp, got: %v", users)
+		t.Fail()
+	}
+	if miniredis_socket.Exists("user_search") {
+		t.Logf("Expected the search's matches to be deleted")
+		t.Fail()
+	}
+
+	// A write based on a stale read of the user unindexes what's stored, not what was read
+	redis_client.SetUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"region": "New York", "country": "USA"}}`)
+	redis_client.storeUser("billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"region": "Toronto", "country": "Canada"}}`,
+		`{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"region": "Bobville", "country": "Bobland"}}`, "set", "", validation.Expiry{}, "")
+	if members, _ := miniredis_socket.ZMembers("user_index:country:usa"); len(members) != 2 || members[0] != "billy3000" || members[1] != "herpderp" {
+		t.Logf("Expected billy3000 and herpderp in USA, got: %v", members)
+		t.Fail()
+	}
+	if members, _ := miniredis_socket.ZMembers("user_index:country:canada"); len(members) != 1 || members[0] != "billy2000" {
+		t.Logf("Expected billy2000 in Canada, got: %v", members)
+		t.Fail()
+	}
+}
+
+func Test_IndexUnindexed(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	// Stored before the indexes
+	miniredis_socket.HSet("users", "billy2000", `{"username": "billy2000", "fullname": "Bob Bobson", "email": "Bob@bobmail.bob", "address": {"region": "Bobville", "country": "Bobland"}}`)
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	users, _, err := redis_client.SearchUsers(map[string]string{"email": "Bob@bobmail.bob", "name_prefix": "bob"}, "", 10)
+	if err != nil || len(users) != 1 {
+		t.Logf("Expected the user stored before the indexes to be found, got: %v (err: %v)", users, err)
+		t.Fail()
+	}
+	if built, _ := miniredis_socket.Get("user_index_built"); built != "1" {
+		t.Logf("Expected the indexes to be marked built")
+		t.Fail()
+	}
+}
+
+func Test_UniqueEmail(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	err = redis_client.SetUser("bobman12", `{"username": "bobman12", "email": "bob@bobmail.com"}`)
+	if err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	err = redis_client.SetUser("herpderp", `{"username": "herpderp", "email": "bob@BOBMAIL.com"}`)
+	if err != dberrors.ErrEmailTaken {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrEmailTaken, err)
+		t.Fail()
+	}
+	if returned_value, _ := redis_client.GetUser("herpderp"); returned_value != "" {
+		t.Logf("User with duplicate email was stored: %s", returned_value)
+		t.Fail()
+	}
+
+	// Once bobman12 changes address the old one is free again
+	redis_client.SetUser("bobman12", `{"username": "bobman12", "email": "bob@newmail.com"}`)
+	err = redis_client.SetUser("herpderp", `{"username": "herpderp", "email": "bob@bobmail.com"}`)
+	if err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	returned_value, err := redis_client.GetUserByEmail("bob@NEWMAIL.com")
+	if returned_value != `{"username": "bobman12", "email": "bob@newmail.com"}` {
+		t.Logf("Lookup by email failed: %s (err: %v)", returned_value, err)
+		t.Fail()
+	}
+
+	redis_client.DeleteUser("bobman12")
+	if _, err = redis_client.GetUserByEmail("bob@newmail.com"); err == nil {
+		t.Logf("Deleted user still found by email")
+		t.Fail()
+	}
+}
+
+func Test_CreateUser(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			errs <- redis_client.CreateUser("bobman12", fmt.Sprintf(`{"username": "bobman12", "email": "bob%d@bobmail.com"}`, i), validation.Expiry{})
+		}(i)
+	}
+
+	created := 0
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		if err == nil {
+			created++
+		} else if err != dberrors.ErrUserExists {
+			t.Logf("Expected: %s\nGot: %s\n", dberrors.ErrUserExists, err)
+			t.Fail()
+		}
+	}
+
+	if created != 1 {
+		t.Logf("Expected exactly 1 user created, got %d", created)
+		t.Fail()
+	}
+}
+
+func Test_Versions(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 32, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+
+	redis_client.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{})
+	_, version, err := redis_client.GetUserWithVersion("bobman12")
+	if version != "1" || err != nil {
+		t.Logf("Expected version 1, got %s (err: %v)", version, err)
+		t.Fail()
+	}
+
+	new_version, err := redis_client.SetUserIfVersion("bobman12", `{"username": "bobman12", "email": "bob@newmail.com"}`, "1", validation.Expiry{})
+	if new_version != "2" || err != nil {
+		t.Logf("Expected version 2, got %s (err: %v)", new_version, err)
+		t.Fail()
+	}
+
+	_, err = redis_client.SetUserIfVersion("bobman12", valid_users["bobman12"], "1", validation.Expiry{})
+	if err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrVersionMismatch, err)
+		t.Fail()
+	}
+
+	err = redis_client.DeleteUserIfVersion("bobman12", "1")
+	if err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected: %s\nGot: %v\n", dberrors.ErrVersionMismatch, err)
+		t.Fail()
+	}
+
+	err = redis_client.DeleteUserIfVersion("bobman12", "2")
+	if err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	// A recreated user must not reuse the version of the deleted one
+	redis_client.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{})
+	_, version, _ = redis_client.GetUserWithVersion("bobman12")
+	if version != "3" {
+		t.Logf("Expected version 3, got %s", version)
+		t.Fail()
+	}
+}
+
+func Test_PerUserExpiry(t *testing.T) {
+	persist_dir, _ := ioutil.TempDir("", "redisutil")
+	defer os.RemoveAll(persist_dir)
+
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 1, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+	defer conn.Close()
+	conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{Never: true})
+	conn.CreateUser("jcdenton", valid_users["jcdenton"], validation.Expiry{TTLSeconds: 60})
+	conn.SetUser("herpderp", valid_users["herpderp"])
+	conn.SetPasswordHash("bobman12", "bob hash")
+	conn.SetPasswordHash("herpderp", "herp hash")
+	time.Sleep(3 * time.Second)
+
+	// Expired users' password hashes go with them
+	if _, err := conn.GetPasswordHash("herpderp"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected the expired user's password hash to be deleted, got: %v", err)
+		t.Fail()
+	}
+	if hash, _ := conn.GetPasswordHash("bobman12"); hash != "bob hash" {
+		t.Logf("Expected the permanent user's password hash to be kept, got: %q", hash)
+		t.Fail()
+	}
+
+	// Only the user with the default ttl expires
+	for username, expected_val := range map[string]string{"bobman12": valid_users["bobman12"], "jcdenton": valid_users["jcdenton"], "herpderp": ""} {
+		if returned_value, _ := conn.GetUser(username); returned_value != expected_val {
+			t.Logf("Expected:\t %s \nGot:\t %s\n", expected_val, returned_value)
+			t.Fail()
+		}
+	}
+
+	expiry, expires_at, err := conn.GetUserExpiry("bobman12")
+	if err != nil || !expiry.Never || !expires_at.IsZero() {
+		t.Logf("Expected a permanent user, got %v %v (err: %v)", expiry, expires_at, err)
+		t.Fail()
+	}
+
+	expiry, expires_at, err = conn.GetUserExpiry("jcdenton")
+	if err != nil || expiry.TTLSeconds != 60 || time.Until(expires_at) < 50*time.Second {
+		t.Logf("Expected a 60 second ttl, got %v %v (err: %v)", expiry, expires_at, err)
+		t.Fail()
+	}
+
+	// A restarted replica must not schedule the permanent user from its time of modification
+	restarted_conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 1, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+	defer restarted_conn.Close()
+	time.Sleep(2 * time.Second)
+
+	if returned_value, _ := restarted_conn.GetUser("bobman12"); returned_value != valid_users["bobman12"] {
+		t.Logf("Permanent user expired after a restart")
+		t.Fail()
+	}
+}
+
 func Test_expire(t *testing.T) {
 	miniredis_socket, err := miniredis.Run()
 	if err != nil {
@@ -79,7 +444,8 @@ func Test_expire(t *testing.T) {
 	}
 	defer miniredis_socket.Close()
 
-	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 5, ".")
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 5, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	defer redis_client.Close()
 	redis_client.SetUser("bob_should_expire", "junk data")
 	time.Sleep(7 * time.Second)
 
@@ -100,6 +466,48 @@ func Test_expire(t *testing.T) {
 
 }
 
+func Test_expireSurvivesRestart(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	persist_dir, _ := ioutil.TempDir("", "redisutil")
+	defer os.RemoveAll(persist_dir)
+
+	redis_client, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 2, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+	redis_client.SetUser("bobman12", valid_users["bobman12"])
+	redis_client.Close()
+
+	// Users written before expiry deadlines were stored only have a time of modification
+	miniredis_socket.HSet("users", "jcdenton", valid_users["jcdenton"])
+	miniredis_socket.HSet("modified_user_time", "jcdenton", strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	// Two replicas, each user must still be expired and persisted exactly once
+	for i := 0; i < 2; i++ {
+		redis_client, _ = NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 2, 60, test_history, archive.NewFileArchiver(persist_dir, false))
+		defer redis_client.Close()
+	}
+	time.Sleep(4 * time.Second)
+
+	for username := range valid_users {
+		if returned_value, _ := redis_client.GetUser(username); returned_value != "" {
+			t.Logf("%s was not expired: %s", username, returned_value)
+			t.Fail()
+		}
+	}
+	if _, err = redis_client.GetUserByEmail("bob@bobmail.com"); err == nil {
+		t.Logf("Email of expired user was not released")
+		t.Fail()
+	}
+
+	if archived := countArchived(persist_dir); archived != 2 {
+		t.Logf("Expected 2 persisted users, got %d", archived)
+		t.Fail()
+	}
+}
+
 /*
 func Test_DeleteUser(t *testing.T) {
 	// Set up minikube for testing, fail if not working
@@ -134,3 +542,392 @@ func Test_DeleteUser(t *testing.T) {
 	}
 }
 */
+
+// countArchived counts the users archived under dir
+func Test_SoftDelete(t *testing.T) {
+	persist_dir, _ := ioutil.TempDir("", "redisutil")
+	defer os.RemoveAll(persist_dir)
+
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 1, test_history, archive.NewFileArchiver(persist_dir, false))
+	defer conn.Close()
+
+	conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{Never: true})
+	conn.CreateUser("jcdenton", valid_users["jcdenton"], validation.Expiry{})
+
+	if err := conn.SoftDeleteUserIfVersion("bobman12", "12345", "admin"); err != dberrors.ErrVersionMismatch {
+		t.Logf("Expected a version mismatch, got: %v", err)
+		t.Fail()
+	}
+	if err := conn.SoftDeleteUserIfVersion("bobman12", "", "admin"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+
+	if returned_value, _ := conn.GetUser("bobman12"); returned_value != "" {
+		t.Logf("Deleted user still returned: %s", returned_value)
+		t.Fail()
+	}
+	if _, deleted_by, err := conn.GetDeletion("bobman12"); err != nil || deleted_by != "admin" {
+		t.Logf("Expected a deletion by admin, got: %s (err: %v)", deleted_by, err)
+		t.Fail()
+	}
+	if err := conn.CreateUser("bobman12", valid_users["bobman12"], validation.Expiry{}); err != dberrors.ErrUserExists {
+		t.Logf("Expected the username to be taken, got: %v", err)
+		t.Fail()
+	}
+
+	// Undeleted users get their expiry back
+	if returned_value, err := conn.UndeleteUser("bobman12"); err != nil || returned_value != valid_users["bobman12"] {
+		t.Logf("Expected:\t %s \nGot:\t %s (err: %v)\n", valid_users["bobman12"], returned_value, err)
+		t.Fail()
+	}
+	if expiry, _, err := conn.GetUserExpiry("bobman12"); err != nil || !expiry.Never {
+		t.Logf("Expected a permanent user, got %v (err: %v)", expiry, err)
+		t.Fail()
+	}
+	if _, err := conn.UndeleteUser("bobman12"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user not to be deleted, got: %v", err)
+		t.Fail()
+	}
+
+	// A soft delete based on a stale read of the user is told it changed, to read it again, rather
+	// than that it's at another version
+	stale_json := valid_users["jcdenton"]
+	conn.SetUser("jcdenton", strings.Replace(stale_json, "jc@unatco.org", "paul@unatco.org", 1))
+	set_keys, fullname_member := indexEntries("jcdenton", stale_json)
+	keys := append([]string{"users", "user_emails", "user_versions", "modified_user_time", "user_expiry", "user_expiry_policy", "deleted_users", "user_purge", fullnameIndexKey}, set_keys...)
+	if changed, err := softDeleteUserScript.Run(conn.client, keys, "jcdenton", "jc@unatco.org", "", stale_json, "{}", 0, fullname_member).Int(); changed != -4 {
+		t.Logf("Expected the user to have changed since it was read, got: %d (err: %v)", changed, err)
+		t.Fail()
+	}
+
+	// Hard deletes erase users in the recycle bin
+	conn.SoftDeleteUserIfVersion("jcdenton", "", "admin")
+	if err := conn.DeleteUser("jcdenton"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, _, err := conn.GetDeletion("jcdenton"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user to be erased, got: %v", err)
+		t.Fail()
+	}
+
+	// Users are purged and archived after the retention period
+	conn.SetPasswordHash("bobman12", "bob hash")
+	conn.SoftDeleteUserIfVersion("bobman12", "", "admin")
+	time.Sleep(3 * time.Second)
+
+	if _, _, err := conn.GetDeletion("bobman12"); err != dberrors.ErrNotDeleted {
+		t.Logf("Expected the user to be purged, got: %v", err)
+		t.Fail()
+	}
+	if _, err := conn.GetPasswordHash("bobman12"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected the purged user's password hash to be deleted, got: %v", err)
+		t.Fail()
+	}
+	if archived := countArchived(persist_dir); archived != 1 {
+		t.Logf("Expected 1 archived user, got %d", archived)
+		t.Fail()
+	}
+}
+
+func countArchived(dir string) int {
+	count := 0
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+
+	return count
+}
+
+func Test_UserVersions(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	defer conn.Close()
+
+	for i := 0; i < 4; i++ {
+		conn.SetUser("bobman12", fmt.Sprintf(`{"username": "bobman12", "email": "bob%d@bobmail.com"}`, i))
+	}
+
+	// The current version, then the 2 earlier versions test_history keeps
+	user_versions, err := conn.GetUserVersions("bobman12")
+	if err != nil || len(user_versions) != 3 || !strings.Contains(user_versions[0].Data, "bob3@") || !strings.Contains(user_versions[2].Data, "bob1@") {
+		t.Logf("Expected 3 versions newest first, got: %+v (err: %v)", user_versions, err)
+		t.FailNow()
+	}
+	if current, _, _ := conn.GetUserWithVersion("bobman12"); current != user_versions[0].Data {
+		t.Logf("Expected the current version first, got: %s", user_versions[0].Data)
+		t.Fail()
+	}
+	if !user_versions[0].ModifiedAt.After(user_versions[1].ModifiedAt) {
+		t.Logf("Expected the current version to be newest, got: %+v", user_versions)
+		t.Fail()
+	}
+
+	// Earlier versions survive the recycle bin
+	conn.SoftDeleteUserIfVersion("bobman12", "", "admin")
+	if _, err := conn.GetUserVersions("bobman12"); err == nil {
+		t.Logf("Expected no versions for a deleted user")
+		t.Fail()
+	}
+	conn.UndeleteUser("bobman12")
+	if user_versions, _ = conn.GetUserVersions("bobman12"); len(user_versions) != 3 {
+		t.Logf("Expected 3 versions after undeleting, got: %+v", user_versions)
+		t.Fail()
+	}
+
+	// and are erased with the user
+	conn.DeleteUser("bobman12")
+	conn.SetUser("bobman12", valid_users["bobman12"])
+	if user_versions, _ = conn.GetUserVersions("bobman12"); len(user_versions) != 1 {
+		t.Logf("Expected only the current version, got: %+v", user_versions)
+		t.Fail()
+	}
+}
+
+func Test_UserVersionsAge(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 60, versions.Policy{MaxVersions: 10, MaxAge: 50 * time.Millisecond}, archive.NewFileArchiver(t.TempDir(), false))
+	defer conn.Close()
+
+	conn.SetUser("bobman12", valid_users["bobman12"])
+	conn.SetUser("bobman12", valid_users["bobman12"])
+	if earlier, _ := miniredis_socket.List("user_history:bobman12"); len(earlier) != 1 {
+		t.Logf("Expected 1 earlier version stored, got: %v", earlier)
+		t.Fail()
+	}
+
+	// Versions written longer ago than MaxAge are pruned by the next write
+	time.Sleep(100 * time.Millisecond)
+	conn.SetUser("bobman12", valid_users["bobman12"])
+	if earlier, _ := miniredis_socket.List("user_history:bobman12"); len(earlier) != 0 {
+		t.Logf("Expected no earlier versions stored, got: %v", earlier)
+		t.Fail()
+	}
+	if user_versions, _ := conn.GetUserVersions("bobman12"); len(user_versions) != 1 {
+		t.Logf("Expected only the current version, got: %+v", user_versions)
+		t.Fail()
+	}
+}
+
+func Test_Subscriptions(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	defer conn.Close()
+
+	created_at := time.Now().UTC().Truncate(time.Millisecond)
+	for i, id := range []string{"b", "a"} {
+		subscription := events.Subscription{ID: id, URL: "https://example.com/" + id, Types: []string{events.TypeCreated}, Secret: "secret", CreatedAt: created_at.Add(time.Duration(i) * time.Second)}
+		if err := conn.CreateSubscription(subscription); err != nil {
+			t.Logf("err: %s", err)
+			t.FailNow()
+		}
+	}
+
+	subscriptions, err := conn.ListSubscriptions()
+	if err != nil || len(subscriptions) != 2 || subscriptions[0].ID != "b" || subscriptions[1].Types[0] != events.TypeCreated {
+		t.Logf("Expected 2 subscriptions oldest first, got: %+v (err: %v)", subscriptions, err)
+		t.Fail()
+	}
+
+	subscription, err := conn.RotateSubscriptionSecret("a", "new secret", created_at)
+	if err != nil || subscription.Secret != "new secret" || subscription.PreviousSecret != "secret" || subscription.URL != "https://example.com/a" {
+		t.Logf("Expected a rotated subscription, got: %+v (err: %v)", subscription, err)
+		t.Fail()
+	}
+	if subscription, err = conn.GetSubscription("a"); err != nil || subscription.Secret != "new secret" || subscription.PreviousSecret != "secret" || !subscription.PreviousSecretExpires.Equal(created_at.Add(events.RotationGrace)) {
+		t.Logf("Expected a rotated secret, got: %+v (err: %v)", subscription, err)
+		t.Fail()
+	}
+
+	for attempt := 1; attempt <= events.MaxDeliveries+2; attempt++ {
+		conn.RecordDelivery(events.Delivery{SubscriptionID: "a", EventID: "event", Attempt: attempt, Time: created_at})
+	}
+	deliveries, err := conn.ListDeliveries("a", events.MaxDeliveries+10)
+	if err != nil || len(deliveries) != events.MaxDeliveries || deliveries[0].Attempt != events.MaxDeliveries+2 || deliveries[len(deliveries)-1].Attempt != 3 {
+		t.Logf("Expected the latest %d deliveries newest first, got %d (err: %v)", events.MaxDeliveries, len(deliveries), err)
+		t.Fail()
+	}
+	if deliveries, _ = conn.ListDeliveries("a", 2); len(deliveries) != 2 {
+		t.Logf("Expected 2 deliveries, got: %+v", deliveries)
+		t.Fail()
+	}
+
+	// Deleting a subscription deletes its deliveries, and nothing can be done to it after
+	if err = conn.DeleteSubscription("a"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, err = conn.GetSubscription("a"); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	if _, err = conn.ListDeliveries("a", 10); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	if _, err = conn.RotateSubscriptionSecret("a", "newer secret", created_at); err != dberrors.ErrSubscriptionNotFound {
+		t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+		t.Fail()
+	}
+	for _, err = range []error{conn.UpdateSubscription(subscription), conn.DeleteSubscription("a"), conn.RecordDelivery(events.Delivery{SubscriptionID: "a"})} {
+		if err != dberrors.ErrSubscriptionNotFound {
+			t.Logf("Expected ErrSubscriptionNotFound, got: %v", err)
+			t.Fail()
+		}
+	}
+}
+
+func Test_Passwords(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	defer conn.Close()
+
+	if _, err := conn.GetPasswordHash("billy2000"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected ErrNoPassword, got: %v", err)
+		t.Fail()
+	}
+
+	conn.SetPasswordHash("billy2000", "first")
+	conn.SetPasswordHash("billy2000", "second")
+	if hash, err := conn.GetPasswordHash("billy2000"); hash != "second" || err != nil {
+		t.Logf("Expected the second hash, got: %s (err: %v)", hash, err)
+		t.Fail()
+	}
+
+	if err := conn.DeletePasswordHash("billy2000"); err != nil {
+		t.Logf("err: %s", err)
+		t.Fail()
+	}
+	if _, err := conn.GetPasswordHash("billy2000"); err != dberrors.ErrNoPassword {
+		t.Logf("Expected ErrNoPassword after deleting, got: %v", err)
+		t.Fail()
+	}
+	if err := conn.DeletePasswordHash("billy2000"); err != nil {
+		t.Logf("Expected deleting no password to succeed, got: %v", err)
+		t.Fail()
+	}
+}
+
+func Test_Lockout(t *testing.T) {
+	miniredis_socket, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer miniredis_socket.Close()
+
+	conn, _ := NewRedisHashConn(miniredis_socket.Addr(), "", 0, 5, 60, 60, test_history, archive.NewFileArchiver(t.TempDir(), false))
+	defer conn.Close()
+	lockout := conn.Lockout(auth.LockoutPolicy{UserFailures: 3, IPFailures: 4, Window: time.Minute, Duration: time.Minute})
+
+	lockout.Attempt("billy2000", "10.0.0.1")
+	lockout.Attempt("billy2000", "10.0.0.1")
+	if _, locked_for, err := lockout.Attempt("billy2000", "10.0.0.2"); locked_for != 0 || err != nil {
+		t.Logf("Expected no lock after 3 attempts, locked for %s (err: %v)", locked_for, err)
+		t.Fail()
+	}
+	if _, locked_for, err := lockout.Attempt("billy2000", "10.0.0.2"); locked_for != time.Minute || err != nil {
+		t.Logf("Expected a minute's lock at the 4th attempt, locked for %s (err: %v)", locked_for, err)
+		t.Fail()
+	}
+
+	// Another replica sees the lock
+	other, _ := NewRedisLockout(miniredis_socket.Addr(), "", 0, 5, auth.DefaultLockoutPolicy())
+	defer other.Close()
+	if _, locked_for, err := other.Attempt("billy2000", "10.0.0.3"); locked_for <= 0 || err != nil {
+		t.Logf("Expected the username to be locked for every replica, locked for %s (err: %v)", locked_for, err)
+		t.Fail()
+	}
+	if _, locked_for, _ := other.Attempt("alice2000", "10.0.0.3"); locked_for != 0 {
+		t.Logf("Expected other usernames to be allowed, locked for %s", locked_for)
+		t.Fail()
+	}
+
+	miniredis_socket.FastForward(time.Minute)
+	if _, locked_for, _ := lockout.Attempt("billy2000", "10.0.0.3"); locked_for != 0 {
+		t.Logf("Expected the lock to end, locked for %s", locked_for)
+		t.Fail()
+	}
+
+	// Logging in forgets the username's failures, and uncounts the attempt from the address
+	lockout.Attempt("billy2000", "10.0.0.5")
+	attempt, _, _ := lockout.Attempt("billy2000", "10.0.0.5")
+	lockout.Succeed("billy2000", "10.0.0.5", attempt)
+	if failures, _ := miniredis_socket.ZMembers("login_failures:ip:10.0.0.5"); len(failures) != 1 {
+		t.Logf("Expected only the failed attempt counted against the address, got: %v", failures)
+		t.Fail()
+	}
+	lockout.Attempt("billy2000", "10.0.0.5")
+	lockout.Attempt("billy2000", "10.0.0.5")
+	if _, locked_for, _ := lockout.Attempt("billy2000", "10.0.0.6"); locked_for != 0 {
+		t.Logf("Expected failures before logging in to be forgotten, locked for %s", locked_for)
+		t.Fail()
+	}
+
+	for _, username := range []string{"a", "b", "c", "d"} {
+		lockout.Attempt(username, "10.0.0.7")
+	}
+	if _, locked_for, _ := lockout.Attempt("e", "10.0.0.7"); locked_for != time.Minute {
+		t.Logf("Expected the address to be locked at the 5th attempt, locked for %s", locked_for)
+		t.Fail()
+	}
+
+	lockout.Unlock("billy2000")
+	if _, locked_for, _ := lockout.Attempt("billy2000", "10.0.0.8"); locked_for != 0 {
+		t.Logf("Expected the username to be unlocked, locked for %s", locked_for)
+		t.Fail()
+	}
+	if _, locked_for, _ := lockout.Attempt("f", "10.0.0.7"); locked_for <= 0 {
+		t.Logf("Expected unlocking a username to leave addresses locked")
+		t.Fail()
+	}
+
+	// Only the limit of concurrent attempts go ahead
+	allowed := make(chan bool, 20)
+	for i := 0; i < cap(allowed); i++ {
+		go func(i int) {
+			_, locked_for, err := lockout.Attempt("alice2000", "10.0.1."+strconv.Itoa(i))
+			allowed <- err == nil && locked_for == 0
+		}(i)
+	}
+	allowed_count := 0
+	for i := 0; i < cap(allowed); i++ {
+		if <-allowed {
+			allowed_count++
+		}
+	}
+	// alice2000 made one attempt above
+	if allowed_count != 2 {
+		t.Logf("Expected 2 of %d concurrent attempts to go ahead, got %d", cap(allowed), allowed_count)
+		t.Fail()
+	}
+}
@@ -0,0 +1,223 @@
+package redisutil
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/validation"
+)
+
+/*
+Secondary indexes, maintained by the scripts writing users so they change together with them:
+
+user_index:email:{email}		- sorted set of usernames with that email, normalized like user_emails
+user_index:country:{country}	- sorted set of usernames with that address country
+user_index:region:{region}		- sorted set of usernames with that address region
+user_index:fullname				- sorted set of "{fullname}\x00{username}"
+
+Every member is scored 0, so each set is ordered by member and ZRANGEBYLEX can page through
+usernames and match fullname prefixes. All other indexed values are trimmed and lowercased, so
+searches are case insensitive. Only the domain of emails is, as the local part may be case
+sensitive.
+
+user_index_built is set once the users stored before these indexes existed are indexed.
+*/
+
+const fullnameIndexKey = "user_index:fullname"
+
+func indexValue(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// indexEntries returns the index sets a user is in, and its member of the fullname index or "" if
+// it has no fullname. A user that isn't stored ("") is in none.
+func indexEntries(username string, user_json_string string) ([]string, string) {
+	set_keys := []string{}
+	if user_json_string == "" {
+		return set_keys, ""
+	}
+	user := validation.ParseUserFields(user_json_string)
+
+	if user.Email != "" {
+		set_keys = append(set_keys, "user_index:email:"+validation.NormalizeEmail(user.Email))
+	}
+	if user.Country != "" {
+		set_keys = append(set_keys, "user_index:country:"+indexValue(user.Country))
+	}
+	if user.Region != "" {
+		set_keys = append(set_keys, "user_index:region:"+indexValue(user.Region))
+	}
+
+	fullname_member := ""
+	if user.FullName != "" {
+		fullname_member = indexValue(user.FullName) + "\x00" + username
+	}
+
+	return set_keys, fullname_member
+}
+
+// KEYS: users, user_index:fullname, the user's index sets
+// ARGV: username, user json the caller read, its fullname index member or ""
+// Indexes a user if it hasn't changed since the caller read it, otherwise whoever changed it did.
+// Returns 1 if it was indexed.
+var indexUserScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+
+for i = 3, #KEYS do
+	redis.call('ZADD', KEYS[i], 0, ARGV[1])
+end
+if ARGV[3] ~= '' then
+	redis.call('ZADD', KEYS[2], 0, ARGV[3])
+end
+
+return 1
+`)
+
+// indexUnindexed indexes the users stored before the user_index sorted sets were. It's only done
+// once, every user stored since is indexed when it's written.
+func (db RedisHashConn) indexUnindexed() error {
+	built, err := db.client.Exists("user_index_built").Result()
+	if err != nil || built == 1 {
+		return err
+	}
+
+	var scan_cursor uint64
+	for {
+		batch, next_scan_cursor, err := db.client.HScan("users", scan_cursor, "", 100).Result()
+		if err != nil {
+			return err
+		}
+
+		for i := 1; i < len(batch); i += 2 {
+			set_keys, fullname_member := indexEntries(batch[i-1], batch[i])
+			keys := append([]string{"users", fullnameIndexKey}, set_keys...)
+			if err = indexUserScript.Run(db.client, keys, batch[i-1], batch[i], fullname_member).Err(); err != nil {
+				return err
+			}
+		}
+
+		scan_cursor = next_scan_cursor
+		if scan_cursor == 0 {
+			return db.client.Set("user_index_built", "1", 0).Err()
+		}
+	}
+}
+
+// KEYS: users, user_search, user_index:fullname, the index sets to intersect
+// ARGV: "1" to match fullname prefixes, the prefix, ZRANGEBYLEX min and max of the fullnames
+// starting with it, ZRANGEBYLEX min of the page, most usernames returned
+// Builds the usernames matching a search in user_search, and returns a page of them followed by
+// the users they name. user_search is deleted before returning, so searches never see each
+// other's matches.
+var searchUsersScript = redis.NewScript(`
+if #KEYS > 3 then
+	redis.call('ZINTERSTORE', KEYS[2], #KEYS - 3, unpack(KEYS, 4))
+end
+if ARGV[1] == '1' then
+	local prefix_matches = {}
+	for _, member in ipairs(redis.call('ZRANGEBYLEX', KEYS[3], ARGV[3], ARGV[4])) do
+		if string.sub(member, 1, #ARGV[2]) == ARGV[2] then
+			local username = string.match(member, '^.*%z(.*)$')
+			if #KEYS > 3 then
+				prefix_matches[username] = true
+			else
+				redis.call('ZADD', KEYS[2], 0, username)
+			end
+		end
+	end
+	if #KEYS > 3 then
+		for _, username in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+			if not prefix_matches[username] then
+				redis.call('ZREM', KEYS[2], username)
+			end
+		end
+	end
+end
+
+local page = redis.call('ZRANGEBYLEX', KEYS[2], ARGV[5], '+', 'LIMIT', 0, ARGV[6])
+redis.call('DEL', KEYS[2])
+
+if #page == 0 then
+	return {page, {}}
+end
+return {page, redis.call('HMGET', KEYS[1], unpack(page))}
+`)
+
+// SearchUsers returns the users matching every filter given, a page at a time.
+// Supported filters are email (exact, with a case insensitive domain), country, region (exact,
+// case insensitive) and name_prefix (case insensitive prefix of fullname). Matches are ordered by
+// username and the cursor is the last username of the previous page.
+func (db RedisHashConn) SearchUsers(filters map[string]string, cursor string, limit int) ([]string, string, error) {
+	after, err := decodeUsernameCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	set_keys := []string{}
+	if email, ok := filters["email"]; ok {
+		set_keys = append(set_keys, "user_index:email:"+validation.NormalizeEmail(email))
+	}
+	for _, field := range []string{"country", "region"} {
+		if value, ok := filters[field]; ok {
+			set_keys = append(set_keys, "user_index:"+field+":"+indexValue(value))
+		}
+	}
+	name_prefix, has_name_prefix := filters["name_prefix"]
+	prefix := indexValue(name_prefix)
+
+	if len(set_keys) == 0 && !has_name_prefix {
+		return nil, "", errors.New("No search filters given")
+	}
+
+	matches_prefix := "0"
+	if has_name_prefix {
+		matches_prefix = "1"
+	}
+	min := "-"
+	if after != "" {
+		min = "(" + after
+	}
+
+	keys := append([]string{"users", "user_search", fullnameIndexKey}, set_keys...)
+	result, err := searchUsersScript.Run(db.client, keys,
+		matches_prefix, prefix, "["+prefix, "["+prefix+"\xff", min, limit+1,
+	).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	usernames := result.([]interface{})[0].([]interface{})
+	values := result.([]interface{})[1].([]interface{})
+
+	next_cursor := ""
+	if len(usernames) > limit {
+		values = values[:limit]
+		next_cursor = encodeUsernameCursor(usernames[limit-1].(string))
+	}
+
+	users := []string{}
+	for _, value := range values {
+		if user_json_string, ok := value.(string); ok {
+			users = append(users, user_json_string)
+		}
+	}
+
+	return users, next_cursor, nil
+}
+
+func encodeUsernameCursor(username string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(username))
+}
+
+func decodeUsernameCursor(cursor string) (string, error) {
+	token, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errors.New("Invalid cursor")
+	}
+
+	return string(token), nil
+}
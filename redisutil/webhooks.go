@@ -0,0 +1,238 @@
+package redisutil
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/Haelium/User-Manager-API/dberrors"
+	"github.com/Haelium/User-Manager-API/events"
+)
+
+/*
+Webhook subscriptions are kept in the webhooks hash, subscription ID -> events.Subscription JSON,
+and the latest delivery attempts of each in the webhook_deliveries:{id} list, newest first and
+trimmed to events.MaxDeliveries.
+*/
+
+func deliveriesKey(id string) string {
+	return "webhook_deliveries:" + id
+}
+
+func (db RedisHashConn) CreateSubscription(subscription events.Subscription) error {
+	subscription_json, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	return db.client.HSet("webhooks", subscription.ID, subscription_json).Err()
+}
+
+func (db RedisHashConn) GetSubscription(id string) (events.Subscription, error) {
+	var subscription events.Subscription
+
+	subscription_json, err := db.client.HGet("webhooks", id).Result()
+	if err == redis.Nil {
+		return subscription, dberrors.ErrSubscriptionNotFound
+	} else if err != nil {
+		return subscription, err
+	}
+
+	return subscription, json.Unmarshal([]byte(subscription_json), &subscription)
+}
+
+// ListSubscriptions returns every subscription, oldest first. There are few enough for HGETALL.
+func (db RedisHashConn) ListSubscriptions() ([]events.Subscription, error) {
+	subscription_jsons, err := db.client.HGetAll("webhooks").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []events.Subscription{}
+	for _, subscription_json := range subscription_jsons {
+		var subscription events.Subscription
+		if err = json.Unmarshal([]byte(subscription_json), &subscription); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].ID < subscriptions[j].ID
+		}
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+
+	return subscriptions, nil
+}
+
+func (db RedisHashConn) UpdateSubscription(subscription events.Subscription) error {
+	subscription_json, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	updated, err := updateSubscriptionScript.Run(db.client, []string{"webhooks"}, subscription.ID, subscription_json).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return dberrors.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+// RotateSubscriptionSecret rotates the secret of the subscription as it was read, and reads it
+// again if it's changed since
+func (db RedisHashConn) RotateSubscriptionSecret(id string, secret string, now time.Time) (events.Subscription, error) {
+	for {
+		subscription_json, err := db.client.HGet("webhooks", id).Result()
+		if err == redis.Nil {
+			return events.Subscription{}, dberrors.ErrSubscriptionNotFound
+		} else if err != nil {
+			return events.Subscription{}, err
+		}
+
+		var subscription events.Subscription
+		if err = json.Unmarshal([]byte(subscription_json), &subscription); err != nil {
+			return subscription, err
+		}
+		subscription.Rotate(secret, now)
+		rotated_json, err := json.Marshal(subscription)
+		if err != nil {
+			return subscription, err
+		}
+
+		rotated, err := rotateSubscriptionScript.Run(db.client, []string{"webhooks"}, id, subscription_json, rotated_json).Int()
+		if err != nil {
+			return subscription, err
+		}
+		if rotated == -4 {
+			// Deleted or updated since it was read
+			continue
+		}
+
+		return subscription, nil
+	}
+}
+
+func (db RedisHashConn) DeleteSubscription(id string) error {
+	deleted, err := deleteSubscriptionScript.Run(db.client, []string{"webhooks", deliveriesKey(id)}, id).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return dberrors.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+func (db RedisHashConn) RecordDelivery(delivery events.Delivery) error {
+	delivery_json, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := recordDeliveryScript.Run(db.client, []string{"webhooks", deliveriesKey(delivery.SubscriptionID)},
+		delivery.SubscriptionID, delivery_json, events.MaxDeliveries,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if recorded == 0 {
+		return dberrors.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+// ListDeliveries returns a subscription's latest deliveries, newest first
+func (db RedisHashConn) ListDeliveries(id string, limit int) ([]events.Delivery, error) {
+	var exists_cmd *redis.BoolCmd
+	var deliveries_cmd *redis.StringSliceCmd
+	db.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		exists_cmd = pipe.HExists("webhooks", id)
+		deliveries_cmd = pipe.LRange(deliveriesKey(id), 0, int64(limit)-1)
+		return nil
+	})
+	exists, err := exists_cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, dberrors.ErrSubscriptionNotFound
+	}
+	delivery_jsons, err := deliveries_cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []events.Delivery{}
+	for _, delivery_json := range delivery_jsons {
+		var delivery events.Delivery
+		if err = json.Unmarshal([]byte(delivery_json), &delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// KEYS: webhooks
+// ARGV: subscription ID, subscription json
+// Replaces a subscription, returning 0 if there isn't one to replace
+var updateSubscriptionScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+
+return 1
+`)
+
+// KEYS: webhooks
+// ARGV: subscription ID, subscription json the caller read, rotated subscription json
+// Replaces a subscription with its rotation. Returns without replacing it -4 if it's changed
+// since the caller read it.
+var rotateSubscriptionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return -4
+end
+
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+
+return 1
+`)
+
+// KEYS: webhooks, webhook_deliveries:{id}
+// ARGV: subscription ID
+// Deletes a subscription and its deliveries, returning 0 if there isn't one
+var deleteSubscriptionScript = redis.NewScript(`
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call('DEL', KEYS[2])
+
+return 1
+`)
+
+// KEYS: webhooks, webhook_deliveries:{id}
+// ARGV: subscription ID, delivery json, deliveries kept
+// Records a delivery unless the subscription has been deleted, when it returns 0
+var recordDeliveryScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+
+redis.call('LPUSH', KEYS[2], ARGV[2])
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[3]) - 1)
+
+return 1
+`)
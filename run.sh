@@ -1,7 +1,39 @@
 #!/bin/bash
 
 ./userapi \
+-backend=${BACKEND:-redis} \
 -redis_address=$REDIS_HOST \
 -redis_max_retries=$REDIS_MAX_RETRIES \
+-postgres_dsn=$POSTGRES_DSN \
+-bolt_path=${BOLT_PATH:-userapi.db} \
+-archive=${ARCHIVE:-file} \
 -persist_path=$PERSISTING_DIR \
--data_ttl=$DATA_TTL
+-data_ttl=$DATA_TTL \
+-deleted_retention=${DELETED_RETENTION:-604800} \
+-audit=$AUDIT \
+-user_versions=${USER_VERSIONS:-10} \
+-user_versions_age=${USER_VERSIONS_AGE:-2592000} \
+-events=$EVENTS \
+-webhook_attempts=${WEBHOOK_ATTEMPTS:-5} \
+-auth=${AUTH:-true} \
+-api_keys=$API_KEYS \
+-jwt_jwks_path=$JWT_JWKS_PATH \
+-jwt_issuer=$JWT_ISSUER \
+-jwt_audience=$JWT_AUDIENCE \
+-policy_path=$POLICY_PATH \
+-session_ttl=${SESSION_TTL:-3600} \
+-sessions=$SESSIONS \
+-lockout=$LOCKOUT \
+-lockout_user_failures=${LOCKOUT_USER_FAILURES:-5} \
+-lockout_ip_failures=${LOCKOUT_IP_FAILURES:-50} \
+-lockout_window=${LOCKOUT_WINDOW:-900} \
+-lockout_duration=${LOCKOUT_DURATION:-900} \
+-trusted_proxies=$TRUSTED_PROXIES \
+-email_tokens=$EMAIL_TOKENS \
+-email_token_ttl=${EMAIL_TOKEN_TTL:-3600} \
+-mailer=${MAILER:-file} \
+-mail_path=$MAIL_PATH \
+-mail_from=${MAIL_FROM:-userapi@localhost} \
+-smtp_address=${SMTP_ADDRESS:-localhost:25} \
+-smtp_username=$SMTP_USERNAME \
+-breached_passwords_path=$BREACHED_PASSWORDS_PATH
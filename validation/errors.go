@@ -0,0 +1,92 @@
+package validation
+
+import "strings"
+
+// Error codes returned by validation, which clients can branch on without matching messages
+const (
+	CodeInvalidJSON            = "INVALID_JSON"
+	CodeUsernameRequired       = "USERNAME_REQUIRED"
+	CodeUsernameTooShort       = "USERNAME_TOO_SHORT"
+	CodeUsernameTooLong        = "USERNAME_TOO_LONG"
+	CodeUsernameInvalidStart   = "USERNAME_INVALID_START"
+	CodeUsernameNotAlphanum    = "USERNAME_NOT_ALPHANUMERIC"
+	CodeUsernameChanged        = "USERNAME_CHANGED"
+	CodeFullnameRequired       = "FULLNAME_REQUIRED"
+	CodeFullnameTooShort       = "FULLNAME_TOO_SHORT"
+	CodeFullnameTooLong        = "FULLNAME_TOO_LONG"
+	CodeEmailRequired          = "EMAIL_REQUIRED"
+	CodeEmailInvalid           = "EMAIL_INVALID"
+	CodeAddressNameRequired    = "ADDRESS_NAME_REQUIRED"
+	CodeAddressLine1Required   = "ADDRESS_LINE1_REQUIRED"
+	CodeAddressRegionRequired  = "ADDRESS_REGION_REQUIRED"
+	CodeAddressCountryRequired = "ADDRESS_COUNTRY_REQUIRED"
+	CodeTTLSecondsInvalid      = "TTL_SECONDS_INVALID"
+	CodeExpiresAtInvalid       = "EXPIRES_AT_INVALID"
+	CodeExpiresAtPast          = "EXPIRES_AT_PAST"
+	CodePermanentInvalid       = "PERMANENT_INVALID"
+	CodeExpiryConflict         = "EXPIRY_CONFLICT"
+	CodePasswordInvalid        = "PASSWORD_INVALID"
+	CodePasswordTooShort       = "PASSWORD_TOO_SHORT"
+	CodePasswordTooLong        = "PASSWORD_TOO_LONG"
+	CodePasswordBreached       = "PASSWORD_BREACHED"
+	CodePasswordIsUsername     = "PASSWORD_IS_USERNAME"
+	CodePasswordNotEditable    = "PASSWORD_NOT_EDITABLE"
+)
+
+// Error is a single validation failure. Field is a JSON pointer to the offending field, and
+// Details holds any parameters of the rule which failed, e.g. a minimum length.
+type Error struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Field   string                 `json:"field,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Errors collects every validation failure of a document, so clients can fix them all at once
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	messages := []string{}
+	for _, err := range errs {
+		messages = append(messages, err.Message)
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// add appends a failure returned by one of the validate functions, which may be an *Error or Errors
+func (errs *Errors) add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case *Error:
+		*errs = append(*errs, err)
+	case Errors:
+		*errs = append(*errs, err...)
+	default:
+		*errs = append(*errs, newError("", "", err.Error()))
+	}
+}
+
+// orNil avoids returning an empty Errors as a non-nil error
+func (errs Errors) orNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+func newError(code string, field string, message string) *Error {
+	return &Error{Code: code, Field: field, Message: message}
+}
+
+func newLengthError(code string, field string, message string, limit string, length int) *Error {
+	err := newError(code, field, message)
+	err.Details = map[string]interface{}{limit: length}
+
+	return err
+}
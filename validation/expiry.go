@@ -0,0 +1,213 @@
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expiry is how long a user is kept before it expires. The zero value is the server's default
+// ttl, restarted by every write.
+type Expiry struct {
+	// TTLSeconds is a lifetime restarted by every write
+	TTLSeconds int
+	// ExpiresAt is a fixed deadline, kept across writes
+	ExpiresAt time.Time
+	// Never marks a permanent user
+	Never bool
+}
+
+// Members of a user document which set its expiry rather than being stored with it
+const (
+	ttlSecondsMember = "ttl_seconds"
+	expiresAtMember  = "expires_at"
+	permanentMember  = "permanent"
+)
+
+// Deadline returns when a user written at now expires, or false if it never does
+func (expiry Expiry) Deadline(now time.Time, default_ttl int) (time.Time, bool) {
+	switch {
+	case expiry.Never:
+		return time.Time{}, false
+	case !expiry.ExpiresAt.IsZero():
+		return expiry.ExpiresAt, true
+	case expiry.TTLSeconds > 0:
+		return now.Add(time.Duration(expiry.TTLSeconds) * time.Second), true
+	default:
+		return now.Add(time.Duration(default_ttl) * time.Second), true
+	}
+}
+
+// String encodes an expiry for storage, "" for the default ttl
+func (expiry Expiry) String() string {
+	switch {
+	case expiry.Never:
+		return "never"
+	case !expiry.ExpiresAt.IsZero():
+		return "at:" + expiry.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	case expiry.TTLSeconds > 0:
+		return "ttl:" + strconv.Itoa(expiry.TTLSeconds)
+	default:
+		return ""
+	}
+}
+
+// ParseExpiry decodes an expiry encoded by Expiry.String
+func ParseExpiry(encoded string) (Expiry, error) {
+	switch {
+	case encoded == "":
+		return Expiry{}, nil
+	case encoded == "never":
+		return Expiry{Never: true}, nil
+	case strings.HasPrefix(encoded, "at:"):
+		expires_at, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(encoded, "at:"))
+		return Expiry{ExpiresAt: expires_at}, err
+	case strings.HasPrefix(encoded, "ttl:"):
+		ttl_seconds, err := strconv.Atoi(strings.TrimPrefix(encoded, "ttl:"))
+		return Expiry{TTLSeconds: ttl_seconds}, err
+	default:
+		return Expiry{}, errors.New("Invalid expiry " + encoded)
+	}
+}
+
+// ExtractExpiry removes the expiry members from a user document, returning the document to store
+// and the expiry they ask for. At most one of ttl_seconds, expires_at (RFC 3339) or
+// "permanent": true may be given, and "permanent": false alone restores the default ttl.
+// The expiry is nil if none of the members are present, and the document is returned untouched.
+func ExtractExpiry(user_json string) (string, *Expiry, error) {
+	names, members, err := decodeMembers(user_json)
+
+	// Anything which isn't an object is left for ValidateUser to reject
+	if err != nil {
+		return user_json, nil, nil
+	}
+
+	var expiry Expiry
+	var errs Errors
+	given := 0
+	found := false
+
+	if value, ok := members[ttlSecondsMember]; ok {
+		found = true
+		given++
+		if json.Unmarshal(value, &expiry.TTLSeconds) != nil || expiry.TTLSeconds < 1 {
+			errs.add(newError(CodeTTLSecondsInvalid, "/"+ttlSecondsMember, "ttl_seconds must be a positive whole number of seconds"))
+		}
+	}
+
+	if value, ok := members[expiresAtMember]; ok {
+		found = true
+		given++
+		var expires_at string
+		if json.Unmarshal(value, &expires_at) != nil {
+			errs.add(newError(CodeExpiresAtInvalid, "/"+expiresAtMember, "expires_at must be an RFC 3339 timestamp"))
+		} else if parsed, err := time.Parse(time.RFC3339, expires_at); err != nil {
+			errs.add(newError(CodeExpiresAtInvalid, "/"+expiresAtMember, "expires_at must be an RFC 3339 timestamp"))
+		} else if !parsed.After(time.Now()) {
+			errs.add(newError(CodeExpiresAtPast, "/"+expiresAtMember, "expires_at is in the past"))
+		} else {
+			expiry.ExpiresAt = parsed
+		}
+	}
+
+	if value, ok := members[permanentMember]; ok {
+		found = true
+		if json.Unmarshal(value, &expiry.Never) != nil {
+			errs.add(newError(CodePermanentInvalid, "/"+permanentMember, "permanent must be true or false"))
+		} else if expiry.Never {
+			given++
+		}
+	}
+
+	if !found {
+		return user_json, nil, nil
+	}
+	if given > 1 {
+		errs.add(newError(CodeExpiryConflict, "", "Only one of ttl_seconds, expires_at or permanent may be given"))
+	}
+	if len(errs) > 0 {
+		return "", nil, errs
+	}
+
+	return withoutMembers(names, members, ttlSecondsMember, expiresAtMember, permanentMember), &expiry, nil
+}
+
+// withoutMembers re-encodes a decoded object without some of its members, by hand to keep the
+// rest in the order they were given
+func withoutMembers(names []string, members map[string]json.RawMessage, removed ...string) string {
+	var stripped_json bytes.Buffer
+	stripped_json.WriteByte('{')
+	for _, name := range names {
+		skip := false
+		for _, removed_name := range removed {
+			skip = skip || name == removed_name
+		}
+		if skip {
+			continue
+		}
+		if stripped_json.Len() > 1 {
+			stripped_json.WriteByte(',')
+		}
+		encoded_name, _ := json.Marshal(name)
+		stripped_json.Write(encoded_name)
+		stripped_json.WriteByte(':')
+		json.Compact(&stripped_json, members[name])
+	}
+	stripped_json.WriteByte('}')
+
+	return stripped_json.String()
+}
+
+// foldedMembers returns the names of an object's members which encoding/json decodes as name. It
+// matches names case insensitively, as strings.EqualFold does.
+func foldedMembers(names []string, name string) []string {
+	folded := []string{}
+	for _, member_name := range names {
+		if strings.EqualFold(member_name, name) {
+			folded = append(folded, member_name)
+		}
+	}
+
+	return folded
+}
+
+// decodeMembers decodes a JSON object, returning its member names in document order
+func decodeMembers(object_json string) ([]string, map[string]json.RawMessage, error) {
+	names := []string{}
+	members := map[string]json.RawMessage{}
+
+	decoder := json.NewDecoder(strings.NewReader(object_json))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, nil, errors.New("Not a JSON object")
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		name := token.(string)
+
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, duplicate := members[name]; !duplicate {
+			names = append(names, name)
+		}
+		members[name] = value
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, nil, errors.New("Trailing data after JSON object")
+	}
+
+	return names, members, nil
+}
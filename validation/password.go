@@ -0,0 +1,116 @@
+package validation
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Limits on passwords' length in characters. The maximum stops hashing being used to tie up CPU.
+const (
+	MinPasswordLength = 12
+	MaxPasswordLength = 256
+)
+
+// The member of a new user document which sets its password rather than being stored with it
+const passwordMember = "password"
+
+var breached_passwords_lock sync.RWMutex
+var breached_passwords = map[string]bool{}
+
+// LoadBreachedPasswords reads a file of passwords known from breaches, one per line, which
+// ValidatePassword refuses from then on
+func LoadBreachedPasswords(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	loaded := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimRight(scanner.Text(), "\r"); password != "" {
+			loaded[password] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	breached_passwords_lock.Lock()
+	breached_passwords = loaded
+	breached_passwords_lock.Unlock()
+
+	return len(loaded), nil
+}
+
+func isBreached(password string) bool {
+	breached_passwords_lock.RLock()
+	defer breached_passwords_lock.RUnlock()
+
+	return breached_passwords[password]
+}
+
+// ValidatePassword checks a password for username against the password policy
+func ValidatePassword(password string, username string) error {
+	length := utf8.RuneCountInString(password)
+	if length < MinPasswordLength {
+		return newLengthError(CodePasswordTooShort, "/password", "Password is less than 12 characters", "min_length", MinPasswordLength)
+	}
+
+	if length > MaxPasswordLength {
+		return newLengthError(CodePasswordTooLong, "/password", "Password is greater than 256 characters", "max_length", MaxPasswordLength)
+	}
+
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return newError(CodePasswordIsUsername, "/password", "Password contains the username")
+	}
+
+	if isBreached(password) {
+		return newError(CodePasswordBreached, "/password", "Password is in a list of breached passwords")
+	}
+
+	return nil
+}
+
+// ExtractPassword removes the password member from a new user document, returning the document to
+// store and the password, nil if none was given. The password isn't checked against the policy,
+// as that needs the username.
+func ExtractPassword(user_json string) (string, *string, error) {
+	names, members, err := decodeMembers(user_json)
+
+	// Anything which isn't an object is left for ValidateUser to reject
+	if err != nil {
+		return user_json, nil, nil
+	}
+
+	// "Password" would be decoded as the password too, so it mustn't be stored either
+	password_members := foldedMembers(names, passwordMember)
+	if len(password_members) == 0 {
+		return user_json, nil, nil
+	}
+
+	// encoding/json decodes the last of them
+	var password string
+	if json.Unmarshal(members[password_members[len(password_members)-1]], &password) != nil {
+		return "", nil, newError(CodePasswordInvalid, "/password", "Password must be a string")
+	}
+
+	return withoutMembers(names, members, password_members...), &password, nil
+}
+
+// RejectPassword fails for a user document with a password member, in any case, as stored users'
+// passwords are only changed on their own
+func RejectPassword(user_json string) error {
+	if names, _, err := decodeMembers(user_json); err == nil {
+		if len(foldedMembers(names, passwordMember)) > 0 {
+			return newError(CodePasswordNotEditable, "/password", "Passwords are changed with POST /user/{username}/password")
+		}
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package validation
 
 import (
 	"encoding/json"
-	"errors"
 	"regexp"
 	"strings"
 )
@@ -22,76 +21,124 @@ type user struct {
 	FullName string  `json:"fullname"`
 	Email    string  `json:"email"`
 	Address  address `json:"address"`
+	// Set by the server, kept so patches don't drop it
+	VerifiedEmail bool `json:"verified_email,omitempty"`
 }
 
-func ModifyUser(old_user_json string, new_parameters_json string) (string, error) {
-	var old_user user
-	var new_user user
-	var changed_fields user
-	var nil_address address
+// UserFields are the fields of a stored user which storage backends index, and its username
+type UserFields struct {
+	Username string
+	Email    string
+	FullName string
+	Region   string
+	Country  string
+}
 
-	err := json.Unmarshal([]byte(new_parameters_json), &old_user)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal([]byte(new_parameters_json), &changed_fields)
-	if err != nil {
-		return "", err
-	}
+// ParseUserFields extracts the indexed fields of a stored user. Data which isn't a user
+// document gives empty fields, so it simply isn't indexed.
+func ParseUserFields(user_json string) UserFields {
+	var stored_user user
 
-	new_user = old_user
+	if err := json.Unmarshal([]byte(user_json), &stored_user); err != nil {
+		return UserFields{}
+	}
 
-	if changed_fields.Username != "" && changed_fields.Username != old_user.Username {
-		return "", errors.New("Username changed (cannot be changed)")
+	return UserFields{
+		Username: stored_user.Username,
+		Email:    stored_user.Email,
+		FullName: stored_user.FullName,
+		Region:   stored_user.Address.Region,
+		Country:  stored_user.Address.Country,
 	}
+}
 
-	if changed_fields.FullName != "" {
-		err = validateFullname(changed_fields.FullName)
-		if err != nil {
-			return "", err
-		} else {
-			new_user.FullName = changed_fields.FullName
+// MatchesFilters reports whether a user matches every search filter: email is the same email,
+// country and region match exactly and name_prefix matches the start of fullname, all case
+// insensitively. Backends with secondary indexes apply the same rules through them instead.
+func (fields UserFields) MatchesFilters(filters map[string]string) bool {
+	for filter, filter_value := range filters {
+		value := strings.ToLower(strings.TrimSpace(filter_value))
+
+		switch filter {
+		case "email":
+			if !SameEmail(fields.Email, filter_value) {
+				return false
+			}
+		case "country":
+			if strings.ToLower(strings.TrimSpace(fields.Country)) != value {
+				return false
+			}
+		case "region":
+			if strings.ToLower(strings.TrimSpace(fields.Region)) != value {
+				return false
+			}
+		case "name_prefix":
+			if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(fields.FullName)), value) {
+				return false
+			}
 		}
 	}
 
-	if changed_fields.Email != "" {
-		err = validateEmail(changed_fields.Email)
-		if err != nil {
-			return "", err
-		} else {
-			new_user.Email = changed_fields.Email
-		}
+	return true
+}
+
+// NormalizeUser re-encodes a stored user with the canonical field names, e.g. "line 1" rather
+// than "Line 1", so it can be patched without creating duplicate members
+func NormalizeUser(user_json string) (string, error) {
+	var stored_user user
+
+	err := json.Unmarshal([]byte(user_json), &stored_user)
+	if err != nil {
+		return "", newError(CodeInvalidJSON, "", err.Error())
 	}
 
-	if changed_fields.Address != nil_address {
-		err = validateAddress(changed_fields.Address)
-		if err != nil {
-			return "", err
-		} else {
-			new_user.Address = changed_fields.Address
-		}
+	user_json_bytes, err := json.Marshal(stored_user)
+
+	return string(user_json_bytes), err
+}
+
+// ValidateUserUpdate validates the full replacement of an existing user, which must keep its username
+func ValidateUserUpdate(username string, input string) error {
+	new_username, err := ValidateUser(input)
+	if err != nil {
+		return err
 	}
 
-	new_user_json_bytes, err := json.Marshal(new_user)
+	if new_username != strings.ToLower(username) {
+		return Errors{newError(CodeUsernameChanged, "/username", "Username changed (cannot be changed)")}
+	}
 
-	return string(new_user_json_bytes), nil
+	return nil
 }
 
 // Email validation does not allow internationalised email domains
 func validateEmail(input string) error {
 	if !isValidEmail.MatchString(input) {
-		return errors.New("Invalid email format")
+		return newError(CodeEmailInvalid, "/email", "Invalid email format")
 	}
 
 	return nil
 }
 
+// NormalizeEmail lowercases the domain of an email address, which is case insensitive.
+// The local part is left alone, as mail servers are allowed to treat it as case sensitive.
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	return email[:at+1] + strings.ToLower(email[at+1:])
+}
+
 func validateFullname(input string) error {
 	// Single unicode character names exist, assuming 2 names seperated by space, 3 character is minimum
 	if len(input) < 3 {
-		return errors.New("Fullname is less than 3 characters")
+		return newLengthError(CodeFullnameTooShort, "/fullname", "Fullname is less than 3 characters", "min_length", 3)
 	} else if len(input) > 128 {
-		return errors.New("Fullname is greater than 128 characters")
+		return newLengthError(CodeFullnameTooLong, "/fullname", "Fullname is greater than 128 characters", "max_length", 128)
 	}
 
 	return nil
@@ -100,65 +147,76 @@ func validateFullname(input string) error {
 func validateUsername(input string) error {
 	// Only accepting 8-64 alphanumeric characters. First character must be alphabetic
 	if len(input) < 8 {
-		return errors.New("Username is less than 8 characters")
+		return newLengthError(CodeUsernameTooShort, "/username", "Username is less than 8 characters", "min_length", 8)
 	}
 
 	if len(input) > 64 {
-		return errors.New("Username is greater than 64 characters")
+		return newLengthError(CodeUsernameTooLong, "/username", "Username is greater than 64 characters", "max_length", 64)
 	}
 
 	if input[0] < 'A' || input[0] > 'z' {
-		return errors.New("Username does not begin with a roman alphabetic character")
+		return newError(CodeUsernameInvalidStart, "/username", "Username does not begin with a roman alphabetic character")
 	}
 
 	if !isAlphaNumeric.MatchString(input) {
-		return errors.New("Username is not alphanumeric")
+		return newError(CodeUsernameNotAlphanum, "/username", "Username is not alphanumeric")
 	}
 
 	return nil
 }
 
 func validateAddress(input address) error {
+	var errs Errors
+
 	if input.Name == "" {
-		return errors.New("Address Name is a required field")
-	} else if input.Line1 == "" {
-		return errors.New("Address Line1 is a required field")
-	} else if input.Region == "" {
-		return errors.New("Address Region is a required field")
-	} else if input.Country == "" {
-		return errors.New("Address Country is a required field")
-	} else {
-		return nil
+		errs.add(newError(CodeAddressNameRequired, "/address/name", "Address Name is a required field"))
+	}
+	if input.Line1 == "" {
+		errs.add(newError(CodeAddressLine1Required, "/address/line 1", "Address Line1 is a required field"))
 	}
+	if input.Region == "" {
+		errs.add(newError(CodeAddressRegionRequired, "/address/region", "Address Region is a required field"))
+	}
+	if input.Country == "" {
+		errs.add(newError(CodeAddressCountryRequired, "/address/country", "Address Country is a required field"))
+	}
+
+	return errs.orNil()
 }
 
+// ValidateUser checks every field of a new user, returning all failures together as Errors
 func ValidateUser(input string) (string, error) {
 	var newuser user
+	var errs Errors
 
 	err := json.Unmarshal([]byte(input), &newuser)
 	if err != nil {
-		return "", err
+		return "", newError(CodeInvalidJSON, "", err.Error())
 	}
 
 	if newuser.Username == "" {
-		return "", errors.New("Username is a required field")
-	} else if newuser.FullName == "" {
-		return "", errors.New("Fullname is a required field")
-	} else if newuser.Email == "" {
-		return "", errors.New("Email is a required field")
+		errs.add(newError(CodeUsernameRequired, "/username", "Username is a required field"))
+	} else {
+		errs.add(validateUsername(newuser.Username))
 	}
 
-	if err = validateUsername(newuser.Username); err != nil {
-		return "", err
-	} else if err = validateFullname(newuser.FullName); err != nil {
-		return "", err
-	} else if err = validateEmail(newuser.Email); err != nil {
-		return "", err
+	if newuser.FullName == "" {
+		errs.add(newError(CodeFullnameRequired, "/fullname", "Fullname is a required field"))
+	} else {
+		errs.add(validateFullname(newuser.FullName))
+	}
+
+	if newuser.Email == "" {
+		errs.add(newError(CodeEmailRequired, "/email", "Email is a required field"))
+	} else {
+		errs.add(validateEmail(newuser.Email))
 	}
 
 	// Address only requires Name, Address Line 1, region, and Country
-	if err = validateAddress(newuser.Address); err != nil {
-		return "", err
+	errs.add(validateAddress(newuser.Address))
+
+	if len(errs) > 0 {
+		return "", errs
 	}
 
 	// Convert all new usernames to lowercase, as their input should be case insensitive
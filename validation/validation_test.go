@@ -1,8 +1,12 @@
 package validation
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 var valid_users = map[string]string{
@@ -39,10 +43,11 @@ func Test_ValidateUser_UserMissingField(t *testing.T) {
 	// Missing fullname
 	user_missing_fullname := `{"username": "billy", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`
 
+	// The username is also too short, every failure is reported
 	expected_err := "Fullname is a required field"
 	returnval, actual_err := ValidateUser(user_missing_fullname)
 
-	if actual_err.Error() != expected_err {
+	if !strings.Contains(actual_err.Error(), expected_err) || !strings.Contains(actual_err.Error(), "Username is less than 8 characters") {
 		t.Logf("Expected: %s\n Got: %s\n", expected_err, actual_err)
 		t.Fail()
 	}
@@ -260,3 +265,260 @@ func Test_validateEmail(t *testing.T) {
 		}
 	}
 }
+
+func Test_NormalizeEmail(t *testing.T) {
+	expected := map[string]string{
+		"username@gmail.com":    "username@gmail.com",
+		"username@GMail.COM":    "username@gmail.com",
+		"UserName@GMAIL.com":    "UserName@gmail.com",
+		" username@gmail.com  ": "username@gmail.com",
+		"notanemail":            "notanemail",
+	}
+
+	for input, expected_email := range expected {
+		if actual := NormalizeEmail(input); actual != expected_email {
+			t.Logf("Input: %s\nExpected: %s\nGot: %s\n", input, expected_email, actual)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ErrorCodes(t *testing.T) {
+	expected_codes := map[string]string{
+		`{"username": "billy", "fullname": "Billy Billy", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`:      CodeUsernameTooShort,
+		`{"username": "1billy2000", "fullname": "Billy Billy", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`: CodeUsernameInvalidStart,
+		`{"username": "billy2000", "fullname": "Billy Billy", "email": "Bob@bobmail", "address": {"name": "Bob", "Line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`:      CodeEmailInvalid,
+		`{"username": "billy2000", "fullname": "Billy Billy", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "region": "Bobville", "country": "Bobland"}}`:                            CodeAddressLine1Required,
+		`{"username": "billy2000"`: CodeInvalidJSON,
+	}
+
+	for input, expected_code := range expected_codes {
+		_, err := ValidateUser(input)
+
+		validation_errs, ok := err.(Errors)
+		if !ok {
+			validation_errs = Errors{}
+			if validation_err, ok := err.(*Error); ok {
+				validation_errs = append(validation_errs, validation_err)
+			}
+		}
+		if len(validation_errs) != 1 || validation_errs[0].Code != expected_code {
+			t.Logf("Input: %s\nExpected: %s\nGot: %#v\n", input, expected_code, err)
+			t.Fail()
+		}
+	}
+
+	_, err := ValidateUser(`{"username": "billy", "fullname": "Billy Billy", "email": "Bob@bobmail.bob"}`)
+	if validation_errs, ok := err.(Errors); !ok || validation_errs[0].Field != "/username" || validation_errs[0].Details["min_length"] != 8 {
+		t.Logf("Expected field and details for username length, got: %#v", err)
+		t.Fail()
+	}
+}
+
+func Test_ValidateUser_ReportsAllErrors(t *testing.T) {
+	invalid_user := `{"username": "1bob", "fullname": "Bo", "email": "bob@bobmail", "address": {"name": "Bob", "country": "Bobland"}}`
+	expected_fields := []string{"/username", "/fullname", "/email", "/address/line 1", "/address/region"}
+
+	_, err := ValidateUser(invalid_user)
+	validation_errs, ok := err.(Errors)
+	if !ok || len(validation_errs) != len(expected_fields) {
+		t.Logf("Expected %d errors\nGot: %v\n", len(expected_fields), err)
+		t.FailNow()
+	}
+
+	for i, expected_field := range expected_fields {
+		if validation_errs[i].Field != expected_field {
+			t.Logf("Expected: %s\nGot: %s\n", expected_field, validation_errs[i].Field)
+			t.Fail()
+		}
+	}
+
+	old_user := `{"username": "billy2000", "fullname": "Billy Billy", "email": "Bob@bobmail.bob", "address": {"name": "Bob", "line 1": "44 Bobstreet", "region": "Bobville", "country": "Bobland"}}`
+	err = ValidateUserUpdate("billy2000", `{"username": "billy2000", "fullname": "B", "email": "nope"}`)
+	if validation_errs, ok := err.(Errors); !ok || len(validation_errs) != 6 {
+		t.Logf("Expected 6 errors\nGot: %v\n", err)
+		t.Fail()
+	}
+
+	if err = ValidateUserUpdate("BILLY2000", old_user); err != nil {
+		t.Logf("Expected nil, got: %s", err)
+		t.Fail()
+	}
+
+	err = ValidateUserUpdate("billy3000", old_user)
+	if validation_errs, ok := err.(Errors); !ok || validation_errs[0].Code != CodeUsernameChanged {
+		t.Logf("Expected: %s\nGot: %v\n", CodeUsernameChanged, err)
+		t.Fail()
+	}
+}
+
+func Test_ExtractExpiry(t *testing.T) {
+	user_json, expiry, err := ExtractExpiry(valid_users["bobman12"])
+	if user_json != valid_users["bobman12"] || expiry != nil || err != nil {
+		t.Logf("Expected the user untouched, got: %s %v %v", user_json, expiry, err)
+		t.Fail()
+	}
+
+	user_json, expiry, err = ExtractExpiry(`{"username": "bobman12", "ttl_seconds": 3600}`)
+	if user_json != `{"username":"bobman12"}` || expiry == nil || expiry.TTLSeconds != 3600 || err != nil {
+		t.Logf("Expected a ttl of 3600, got: %s %v %v", user_json, expiry, err)
+		t.Fail()
+	}
+
+	_, expiry, err = ExtractExpiry(`{"username": "bobman12", "expires_at": "2999-01-01T00:00:00Z"}`)
+	if expiry == nil || expiry.ExpiresAt.Year() != 2999 || err != nil {
+		t.Logf("Expected expiry in 2999, got: %v %v", expiry, err)
+		t.Fail()
+	}
+
+	_, expiry, err = ExtractExpiry(`{"username": "bobman12", "permanent": false}`)
+	if expiry == nil || *expiry != (Expiry{}) || err != nil {
+		t.Logf("Expected the default expiry, got: %v %v", expiry, err)
+		t.Fail()
+	}
+
+	expected_codes := map[string]string{
+		`{"ttl_seconds": 0}`:                      CodeTTLSecondsInvalid,
+		`{"ttl_seconds": "60"}`:                   CodeTTLSecondsInvalid,
+		`{"expires_at": "tomorrow"}`:              CodeExpiresAtInvalid,
+		`{"expires_at": "2001-01-01T00:00:00Z"}`:  CodeExpiresAtPast,
+		`{"permanent": "yes"}`:                    CodePermanentInvalid,
+		`{"permanent": true, "ttl_seconds": 60}`:  CodeExpiryConflict,
+		`{"permanent": false, "ttl_seconds": 60}`: "",
+	}
+	for input, expected_code := range expected_codes {
+		_, _, err := ExtractExpiry(input)
+
+		validation_errs, _ := err.(Errors)
+		if (expected_code == "" && err != nil) || (expected_code != "" && (len(validation_errs) != 1 || validation_errs[0].Code != expected_code)) {
+			t.Logf("Input: %s\nExpected: %s\nGot: %v\n", input, expected_code, err)
+			t.Fail()
+		}
+	}
+
+	for _, expiry := range []Expiry{{}, {Never: true}, {TTLSeconds: 60}, {ExpiresAt: time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)}} {
+		parsed, err := ParseExpiry(expiry.String())
+		if err != nil || parsed != expiry {
+			t.Logf("Expected: %v\nGot: %v (err: %v)\n", expiry, parsed, err)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ExtractPassword(t *testing.T) {
+	user_json, password, err := ExtractPassword(valid_users["bobman12"])
+	if user_json != valid_users["bobman12"] || password != nil || err != nil {
+		t.Logf("Expected the user untouched, got: %s %v %v", user_json, password, err)
+		t.Fail()
+	}
+
+	user_json, password, err = ExtractPassword(`{"username": "bobman12", "password": "correct horse", "permanent": true}`)
+	if user_json != `{"username":"bobman12","permanent":true}` || password == nil || *password != "correct horse" || err != nil {
+		t.Logf("Expected the password taken out, got: %s %v %v", user_json, password, err)
+		t.Fail()
+	}
+
+	if _, _, err = ExtractPassword(`{"username": "bobman12", "password": 12345}`); err == nil || err.(*Error).Code != CodePasswordInvalid {
+		t.Logf("Expected %s, got: %v", CodePasswordInvalid, err)
+		t.Fail()
+	}
+
+	if RejectPassword(`{"username": "bobman12"}`) != nil || RejectPassword(`{"password": "correct horse"}`).(*Error).Code != CodePasswordNotEditable {
+		t.Logf("Expected only documents with passwords to be rejected")
+		t.Fail()
+	}
+
+	// encoding/json matches member names case insensitively, so these are passwords too
+	user_json, password, err = ExtractPassword(`{"username": "bobman12", "Password": "first horse", "PASSWORD": "second horse"}`)
+	if user_json != `{"username":"bobman12"}` || password == nil || *password != "second horse" || err != nil {
+		t.Logf("Expected every case of password taken out, got: %s %v %v", user_json, password, err)
+		t.Fail()
+	}
+	if err = RejectPassword(`{"username": "bobman12", "pAsSwOrD": "correct horse"}`); err == nil || err.(*Error).Code != CodePasswordNotEditable {
+		t.Logf("Expected %s for a password in another case, got: %v", CodePasswordNotEditable, err)
+		t.Fail()
+	}
+}
+
+func Test_ValidatePassword(t *testing.T) {
+	breached_dir, _ := ioutil.TempDir("", "validation")
+	defer os.RemoveAll(breached_dir)
+	breached_path := filepath.Join(breached_dir, "breached.txt")
+	ioutil.WriteFile(breached_path, []byte("password1234\r\nqwertyuiopasdf\n\n"), 0600)
+
+	if loaded, err := LoadBreachedPasswords(breached_path); loaded != 2 || err != nil {
+		t.Logf("Expected 2 breached passwords, got %d (err: %v)", loaded, err)
+		t.Fail()
+	}
+	defer func() { breached_passwords = map[string]bool{} }()
+
+	expected_codes := map[string]string{
+		"correct horse battery":  "",
+		"ünïcödé pässwörd":       "",
+		"short":                  CodePasswordTooShort,
+		"ünïcödé":                CodePasswordTooShort,
+		strings.Repeat("a", 257): CodePasswordTooLong,
+		"my name is Bobman12!":   CodePasswordIsUsername,
+		"password1234":           CodePasswordBreached,
+		"qwertyuiopasdf":         CodePasswordBreached,
+	}
+	for password, expected_code := range expected_codes {
+		err := ValidatePassword(password, "bobman12")
+		if (expected_code == "" && err != nil) || (expected_code != "" && (err == nil || err.(*Error).Code != expected_code)) {
+			t.Logf("Password: %s\nExpected: %s\nGot: %v\n", password, expected_code, err)
+			t.Fail()
+		}
+	}
+}
+
+func Test_EmailVerified(t *testing.T) {
+	unverified := `{"username": "bobman12", "email": "bob@bobmail.com"}`
+	if SetEmailVerified(unverified, false) != unverified || EmailVerified(unverified) {
+		t.Logf("Expected an unverified user untouched")
+		t.Fail()
+	}
+
+	verified := SetEmailVerified(unverified, true)
+	if verified != `{"username":"bobman12","email":"bob@bobmail.com","verified_email":true}` || !EmailVerified(verified) {
+		t.Logf("Expected verified_email added, got: %s", verified)
+		t.Fail()
+	}
+	if SetEmailVerified(verified, true) != verified || SetEmailVerified(verified, false) != `{"username":"bobman12","email":"bob@bobmail.com"}` {
+		t.Logf("Expected verified_email to be kept or removed")
+		t.Fail()
+	}
+
+	// The flag survives normalizing for patches
+	if normalized, _ := NormalizeUser(verified); !EmailVerified(normalized) {
+		t.Logf("Expected verified_email kept by NormalizeUser, got: %s", normalized)
+		t.Fail()
+	}
+
+	updates := map[string]bool{
+		`{"username": "bobman12", "email": "bob@BOBMAIL.com"}`:                          true,
+		`{"username": "bobman12", "email": "bob@bobmail.com", "verified_email": false}`: true,
+		`{"username": "bobman12", "email": "bobby@bobmail.com"}`:                        false,
+		`{"username": "bobman12", "email": "Bob@bobmail.com"}`:                          false,
+	}
+	for update, expected := range updates {
+		if kept := KeepEmailVerified(verified, update); EmailVerified(kept) != expected {
+			t.Logf("Expected %s to be verified: %t, got: %s", update, expected, kept)
+			t.Fail()
+		}
+	}
+	for _, member := range []string{"verified_email", "Verified_Email", "VERIFIED_EMAIL"} {
+		self_verified := `{"username": "bobman12", "email": "bob@bobmail.com", "` + member + `": true}`
+		if kept := KeepEmailVerified(unverified, self_verified); EmailVerified(kept) || kept != `{"username":"bobman12","email":"bob@bobmail.com"}` {
+			t.Logf("Expected users not to verify their own email with %s, got: %s", member, kept)
+			t.Fail()
+		}
+		if cleared := SetEmailVerified(self_verified, false); EmailVerified(cleared) {
+			t.Logf("Expected %s to be cleared, got: %s", member, cleared)
+			t.Fail()
+		}
+	}
+	if marked := SetEmailVerified(`{"username": "bobman12", "Verified_Email": false}`, true); marked != `{"username":"bobman12","verified_email":true}` {
+		t.Logf("Expected other cases replaced by verified_email, got: %s", marked)
+		t.Fail()
+	}
+}
@@ -0,0 +1,57 @@
+package validation
+
+import "encoding/json"
+
+// The member of a stored user recording that its owner proved they receive mail at its email. Only
+// the server sets it, and it's left out rather than stored as false.
+const verifiedEmailMember = "verified_email"
+
+// EmailVerified reports whether a stored user's email has been verified
+func EmailVerified(user_json string) bool {
+	var stored_user user
+
+	return json.Unmarshal([]byte(user_json), &stored_user) == nil && stored_user.VerifiedEmail
+}
+
+// SameEmail reports whether two emails belong to the same mailbox, compared like they are for
+// uniqueness
+func SameEmail(email string, other_email string) bool {
+	return NormalizeEmail(email) == NormalizeEmail(other_email)
+}
+
+// SetEmailVerified marks a user document's email verified or not, replacing any verified_email
+// member it has in any case, as encoding/json would decode those as the flag too. A document
+// which is already marked that way is returned untouched.
+func SetEmailVerified(user_json string, verified bool) string {
+	names, members, err := decodeMembers(user_json)
+
+	// Anything which isn't an object is left for ValidateUser to reject
+	if err != nil {
+		return user_json
+	}
+
+	verified_members := foldedMembers(names, verifiedEmailMember)
+	if !verified && len(verified_members) == 0 {
+		return user_json
+	}
+	if verified && len(verified_members) == 1 && verified_members[0] == verifiedEmailMember && string(members[verifiedEmailMember]) == "true" {
+		return user_json
+	}
+
+	user_json = withoutMembers(names, members, verified_members...)
+	if !verified {
+		return user_json
+	}
+	names, members, _ = decodeMembers(user_json)
+	members[verifiedEmailMember] = json.RawMessage("true")
+
+	return withoutMembers(append(names, verifiedEmailMember), members)
+}
+
+// KeepEmailVerified carries a user's verification over to its new document, unless that changes
+// the email. Whatever verified_email the new document gives itself is ignored.
+func KeepEmailVerified(old_user_json string, new_user_json string) string {
+	verified := EmailVerified(old_user_json) && SameEmail(ParseUserFields(old_user_json).Email, ParseUserFields(new_user_json).Email)
+
+	return SetEmailVerified(new_user_json, verified)
+}
@@ -0,0 +1,70 @@
+package versions
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Every storage backend keeps the earlier versions of a user when it's written, so old addresses
+and emails can be read back and reverted to. Policy bounds how many are kept, and for how long.
+Earlier versions go when the user is erased, expired or purged, and survive the recycle bin.
+*/
+
+// Version is a user as it was stored, under the backend's version for it
+type Version struct {
+	Version    string
+	Data       string
+	ModifiedAt time.Time
+}
+
+// Policy bounds the earlier versions kept per user. The zero Policy keeps none.
+type Policy struct {
+	// Most earlier versions kept
+	MaxVersions int
+	// How long after it was written an earlier version is kept, 0 for no limit
+	MaxAge time.Duration
+}
+
+var ErrVersionNotFound = errors.New("Version not found")
+
+// Keep returns how many of a user's earlier versions, newest first, the policy keeps at now
+func (policy Policy) Keep(earlier []Version, now time.Time) int {
+	kept := len(earlier)
+	if kept > policy.MaxVersions {
+		kept = policy.MaxVersions
+	}
+	if policy.MaxAge <= 0 {
+		return kept
+	}
+
+	for i := 0; i < kept; i++ {
+		if now.Sub(earlier[i].ModifiedAt) > policy.MaxAge {
+			return i
+		}
+	}
+
+	return kept
+}
+
+// Find returns the version of a user's versions with the given version
+func Find(user_versions []Version, version string) (Version, error) {
+	for _, user_version := range user_versions {
+		if user_version.Version == version {
+			return user_version, nil
+		}
+	}
+
+	return Version{}, ErrVersionNotFound
+}
+
+// AsOf returns the version of a user's versions, newest first, which was current at a time
+func AsOf(user_versions []Version, as_of time.Time) (Version, error) {
+	for _, user_version := range user_versions {
+		if !user_version.ModifiedAt.After(as_of) {
+			return user_version, nil
+		}
+	}
+
+	return Version{}, ErrVersionNotFound
+}
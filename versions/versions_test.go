@@ -0,0 +1,73 @@
+package versions
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testVersions(now time.Time, ages ...time.Duration) []Version {
+	user_versions := []Version{}
+	for i, age := range ages {
+		user_versions = append(user_versions, Version{Version: strconv.Itoa(len(ages) - i), ModifiedAt: now.Add(-age)})
+	}
+
+	return user_versions
+}
+
+func Test_Keep(t *testing.T) {
+	now := time.Now()
+	earlier := testVersions(now, time.Minute, time.Hour, 2*time.Hour, 48*time.Hour)
+
+	test_cases := []struct {
+		policy   Policy
+		expected int
+	}{
+		{Policy{}, 0},
+		{Policy{MaxVersions: 2}, 2},
+		{Policy{MaxVersions: 10}, 4},
+		{Policy{MaxVersions: 10, MaxAge: 24 * time.Hour}, 3},
+		{Policy{MaxVersions: 2, MaxAge: 24 * time.Hour}, 2},
+		{Policy{MaxVersions: 10, MaxAge: time.Second}, 0},
+	}
+
+	for _, test_case := range test_cases {
+		if kept := test_case.policy.Keep(earlier, now); kept != test_case.expected {
+			t.Logf("%+v\nExpected: %d\nGot: %d", test_case.policy, test_case.expected, kept)
+			t.Fail()
+		}
+	}
+}
+
+func Test_FindAndAsOf(t *testing.T) {
+	now := time.Now()
+	user_versions := testVersions(now, 0, time.Hour, 2*time.Hour)
+
+	if found, err := Find(user_versions, "2"); err != nil || found.Version != "2" {
+		t.Logf("Expected version 2, got: %+v (err: %v)", found, err)
+		t.Fail()
+	}
+	if _, err := Find(user_versions, "4"); err != ErrVersionNotFound {
+		t.Logf("Expected ErrVersionNotFound, got: %v", err)
+		t.Fail()
+	}
+
+	test_cases := []struct {
+		as_of    time.Time
+		expected string
+	}{
+		{now, "3"},
+		{now.Add(-time.Minute), "2"},
+		{now.Add(-time.Hour), "2"},
+		{now.Add(-90 * time.Minute), "1"},
+		{now.Add(-3 * time.Hour), ""},
+	}
+
+	for _, test_case := range test_cases {
+		found, err := AsOf(user_versions, test_case.as_of)
+		if found.Version != test_case.expected || (test_case.expected == "") != (err == ErrVersionNotFound) {
+			t.Logf("AsOf(%s)\nExpected: %s\nGot: %s (err: %v)", test_case.as_of, test_case.expected, found.Version, err)
+			t.Fail()
+		}
+	}
+}